@@ -0,0 +1,529 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var surveyIdPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,39}$`)
+
+// requireAdmin returns the current session if the user is an admin.
+// Otherwise it responds with 401 or 403 and ok is false.
+func (s *server) requireAdmin(w http.ResponseWriter, r *http.Request) (session Session, ok bool) {
+	session = s.getSession(r)
+	if !session.LoggedIn {
+		w.WriteHeader(http.StatusUnauthorized)
+		return session, false
+	}
+	if session.Role != roleAdmin {
+		w.WriteHeader(http.StatusForbidden)
+		return session, false
+	}
+	return session, true
+}
+
+// parseChoices returns a choice for each non-empty line of text. Labels must
+// differ regardless of case, since updateQuestion keeps the ids of choices by
+// their label and answers could not tell such choices apart.
+func parseChoices(text string) ([]Choice, error) {
+	var labels []string
+	seen := make(map[string]bool)
+	for _, line := range strings.Split(text, "\n") {
+		label := strings.TrimSpace(line)
+		if label == "" {
+			continue
+		}
+		key := strings.ToLower(label)
+		if seen[key] {
+			return nil, invalidEditError("duplicate choice " + label)
+		}
+		seen[key] = true
+		labels = append(labels, label)
+	}
+	return choices(labels...), nil
+}
+
+// parseQuestion returns the question described by the request form. Choice
+// and multi-select questions need choices, likert questions a scale of 5 or
+// 7 points and number questions a range.
+func parseQuestion(r *http.Request) (Question, error) {
+	question := Question{
+		Text: strings.TrimSpace(r.FormValue("text")),
+		Type: r.FormValue("type"),
+	}
+	if question.Type == "" {
+		question.Type = questionChoice
+	}
+	if question.Text == "" {
+		return question, invalidEditError("a question needs text")
+	}
+	switch question.Type {
+	case questionChoice, questionMulti:
+		var err error
+		if question.Choices, err = parseChoices(r.FormValue("choices")); err != nil {
+			return question, err
+		}
+		if len(question.Choices) == 0 {
+			return question, invalidEditError("a choice question needs at least one choice")
+		}
+	case questionLikert:
+		points, err := strconv.Atoi(r.FormValue("scale"))
+		if err != nil || (points != 5 && points != 7) {
+			return question, invalidEditError("a likert scale has 5 or 7 points")
+		}
+		question.Min, question.Max = 1, float64(points)
+		question.MinLabel = strings.TrimSpace(r.FormValue("minLabel"))
+		question.MaxLabel = strings.TrimSpace(r.FormValue("maxLabel"))
+	case questionNumber:
+		min, minErr := strconv.ParseFloat(r.FormValue("min"), 64)
+		max, maxErr := strconv.ParseFloat(r.FormValue("max"), 64)
+		if minErr != nil || maxErr != nil || math.IsNaN(min) || math.IsInf(min, 0) || math.IsInf(max, 0) || !(min < max) {
+			return question, invalidEditError("a number question needs a minimum below its maximum")
+		}
+		question.Min, question.Max = min, max
+	case questionText:
+	default:
+		return question, invalidEditError("unknown question type")
+	}
+	return question, nil
+}
+
+// parseRules parses the rules of the question at position q of survey, one
+// per line of text. A rule reads "when -> target" where when is a choice
+// label for choice and multi-select questions, a number or a range "min..max"
+// for likert and number questions, or "*" to match any answer, and target
+// is the number of a later question or "end".
+func parseRules(text string, survey *Survey, q int) ([]Rule, error) {
+	question := survey.Questions[q]
+	var rules []Rule
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		parts := strings.Split(line, "->")
+		if len(parts) != 2 {
+			return nil, invalidEditError(fmt.Sprintf("rule %q must read \"answer -> question\"", line))
+		}
+		when, target := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+		var rule Rule
+		if target != "end" {
+			number, err := strconv.Atoi(target)
+			if err != nil || number <= q+1 || number > len(survey.Questions) {
+				return nil, invalidEditError(fmt.Sprintf("rule %q must go to a later question or end", line))
+			}
+			rule.Goto = survey.Questions[number-1].Id
+		}
+		switch {
+		case when == "*":
+			rule.Otherwise = true
+		case question.HasChoices():
+			rule.Choice = -1
+			for i, choice := range question.Choices {
+				if strings.EqualFold(choice.Label, when) {
+					rule.Choice = i
+				}
+			}
+			if rule.Choice < 0 {
+				return nil, invalidEditError(fmt.Sprintf("rule %q names no choice of the question", line))
+			}
+		case question.Type == questionLikert || question.Type == questionNumber:
+			bounds := strings.SplitN(when, "..", 2)
+			min, err := strconv.ParseFloat(strings.TrimSpace(bounds[0]), 64)
+			max := min
+			if err == nil && len(bounds) == 2 {
+				max, err = strconv.ParseFloat(strings.TrimSpace(bounds[1]), 64)
+			}
+			if err != nil || !(min <= max) {
+				return nil, invalidEditError(fmt.Sprintf("rule %q needs a number or a range min..max", line))
+			}
+			rule.Min, rule.Max = min, max
+		default:
+			return nil, invalidEditError(fmt.Sprintf("rule %q: text questions only take \"*\" rules", line))
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// checkRules parses the rules of the questions at the given positions of
+// survey again, so that moving a question past the target of a rule is
+// rejected just as editing the rule to go back would be.
+func checkRules(survey *Survey, positions ...int) error {
+	for _, q := range positions {
+		if _, err := parseRules(survey.RulesText(survey.Questions[q]), survey, q); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GET /admin
+// adminHome lists every survey along with its versions.
+func (s *server) adminHome(w http.ResponseWriter, r *http.Request) {
+	session, ok := s.requireAdmin(w, r)
+	if !ok {
+		return
+	}
+	s.serveAdminHome(w, r, session, "")
+}
+
+// serveAdminHome serves the list of surveys along with message.
+func (s *server) serveAdminHome(w http.ResponseWriter, r *http.Request, session Session, message string) {
+	s.serveAdminReport(w, r, session, message, nil)
+}
+
+// adminAuditEntries is the number of the latest audit log entries listed on
+// the admin home page.
+const adminAuditEntries = 20
+
+// serveAdminReport serves the admin home page showing message along with the
+// report of an import, if any, and the latest entries of the audit log.
+func (s *server) serveAdminReport(w http.ResponseWriter, r *http.Request, session Session, message string, report *importReport) {
+	ctx := s.newContext(r)
+	surveys, err := s.listSurveys(ctx, true)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	auditLog, err := s.store.ListAuditEntries(ctx, adminAuditEntries)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	data := Data{
+		Session:      session,
+		Message:      message,
+		AdminSurveys: surveys,
+		Migrate:      s.migrateTo != nil,
+		Import:       report,
+		AuditLog:     auditLog,
+	}
+	s.serveTemplate(w, "admin", data)
+}
+
+// POST /admin/migrate
+// adminMigrate copies the surveys, users and attempts of the app into the
+// SQL database configured to migrate to, see copyTo.
+func (s *server) adminMigrate(w http.ResponseWriter, r *http.Request) {
+	session, ok := s.requireAdmin(w, r)
+	if !ok {
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if s.migrateTo == nil {
+		http.NotFound(w, r)
+		return
+	}
+	stats, err := s.copyTo(s.newContext(r), s.migrateTo)
+	if err != nil {
+		log.Print("migration failed: ", err)
+		http.Error(w, fmt.Sprintf("migration failed after copying %d surveys and %d users: %v", stats.Surveys, stats.Users, err), http.StatusInternalServerError)
+		return
+	}
+	message := fmt.Sprintf("Copied %d surveys and %d users with %d attempts. Surveys and users copied before were skipped.",
+		stats.Surveys, stats.Users, stats.Attempts)
+	s.serveAdminHome(w, r, session, message)
+}
+
+// POST /admin/usernames
+// adminReserveUsernames reserves the usernames of users who signed up before
+// usernames were reserved, see reserveUsernames.
+func (s *server) adminReserveUsernames(w http.ResponseWriter, r *http.Request) {
+	session, ok := s.requireAdmin(w, r)
+	if !ok {
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	reserved, err := s.reserveUsernames(s.newContext(r))
+	if err != nil {
+		log.Print("reserving usernames failed: ", err)
+		http.Error(w, fmt.Sprintf("reserving usernames failed after %d usernames: %v", reserved, err), http.StatusInternalServerError)
+		return
+	}
+	s.serveAdminHome(w, r, session, fmt.Sprintf("Reserved %d usernames.", reserved))
+}
+
+// POST /admin/counters
+// adminRebuildCounters recomputes the answer counters of every survey
+// version from the recorded answers, see rebuildCounters.
+func (s *server) adminRebuildCounters(w http.ResponseWriter, r *http.Request) {
+	session, ok := s.requireAdmin(w, r)
+	if !ok {
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	rebuilt, err := s.rebuildAllCounters(s.newContext(r))
+	if err != nil {
+		log.Print("rebuilding counters failed: ", err)
+		http.Error(w, fmt.Sprintf("rebuilding counters failed after %d survey versions: %v", rebuilt, err), http.StatusInternalServerError)
+		return
+	}
+	s.serveAdminHome(w, r, session, fmt.Sprintf("Rebuilt the answer counters of %d survey versions.", rebuilt))
+}
+
+// POST /admin/import
+// adminImport imports the users and responses of the uploaded csv or jsonl
+// file, see importRecords, and shows the report. The file is only checked if
+// dryrun is set.
+func (s *server) adminImport(w http.ResponseWriter, r *http.Request) {
+	session, ok := s.requireAdmin(w, r)
+	if !ok {
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxImportSize)
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, "missing import file", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+	records, err := readImportRecords(file, importFormat(header.Filename))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("reading %s: %v", header.Filename, err), http.StatusBadRequest)
+		return
+	}
+	report, err := s.importRecords(s.newContext(r), records, r.FormValue("dryrun") != "")
+	if err != nil {
+		log.Print("import failed: ", err)
+		http.Error(w, fmt.Sprintf("import failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+	s.serveAdminReport(w, r, session, report.String(), report)
+}
+
+// GET /admin/export
+// adminExport streams every response, or the responses to the survey with id
+// survey, as a csv or jsonl attachment depending on format, see
+// exportResponses. Errors after the export started can only be logged, and
+// truncate the download.
+func (s *server) adminExport(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.requireAdmin(w, r); !ok {
+		return
+	}
+	format := r.FormValue("format")
+	contentType, ok := exportFormats[format]
+	if !ok {
+		http.Error(w, "format must be csv or jsonl", http.StatusBadRequest)
+		return
+	}
+	if len(s.pseudonymKey) == 0 {
+		http.Error(w, errNoPseudonymKey.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	ctx := s.newContext(r)
+	surveyId := r.FormValue("survey")
+	name := "all"
+	if surveyId != "" {
+		if _, err := s.getSurvey(ctx, surveyId); err == errNotFound {
+			http.NotFound(w, r)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		name = surveyId
+	}
+	// exports take longer than the write timeout of regular requests
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="responses-%s-%s.%s"`,
+		name, time.Now().Format("2006-01-02"), format))
+	if _, err := s.exportResponses(ctx, w, format, surveyId); err != nil {
+		log.Print("exporting responses failed: ", err)
+	}
+}
+
+// POST /admin/surveys
+// adminCreateSurvey creates an unpublished survey and redirects to its
+// editor.
+func (s *server) adminCreateSurvey(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.requireAdmin(w, r); !ok {
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	surveyId := strings.TrimSpace(r.FormValue("id"))
+	title := strings.TrimSpace(r.FormValue("title"))
+	if !surveyIdPattern.MatchString(surveyId) || title == "" {
+		http.Error(w, "survey id must be lowercase letters, digits and dashes, and title must not be empty", http.StatusBadRequest)
+		return
+	}
+	ctx := s.newContext(r)
+	err := s.createSurvey(ctx, surveyId, title)
+	if err == errSurveyExists {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/admin/survey/"+surveyId, http.StatusFound)
+}
+
+// GET /admin/survey/{id}
+// POST /admin/survey/{id}
+// adminSurvey serves the editor for the latest version of the survey and
+// applies the edit named by the action form value. Editing a published
+// version creates a new draft version so answered versions never change.
+func (s *server) adminSurvey(w http.ResponseWriter, r *http.Request) {
+	session, ok := s.requireAdmin(w, r)
+	if !ok {
+		return
+	}
+	surveyId := pathId(r, "/admin/survey")
+	ctx := s.newContext(r)
+	survey, err := s.getSurvey(ctx, surveyId)
+	if err == errNotFound {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	data := Data{
+		Session: session,
+	}
+	status := http.StatusOK
+	if r.Method == http.MethodPost {
+		err = s.applySurveyAction(r, surveyId)
+		if err == nil {
+			http.Redirect(w, r, "/admin/survey/"+surveyId, http.StatusFound)
+			return
+		}
+		if _, invalid := err.(invalidEditError); !invalid && err != errNoQuestions {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		data.Message = err.Error()
+		status = http.StatusBadRequest
+	}
+	survey, err = s.loadSurveyVersion(ctx, surveyId, survey.LatestVersion)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	data.Survey = survey
+	s.serveTemplateStatus(w, status, "adminsurvey", data)
+}
+
+// invalidEditError is returned for survey edits rejected by validation.
+type invalidEditError string
+
+func (e invalidEditError) Error() string {
+	return string(e)
+}
+
+// applySurveyAction applies the edit described by the request form to the
+// survey with id surveyId.
+func (s *server) applySurveyAction(r *http.Request, surveyId string) error {
+	ctx := s.newContext(r)
+	switch r.FormValue("action") {
+	case "title":
+		title := strings.TrimSpace(r.FormValue("title"))
+		if title == "" {
+			return invalidEditError("title must not be empty")
+		}
+		return s.renameSurvey(ctx, surveyId, title)
+	case "publish":
+		return s.publishSurvey(ctx, surveyId)
+	case "unpublish":
+		return s.unpublishSurvey(ctx, surveyId)
+	case "addQuestion":
+		question, err := parseQuestion(r)
+		if err != nil {
+			return err
+		}
+		return s.editSurvey(ctx, surveyId, func(survey *Survey) error {
+			survey.Questions = append(survey.Questions, question)
+			rules, err := parseRules(r.FormValue("rules"), survey, len(survey.Questions)-1)
+			if err != nil {
+				return err
+			}
+			survey.Questions[len(survey.Questions)-1].Rules = rules
+			return nil
+		})
+	}
+	index, err := strconv.Atoi(r.FormValue("question"))
+	if err != nil {
+		return invalidEditError("unknown action")
+	}
+	return s.editSurvey(ctx, surveyId, func(survey *Survey) error {
+		questions := survey.Questions
+		if index < 0 || index >= len(questions) {
+			return invalidEditError("unknown question")
+		}
+		switch r.FormValue("action") {
+		case "updateQuestion":
+			question, err := parseQuestion(r)
+			if err != nil {
+				return err
+			}
+			// keep the ids of the question and of choices whose label is
+			// unchanged but for case, as parseChoices compares them, so
+			// rules and answers still refer to them
+			question.Id = questions[index].Id
+			for i, choice := range question.Choices {
+				for _, old := range questions[index].Choices {
+					if strings.EqualFold(old.Label, choice.Label) {
+						question.Choices[i].Id = old.Id
+					}
+				}
+			}
+			questions[index] = question
+			rules, err := parseRules(r.FormValue("rules"), survey, index)
+			if err != nil {
+				return err
+			}
+			questions[index].Rules = rules
+		case "deleteQuestion":
+			// drop the rules going to the deleted question
+			for i := range questions {
+				var rules []Rule
+				for _, rule := range questions[i].Rules {
+					if rule.Goto != questions[index].Id {
+						rules = append(rules, rule)
+					}
+				}
+				questions[i].Rules = rules
+			}
+			survey.Questions = append(questions[:index], questions[index+1:]...)
+		case "moveUp":
+			if index > 0 {
+				questions[index-1], questions[index] = questions[index], questions[index-1]
+				return checkRules(survey, index-1, index)
+			}
+		case "moveDown":
+			if index < len(questions)-1 {
+				questions[index+1], questions[index] = questions[index], questions[index+1]
+				return checkRules(survey, index, index+1)
+			}
+		default:
+			return invalidEditError("unknown action")
+		}
+		return nil
+	})
+}
@@ -0,0 +1,453 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// apiPrefix is the path of the versioned json api.
+const apiPrefix = "/api/v1"
+
+// maxAPIBody is the size in bytes of the largest request body the api reads.
+const maxAPIBody = 64 << 10
+
+// apiData model for the json body of successful api responses.
+type apiData struct {
+	Data interface{} `json:"data"`
+}
+
+// apiFailure model for the json body of failed api responses.
+type apiFailure struct {
+	Error apiFailureError `json:"error"`
+}
+
+// apiFailureError model for the error of a failed api response, repeating
+// the status of the response. Fields holds the problem with each invalid
+// field of the request by name, if any.
+type apiFailureError struct {
+	Status  int               `json:"status"`
+	Message string            `json:"message"`
+	Fields  map[string]string `json:"fields,omitempty"`
+}
+
+// writeData responds with status and a json body carrying data.
+func writeData(w http.ResponseWriter, status int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(apiData{Data: data})
+}
+
+// writeFailure responds with status and a json body carrying message.
+func writeFailure(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(apiFailure{Error: apiFailureError{Status: status, Message: message}})
+}
+
+// writeFieldFailure responds with 400 Bad Request and a json body carrying
+// message and fields, the problem with each invalid field by name.
+func writeFieldFailure(w http.ResponseWriter, message string, fields map[string]string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	failure := apiFailureError{Status: http.StatusBadRequest, Message: message, Fields: fields}
+	json.NewEncoder(w).Encode(apiFailure{Error: failure})
+}
+
+// writeAPIError responds with the status matching err: the status of a
+// requestError, 400 Bad Request for invalid answers, 401 Unauthorized for
+// invalid credentials, 404 Not Found for unknown or unpublished surveys and
+// for unknown attempts and questions, each with its own message, 409 Conflict
+// for taken usernames, attempts started while the latest is not complete and
+// answers that are out of order, duplicated or past the end of the survey, 422 Unprocessable Entity for cohorts too
+// small to report on, 429 Too Many Requests with a Retry-After header for
+// throttled logins and 500 Internal Server Error otherwise, in which case err
+// is logged along with action.
+func writeAPIError(w http.ResponseWriter, action string, err error) {
+	if e, ok := err.(requestError); ok {
+		writeFailure(w, e.status, e.message)
+		return
+	}
+	if e, ok := err.(loginThrottledError); ok {
+		w.Header().Set("Retry-After", strconv.Itoa(e.seconds()))
+		writeFailure(w, http.StatusTooManyRequests, e.Error())
+		return
+	}
+	if _, ok := err.(invalidAnswerError); ok {
+		writeFailure(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	switch err {
+	case errInvalidCredentials:
+		writeFailure(w, http.StatusUnauthorized, err.Error())
+	case errNotFound, errNotPublished:
+		writeFailure(w, http.StatusNotFound, "survey not found")
+	case errAttemptNotFound, errQuestionNotFound:
+		writeFailure(w, http.StatusNotFound, err.Error())
+	case errUserExists, errSurveyComplete, errOutOfOrder, errAttemptOpen:
+		writeFailure(w, http.StatusConflict, err.Error())
+	case errCohortTooSmall:
+		writeFailure(w, http.StatusUnprocessableEntity, err.Error())
+	default:
+		log.Print(action, " failed: ", err)
+		writeFailure(w, http.StatusInternalServerError, "internal error")
+	}
+}
+
+// readJSON decodes the json body of r into v. Malformed bodies fail with a
+// requestError.
+func readJSON(w http.ResponseWriter, r *http.Request, v interface{}) error {
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAPIBody)).Decode(v); err != nil {
+		return requestError{http.StatusBadRequest, "invalid json body"}
+	}
+	return nil
+}
+
+// apiMethods serves r with the handler of its method among methods, or
+// responds with 405 Method Not Allowed listing the allowed methods.
+func apiMethods(w http.ResponseWriter, r *http.Request, methods map[string]http.HandlerFunc) {
+	if handler, ok := methods[r.Method]; ok {
+		handler(w, r)
+		return
+	}
+	var allowed []string
+	for method := range methods {
+		allowed = append(allowed, method)
+	}
+	sort.Strings(allowed)
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	writeFailure(w, http.StatusMethodNotAllowed, "method not allowed")
+}
+
+// /api/v1/...
+// api serves the versioned json api. Successful responses carry their
+// resource in a json body of the form {"data": ...}, and failures carry
+// {"error": {"status": ..., "message": ...}}, see writeAPIError. Requests are
+// authenticated by the session cookie or by a bearer token, see
+// sessionToken, and POST requests take a json body.
+//
+//	GET    /api/v1/session                       the logged in user
+//	POST   /api/v1/session                       log in
+//	DELETE /api/v1/session                       log out
+//	POST   /api/v1/users                         sign up and log in
+//	GET    /api/v1/surveys                       published surveys and progress
+//	GET    /api/v1/surveys/{id}                  published version of a survey
+//	GET    /api/v1/surveys/{id}/attempt          latest attempt and next question
+//	POST   /api/v1/surveys/{id}/attempts         start another attempt
+//	POST   /api/v1/surveys/{id}/attempt/answers  answer the next question
+//	GET    /api/v1/surveys/{id}/aggregates       distribution of answers
+//	GET    /api/v1/surveys/{id}/crosstab         joint distribution of answers
+func (s *server) api(w http.ResponseWriter, r *http.Request) {
+	path := strings.Split(pathId(r, apiPrefix), "/")
+	switch {
+	case len(path) == 1 && path[0] == "session":
+		apiMethods(w, r, map[string]http.HandlerFunc{
+			http.MethodGet:    s.apiGetSession,
+			http.MethodPost:   s.apiLogin,
+			http.MethodDelete: s.apiLogout,
+		})
+	case len(path) == 1 && path[0] == "users":
+		apiMethods(w, r, map[string]http.HandlerFunc{http.MethodPost: s.apiCreateUser})
+	case len(path) == 1 && path[0] == "surveys":
+		apiMethods(w, r, map[string]http.HandlerFunc{http.MethodGet: s.apiListSurveys})
+	case len(path) < 2 || path[0] != "surveys" || path[1] == "":
+		writeFailure(w, http.StatusNotFound, "not found")
+	default:
+		routes := map[string]map[string]http.HandlerFunc{
+			"":                {http.MethodGet: s.apiGetSurvey},
+			"attempt":         {http.MethodGet: s.apiGetAttempt},
+			"attempts":        {http.MethodPost: s.apiStartAttempt},
+			"attempt/answers": {http.MethodPost: s.apiAnswer},
+			"aggregates":      {http.MethodGet: s.apiAggregates},
+			"crosstab":        {http.MethodGet: s.apiCrosstab},
+		}
+		methods, ok := routes[strings.Join(path[2:], "/")]
+		if !ok {
+			writeFailure(w, http.StatusNotFound, "not found")
+			return
+		}
+		apiMethods(w, r, methods)
+	}
+}
+
+// apiSurveyId returns the id of the survey in the path of r, a request for
+// a resource below /api/v1/surveys/{id}.
+func apiSurveyId(r *http.Request) string {
+	return strings.SplitN(pathId(r, apiPrefix+"/surveys"), "/", 2)[0]
+}
+
+// apiSession returns the current session, or responds with 401 Unauthorized
+// and ok is false if the user is not logged in.
+func (s *server) apiSession(w http.ResponseWriter, r *http.Request) (session Session, ok bool) {
+	session = s.getSession(r)
+	if !session.LoggedIn {
+		writeFailure(w, http.StatusUnauthorized, "not logged in")
+		return session, false
+	}
+	return session, true
+}
+
+// GET /api/v1/session
+// apiGetSession serves the logged in user.
+func (s *server) apiGetSession(w http.ResponseWriter, r *http.Request) {
+	session, ok := s.apiSession(w, r)
+	if !ok {
+		return
+	}
+	user, err := s.store.GetUser(s.newContext(r), session.Id)
+	if err != nil {
+		writeAPIError(w, "getting session", err)
+		return
+	}
+	writeData(w, http.StatusOK, user)
+}
+
+// apiStartSession starts a session for user and responds with status and the
+// session token.
+func (s *server) apiStartSession(w http.ResponseWriter, r *http.Request, status int, user User) {
+	token, record, err := s.startSession(w, r, user.Id)
+	if err != nil {
+		writeAPIError(w, "starting session", err)
+		return
+	}
+	writeData(w, status, SessionToken{User: user, Token: token, Expires: record.Expires})
+}
+
+// POST /api/v1/session {"username": ..., "password": ...}
+// apiLogin authenticates the user and starts a session, which is set as the
+// session cookie and returned as a token. Failed logins are throttled, see
+// verifyLogin.
+func (s *server) apiLogin(w http.ResponseWriter, r *http.Request) {
+	var credentials struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+	if err := readJSON(w, r, &credentials); err != nil {
+		writeAPIError(w, "logging in", err)
+		return
+	}
+	user, err := s.verifyLogin(s.newContext(r), r, credentials.Username, credentials.Password)
+	if err != nil {
+		writeAPIError(w, "logging in", err)
+		return
+	}
+	s.apiStartSession(w, r, http.StatusCreated, user)
+}
+
+// DELETE /api/v1/session
+// apiLogout revokes the current session.
+func (s *server) apiLogout(w http.ResponseWriter, r *http.Request) {
+	if err := s.endSession(w, r); err != nil {
+		writeAPIError(w, "logging out", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// POST /api/v1/users {"username": ..., "password": ..., "email": ..., "ageBand": ..., "program": ...}
+// apiCreateUser signs the user up with the optional email address and
+// attributes named by userAttributes and starts a session like apiLogin.
+// Invalid fields are rejected with the problem with each, see
+// parseRegistration.
+func (s *server) apiCreateUser(w http.ResponseWriter, r *http.Request) {
+	var fields map[string]string
+	if err := readJSON(w, r, &fields); err != nil {
+		writeAPIError(w, "signing up", err)
+		return
+	}
+	user, problems := s.parseRegistration(func(name string) string { return fields[name] })
+	if len(problems) > 0 {
+		writeFieldFailure(w, "invalid registration", problems)
+		return
+	}
+	user, err := s.registerUser(s.newContext(r), user, fields["password"])
+	if err != nil {
+		writeAPIError(w, "signing up", err)
+		return
+	}
+	s.apiStartSession(w, r, http.StatusCreated, user)
+}
+
+// GET /api/v1/surveys
+// apiListSurveys serves the published surveys along with the progress of the
+// logged in user, if any, see surveySummaries.
+func (s *server) apiListSurveys(w http.ResponseWriter, r *http.Request) {
+	summaries, err := s.surveySummaries(s.newContext(r), s.getSession(r))
+	if err != nil {
+		writeAPIError(w, "listing surveys", err)
+		return
+	}
+	writeData(w, http.StatusOK, summaries)
+}
+
+// GET /api/v1/surveys/{id}
+// apiGetSurvey serves the published version of the survey along with its
+// questions.
+func (s *server) apiGetSurvey(w http.ResponseWriter, r *http.Request) {
+	survey, err := s.loadSurvey(s.newContext(r), apiSurveyId(r))
+	if err != nil {
+		writeAPIError(w, "getting survey", err)
+		return
+	}
+	writeData(w, http.StatusOK, survey)
+}
+
+// progress returns the progress of user on their latest attempt at the
+// survey with id surveyId, see Progress. It returns errNotPublished if the
+// survey is unpublished and the attempt is not complete.
+func (s *server) progress(ctx context.Context, user User, surveyId string) (Progress, error) {
+	survey, err := s.getSurvey(ctx, surveyId)
+	if err != nil {
+		return Progress{}, err
+	}
+	attempt, err := s.loadAttempt(ctx, user, surveyId)
+	if err != nil {
+		return Progress{}, err
+	}
+	if !survey.Published && !attempt.Complete {
+		return Progress{}, errNotPublished
+	}
+	progress := Progress{Version: attemptVersion(attempt, survey)}
+	if attempt.Id != 0 {
+		if attempt.Answers == nil {
+			attempt.Answers = []Answer{}
+		}
+		progress.Attempt = &attempt
+	}
+	if attempt.Complete {
+		return progress, nil
+	}
+	survey, err = s.loadSurveyVersion(ctx, surveyId, progress.Version)
+	if err != nil {
+		return Progress{}, err
+	}
+	progress.Next = nextQuestion(survey, attempt.Answers)
+	return progress, nil
+}
+
+// apiProgress responds with status and the progress of the logged in user on
+// the survey with id surveyId.
+func (s *server) apiProgress(w http.ResponseWriter, r *http.Request, status int, session Session, surveyId string) {
+	ctx := s.newContext(r)
+	user, err := s.store.GetUser(ctx, session.Id)
+	if err != nil {
+		writeAPIError(w, "getting attempt", err)
+		return
+	}
+	progress, err := s.progress(ctx, user, surveyId)
+	if err != nil {
+		writeAPIError(w, "getting attempt", err)
+		return
+	}
+	writeData(w, status, progress)
+}
+
+// GET /api/v1/surveys/{id}/attempt
+// apiGetAttempt serves the progress of the logged in user on their latest
+// attempt at the survey, see Progress.
+func (s *server) apiGetAttempt(w http.ResponseWriter, r *http.Request) {
+	session, ok := s.apiSession(w, r)
+	if !ok {
+		return
+	}
+	s.apiProgress(w, r, http.StatusOK, session, apiSurveyId(r))
+}
+
+// POST /api/v1/surveys/{id}/attempts
+// apiStartAttempt starts another attempt of the logged in user at the
+// published version of the survey, and responds with 201 Created and the
+// progress on it. Only one attempt is answered at a time, so starting one
+// while the latest is not complete fails with 409 Conflict, see
+// startNextAttempt.
+func (s *server) apiStartAttempt(w http.ResponseWriter, r *http.Request) {
+	surveyId := apiSurveyId(r)
+	session, ok := s.apiSession(w, r)
+	if !ok {
+		return
+	}
+	ctx := s.newContext(r)
+	survey, err := s.loadSurvey(ctx, surveyId)
+	if err != nil {
+		writeAPIError(w, "starting attempt", err)
+		return
+	}
+	if _, err = s.startNextAttempt(ctx, session.Id, survey); err != nil {
+		writeAPIError(w, "starting attempt", err)
+		return
+	}
+	s.apiProgress(w, r, http.StatusCreated, session, surveyId)
+}
+
+// POST /api/v1/surveys/{id}/attempt/answers {"question": ..., "response": [...]}
+// apiAnswer records response as the logged in user's answer to the question
+// with id question, which must be the next question of their latest attempt,
+// see updateUserResponses, and responds with 201 Created and the progress on
+// the attempt. Responses take the form values of /api/recordUserResponse.
+func (s *server) apiAnswer(w http.ResponseWriter, r *http.Request) {
+	surveyId := apiSurveyId(r)
+	session, ok := s.apiSession(w, r)
+	if !ok {
+		return
+	}
+	var body struct {
+		Question int64    `json:"question"`
+		Response []string `json:"response"`
+	}
+	if err := readJSON(w, r, &body); err != nil {
+		writeAPIError(w, "recording response", err)
+		return
+	}
+	if body.Question <= 0 {
+		writeFailure(w, http.StatusBadRequest, "invalid question")
+		return
+	}
+	err := s.updateUserResponses(s.newContext(r), session.Id, surveyId, body.Question, body.Response)
+	if err != nil {
+		writeAPIError(w, "recording response", err)
+		return
+	}
+	s.apiProgress(w, r, http.StatusCreated, session, surveyId)
+}
+
+// GET /api/v1/surveys/{id}/aggregates
+// apiAggregates serves the distribution of the answers to each question of
+// a version of the survey, taking the parameters of /api/aggregateResponses
+// but the survey.
+func (s *server) apiAggregates(w http.ResponseWriter, r *http.Request) {
+	ctx := s.newContext(r)
+	session := s.getSession(r)
+	survey, filter, err := s.loadAggregateRequest(ctx, r, session, apiSurveyId(r))
+	if err != nil {
+		writeAPIError(w, "aggregating responses", err)
+		return
+	}
+	aggregates, err := s.aggregate(ctx, session, survey, filter)
+	if err != nil {
+		writeAPIError(w, "aggregating responses", err)
+		return
+	}
+	writeData(w, http.StatusOK, aggregates)
+}
+
+// GET /api/v1/surveys/{id}/crosstab
+// apiCrosstab serves the joint distribution of the answers to two questions
+// of a version of the survey, taking the parameters of /api/crosstab but the
+// survey.
+func (s *server) apiCrosstab(w http.ResponseWriter, r *http.Request) {
+	ctx := s.newContext(r)
+	survey, filter, err := s.loadAggregateRequest(ctx, r, s.getSession(r), apiSurveyId(r))
+	if err != nil {
+		writeAPIError(w, "crossing responses", err)
+		return
+	}
+	c, err := s.crossResponses(ctx, r, survey, filter)
+	if err != nil {
+		writeAPIError(w, "crossing responses", err)
+		return
+	}
+	writeData(w, http.StatusOK, c)
+}
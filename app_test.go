@@ -1,107 +1,136 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"math"
+	"mime/multipart"
+	"net"
 	"net/http"
+	"net/http/cookiejar"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/mattn/go-sqlite3"
 	"golang.org/x/crypto/bcrypt"
-
 	"google.golang.org/appengine"
 	"google.golang.org/appengine/aetest"
-	"google.golang.org/appengine/datastore"
 )
 
-var inst aetest.Instance
-
-func TestMain(m *testing.M) {
-	var err error
-	inst, err = aetest.NewInstance(nil)
+// newTestServer returns a server backed by an empty in-memory store.
+func newTestServer() *server {
+	templates, err := loadTemplates("templates", false)
 	if err != nil {
-		log.Fatalf("failed to create new Instance: %v", err)
+		log.Fatalf("failed to parse templates: %v", err)
+	}
+	commonPasswords, err := loadCommonPasswords("common-passwords.txt")
+	if err != nil {
+		log.Fatalf("failed to load common passwords: %v", err)
+	}
+	return &server{
+		store: newMemoryStore(),
+		newContext: func(r *http.Request) context.Context {
+			return r.Context()
+		},
+		templates:       templates,
+		commonPasswords: commonPasswords,
+		secureCookies:   true,
+		now:             time.Now,
 	}
-	defer inst.Close()
-	e := m.Run()
-	os.Exit(e)
 }
 
 func TestCreateUser(t *testing.T) {
+	s := newTestServer()
+	created := time.Date(2017, 3, 1, 12, 0, 0, 0, time.UTC)
+	s.now = func() time.Time {
+		return created
+	}
 	username := "User"
-	password := "password"
+	password := "horse-battery-staple"
 	params := fmt.Sprintf("username=%s&password=%s", username, password)
-	r, _ := inst.NewRequest("POST", "/createusers", strings.NewReader(params))
+	r := httptest.NewRequest("POST", "/createusers", strings.NewReader(params))
 	r.Header.Set("Content-Type", "application/x-www-form-urlencoded; param=value")
 	w := httptest.NewRecorder()
 	// create new user
-	createUser(w, r)
-	ctx := appengine.NewContext(r)
-	key := datastore.NewKey(ctx, "User", username, 0, nil)
-	var user User
-	err := datastore.Get(ctx, key, &user)
+	s.createUser(w, r)
+	ctx := context.Background()
+	user, err := s.store.GetUser(ctx, username)
 	if user.Id != username {
 		t.Error("Expected user to have username:", username)
 	}
+	if !user.Created.Equal(created) {
+		t.Errorf("Expected user to be created at %v, got %v", created, user.Created)
+	}
 	err = bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password))
 	if err != nil {
 		t.Error("Expected user to have password: ", password)
 	}
 	// create user that already exists
-	password = "changed"
+	password = "changed-battery-staple"
 	params = fmt.Sprintf("username=%s&password=%s", username, password)
-	r, _ = inst.NewRequest("POST", "/createusers", strings.NewReader(params))
+	r = httptest.NewRequest("POST", "/createusers", strings.NewReader(params))
 	r.Header.Set("Content-Type", "application/x-www-form-urlencoded; param=value")
 	w = httptest.NewRecorder()
-	createUser(w, r)
-	err = datastore.Get(ctx, key, &user)
+	s.createUser(w, r)
+	user, err = s.store.GetUser(ctx, username)
 	err = bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password))
 	if err == nil {
 		t.Error("Did not expect password to be changed")
 	}
-	datastore.Delete(ctx, key)
-	datastore.Get(ctx, key, &user)
 }
 
 func TestLoginAndLogout(t *testing.T) {
+	s := newTestServer()
 	username := "User"
-	password := "password"
+	password := "horse-battery-staple"
 	params := fmt.Sprintf("username=%s&password=%s", username, password)
-	r, _ := inst.NewRequest("POST", "/createusers", strings.NewReader(params))
+	r := httptest.NewRequest("POST", "/createusers", strings.NewReader(params))
 	r.Header.Set("Content-Type", "application/x-www-form-urlencoded; param=value")
 	w := httptest.NewRecorder()
-	createUser(w, r)
+	s.createUser(w, r)
 	//login success
 	paramsSuccess := fmt.Sprintf("username=%s&password=%s", username, password)
-	r, _ = inst.NewRequest("POST", "/login", strings.NewReader(paramsSuccess))
+	r = httptest.NewRequest("POST", "/login", strings.NewReader(paramsSuccess))
 	r.Header.Set("Content-Type", "application/x-www-form-urlencoded; param=value")
 	w = httptest.NewRecorder()
-	login(w, r)
+	s.login(w, r)
 	content, _ := ioutil.ReadAll(w.Body)
 	if string(content) != "true" {
 		t.Error("Expected login to succeed for user")
 	}
 	//login failure
 	paramsFailure := fmt.Sprintf("username=%s&password=fail", username)
-	r, _ = inst.NewRequest("POST", "/login", strings.NewReader(paramsFailure))
+	r = httptest.NewRequest("POST", "/login", strings.NewReader(paramsFailure))
 	r.Header.Set("Content-Type", "application/x-www-form-urlencoded; param=value")
 	w = httptest.NewRecorder()
-	login(w, r)
+	s.login(w, r)
 	content, _ = ioutil.ReadAll(w.Body)
 	if string(content) == "true" {
 		t.Error("Expected login to fail for user")
 	}
 	// login nonexistent user
 	paramsNonExist := fmt.Sprintf("username=nonuser&password=fail")
-	r, _ = inst.NewRequest("POST", "/login", strings.NewReader(paramsNonExist))
+	r = httptest.NewRequest("POST", "/login", strings.NewReader(paramsNonExist))
 	r.Header.Set("Content-Type", "application/x-www-form-urlencoded; param=value")
 	w = httptest.NewRecorder()
-	login(w, r)
+	s.login(w, r)
 	content, _ = ioutil.ReadAll(w.Body)
 	if string(content) == "true" {
 		t.Error("Expected login to fail for nonexistent user")
@@ -114,150 +143,447 @@ func TestLoginAndLogout(t *testing.T) {
 		Responses:      []int{},
 		SurveyComplete: true,
 	}
-	ctx := appengine.NewContext(r)
-	key := datastore.NewKey(ctx, "User", user.Id, 0, nil)
-	datastore.Put(ctx, key, &user)
+	s.store.PutUser(context.Background(), user)
 	paramsComplete := fmt.Sprintf("username=%s&password=%s", username, password)
-	r, _ = inst.NewRequest("POST", "/login", strings.NewReader(paramsComplete))
+	r = httptest.NewRequest("POST", "/login", strings.NewReader(paramsComplete))
 	r.Header.Set("Content-Type", "application/x-www-form-urlencoded; param=value")
 	w = httptest.NewRecorder()
-	login(w, r)
+	s.login(w, r)
 	content, _ = ioutil.ReadAll(w.Body)
 	if string(content) != "true" {
 		t.Error("Expected login to succeed for user")
 	}
-	r, _ = inst.NewRequest("POST", "/logout", nil)
+	r = httptest.NewRequest("POST", "/logout", nil)
 	w = httptest.NewRecorder()
-	logout(w, r)
+	s.logout(w, r)
 	if w.Code != http.StatusFound {
 		t.Error("Logout failed")
 	}
-	datastore.Delete(ctx, key)
-	datastore.Get(ctx, key, &user)
+}
+
+func TestLoginThrottle(t *testing.T) {
+	sqlServer, _ := newSQLTestServer(t)
+	for name, s := range map[string]*server{"memory": newTestServer(), "sql": sqlServer} {
+		ctx := context.Background()
+		// the clock only moves when the test moves it, however long
+		// checking passwords takes
+		clock := time.Date(2017, 3, 1, 12, 0, 0, 0, time.UTC)
+		s.now = func() time.Time {
+			return clock
+		}
+		hash, _ := bcrypt.GenerateFromPassword([]byte("horse-battery-staple"), bcrypt.DefaultCost)
+		s.store.PutUser(ctx, User{Id: "User", Password: string(hash), Role: roleAdmin})
+		s.store.PutUsername(ctx, "user", "User")
+		login := func(client string, username string, password string) *httptest.ResponseRecorder {
+			r := httptest.NewRequest("POST", "/login", strings.NewReader("username="+username+"&password="+password))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded; param=value")
+			r.RemoteAddr = client + ":1234"
+			w := httptest.NewRecorder()
+			s.login(w, r)
+			return w
+		}
+		// failures beyond the free ones delay the next login, even with the
+		// right password
+		for i := 0; i <= accountLimit.free; i++ {
+			if w := login("192.0.2.1", "User", "wrong"); w.Code != http.StatusOK || w.Body.String() != "false" {
+				t.Fatalf("%s: Expected failed login %d to be answered, got %d", name, i+1, w.Code)
+			}
+		}
+		w := login("192.0.2.1", "user", "horse-battery-staple")
+		if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "1" {
+			t.Errorf("%s: Expected throttled login to be refused with Retry-After, got %d %q", name, w.Code, w.Header().Get("Retry-After"))
+		}
+		// once the delay passed, a successful login clears the failures of
+		// the account but not of the client
+		clock = clock.Add(time.Second)
+		if w = login("192.0.2.1", "User", "horse-battery-staple"); w.Body.String() != "true" {
+			t.Errorf("%s: Expected login to succeed after the delay, got %d", name, w.Code)
+		}
+		if _, err := s.store.GetLoginThrottle(ctx, "account:user"); err != errNotFound {
+			t.Errorf("%s: Expected successful login to clear the failures of the account", name)
+		}
+		if throttle, err := s.store.GetLoginThrottle(ctx, "client:192.0.2.1"); err != nil || throttle.Failures != accountLimit.free+1 {
+			t.Errorf("%s: Expected failures of the client to be kept, got %+v: %v", name, throttle, err)
+		}
+		// made-up accounts are throttled by client only, so they do not
+		// store a throttle each
+		if w = login("192.0.2.2", "Ghost", "wrong"); w.Body.String() != "false" {
+			t.Errorf("%s: Expected login to an unknown account to fail, got %d", name, w.Code)
+		}
+		if _, err := s.store.GetLoginThrottle(ctx, "account:ghost"); err != errNotFound {
+			t.Errorf("%s: Expected no throttle for an unknown account, got %v", name, err)
+		}
+		if throttle, err := s.store.GetLoginThrottle(ctx, "client:192.0.2.2"); err != nil || throttle.Failures != 1 {
+			t.Errorf("%s: Expected failure of the client to be counted, got %+v: %v", name, throttle, err)
+		}
+		// logins in flight count as failures, so logins sent at once cannot
+		// all be checked before their failures are counted
+		s.store.PutUser(ctx, User{Id: "Racer", Password: string(hash)})
+		answered := make(chan bool)
+		for i := 0; i < 10; i++ {
+			go func(i int) {
+				w := login(fmt.Sprintf("192.0.2.%d", 100+i), "Racer", "wrong")
+				answered <- w.Code == http.StatusOK
+			}(i)
+		}
+		checked := 0
+		for i := 0; i < 10; i++ {
+			if <-answered {
+				checked++
+			}
+		}
+		if checked != accountLimit.free+1 {
+			t.Errorf("%s: Expected %d of the concurrent logins to be checked, got %d", name, accountLimit.free+1, checked)
+		}
+		if throttle, err := s.store.GetLoginThrottle(ctx, "account:racer"); err != nil || throttle.Failures != checked || throttle.Pending != 0 {
+			t.Errorf("%s: Expected the checked logins to be counted, got %+v: %v", name, throttle, err)
+		}
+		// logins cut short before they were settled stop counting
+		s.store.PutLoginThrottle(ctx, "account:racer", LoginThrottle{Failures: accountLimit.free, LastFailure: clock, Pending: 1, LastAttempt: clock})
+		if w = login("192.0.2.99", "Racer", "horse-battery-staple"); w.Code != http.StatusTooManyRequests {
+			t.Errorf("%s: Expected login to wait for the login in flight, got %d", name, w.Code)
+		}
+		clock = clock.Add(2 * loginPendingTimeout)
+		if w = login("192.0.2.99", "Racer", "horse-battery-staple"); w.Body.String() != "true" {
+			t.Errorf("%s: Expected login to succeed once the login in flight timed out, got %d", name, w.Code)
+		}
+		// the last failure before the lockout locks the account out and is
+		// audited
+		s.store.PutLoginThrottle(ctx, "account:user", LoginThrottle{Failures: accountLimit.lockout - 1, LastFailure: clock.Add(-time.Hour)})
+		login("198.51.100.7", "USER", "wrong")
+		w = login("198.51.100.8", "User", "horse-battery-staple")
+		if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "1800" {
+			t.Errorf("%s: Expected locked out account to be refused for the lockout, got %d %q", name, w.Code, w.Header().Get("Retry-After"))
+		}
+		entries, err := s.store.ListAuditEntries(ctx, 10)
+		if err != nil || len(entries) != 1 || entries[0].Event != "lockout" || entries[0].Subject != "account:user" || entries[0].Client != "198.51.100.7" {
+			t.Errorf("%s: Expected lockout to be audited, got %+v: %v", name, entries, err)
+		}
+		// clients are throttled across accounts, and the api answers 429
+		s.store.PutLoginThrottle(ctx, "client:203.0.113.9", LoginThrottle{LockedUntil: clock.Add(time.Minute)})
+		r := httptest.NewRequest("POST", "/api/v1/session", strings.NewReader(`{"username": "Other", "password": "horse-battery-staple"}`))
+		r.Header.Set("Content-Type", "application/json")
+		r.RemoteAddr = "203.0.113.9:1234"
+		w = httptest.NewRecorder()
+		s.handler().ServeHTTP(w, r)
+		if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "60" || !strings.Contains(w.Body.String(), "too many failed logins") {
+			t.Errorf("%s: Expected throttled api login to be refused, got %d %s", name, w.Code, w.Body.String())
+		}
+		// the lockout is listed on the admin page
+		r = httptest.NewRequest("GET", "/admin", nil)
+		addCookies(s, r, "User")
+		w = httptest.NewRecorder()
+		s.adminHome(w, r)
+		if !strings.Contains(w.Body.String(), "account:user") {
+			t.Errorf("%s: Expected lockout in the audit log on the admin page", name)
+		}
+	}
+	// behind trusted proxies the client is the address the first one saw
+	s := newTestServer()
+	r := httptest.NewRequest("POST", "/login", nil)
+	r.RemoteAddr = "10.0.0.2:1234"
+	r.Header.Add("X-Forwarded-For", "203.0.113.1, 198.51.100.2")
+	r.Header.Add("X-Forwarded-For", "10.0.0.1")
+	for proxies, client := range []string{"10.0.0.2", "10.0.0.1", "198.51.100.2", "203.0.113.1", "10.0.0.2"} {
+		s.trustedProxies = proxies
+		if got := s.clientAddress(r); got != client {
+			t.Errorf("Expected client %s behind %d proxies, got %s", client, proxies, got)
+		}
+	}
+}
+
+func TestCSRF(t *testing.T) {
+	s := newTestServer()
+	handler := s.handler()
+	hash, _ := bcrypt.GenerateFromPassword([]byte("horse-battery-staple"), bcrypt.DefaultCost)
+	s.store.PutUser(context.Background(), User{Id: "User", Password: string(hash)})
+	post := func(path string, body string, cookie *http.Cookie, header string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", path, strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if cookie != nil {
+			r.AddCookie(cookie)
+		}
+		if header != "" {
+			r.Header.Set(csrfHeader, header)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+	// visitors without a session get a csrf cookie along with the token
+	// bound to it
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	var visitor *http.Cookie
+	for _, c := range w.Result().Cookies() {
+		if c.Name == csrfCookie {
+			visitor = c
+		}
+	}
+	if visitor == nil || !visitor.HttpOnly {
+		t.Fatal("Expected a csrf cookie for a visitor without a session")
+	}
+	token := csrfToken(visitor.Value)
+	if !strings.Contains(w.Body.String(), `<meta name="csrf-token" content="`+token+`">`) || !strings.Contains(w.Body.String(), `name="csrf_token" value="`+token+`"`) {
+		t.Error("Expected the csrf token of the visitor in the page")
+	}
+	// state-changing handlers do not take their fields from GET requests,
+	// which are not checked for tokens
+	for _, path := range []string{"/login?username=User&password=horse-battery-staple", "/createuser?username=Other&password=horse-battery-staple", "/logout"} {
+		r := httptest.NewRequest("GET", path, nil)
+		r.AddCookie(visitor)
+		w = httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != http.StatusMethodNotAllowed || len(w.Result().Cookies()) > 0 {
+			t.Errorf("Expected GET %s to be refused, got %d", path, w.Code)
+		}
+	}
+	if _, err := s.store.GetUser(context.Background(), "Other"); err != errNotFound {
+		t.Error("Expected GET /createuser not to create a user, got", err)
+	}
+	// cross-site posts are refused without the token
+	if w = post("/login", "username=User&password=horse-battery-staple", visitor, ""); w.Code != http.StatusForbidden {
+		t.Errorf("Expected login without csrf token to be refused, got %d", w.Code)
+	}
+	if w = post("/createuser", "username=Other&password=horse-battery-staple", nil, ""); w.Code != http.StatusForbidden {
+		t.Errorf("Expected sign-up without cookies to be refused, got %d", w.Code)
+	}
+	if w = post("/login", "username=User&password=horse-battery-staple", visitor, csrfToken("other")); w.Code != http.StatusForbidden {
+		t.Errorf("Expected login with another csrf token to be refused, got %d", w.Code)
+	}
+	w = post("/login", "username=User&password=horse-battery-staple", visitor, token)
+	if w.Code != http.StatusOK || w.Body.String() != "true" {
+		t.Fatalf("Expected login with csrf token to succeed, got %d %s", w.Code, w.Body.String())
+	}
+	// logged in, tokens are bound to the session instead
+	session := w.Result().Cookies()[0]
+	if w = post("/logout", "csrf_token="+token, session, ""); w.Code != http.StatusForbidden {
+		t.Errorf("Expected logout with the token of the visitor to be refused, got %d", w.Code)
+	}
+	if w = post("/api/recordUserResponse", "survey=1&question=1&response=1", session, ""); w.Code != http.StatusForbidden {
+		t.Errorf("Expected answer without csrf token to be refused, got %d", w.Code)
+	}
+	if w = post("/api/aggregateResponses", "survey=1", session, csrfToken(session.Value)); w.Code == http.StatusForbidden {
+		t.Errorf("Expected aggregates with csrf token to be served, got %d", w.Code)
+	}
+	// json api requests and bearer tokens cannot be sent cross-site
+	if w = post(apiPrefix+"/session", `{"username": "User", "password": "horse-battery-staple"}`, session, ""); w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "CSRF") {
+		t.Errorf("Expected api form post to be refused, got %d %s", w.Code, w.Body.String())
+	}
+	r := httptest.NewRequest("DELETE", apiPrefix+"/session", nil)
+	r.Header.Set("Authorization", "Bearer "+session.Value)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusNoContent {
+		t.Errorf("Expected api logout with bearer token to succeed, got %d", w.Code)
+	}
+	if w = post("/logout", "csrf_token="+csrfToken(session.Value), session, ""); w.Code != http.StatusFound {
+		t.Errorf("Expected logout with csrf token to succeed, got %d", w.Code)
+	}
+}
+
+func TestSession(t *testing.T) {
+	s := newTestServer()
+	username := "User"
+	password := "horse-battery-staple"
+	params := fmt.Sprintf("username=%s&password=%s", username, password)
+	r := httptest.NewRequest("POST", "/createusers", strings.NewReader(params))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded; param=value")
+	w := httptest.NewRecorder()
+	s.createUser(w, r)
+	ctx := context.Background()
+	cookies := w.Result().Cookies()
+	var token string
+	for _, c := range cookies {
+		if c.Name == sessionCookie {
+			token = c.Value
+			if !c.HttpOnly || !c.Secure {
+				t.Error("Expected session cookie to be HttpOnly and Secure")
+			}
+		}
+	}
+	if token == "" || token == username {
+		t.Fatal("Expected opaque session token in cookie")
+	}
+	// session token resolves to user
+	r = httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(&http.Cookie{Name: sessionCookie, Value: token})
+	if session := s.getSession(r); !session.LoggedIn || session.Id != username {
+		t.Error("Expected session to resolve to user")
+	}
+	// forged cookie containing the username is rejected
+	r = httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(&http.Cookie{Name: sessionCookie, Value: username})
+	if session := s.getSession(r); session.LoggedIn {
+		t.Error("Unexpected session for forged cookie")
+	}
+	// so is a token naming another user
+	forged := base64.RawURLEncoding.EncodeToString([]byte("Other")) + token[strings.IndexByte(token, '.'):]
+	if tokenUser(token) != username || tokenUser(forged) != "Other" {
+		t.Fatal("Expected tokens to carry their user")
+	}
+	if _, err := s.lookupSession(ctx, forged); err != errInvalidSession {
+		t.Error("Unexpected session for token naming another user")
+	}
+	// expired session is rejected
+	expired := SessionRecord{
+		UserId:  username,
+		Created: time.Now().Add(-2 * sessionLifetime),
+		Expires: time.Now().Add(-sessionLifetime),
+	}
+	expiredToken, _ := newUserToken(username)
+	s.store.PutSession(ctx, sessionId(expiredToken), expired)
+	r = httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(&http.Cookie{Name: sessionCookie, Value: expiredToken})
+	if session := s.getSession(r); session.LoggedIn {
+		t.Error("Unexpected session for expired token")
+	}
+	// logout revokes session
+	r = httptest.NewRequest("POST", "/logout", nil)
+	r.AddCookie(&http.Cookie{Name: sessionCookie, Value: token})
+	w = httptest.NewRecorder()
+	s.logout(w, r)
+	r = httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(&http.Cookie{Name: sessionCookie, Value: token})
+	if session := s.getSession(r); session.LoggedIn {
+		t.Error("Expected session to be revoked by logout")
+	}
 }
 
 func TestHome(t *testing.T) {
-	r, _ := inst.NewRequest("GET", "/home", nil)
+	s := newTestServer()
+	r := httptest.NewRequest("GET", "/home", nil)
 	w := httptest.NewRecorder()
-	home(w, r)
+	s.home(w, r)
 	if w.Code != http.StatusOK {
 		t.Error("Failed to access home page")
 	}
 	// access home with account
 	username := "User"
-	password := "password"
+	password := "horse-battery-staple"
 	params := fmt.Sprintf("username=%s&password=%s", username, password)
-	r, _ = inst.NewRequest("POST", "/createusers", strings.NewReader(params))
+	r = httptest.NewRequest("POST", "/createusers", strings.NewReader(params))
 	r.Header.Set("Content-Type", "application/x-www-form-urlencoded; param=value")
 	w = httptest.NewRecorder()
-	createUser(w, r)
-	r, _ = inst.NewRequest("GET", "/home", nil)
-	addCookies(r, username)
+	s.createUser(w, r)
+	r = httptest.NewRequest("GET", "/home", nil)
+	addCookies(s, r, username)
 	w = httptest.NewRecorder()
-	home(w, r)
+	s.home(w, r)
 	if w.Code != http.StatusOK {
 		t.Error("Failed to access home page")
 	}
 	// access home when completed survey
-	hash, _ := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
-	user := User{
-		Id:             username,
-		Password:       string(hash[:]),
-		Responses:      []int{},
-		SurveyComplete: true,
-	}
-	ctx := appengine.NewContext(r)
-	key := datastore.NewKey(ctx, "User", user.Id, 0, nil)
-	datastore.Put(ctx, key, &user)
-	r, _ = inst.NewRequest("GET", "/home", nil)
-	addCookies(r, user.Id)
+	ctx := context.Background()
+	putAttempt(s, ctx, username, defaultSurveyId, []int{0, 0, 0, 0})
+	r = httptest.NewRequest("GET", "/home", nil)
+	addCookies(s, r, username)
 	w = httptest.NewRecorder()
-	home(w, r)
-	if w.Code != http.StatusFound {
-		t.Error("Failed to redirect to dashboard")
+	s.home(w, r)
+	if w.Code != http.StatusOK {
+		t.Error("Failed to access home page")
+	}
+	if !strings.Contains(w.Body.String(), "/dashboard/"+defaultSurveyId) {
+		t.Error("Expected link to results of completed survey")
 	}
-	datastore.Delete(ctx, key)
-	datastore.Get(ctx, key, &user)
 }
 
 func TestAbout(t *testing.T) {
-	r, _ := inst.NewRequest("GET", "/about", nil)
+	s := newTestServer()
+	r := httptest.NewRequest("GET", "/about", nil)
 	w := httptest.NewRecorder()
-	about(w, r)
+	s.about(w, r)
 	if w.Code != http.StatusOK {
 		t.Error("Failed to get about page")
 	}
 }
 
 func TestSurvey(t *testing.T) {
+	s := newTestServer()
 	// attempt to take survey without account
-	r, _ := inst.NewRequest("POST", "/survey", nil)
+	r := httptest.NewRequest("POST", "/survey", nil)
 	w := httptest.NewRecorder()
-	handleSurvey(w, r)
+	s.handleSurvey(w, r)
 	if w.Code != http.StatusUnauthorized {
 		t.Error("Unexpected access to survey without logging in")
 	}
 	username := "User"
-	password := "password"
+	password := "horse-battery-staple"
 	params := fmt.Sprintf("username=%s&password=%s", username, password)
-	r, _ = inst.NewRequest("POST", "/createusers", strings.NewReader(params))
+	r = httptest.NewRequest("POST", "/createusers", strings.NewReader(params))
 	r.Header.Set("Content-Type", "application/x-www-form-urlencoded; param=value")
 	w = httptest.NewRecorder()
-	createUser(w, r)
+	s.createUser(w, r)
+	// /survey redirects to the default survey
+	r = httptest.NewRequest("GET", "/survey", nil)
+	addCookies(s, r, username)
+	w = httptest.NewRecorder()
+	s.handleSurvey(w, r)
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "/survey/"+defaultSurveyId {
+		t.Error("Failed to redirect to default survey")
+	}
 	// take survey with existing account
-	r, _ = inst.NewRequest("POST", "/survey", nil)
-	addCookies(r, username)
+	r = httptest.NewRequest("GET", "/survey/"+defaultSurveyId, nil)
+	addCookies(s, r, username)
 	w = httptest.NewRecorder()
-	handleSurvey(w, r)
+	s.handleSurvey(w, r)
 	if w.Code != http.StatusOK {
 		t.Error("Failed to take survey")
 	}
-	hash, _ := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
-	user := User{
-		Id:             username,
-		Password:       string(hash[:]),
-		Responses:      []int{},
-		SurveyComplete: true,
+	// take nonexistent survey
+	r = httptest.NewRequest("GET", "/survey/nonexistent", nil)
+	addCookies(s, r, username)
+	w = httptest.NewRecorder()
+	s.handleSurvey(w, r)
+	if w.Code != http.StatusNotFound {
+		t.Error("Expected nonexistent survey to be not found")
 	}
-	ctx := appengine.NewContext(r)
-	key := datastore.NewKey(ctx, "User", user.Id, 0, nil)
-	datastore.Put(ctx, key, &user)
+	ctx := context.Background()
+	putAttempt(s, ctx, username, defaultSurveyId, []int{0, 0, 0, 0})
 	// attempt to take survey when already complete
-	r, _ = inst.NewRequest("POST", "/survey", nil)
-	addCookies(r, user.Id)
+	r = httptest.NewRequest("GET", "/survey/"+defaultSurveyId, nil)
+	addCookies(s, r, username)
 	w = httptest.NewRecorder()
-	handleSurvey(w, r)
+	s.handleSurvey(w, r)
 	if w.Code != http.StatusFound {
 		t.Error("Failed to redirect to dashboard")
 	}
-	datastore.Delete(ctx, key)
-	datastore.Get(ctx, key, &user)
+	// other surveys are tracked separately
+	r = httptest.NewRequest("GET", "/survey/intake", nil)
+	addCookies(s, r, username)
+	w = httptest.NewRecorder()
+	s.handleSurvey(w, r)
+	if w.Code != http.StatusOK {
+		t.Error("Failed to take another survey")
+	}
 }
 
 func TestDashboard(t *testing.T) {
+	s := newTestServer()
 	// get dashboard without logging in
-	r, _ := inst.NewRequest("GET", "/dashboard", nil)
+	r := httptest.NewRequest("GET", "/dashboard", nil)
 	w := httptest.NewRecorder()
-	dashboard(w, r)
+	s.dashboard(w, r)
 	if w.Code != http.StatusUnauthorized {
 		t.Error("Unexpected access to dashboard")
 	}
 	username := "User"
-	password := "password"
+	password := "horse-battery-staple"
 	params := fmt.Sprintf("username=%s&password=%s", username, password)
-	r, _ = inst.NewRequest("POST", "/createusers", strings.NewReader(params))
+	r = httptest.NewRequest("POST", "/createusers", strings.NewReader(params))
 	r.Header.Set("Content-Type", "application/x-www-form-urlencoded; param=value")
 	w = httptest.NewRecorder()
-	createUser(w, r)
+	s.createUser(w, r)
 	// get dashboard without completing survey
-	r, _ = inst.NewRequest("GET", "/dashboard", nil)
-	addCookies(r, username)
+	r = httptest.NewRequest("GET", "/dashboard", nil)
+	addCookies(s, r, username)
 	w = httptest.NewRecorder()
-	dashboard(w, r)
+	s.dashboard(w, r)
 	if w.Code == http.StatusOK {
 		t.Error("Unexpected access to dashboard")
 	}
-	// get dashboard after completing survey
+	// get dashboard after completing survey before responses were tracked
+	// per survey
 	hash, _ := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 	user := User{
 		Id:             username,
@@ -265,94 +591,217 @@ func TestDashboard(t *testing.T) {
 		Responses:      []int{1, 1, 1, 1},
 		SurveyComplete: true,
 	}
-	ctx := appengine.NewContext(r)
-	key := datastore.NewKey(ctx, "User", user.Id, 0, nil)
-	datastore.Put(ctx, key, &user)
-	r, _ = inst.NewRequest("GET", "/dashboard", nil)
-	addCookies(r, user.Id)
+	ctx := context.Background()
+	s.store.PutUser(ctx, user)
+	r = httptest.NewRequest("GET", "/dashboard/"+defaultSurveyId, nil)
+	addCookies(s, r, user.Id)
 	w = httptest.NewRecorder()
-	dashboard(w, r)
+	s.dashboard(w, r)
 	if w.Code != http.StatusOK {
 		t.Error("failed to access dashboard")
 	}
-	datastore.Delete(ctx, key)
-	datastore.Get(ctx, key, &user)
+	attempt, _ := s.loadAttempt(ctx, User{Id: username}, defaultSurveyId)
+	if !attempt.Complete || len(attempt.Answers) != 4 || attempt.Version != 1 {
+		t.Error("Expected legacy responses to be migrated")
+	}
+	// dashboard of a survey that was not completed
+	r = httptest.NewRequest("GET", "/dashboard/intake", nil)
+	addCookies(s, r, user.Id)
+	w = httptest.NewRecorder()
+	s.dashboard(w, r)
+	if w.Code == http.StatusOK {
+		t.Error("Unexpected access to dashboard")
+	}
 }
 
 func TestRecordUserResponse(t *testing.T) {
+	s := newTestServer()
 	username := "User"
-	password := "password"
+	password := "horse-battery-staple"
 	params := fmt.Sprintf("username=%s&password=%s", username, password)
-	r, _ := inst.NewRequest("POST", "/createusers", strings.NewReader(params))
+	r := httptest.NewRequest("POST", "/createusers", strings.NewReader(params))
 	r.Header.Set("Content-Type", "application/x-www-form-urlencoded; param=value")
 	w := httptest.NewRecorder()
-	createUser(w, r)
-	testResponse := "1"
-	responseParam := fmt.Sprintf("response=%s", testResponse)
+	s.createUser(w, r)
+	ctx := context.Background()
+	survey, err := s.loadSurvey(ctx, defaultSurveyId)
+	if err != nil {
+		t.Fatal("failed to load survey:", err)
+	}
+	numQuestions := len(survey.Questions)
+	// responseParams answers question i of the survey with its second choice
+	responseParams := func(i int) string {
+		question := survey.Questions[i%numQuestions]
+		return fmt.Sprintf("survey=%s&question=%d&response=%d", defaultSurveyId, question.Id, question.Choices[1].Id)
+	}
 	// test record with invalid session
 	cUser := &http.Cookie{
 		Name:  "session-id",
 		Value: "-1",
 	}
-	r, _ = inst.NewRequest("POST", "/api/recordUserResponse", strings.NewReader(responseParam))
+	r = httptest.NewRequest("POST", "/api/recordUserResponse", strings.NewReader(responseParams(0)))
 	r.Header.Set("Content-Type", "application/x-www-form-urlencoded; param=value")
 	r.AddCookie(cUser)
 	w = httptest.NewRecorder()
-	recordUserResponse(w, r)
-	if w.Code == http.StatusOK {
+	s.recordUserResponse(w, r)
+	if w.Code != http.StatusUnauthorized {
 		t.Fatal("Unexpected success with invalid session")
 	}
+	// test record without session cookie
+	r = httptest.NewRequest("POST", "/api/recordUserResponse", strings.NewReader(responseParams(0)))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded; param=value")
+	w = httptest.NewRecorder()
+	s.recordUserResponse(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatal("Unexpected success without session")
+	}
+	// test malformed records
+	first := survey.Questions[0]
+	malformed := []string{
+		fmt.Sprintf("question=%d&response=%d", first.Id, first.Choices[1].Id),
+		fmt.Sprintf("survey=%s&question=x&response=%d", defaultSurveyId, first.Choices[1].Id),
+		fmt.Sprintf("survey=%s&question=-1&response=%d", defaultSurveyId, first.Choices[1].Id),
+		fmt.Sprintf("survey=%s&question=%d", defaultSurveyId, first.Id),
+		fmt.Sprintf("survey=%s&question=%d&response=-1", defaultSurveyId, first.Id),
+		fmt.Sprintf("survey=%s&question=%d&response=99999999999999999999", defaultSurveyId, first.Id),
+	}
+	for _, params := range malformed {
+		r = httptest.NewRequest("POST", "/api/recordUserResponse", strings.NewReader(params))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded; param=value")
+		addCookies(s, r, username)
+		w = httptest.NewRecorder()
+		s.recordUserResponse(w, r)
+		var body apiError
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected %q to be rejected with 400, got %d", params, w.Code)
+		} else if err = json.NewDecoder(w.Body).Decode(&body); err != nil || body.Error == "" {
+			t.Errorf("Expected json error body for %q", params)
+		}
+	}
 	// test record with valid session
-	r, _ = inst.NewRequest("POST", "/api/recordUserResponse", strings.NewReader(responseParam))
+	r = httptest.NewRequest("POST", "/api/recordUserResponse", strings.NewReader(responseParams(0)))
 	r.Header.Set("Content-Type", "application/x-www-form-urlencoded; param=value")
-	addCookies(r, username)
+	addCookies(s, r, username)
 	w = httptest.NewRecorder()
-	recordUserResponse(w, r)
+	s.recordUserResponse(w, r)
 	if w.Code != http.StatusOK {
 		t.Fatal("Failed to record user response")
 	}
-	ctx := appengine.NewContext(r)
-	key := datastore.NewKey(ctx, "User", username, 0, nil)
-	var user User
-	datastore.Get(ctx, key, &user)
-	if len(user.Responses) != 1 {
-		t.Error("failed to record user response")
+	user := User{Id: username}
+	attempt, _ := s.loadAttempt(ctx, user, defaultSurveyId)
+	if len(attempt.Answers) != 1 {
+		t.Fatal("failed to record user response")
 	}
-	if user.Responses[0] != 1 {
+	answer := attempt.Answers[0]
+	if answer.QuestionId != survey.Questions[0].Id || answer.ChoiceId != survey.Questions[0].Choices[1].Id {
 		t.Error("incorrect recorded response")
 	}
+	if answer.Version != survey.Version || attempt.Version != survey.Version {
+		t.Error("Expected response to record survey version")
+	}
+	// test duplicate and out of order responses
+	for _, question := range []int{0, 2} {
+		r = httptest.NewRequest("POST", "/api/recordUserResponse", strings.NewReader(responseParams(question)))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded; param=value")
+		addCookies(s, r, username)
+		w = httptest.NewRecorder()
+		s.recordUserResponse(w, r)
+		if w.Code != http.StatusConflict {
+			t.Errorf("Expected response to question %d to be rejected", question)
+		}
+	}
 	// test finish survey
-	for i := 1; i < MAX_ANSWERS; i++ {
-		r, _ = inst.NewRequest("POST", "/api/recordUserResponse", strings.NewReader(responseParam))
+	for i := 1; i < numQuestions; i++ {
+		r = httptest.NewRequest("POST", "/api/recordUserResponse", strings.NewReader(responseParams(i)))
 		r.Header.Set("Content-Type", "application/x-www-form-urlencoded; param=value")
-		addCookies(r, username)
+		addCookies(s, r, username)
 		w = httptest.NewRecorder()
-		recordUserResponse(w, r)
+		s.recordUserResponse(w, r)
 		if w.Code != http.StatusOK {
 			t.Fatal("Failed to record user response")
 		}
 	}
-	datastore.Get(ctx, key, &user)
-	if len(user.Responses) != 4 {
-		t.Error("failed to record user response")
+	attempt, _ = s.loadAttempt(ctx, user, defaultSurveyId)
+	if len(attempt.Answers) != numQuestions {
+		t.Fatal("failed to record user response")
 	}
-	if !user.SurveyComplete {
+	if !attempt.Complete {
 		t.Error("failed to update survey completion")
 	}
-	for i := 0; i < MAX_ANSWERS; i++ {
-		if user.Responses[0] != 1 {
+	for i := 0; i < numQuestions; i++ {
+		if attempt.Answers[i].ChoiceId != survey.Questions[i].Choices[1].Id {
 			t.Error("incorrect recorded response")
 			break
 		}
 	}
-	datastore.Delete(ctx, key)
-	datastore.Get(ctx, key, &user)
+	// test extra response after completion
+	r = httptest.NewRequest("POST", "/api/recordUserResponse", strings.NewReader(responseParams(numQuestions)))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded; param=value")
+	addCookies(s, r, username)
+	w = httptest.NewRecorder()
+	s.recordUserResponse(w, r)
+	if w.Code != http.StatusConflict {
+		t.Error("Expected response after completion to be rejected")
+	}
+	// test record for nonexistent survey
+	params = "survey=nonexistent&question=1&response=1"
+	r = httptest.NewRequest("POST", "/api/recordUserResponse", strings.NewReader(params))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded; param=value")
+	addCookies(s, r, username)
+	w = httptest.NewRecorder()
+	s.recordUserResponse(w, r)
+	if w.Code != http.StatusNotFound {
+		t.Error("Expected response to nonexistent survey to be rejected")
+	}
+}
+
+func TestLoadSurvey(t *testing.T) {
+	s := newTestServer()
+	ctx := context.Background()
+	survey, err := s.loadSurvey(ctx, defaultSurveyId)
+	if err != nil {
+		t.Fatal("failed to load default survey:", err)
+	}
+	defaultSurvey := findSeedSurvey(defaultSurveyId)
+	if len(survey.Questions) != len(defaultSurvey.Questions) {
+		t.Fatal("Expected default survey to be seeded")
+	}
+	for i, question := range survey.Questions {
+		if question.Id == 0 || question.Position != i {
+			t.Error("Expected questions to have ids and be ordered by position")
+		}
+		if question.Text != defaultSurvey.Questions[i].Text {
+			t.Error("incorrect question text")
+		}
+		for j, choice := range question.Choices {
+			if choice.Id == 0 || choice.Label != defaultSurvey.Questions[i].Choices[j].Label {
+				t.Error("incorrect choice")
+			}
+		}
+	}
+	// seeding again must not duplicate questions
+	s.seedSurvey(ctx, defaultSurvey)
+	survey, _ = s.loadSurvey(ctx, defaultSurveyId)
+	if len(survey.Questions) != len(defaultSurvey.Questions) {
+		t.Error("Expected seeding to be idempotent")
+	}
+	if _, err = s.loadSurvey(ctx, "nonexistent"); err == nil {
+		t.Error("Expected error loading nonexistent survey")
+	}
+	surveys, err := s.listSurveys(ctx, false)
+	if err != nil || len(surveys) < len(seedSurveys) {
+		t.Fatal("Expected seed surveys to be listed")
+	}
+	if surveys[0].Id != defaultSurveyId {
+		t.Error("Expected default survey to be listed first")
+	}
 }
 
 func TestGetUserResponses(t *testing.T) {
+	s := newTestServer()
 	username1 := "User1"
 	username2 := "User2"
-	password := "password"
+	password := "horse-battery-staple"
 	user1 := User{
 		Id:             username1,
 		Password:       password,
@@ -360,62 +809,2066 @@ func TestGetUserResponses(t *testing.T) {
 		SurveyComplete: true,
 	}
 	user2 := User{
-		Id:             username2,
-		Password:       password,
-		Responses:      []int{1, 1, 1, 1},
-		SurveyComplete: true,
+		Id:       username2,
+		Password: password,
 	}
-	r, _ := inst.NewRequest("POST", "/api/aggregateResponses", nil)
-	ctx := appengine.NewContext(r)
-	key1 := datastore.NewKey(ctx, "User", username1, 0, nil)
-	datastore.Put(ctx, key1, &user1)
-	datastore.Get(ctx, key1, &user1)
-	key2 := datastore.NewKey(ctx, "User", username2, 0, nil)
-	datastore.Put(ctx, key2, &user2)
-	datastore.Get(ctx, key2, &user2)
-	u := datastore.NewQuery("User")
-	var users []User
-	u.GetAll(ctx, &users)
+	params := fmt.Sprintf("survey=%s", defaultSurveyId)
+	r := httptest.NewRequest("POST", "/api/aggregateResponses", strings.NewReader(params))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded; param=value")
+	addCookies(s, r, username2)
+	ctx := context.Background()
+	// user1 completed the survey before responses were tracked per survey
+	s.store.PutUser(ctx, user1)
+	s.store.PutUser(ctx, user2)
+	putAttempt(s, ctx, username2, defaultSurveyId, []int{1, 1, 1, 1})
+	putAttempt(s, ctx, username2, "intake", []int{2, 2, 1, 2})
 	w := httptest.NewRecorder()
-	aggregateResponses(w, r)
+	s.aggregateResponses(w, r)
 	expected := [][]int{
 		{1, 1, 0, 0},
 		{1, 1, 0, 0},
 		{1, 1, 0, 0},
 		{1, 1, 0, 0},
 	}
-	output := [][]int{}
+	output := []QuestionAggregate{}
 	json.NewDecoder(w.Body).Decode(&output)
-	if len(output) != MAX_QUESTIONS {
+	if len(output) != len(expected) {
 		t.Fatal("error decoding response")
 	}
-	for i := 0; i < MAX_QUESTIONS; i++ {
-		for j := 0; j < MAX_ANSWERS; j++ {
-			if expected[i][j] != output[i][j] {
+	for i := range expected {
+		if len(output[i].Counts) != len(expected[i]) || len(output[i].Labels) != len(expected[i]) {
+			t.Fatal("incorrect number of choices in aggregate response")
+		}
+		for j := range expected[i] {
+			if expected[i][j] != output[i].Counts[j] {
 				t.Error("incorrect aggregate response")
 			}
 		}
 	}
-	datastore.Delete(ctx, key1)
-	datastore.Delete(ctx, key2)
-	datastore.Get(ctx, key1, &user1)
-	datastore.Get(ctx, key2, &user2)
+	if output[0].Labels[0] != "Bored" {
+		t.Error("Expected aggregate response to carry choice labels")
+	}
+	// aggregate without a survey
+	r = httptest.NewRequest("POST", "/api/aggregateResponses", nil)
+	addCookies(s, r, username2)
+	w = httptest.NewRecorder()
+	s.aggregateResponses(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Error("Expected aggregate without survey to be rejected")
+	}
+	// aggregate without a session
+	r = httptest.NewRequest("POST", "/api/aggregateResponses", strings.NewReader(params))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded; param=value")
+	w = httptest.NewRecorder()
+	s.aggregateResponses(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Error("Expected aggregate without a session to be rejected")
+	}
 }
 
-func addCookies(r *http.Request, id string) {
-	cUser := &http.Cookie{
-		Name:  "session-id",
-		Value: id,
+func TestSurveyVersioning(t *testing.T) {
+	s := newTestServer()
+	username := "User"
+	r := httptest.NewRequest("GET", "/dashboard/versioned", nil)
+	ctx := context.Background()
+	s.store.PutUser(ctx, User{Id: username})
+	s.createSurvey(ctx, "versioned", "Versioned")
+	s.editSurvey(ctx, "versioned", func(survey *Survey) error {
+		survey.Questions = []Question{{Text: "How are you?", Choices: choices("Fine", "Bad")}}
+		return nil
+	})
+	s.publishSurvey(ctx, "versioned")
+	putAttempt(s, ctx, username, "versioned", []int{1})
+	// reword and reorder the published question
+	s.editSurvey(ctx, "versioned", func(survey *Survey) error {
+		survey.Questions[0].Text = "How do you feel?"
+		survey.Questions[0].Choices = choices("Terrible", "Great")
+		return nil
+	})
+	s.publishSurvey(ctx, "versioned")
+	// dashboard shows the wording that was answered
+	addCookies(s, r, username)
+	w := httptest.NewRecorder()
+	s.dashboard(w, r)
+	if body := w.Body.String(); !strings.Contains(body, "How are you?") || !strings.Contains(body, "Bad") {
+		t.Error("Expected dashboard to show responses against the answered version")
+	}
+	// aggregate resolves labels against the requested version
+	s.store.PutUser(ctx, User{Id: "Admin", Role: roleAdmin})
+	aggregate := func(params string, userId string) ([]QuestionAggregate, int) {
+		r := httptest.NewRequest("POST", "/api/aggregateResponses", strings.NewReader(params))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded; param=value")
+		addCookies(s, r, userId)
+		w := httptest.NewRecorder()
+		s.aggregateResponses(w, r)
+		output := []QuestionAggregate{}
+		json.NewDecoder(w.Body).Decode(&output)
+		return output, w.Code
+	}
+	output, _ := aggregate("survey=versioned&version=1", username)
+	if len(output) != 1 || output[0].Labels[1] != "Bad" || output[0].Counts[1] != 1 {
+		t.Error("incorrect aggregate response for answered version")
+	}
+	output, _ = aggregate("survey=versioned", username)
+	if len(output) != 1 || output[0].Labels[1] != "Great" || output[0].Counts[1] != 0 {
+		t.Error("incorrect aggregate response for published version")
+	}
+	// drafts and unpublished surveys are only aggregated for admins
+	s.editSurvey(ctx, "versioned", func(survey *Survey) error {
+		survey.Questions[0].Text = "How are you today?"
+		return nil
+	})
+	draft, _ := s.getSurvey(ctx, "versioned")
+	params := fmt.Sprintf("survey=versioned&version=%d", draft.LatestVersion)
+	if _, code := aggregate(params, username); code != http.StatusNotFound {
+		t.Errorf("Expected draft aggregate to be refused, got %d", code)
+	}
+	if _, code := aggregate(params, "Admin"); code != http.StatusOK {
+		t.Errorf("Expected draft aggregate to be served to admins, got %d", code)
+	}
+	s.unpublishSurvey(ctx, "versioned")
+	if _, code := aggregate("survey=versioned&version=1", username); code != http.StatusNotFound {
+		t.Errorf("Expected unpublished survey aggregate to be refused, got %d", code)
+	}
+	if _, code := aggregate("survey=versioned&version=1", "Admin"); code != http.StatusOK {
+		t.Errorf("Expected unpublished survey aggregate to be served to admins, got %d", code)
+	}
+}
+
+func TestAdmin(t *testing.T) {
+	s := newTestServer()
+	username := "Admin"
+	r := httptest.NewRequest("GET", "/admin", nil)
+	ctx := context.Background()
+	user := User{Id: username}
+	s.store.PutUser(ctx, user)
+	// access admin without admin role
+	addCookies(s, r, username)
+	w := httptest.NewRecorder()
+	s.adminHome(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Error("Unexpected access to admin")
+	}
+	user.Role = roleAdmin
+	s.store.PutUser(ctx, user)
+	r = httptest.NewRequest("GET", "/admin", nil)
+	addCookies(s, r, username)
+	w = httptest.NewRecorder()
+	s.adminHome(w, r)
+	if w.Code != http.StatusOK {
+		t.Error("Failed to access admin")
+	}
+	post := func(path string, params string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", path, strings.NewReader(params))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded; param=value")
+		addCookies(s, r, username)
+		w := httptest.NewRecorder()
+		if path == "/admin/surveys" {
+			s.adminCreateSurvey(w, r)
+		} else {
+			s.adminSurvey(w, r)
+		}
+		return w
+	}
+	// create survey
+	if w = post("/admin/surveys", "id=checkin&title=Check-in"); w.Code != http.StatusFound {
+		t.Fatal("Failed to create survey")
+	}
+	if w = post("/admin/surveys", "id=checkin&title=Check-in"); w.Code != http.StatusConflict {
+		t.Error("Expected duplicate survey id to be rejected")
 	}
-	cQuestion := &http.Cookie{
-		Name:  "current-question",
-		Value: strconv.Itoa(1),
+	if w = post("/admin/survey/checkin", "action=publish"); w.Code != http.StatusBadRequest {
+		t.Error("Expected publishing survey without questions to be rejected")
 	}
-	qIndex := &http.Cookie{
-		Name:  "current-qindex",
-		Value: strconv.Itoa(0),
+	params := "action=addQuestion&text=How+are+you%3F&choices=Fine%0AGood%0A%0ABad"
+	if w = post("/admin/survey/checkin", params); w.Code != http.StatusFound {
+		t.Fatal("Failed to add question")
+	}
+	survey, err := s.loadSurveyVersion(ctx, "checkin", 1)
+	if err != nil || len(survey.Questions) != 1 || len(survey.Questions[0].Choices) != 3 {
+		t.Fatal("Expected question with three choices")
+	}
+	if _, err = s.loadSurvey(ctx, "checkin"); err != errNotPublished {
+		t.Error("Expected survey to be unpublished")
+	}
+	// publish and edit published survey
+	if w = post("/admin/survey/checkin", "action=publish"); w.Code != http.StatusFound {
+		t.Fatal("Failed to publish survey")
+	}
+	for _, choices := range []string{"Fine%0AGood%0AFine", "Fine%0A+fine+%0ABad"} {
+		params = "action=updateQuestion&question=0&text=How+do+you+feel%3F&choices=" + choices
+		if w = post("/admin/survey/checkin", params); w.Code != http.StatusBadRequest {
+			t.Errorf("Expected duplicate choices %q to be rejected", choices)
+		}
+	}
+	params = "action=updateQuestion&question=0&text=How+do+you+feel%3F&choices=FINE%0ABad"
+	if w = post("/admin/survey/checkin", params); w.Code != http.StatusFound {
+		t.Fatal("Failed to update question")
+	}
+	published, err := s.loadSurvey(ctx, "checkin")
+	if err != nil || published.Version != 1 || published.Questions[0].Text != "How are you?" {
+		t.Error("Expected published version to be unchanged")
+	}
+	if !published.HasDraft() || published.LatestVersion != 2 {
+		t.Error("Expected edit to create a new version")
+	}
+	draft, _ := s.loadSurveyVersion(ctx, "checkin", 2)
+	if len(draft.Questions) != 1 || draft.Questions[0].Text != "How do you feel?" {
+		t.Error("incorrect draft version")
+	}
+	// changing the case of a label keeps its choice
+	if choices := draft.Questions[0].Choices; choices[0].Label != "FINE" || choices[0].Id != published.Questions[0].Choices[0].Id {
+		t.Error("Expected choice to keep its id when its label changes case")
+	}
+	// moves that would make a rule go back are rejected
+	for _, text := range []string{"Why%3F", "Anything+else%3F"} {
+		if w = post("/admin/survey/checkin", "action=addQuestion&type=text&text="+text); w.Code != http.StatusFound {
+			t.Fatal("Failed to add question")
+		}
+	}
+	params = "action=updateQuestion&question=0&text=How+do+you+feel%3F&choices=FINE%0ABad&rules=Bad+->+2"
+	if w = post("/admin/survey/checkin", params); w.Code != http.StatusFound {
+		t.Fatal("Failed to add rule")
+	}
+	for _, params := range []string{"action=moveDown&question=0", "action=moveUp&question=1"} {
+		if w = post("/admin/survey/checkin", params); w.Code != http.StatusBadRequest {
+			t.Errorf("Expected %q breaking a rule to be rejected, got %d", params, w.Code)
+		}
+	}
+	if w = post("/admin/survey/checkin", "action=moveUp&question=2"); w.Code != http.StatusFound {
+		t.Error("Failed to move question")
+	}
+	draft, _ = s.loadSurveyVersion(ctx, "checkin", 2)
+	if len(draft.Questions) != 3 || draft.Questions[0].Text != "How do you feel?" || draft.Questions[2].Text != "Why?" {
+		t.Error("incorrect order after moves")
+	}
+	if text := draft.RulesText(draft.Questions[0]); text != "Bad -> 3" {
+		t.Errorf("Expected rule to follow its moved target, got %q", text)
+	}
+	if w = post("/admin/survey/checkin", "action=unpublish"); w.Code != http.StatusFound {
+		t.Fatal("Failed to unpublish survey")
+	}
+	if _, err = s.loadSurvey(ctx, "checkin"); err != errNotPublished {
+		t.Error("Expected survey to be unpublished")
+	}
+}
+
+func TestParseAnswer(t *testing.T) {
+	choice := Question{Id: 1, Type: questionChoice, Choices: []Choice{{Id: 10}, {Id: 11}}}
+	multi := Question{Id: 2, Type: questionMulti, Choices: []Choice{{Id: 20}, {Id: 21}}}
+	likert := Question{Id: 3, Type: questionLikert, Min: 1, Max: 5}
+	text := Question{Id: 4, Type: questionText}
+	number := Question{Id: 5, Type: questionNumber, Min: 0, Max: 100}
+	tests := []struct {
+		question Question
+		values   []string
+		valid    bool
+	}{
+		{choice, []string{"11"}, true},
+		{choice, []string{"12"}, false},
+		{choice, []string{"x"}, false},
+		{choice, []string{"10", "11"}, false},
+		{choice, nil, false},
+		{multi, []string{"20", "21"}, true},
+		{multi, []string{"20", "20"}, false},
+		{multi, []string{"20", "22"}, false},
+		{likert, []string{"5"}, true},
+		{likert, []string{"6"}, false},
+		{likert, []string{"2.5"}, false},
+		{text, []string{" Fine "}, true},
+		{text, []string{"  "}, false},
+		{text, []string{strings.Repeat("a", maxTextAnswer+1)}, false},
+		{number, []string{"42.5"}, true},
+		{number, []string{"-1"}, false},
+		{number, []string{"NaN"}, false},
+	}
+	for _, test := range tests {
+		_, err := parseAnswer(test.question, test.values)
+		if (err == nil) != test.valid {
+			t.Errorf("parseAnswer(%s, %q) = %v, want valid %v", test.question.Type, test.values, err, test.valid)
+		}
+	}
+	answer, _ := parseAnswer(multi, []string{"21", "20"})
+	if len(answer.ChoiceIds) != 2 || answer.ChoiceIds[0] != 21 || answer.ChoiceId != 0 {
+		t.Error("incorrect multi-select answer")
+	}
+	answer, _ = parseAnswer(text, []string{" Fine "})
+	if answer.Text != "Fine" {
+		t.Error("incorrect text answer")
+	}
+}
+
+func TestAggregateMalformed(t *testing.T) {
+	questions := []Question{
+		{Type: questionChoice, Choices: []Choice{{Id: 1, Label: "A"}}},
+		{Type: questionMulti},
+		{Type: questionLikert, Min: 1, Max: 1e9},
+		{Type: questionNumber, Min: 5, Max: 5},
+		{Type: questionNumber, Min: 0, Max: math.Inf(1)},
+		{Type: "unknown"},
+	}
+	answers := []Answer{
+		{ChoiceId: -1},
+		{ChoiceId: 99, ChoiceIds: []int64{-5, 1}},
+		{Number: math.NaN()},
+		{Number: -1e300},
+		{Number: 1e300},
+	}
+	for _, question := range questions {
+		aggregate := newQuestionAggregate(question)
+		for _, answer := range answers {
+			aggregate.add(question, answer)
+		}
+		for _, count := range aggregate.Counts {
+			if count != 0 {
+				t.Errorf("Expected malformed answers to %s question to be skipped", question.Type)
+			}
+		}
+	}
+}
+
+func TestQuestionTypes(t *testing.T) {
+	s := newTestServer()
+	username := "Typed"
+	ctx := context.Background()
+	s.store.PutUser(ctx, User{Id: username})
+	seed := &Survey{
+		Id:    "typed",
+		Title: "Typed",
+		Questions: []Question{
+			{Text: "Which apply?", Type: questionMulti, Choices: choices("A", "B", "C")},
+			{Text: "How much do you agree?", Type: questionLikert, Min: 1, Max: 7, MinLabel: "Not at all", MaxLabel: "Completely"},
+			{Text: "How many hours did you sleep?", Type: questionNumber, Min: 0, Max: 24},
+			{Text: "Anything else?", Type: questionText},
+		},
+	}
+	if err := s.seedSurvey(ctx, seed); err != nil {
+		t.Fatal("failed to seed survey")
+	}
+	survey, err := s.loadSurvey(ctx, "typed")
+	if err != nil || len(survey.Questions) != 4 || survey.Questions[1].Type != questionLikert {
+		t.Fatal("failed to load typed survey")
+	}
+	// the survey page renders the partial of the question type
+	r := httptest.NewRequest("GET", "/survey/typed", nil)
+	addCookies(s, r, username)
+	w := httptest.NewRecorder()
+	s.handleSurvey(w, r)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `type="checkbox"`) {
+		t.Error("Expected multi-select question to render checkboxes")
+	}
+	record := func(i int, responses ...string) int {
+		params := fmt.Sprintf("survey=typed&question=%d", survey.Questions[i].Id)
+		for _, response := range responses {
+			params += "&response=" + response
+		}
+		r := httptest.NewRequest("POST", "/api/recordUserResponse", strings.NewReader(params))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded; param=value")
+		addCookies(s, r, username)
+		w := httptest.NewRecorder()
+		s.recordUserResponse(w, r)
+		return w.Code
+	}
+	a, c := survey.Questions[0].Choices[0].Id, survey.Questions[0].Choices[2].Id
+	if code := record(0, "0"); code != http.StatusBadRequest {
+		t.Error("Expected unknown choice to be rejected")
+	}
+	if code := record(0, fmt.Sprint(a), fmt.Sprint(c)); code != http.StatusOK {
+		t.Fatal("Failed to record multi-select response")
+	}
+	if code := record(1, "8"); code != http.StatusBadRequest {
+		t.Error("Expected response outside the scale to be rejected")
+	}
+	if code := record(1, "6"); code != http.StatusOK {
+		t.Fatal("Failed to record likert response")
+	}
+	if code := record(2, "7.5"); code != http.StatusOK {
+		t.Fatal("Failed to record number response")
+	}
+	if code := record(3, "Slept+well"); code != http.StatusOK {
+		t.Fatal("Failed to record text response")
+	}
+	// aggregate counts per choice, scale point and bin and lists text to
+	// admins
+	s.store.PutUser(ctx, User{Id: "Admin", Role: roleAdmin})
+	aggregate := func(userId string) []QuestionAggregate {
+		r := httptest.NewRequest("POST", "/api/aggregateResponses", strings.NewReader("survey=typed"))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded; param=value")
+		addCookies(s, r, userId)
+		w := httptest.NewRecorder()
+		s.aggregateResponses(w, r)
+		var aggregates []QuestionAggregate
+		if err := json.NewDecoder(w.Body).Decode(&aggregates); err != nil || len(aggregates) != 4 {
+			t.Fatal("error decoding response")
+		}
+		return aggregates
+	}
+	if aggregates := aggregate(username); aggregates[3].Texts != nil {
+		t.Error("Expected text answers to be left out for users")
+	}
+	aggregates := aggregate("Admin")
+	if counts := aggregates[0].Counts; counts[0] != 1 || counts[1] != 0 || counts[2] != 1 {
+		t.Error("incorrect multi-select aggregate")
+	}
+	if len(aggregates[1].Counts) != 7 || aggregates[1].Counts[5] != 1 {
+		t.Error("incorrect likert aggregate")
+	}
+	if len(aggregates[2].Counts) != maxNumberBins || aggregates[2].Counts[3] != 1 {
+		t.Error("incorrect number aggregate")
+	}
+	if aggregates[3].Type != questionText || len(aggregates[3].Texts) != 1 || aggregates[3].Texts[0] != "Slept well" {
+		t.Error("incorrect text aggregate")
+	}
+}
+
+func TestNextQuestion(t *testing.T) {
+	survey := &Survey{Questions: []Question{
+		{Id: 1, Type: questionChoice, Choices: []Choice{{Id: 10}, {Id: 11}}, Rules: []Rule{
+			{Choice: 1, Goto: 4},
+			{Otherwise: true, Goto: 3},
+		}},
+		{Id: 2, Type: questionText},
+		{Id: 3, Type: questionNumber, Min: 0, Max: 10, Rules: []Rule{
+			{Min: 0, Max: 2, Goto: endOfSurvey},
+			{Min: 3, Max: 10, Goto: 1},
+		}},
+		{Id: 4, Type: questionText},
+	}}
+	for i := range survey.Questions {
+		survey.Questions[i].Position = i
+	}
+	next := func(answers ...Answer) int64 {
+		if question := nextQuestion(survey, answers); question != nil {
+			return question.Id
+		}
+		return endOfSurvey
+	}
+	if id := next(); id != 1 {
+		t.Errorf("first question = %d, want 1", id)
+	}
+	if id := next(Answer{QuestionId: 1, ChoiceId: 11}); id != 4 {
+		t.Errorf("next question after choice rule = %d, want 4", id)
+	}
+	if id := next(Answer{QuestionId: 1, ChoiceId: 10}); id != 3 {
+		t.Errorf("next question after otherwise rule = %d, want 3", id)
+	}
+	if id := next(Answer{QuestionId: 1, ChoiceId: 10}, Answer{QuestionId: 3, Number: 1}); id != endOfSurvey {
+		t.Errorf("next question after end rule = %d, want end", id)
+	}
+	// rules jumping back are ignored
+	if id := next(Answer{QuestionId: 1, ChoiceId: 10}, Answer{QuestionId: 3, Number: 5}); id != 4 {
+		t.Errorf("next question after backward rule = %d, want 4", id)
+	}
+	// answers off the path are ignored
+	if id := next(Answer{QuestionId: 1, ChoiceId: 11}, Answer{QuestionId: 2, Text: "x"}); id != 4 {
+		t.Errorf("next question with answer off path = %d, want 4", id)
+	}
+	// parse rules in the admin syntax and print them back
+	rules, err := parseRules("11 -> 4\n* -> end", survey, 0)
+	if err == nil {
+		t.Error("Expected rule naming no choice to be rejected")
+	}
+	survey.Questions[0].Choices = []Choice{{Id: 10, Label: "Happy"}, {Id: 11, Label: "Sad"}}
+	rules, err = parseRules("sad -> 4\n* -> end", survey, 0)
+	if err != nil || len(rules) != 2 || rules[0].Choice != 1 || rules[0].Goto != 4 || !rules[1].Otherwise {
+		t.Fatal("failed to parse rules")
+	}
+	survey.Questions[0].Rules = rules
+	if text := survey.RulesText(survey.Questions[0]); text != "Sad -> 4\n* -> end" {
+		t.Errorf("RulesText = %q", text)
+	}
+	if _, err = parseRules("5 -> 2", survey, 2); err == nil {
+		t.Error("Expected rule going back to be rejected")
+	}
+	if rules, err = parseRules("0..2 -> end", survey, 2); err != nil || rules[0].Max != 2 {
+		t.Error("failed to parse range rule")
+	}
+}
+
+func TestBranching(t *testing.T) {
+	s := newTestServer()
+	username := "Branching"
+	ctx := context.Background()
+	s.store.PutUser(ctx, User{Id: username})
+	seed := &Survey{
+		Id:    "branching",
+		Title: "Branching",
+		Questions: []Question{
+			{Id: 1, Text: "How do you feel?", Type: questionChoice, Choices: choices("Happy", "Sad"), Rules: []Rule{
+				{Choice: 1, Goto: 3},
+				{Otherwise: true, Goto: endOfSurvey},
+			}},
+			{Id: 2, Text: "Skipped", Type: questionText},
+			{Id: 3, Text: "Why?", Type: questionText},
+		},
+	}
+	if err := s.seedSurvey(ctx, seed); err != nil {
+		t.Fatal("failed to seed survey")
+	}
+	survey, _ := s.loadSurvey(ctx, "branching")
+	record := func(question int64, response string) int {
+		params := fmt.Sprintf("survey=branching&question=%d&response=%s", question, response)
+		r := httptest.NewRequest("POST", "/api/recordUserResponse", strings.NewReader(params))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded; param=value")
+		addCookies(s, r, username)
+		w := httptest.NewRecorder()
+		s.recordUserResponse(w, r)
+		return w.Code
+	}
+	if code := record(1, fmt.Sprint(survey.Questions[0].Choices[1].Id)); code != http.StatusOK {
+		t.Fatal("Failed to record response")
+	}
+	if code := record(2, "x"); code != http.StatusConflict {
+		t.Error("Expected response to skipped question to be rejected")
+	}
+	r := httptest.NewRequest("GET", "/survey/branching", nil)
+	addCookies(s, r, username)
+	w := httptest.NewRecorder()
+	s.handleSurvey(w, r)
+	if !strings.Contains(w.Body.String(), "Why?") {
+		t.Error("Expected survey to continue at the rule's question")
+	}
+	if code := record(3, "Tired"); code != http.StatusOK {
+		t.Fatal("Failed to record response")
+	}
+	attempt, _ := s.loadAttempt(ctx, User{Id: username}, "branching")
+	if !attempt.Complete || len(attempt.Answers) != 2 {
+		t.Error("Expected attempt to be complete at the end of its path")
+	}
+}
+
+func TestCheckIns(t *testing.T) {
+	s := newTestServer()
+	username := "CheckIns"
+	ctx := context.Background()
+	s.store.PutUser(ctx, User{Id: username})
+	survey, _ := s.loadSurvey(ctx, defaultSurveyId)
+	putAttempt(s, ctx, username, defaultSurveyId, []int{0, 0, 0, 0})
+	// a completed survey is answered again after starting another attempt
+	params := fmt.Sprintf("survey=%s&question=%d&response=%d", defaultSurveyId, survey.Questions[0].Id, survey.Questions[0].Choices[1].Id)
+	r := httptest.NewRequest("POST", "/api/recordUserResponse", strings.NewReader(params))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded; param=value")
+	addCookies(s, r, username)
+	w := httptest.NewRecorder()
+	s.recordUserResponse(w, r)
+	if w.Code != http.StatusConflict {
+		t.Error("Expected response to completed attempt to be rejected")
+	}
+	r = httptest.NewRequest("POST", "/survey/"+defaultSurveyId, nil)
+	addCookies(s, r, username)
+	w = httptest.NewRecorder()
+	s.handleSurvey(w, r)
+	if w.Code != http.StatusFound {
+		t.Fatal("Failed to start another attempt")
+	}
+	for _, question := range survey.Questions {
+		params := fmt.Sprintf("survey=%s&question=%d&response=%d", defaultSurveyId, question.Id, question.Choices[1].Id)
+		r = httptest.NewRequest("POST", "/api/recordUserResponse", strings.NewReader(params))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded; param=value")
+		addCookies(s, r, username)
+		w = httptest.NewRecorder()
+		s.recordUserResponse(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatal("Failed to record user response")
+		}
+	}
+	attempts, _ := s.loadAttempts(ctx, User{Id: username}, defaultSurveyId)
+	if len(attempts) != 2 || !attempts[1].Complete || attempts[1].Started.Before(attempts[0].Started) {
+		t.Fatal("Expected a second completed attempt")
+	}
+	// the dashboard shows the latest answers along with the history
+	r = httptest.NewRequest("GET", "/dashboard/"+defaultSurveyId, nil)
+	addCookies(s, r, username)
+	w = httptest.NewRecorder()
+	s.dashboard(w, r)
+	body := w.Body.String()
+	first, second := survey.Questions[0].Choices[0].Label, survey.Questions[0].Choices[1].Label
+	if w.Code != http.StatusOK || !strings.Contains(body, "<b>"+second+"</b>") {
+		t.Error("Expected dashboard to show latest answers")
+	}
+	if !strings.Contains(body, "<td>"+second+"</td>") || !strings.Contains(body, "<td>"+first+"</td>") {
+		t.Error("Expected dashboard to show answers of every attempt")
+	}
+}
+
+func TestSQLStore(t *testing.T) {
+	s, store := newSQLTestServer(t)
+	ctx := context.Background()
+	if version, err := store.schemaVersion(ctx); err != nil || version != len(migrations) {
+		t.Fatal("Expected every migration to be applied")
+	}
+	if err := store.migrate(ctx); err != nil {
+		t.Error("Expected migrating an up to date database to succeed:", err)
+	}
+	// surveys round trip with their types, rules and choices
+	seed := &Survey{
+		Id:    "typed",
+		Title: "Typed",
+		Questions: []Question{
+			{Text: "Which apply?", Type: questionMulti, Choices: choices("A", "B", "C"), Rules: []Rule{
+				{Choice: 2, Goto: endOfSurvey},
+			}},
+			{Text: "How much do you agree?", Type: questionLikert, Min: 1, Max: 5, MinLabel: "Not at all", MaxLabel: "Completely"},
+			{Text: "Anything else?", Type: questionText},
+		},
+	}
+	if err := s.seedSurvey(ctx, seed); err != nil {
+		t.Fatal("failed to seed survey:", err)
+	}
+	survey, err := s.loadSurvey(ctx, "typed")
+	if err != nil || len(survey.Questions) != 3 {
+		t.Fatal("failed to load survey:", err)
+	}
+	multi, likert := survey.Questions[0], survey.Questions[1]
+	if len(multi.Choices) != 3 || multi.Choices[2].Label != "C" || multi.Choices[2].Id == 0 || len(multi.Rules) != 1 || multi.Rules[0].Choice != 2 {
+		t.Error("incorrect multi-select question")
+	}
+	if likert.Type != questionLikert || likert.Max != 5 || likert.MaxLabel != "Completely" {
+		t.Error("incorrect likert question")
+	}
+	// users answer through the handlers
+	username := "User"
+	r := httptest.NewRequest("POST", "/createuser", strings.NewReader("username=User&password=horse-battery-staple"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded; param=value")
+	w := httptest.NewRecorder()
+	s.createUser(w, r)
+	cookies := w.Result().Cookies()
+	record := func(i int, responses ...string) int {
+		params := fmt.Sprintf("survey=typed&question=%d", survey.Questions[i].Id)
+		for _, response := range responses {
+			params += "&response=" + response
+		}
+		r := httptest.NewRequest("POST", "/api/recordUserResponse", strings.NewReader(params))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded; param=value")
+		for _, c := range cookies {
+			r.AddCookie(c)
+		}
+		w := httptest.NewRecorder()
+		s.recordUserResponse(w, r)
+		return w.Code
+	}
+	if code := record(0, fmt.Sprint(multi.Choices[1].Id), fmt.Sprint(multi.Choices[0].Id)); code != http.StatusOK {
+		t.Fatal("Failed to record multi-select response")
+	}
+	if code := record(1, "4"); code != http.StatusOK {
+		t.Fatal("Failed to record likert response")
+	}
+	if code := record(2, "Fine"); code != http.StatusOK {
+		t.Fatal("Failed to record text response")
+	}
+	attempt, err := s.loadAttempt(ctx, User{Id: username}, "typed")
+	if err != nil || !attempt.Complete || len(attempt.Answers) != 3 {
+		t.Fatal("Expected a complete attempt")
+	}
+	if ids := attempt.Answers[0].ChoiceIds; len(ids) != 2 || ids[0] != multi.Choices[1].Id {
+		t.Error("Expected multi-select answer to keep its choices in order")
+	}
+	if attempt.Answers[1].Number != 4 || attempt.Answers[2].Text != "Fine" {
+		t.Error("incorrect recorded answers")
+	}
+	r = httptest.NewRequest("POST", "/api/aggregateResponses", strings.NewReader("survey=typed"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded; param=value")
+	addCookies(s, r, username)
+	w = httptest.NewRecorder()
+	s.aggregateResponses(w, r)
+	var aggregates []QuestionAggregate
+	if err = json.NewDecoder(w.Body).Decode(&aggregates); err != nil || len(aggregates) != 3 {
+		t.Fatal("error decoding response")
+	}
+	if aggregates[0].Counts[0] != 1 || aggregates[0].Counts[1] != 1 || aggregates[1].Counts[3] != 1 {
+		t.Error("incorrect aggregate response")
+	}
+	// edits keep question and choice ids in the new version
+	err = s.editSurvey(ctx, "typed", func(survey *Survey) error {
+		survey.Questions[0].Text = "Which of these apply?"
+		survey.Questions = append(survey.Questions, Question{Text: "How many?", Type: questionNumber, Max: 10})
+		return nil
+	})
+	if err != nil {
+		t.Fatal("failed to edit survey:", err)
+	}
+	draft, err := s.loadSurveyVersion(ctx, "typed", 2)
+	if err != nil || len(draft.Questions) != 4 || draft.Questions[0].Id != multi.Id || draft.Questions[0].Choices[2].Id != multi.Choices[2].Id {
+		t.Error("Expected edit to keep ids")
+	}
+	for _, question := range survey.Questions {
+		if draft.Questions[3].Id == question.Id {
+			t.Error("Expected new question to get a new id")
+		}
+	}
+	// failed transactions are rolled back
+	err = store.RunInTransaction(ctx, func(ctx context.Context) error {
+		if err := store.PutUser(ctx, User{Id: "RolledBack"}); err != nil {
+			return err
+		}
+		return errors.New("rollback")
+	})
+	if _, err = store.GetUser(ctx, "RolledBack"); err != errNotFound {
+		t.Error("Expected failed transaction to be rolled back")
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	store := newMemoryStore()
+	ctx := context.Background()
+	store.PutUser(ctx, User{Id: "Kept", Password: "hash"})
+	store.PutSession(ctx, "session", SessionRecord{UserId: "Kept"})
+	attemptId, _ := store.PutAttempt(ctx, "Kept", Attempt{SurveyId: "mood", Version: 1})
+	store.PutAnswer(ctx, "Kept", attemptId, Answer{QuestionId: 1, ChoiceIds: []int64{10}})
+	store.AddCounts(ctx, "mood", 1, map[counterKey]int{{1, 0}: 1})
+	// failed transactions undo each of their changes, and only those
+	err := store.RunInTransaction(ctx, func(ctx context.Context) error {
+		store.PutUser(ctx, User{Id: "Kept", Password: "changed"})
+		store.PutUser(ctx, User{Id: "RolledBack"})
+		store.DeleteUserSessions(ctx, "Kept")
+		store.PutAnswer(ctx, "Kept", attemptId, Answer{QuestionId: 1, ChoiceIds: []int64{11}})
+		store.PutAnswer(ctx, "Kept", attemptId, Answer{QuestionId: 2, Number: 3})
+		store.PutAttempt(ctx, "Kept", Attempt{SurveyId: "mood", Version: 1})
+		store.AddCounts(ctx, "mood", 1, map[counterKey]int{{1, 0}: 1, {2, 3}: 1})
+		store.PutAuditEntry(ctx, AuditEntry{Event: "rolled back"})
+		return errors.New("rollback")
+	})
+	if err == nil {
+		t.Fatal("Expected transaction to fail")
+	}
+	if user, _ := store.GetUser(ctx, "Kept"); user.Password != "hash" {
+		t.Error("Expected changed user to be restored")
+	}
+	if _, err = store.GetUser(ctx, "RolledBack"); err != errNotFound {
+		t.Error("Expected added user to be removed")
+	}
+	if _, err = store.GetSession(ctx, "Kept", "session"); err != nil {
+		t.Error("Expected deleted session to be restored")
+	}
+	attempts, _ := store.ListAttempts(ctx, "Kept", "mood")
+	if len(attempts) != 1 || len(attempts[0].Answers) != 1 || attempts[0].Answers[0].ChoiceIds[0] != 10 {
+		t.Errorf("Expected attempts to be restored, got %v", attempts)
+	}
+	if counts, _ := store.GetCounts(ctx, "mood", 1); len(counts) != 1 || counts[counterKey{1, 0}] != 1 {
+		t.Errorf("Expected counters to be restored, got %v", counts)
+	}
+	if entries, _ := store.ListAuditEntries(ctx, 10); len(entries) != 0 {
+		t.Error("Expected audit entry to be removed")
+	}
+	// the changes of the next transaction are kept
+	store.RunInTransaction(ctx, func(ctx context.Context) error {
+		return store.PutUser(ctx, User{Id: "Committed"})
+	})
+	if _, err = store.GetUser(ctx, "Committed"); err != nil {
+		t.Error("Expected committed transaction to be kept")
+	}
+}
+
+// TestDatastoreStore runs against the App Engine development server, and is
+// skipped where it is not installed.
+func TestDatastoreStore(t *testing.T) {
+	inst, err := aetest.NewInstance(&aetest.Options{StronglyConsistentDatastore: true})
+	if err != nil {
+		t.Skip("App Engine development server unavailable:", err)
+	}
+	defer inst.Close()
+	r, err := inst.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal("failed to create request:", err)
+	}
+	ctx := appengine.NewContext(r)
+	s := newTestServer()
+	s.store = datastoreStore{}
+	seed := &Survey{
+		Id:    "typed",
+		Title: "Typed",
+		Questions: []Question{
+			{Text: "Which apply?", Type: questionMulti, Choices: choices("A", "B")},
+			{Text: "How much?", Type: questionLikert, Min: 1, Max: 5},
+		},
+	}
+	if err := s.seedSurvey(ctx, seed); err != nil {
+		t.Fatal("failed to seed survey:", err)
+	}
+	survey, err := s.loadSurvey(ctx, "typed")
+	if err != nil || len(survey.Questions) != 2 || len(survey.Questions[0].Choices) != 2 {
+		t.Fatal("failed to load survey:", err)
+	}
+	multi := survey.Questions[0]
+	if err := s.store.PutUser(ctx, User{Id: "User", Password: "hash"}); err != nil {
+		t.Fatal("failed to put user:", err)
+	}
+	attemptId, err := s.store.PutAttempt(ctx, "User", Attempt{SurveyId: "typed", Version: survey.Version, Started: time.Now()})
+	if err != nil {
+		t.Fatal("failed to put attempt:", err)
+	}
+	answer := Answer{SurveyId: "typed", Version: survey.Version, QuestionId: multi.Id, ChoiceIds: []int64{multi.Choices[1].Id, multi.Choices[0].Id}}
+	if err := s.store.PutAnswer(ctx, "User", attemptId, answer); err != nil {
+		t.Fatal("failed to put answer:", err)
+	}
+	attempts, err := s.store.ListAttempts(ctx, "User", "typed")
+	if err != nil || len(attempts) != 1 || len(attempts[0].Answers) != 1 || attempts[0].Answers[0].ChoiceIds[0] != multi.Choices[1].Id {
+		t.Errorf("Expected attempt to round trip, got %v: %v", attempts, err)
+	}
+	testManyChoices(t, s, ctx, "datastore")
+	// sessions and resets of a user are deleted in a transaction
+	s.store.PutSession(ctx, "session", SessionRecord{UserId: "User"})
+	s.store.PutPasswordReset(ctx, "reset", PasswordReset{UserId: "User"})
+	err = s.store.RunInTransaction(ctx, func(ctx context.Context) error {
+		if err := s.store.DeleteUserSessions(ctx, "User"); err != nil {
+			return err
+		}
+		return s.store.DeleteUserPasswordResets(ctx, "User")
+	})
+	if err != nil {
+		t.Error("failed to delete sessions and resets:", err)
+	}
+	if _, err = s.store.GetSession(ctx, "User", "session"); err != errNotFound {
+		t.Error("Expected session to be deleted")
+	}
+	if _, err = s.store.GetPasswordReset(ctx, "User", "reset"); err != errNotFound {
+		t.Error("Expected reset to be deleted")
+	}
+	// failed transactions are rolled back
+	err = s.store.RunInTransaction(ctx, func(ctx context.Context) error {
+		if err := s.store.PutUser(ctx, User{Id: "RolledBack"}); err != nil {
+			return err
+		}
+		return errors.New("rollback")
+	})
+	if _, err = s.store.GetUser(ctx, "RolledBack"); err != errNotFound {
+		t.Error("Expected failed transaction to be rolled back")
+	}
+}
+
+func TestPassword(t *testing.T) {
+	// reset links are only logged in development
+	t.Setenv("SMTP_ADDR", "")
+	t.Setenv("MAIL_FILE", "")
+	if m, err := newMailer(false); m != nil || err != nil {
+		t.Errorf("Expected no mailer without mail settings, got %T: %v", m, err)
+	}
+	if m, _ := newMailer(true); m != (logMailer{}) {
+		t.Errorf("Expected mail to be logged in development, got %T", m)
+	}
+	sqlServer, _ := newSQLTestServer(t)
+	for _, s := range []*server{newTestServer(), sqlServer} {
+		ctx := context.Background()
+		mailFile := filepath.Join(t.TempDir(), "mail.txt")
+		s.mailer = &fileMailer{path: mailFile}
+		s.baseURL = "https://behaviorix.example"
+		post := func(handler http.HandlerFunc, path string, params string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+			r := httptest.NewRequest("POST", path, strings.NewReader(params))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded; param=value")
+			for _, c := range cookies {
+				r.AddCookie(c)
+			}
+			w := httptest.NewRecorder()
+			handler(w, r)
+			return w
+		}
+		if w := post(s.createUser, "/createuser", "username=User&password=first-password-1&email=not-an-address"); w.Code != http.StatusBadRequest {
+			t.Error("Expected invalid email address to be rejected")
+		}
+		post(s.createUser, "/createuser", "username=User&password=first-password-1&email=user@example.com")
+		post(s.createUser, "/createuser", "username=NoEmail&password=first-password-1")
+		// reset links are only mailed to users with an email address
+		for _, username := range []string{"Nobody", "NoEmail"} {
+			if w := post(s.forgotPassword, "/password/forgot", "username="+username); w.Code != http.StatusOK {
+				t.Error("Failed to ask for reset link")
+			}
+		}
+		if _, err := os.Stat(mailFile); !os.IsNotExist(err) {
+			t.Error("Expected no reset link to be sent")
+		}
+		// links are never built from the host the request was sent to
+		s.baseURL = ""
+		if w := post(s.forgotPassword, "/password/forgot", "username=User"); w.Code != http.StatusServiceUnavailable {
+			t.Error("Expected resets to be unavailable without BASE_URL")
+		}
+		if _, err := os.Stat(mailFile); !os.IsNotExist(err) {
+			t.Error("Expected no reset link to be sent without BASE_URL")
+		}
+		s.baseURL = "https://behaviorix.example"
+		post(s.forgotPassword, "/password/forgot", "username=User")
+		mail, _ := ioutil.ReadFile(mailFile)
+		link := regexp.MustCompile(`https://behaviorix.example/password/reset\?token=([A-Za-z0-9_.-]+)`).FindSubmatch(mail)
+		if !strings.Contains(string(mail), "To: user@example.com") || link == nil {
+			t.Fatal("Expected reset link to be mailed")
+		}
+		token := string(link[1])
+		r := httptest.NewRequest("GET", "/password/reset?token="+token, nil)
+		w := httptest.NewRecorder()
+		s.resetPassword(w, r)
+		if w.Code != http.StatusOK || w.Header().Get("Referrer-Policy") != "no-referrer" || !strings.Contains(w.Body.String(), token) {
+			t.Error("Failed to serve reset form")
+		}
+		r = httptest.NewRequest("GET", "/password/reset?token=unknown", nil)
+		w = httptest.NewRecorder()
+		s.resetPassword(w, r)
+		if w.Code != http.StatusNotFound {
+			t.Error("Expected unknown token to be rejected")
+		}
+		if w = post(s.resetPassword, "/password/reset", "token="+token+"&password=second-password-2&confirm=other-password-2"); w.Code != http.StatusBadRequest {
+			t.Error("Expected mismatched passwords to be rejected")
+		}
+		// resetting ends the existing sessions and the other reset links and
+		// starts a new session
+		oldToken, _, _ := s.createSession(ctx, "User")
+		other, _ := newUserToken("User")
+		s.store.PutPasswordReset(ctx, sessionId(other), PasswordReset{UserId: "User", Expires: time.Now().Add(time.Hour)})
+		if w = post(s.resetPassword, "/password/reset", "token="+token+"&password=second-password-2&confirm=second-password-2"); w.Code != http.StatusFound || len(w.Result().Cookies()) == 0 {
+			t.Fatal("Failed to reset password")
+		}
+		if _, err := s.authenticate(ctx, "User", "second-password-2"); err != nil {
+			t.Error("Expected reset password to log in")
+		}
+		if _, err := s.lookupSession(ctx, oldToken); err != errInvalidSession {
+			t.Error("Expected reset to end existing sessions")
+		}
+		if _, err := s.lookupPasswordReset(ctx, other); err != errInvalidReset {
+			t.Error("Expected reset to delete the other reset links")
+		}
+		if w = post(s.resetPassword, "/password/reset", "token="+token+"&password=fourth-password-4&confirm=fourth-password-4"); w.Code != http.StatusNotFound {
+			t.Error("Expected reset link to work once")
+		}
+		expired, _ := newUserToken("User")
+		s.store.PutPasswordReset(ctx, sessionId(expired), PasswordReset{UserId: "User", Expires: time.Now().Add(-time.Minute)})
+		if w = post(s.resetPassword, "/password/reset", "token="+expired+"&password=fourth-password-4&confirm=fourth-password-4"); w.Code != http.StatusNotFound {
+			t.Error("Expected expired reset link to be rejected")
+		}
+		// changing the password needs the current one
+		if w = post(s.changePassword, "/password/change", "current=second-password-2&password=third-password-3&confirm=third-password-3"); w.Code != http.StatusUnauthorized {
+			t.Error("Expected change without session to be unauthorized")
+		}
+		current, _, _ := s.createSession(ctx, "User")
+		cookie := &http.Cookie{Name: sessionCookie, Value: current}
+		if w = post(s.changePassword, "/password/change", "current=wrong&password=third-password-3&confirm=third-password-3", cookie); w.Code != http.StatusBadRequest {
+			t.Error("Expected wrong current password to be rejected")
+		}
+		if w = post(s.changePassword, "/password/change", "current=second-password-2&password=third-password-3&confirm=third-password-3", cookie); w.Code != http.StatusOK || len(w.Result().Cookies()) == 0 {
+			t.Error("Failed to change password")
+		}
+		if _, err := s.authenticate(ctx, "User", "third-password-3"); err != nil {
+			t.Error("Expected changed password to log in")
+		}
+		if _, err := s.lookupSession(ctx, current); err != errInvalidSession {
+			t.Error("Expected change to end existing sessions")
+		}
+		// reset requests are throttled like logins, apart from them
+		os.Remove(mailFile)
+		// the first request was counted above
+		for i := 0; i < resetAccountLimit.free; i++ {
+			post(s.forgotPassword, "/password/forgot", "username=User")
+		}
+		if w = post(s.forgotPassword, "/password/forgot", "username=User"); w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+			t.Errorf("Expected throttled reset request to be refused, got %d", w.Code)
+		}
+		if mail, _ = ioutil.ReadFile(mailFile); strings.Count(string(mail), "To: user@example.com") != resetAccountLimit.free {
+			t.Error("Expected no mail for throttled reset requests")
+		}
+		if _, err := s.store.GetLoginThrottle(ctx, "account:user"); err != errNotFound {
+			t.Error("Expected reset requests not to throttle logins")
+		}
+	}
+}
+
+func TestRegistration(t *testing.T) {
+	sqlServer, _ := newSQLTestServer(t)
+	for _, s := range []*server{newTestServer(), sqlServer} {
+		ctx := context.Background()
+		register := func(params string) *httptest.ResponseRecorder {
+			r := httptest.NewRequest("POST", "/createuser", strings.NewReader(params))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded; param=value")
+			w := httptest.NewRecorder()
+			s.createUser(w, r)
+			return w
+		}
+		rejected := map[string]string{
+			"username=ab&password=horse-battery-staple":                  "usernames are",
+			"username=no+spaces&password=horse-battery-staple":           "usernames are",
+			"username=Zoe&password=short":                                "at least 8 characters",
+			"username=Zoe&password=Password123":                          "too common",
+			"username=Zoe&password=zoe-rules-2017":                       "cannot contain the username",
+			"username=Zoe&password=horse-battery-staple&email=not-email": "invalid email address",
+		}
+		for params, message := range rejected {
+			w := register(params)
+			if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), message) || !strings.Contains(w.Body.String(), `data-open="true"`) {
+				t.Errorf("Expected %q to be rejected in the sign-up form with %q, got %d", params, message, w.Code)
+			}
+		}
+		if _, err := s.store.GetUser(ctx, "Zoe"); err != errNotFound {
+			t.Error("Expected rejected user not to be stored")
+		}
+		if w := register("username=User&password=horse-battery-staple&email=user@example.com"); w.Code != http.StatusFound {
+			t.Fatal("Failed to create user")
+		}
+		// usernames are compared regardless of case and Unicode normalization
+		w := register("username=uSER&password=other-battery-staple&email=other@example.com&ageBand=25-34")
+		body := w.Body.String()
+		if w.Code != http.StatusBadRequest || !strings.Contains(body, "this username is taken") || !strings.Contains(body, `value="uSER"`) || !strings.Contains(body, "<option selected>25-34</option>") {
+			t.Error("Expected taken username to be shown in the sign-up form")
+		}
+		if w = register("username=Jos%C3%A9&password=horse-battery-staple"); w.Code != http.StatusFound {
+			t.Error("Failed to create user with accented username")
+		}
+		if w = register("username=Jose%CC%81&password=horse-battery-staple"); w.Code != http.StatusBadRequest {
+			t.Error("Expected decomposed username to match the composed one")
+		}
+		if user, err := s.authenticate(ctx, "user", "horse-battery-staple"); err != nil || user.Id != "User" {
+			t.Error("Expected login in another case to find the user")
+		}
+		// users from before usernames were reserved keep their username
+		hash, _ := bcrypt.GenerateFromPassword([]byte("legacy-password"), bcrypt.DefaultCost)
+		s.store.PutUser(ctx, User{Id: "Legacy", Password: string(hash)})
+		s.store.PutUser(ctx, User{Id: "has space", Password: string(hash)})
+		if _, err := s.authenticate(ctx, "has space", "legacy-password"); err != nil {
+			t.Error("Expected user breaking the username rules to log in")
+		}
+		if reserved, err := s.reserveUsernames(ctx); err != nil || reserved != 1 {
+			t.Errorf("Expected 1 username to be reserved, got %d: %v", reserved, err)
+		}
+		if _, err := s.authenticate(ctx, "LEGACY", "legacy-password"); err != nil {
+			t.Error("Expected login in another case to find the legacy user")
+		}
+		if w = register("username=legacy&password=horse-battery-staple"); w.Code != http.StatusBadRequest {
+			t.Error("Expected username of legacy user to be taken")
+		}
+	}
+}
+
+// yieldingStore is a Store that lets other goroutines run after reads, so
+// that concurrent requests interleave between reading and writing even on a
+// single CPU.
+type yieldingStore struct {
+	Store
+}
+
+func (s yieldingStore) GetUser(ctx context.Context, userId string) (User, error) {
+	defer runtime.Gosched()
+	return s.Store.GetUser(ctx, userId)
+}
+
+func (s yieldingStore) GetUsername(ctx context.Context, name string) (string, error) {
+	defer runtime.Gosched()
+	return s.Store.GetUsername(ctx, name)
+}
+
+func (s yieldingStore) ListAttempts(ctx context.Context, userId string, surveyId string) ([]Attempt, error) {
+	defer runtime.Gosched()
+	return s.Store.ListAttempts(ctx, userId, surveyId)
+}
+
+func TestConcurrentWrites(t *testing.T) {
+	sqlServer, store := newSQLTestServer(t)
+	ctx := context.Background()
+	const n = 20
+	for name, s := range map[string]*server{"memory": newTestServer(), "sql": sqlServer} {
+		s.store = yieldingStore{s.store}
+		// concurrent sign-ups with one username create one user, whose
+		// password is kept
+		codes := make([]int, n)
+		var wg sync.WaitGroup
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				params := fmt.Sprintf("username=Racer&password=racing-password-%d", i)
+				r := httptest.NewRequest("POST", "/createuser", strings.NewReader(params))
+				r.Header.Set("Content-Type", "application/x-www-form-urlencoded; param=value")
+				w := httptest.NewRecorder()
+				s.createUser(w, r)
+				codes[i] = w.Code
+			}(i)
+		}
+		wg.Wait()
+		winner := -1
+		for i, code := range codes {
+			if code == http.StatusFound && winner == -1 {
+				winner = i
+			} else if code != http.StatusBadRequest {
+				t.Errorf("%s: Expected one sign-up to succeed and the others to be rejected, got %v", name, codes)
+				break
+			}
+		}
+		user, err := s.store.GetUser(ctx, "Racer")
+		if winner == -1 || err != nil || bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(fmt.Sprintf("racing-password-%d", winner))) != nil {
+			t.Fatalf("%s: Expected the password of the created user to be kept", name)
+		}
+		// concurrent responses to one question record one answer
+		survey, _ := s.loadSurvey(ctx, defaultSurveyId)
+		first := survey.Questions[0]
+		response := []string{strconv.FormatInt(first.Choices[0].Id, 10)}
+		errs := make(chan error, n)
+		for i := 0; i < n; i++ {
+			go func() {
+				errs <- s.updateUserResponses(ctx, "Racer", defaultSurveyId, first.Id, response)
+			}()
+		}
+		recorded := 0
+		for i := 0; i < n; i++ {
+			if err := <-errs; err == nil {
+				recorded++
+			} else if err != errOutOfOrder {
+				t.Errorf("%s: Expected repeated response to be out of order, got %v", name, err)
+			}
+		}
+		attempt, _ := s.loadAttempt(ctx, user, defaultSurveyId)
+		counts, _ := s.store.GetCounts(ctx, defaultSurveyId, survey.Version)
+		if recorded != 1 || len(attempt.Answers) != 1 || counts[counterKey{first.Id, 0}] != 1 {
+			t.Errorf("%s: Expected one answer to be recorded and counted, got %d recorded, %d stored, %v counted", name, recorded, len(attempt.Answers), counts)
+		}
+	}
+	// SQL transactions conflicting with concurrent ones are run again
+	runs := 0
+	err := store.RunInTransaction(ctx, func(ctx context.Context) error {
+		runs++
+		if runs == 1 {
+			return sqlite3.Error{Code: sqlite3.ErrBusy}
+		}
+		return store.PutUser(ctx, User{Id: "Retried"})
+	})
+	if _, getErr := store.GetUser(ctx, "Retried"); err != nil || runs != 2 || getErr != nil {
+		t.Errorf("Expected conflicting transaction to be run again, ran %d times: %v", runs, err)
+	}
+}
+
+func TestCopyTo(t *testing.T) {
+	s := newTestServer()
+	ctx := context.Background()
+	// one user answered before responses were tracked per survey, the
+	// other took the intake survey
+	s.store.PutUser(ctx, User{Id: "Legacy", Password: "hash", Responses: []int{1, 1, 1, 1}, SurveyComplete: true})
+	s.store.PutUser(ctx, User{Id: "Intake", Password: "hash", Role: roleAdmin})
+	putAttempt(s, ctx, "Intake", "intake", []int{0, 1, 0, 1})
+	s.reserveUsername(ctx, "Intake")
+	dst, store := newSQLTestServer(t)
+	stats, err := s.copyTo(ctx, store)
+	if err != nil {
+		t.Fatal("failed to copy:", err)
+	}
+	if stats.Surveys != len(seedSurveys) || stats.Users != 2 || stats.Attempts != 2 {
+		t.Errorf("copied %+v", stats)
+	}
+	user, err := store.GetUser(ctx, "Intake")
+	if err != nil || user.Role != roleAdmin || user.Password != "hash" {
+		t.Error("Expected user to be copied")
+	}
+	if userId, err := store.GetUsername(ctx, "intake"); err != nil || userId != "Intake" {
+		t.Error("Expected username reservation to be copied")
+	}
+	attempt, err := dst.loadAttempt(ctx, User{Id: "Legacy"}, defaultSurveyId)
+	if err != nil || !attempt.Complete || len(attempt.Answers) != 4 || attempt.Version != 1 {
+		t.Fatal("Expected legacy responses to be copied as an attempt")
+	}
+	survey, _ := dst.loadSurvey(ctx, defaultSurveyId)
+	if attempt.Answers[0].ChoiceId != survey.Questions[0].Choices[1].Id {
+		t.Error("incorrect copied legacy answer")
+	}
+	attempt, _ = dst.loadAttempt(ctx, User{Id: "Intake"}, "intake")
+	if !attempt.Complete || len(attempt.Answers) != 4 {
+		t.Error("Expected attempt to be copied")
+	}
+	// copying again skips what was copied
+	stats, err = s.copyTo(ctx, store)
+	if err != nil || stats.Surveys != 0 || stats.Users != 0 {
+		t.Error("Expected copied surveys and users to be skipped")
+	}
+}
+
+func TestCounters(t *testing.T) {
+	sqlServer, _ := newSQLTestServer(t)
+	for name, s := range map[string]*server{"memory": newTestServer(), "sql": sqlServer} {
+		ctx := context.Background()
+		s.store.PutUser(ctx, User{Id: "First", Password: "hash"})
+		s.store.PutUser(ctx, User{Id: "Second", Password: "hash"})
+		putAttempt(s, ctx, "First", defaultSurveyId, []int{0, 1, 0, 1})
+		putAttempt(s, ctx, "Second", defaultSurveyId, []int{0, 0, 0, 1})
+		survey, _ := s.loadSurvey(ctx, defaultSurveyId)
+		first := survey.Questions[0].Id
+		counts, err := s.store.GetCounts(ctx, defaultSurveyId, 1)
+		if err != nil || counts[counterKey{first, 0}] != 2 || counts[counterKey{survey.Questions[1].Id, 1}] != 1 {
+			t.Errorf("%s: Expected answers to be counted, got %v", name, counts)
+		}
+		// seeded versions are counted from the start
+		surveyVersion, _ := s.store.GetSurveyVersion(ctx, defaultSurveyId, 1)
+		if !surveyVersion.Counted {
+			t.Errorf("%s: Expected seeded survey version to be counted", name)
+		}
+		// versions whose counters were never built, such as copied ones, are
+		// counted from the answers, legacy responses included, until their
+		// counters are rebuilt
+		surveyVersion.Counted = false
+		s.store.PutSurveyVersion(ctx, defaultSurveyId, 1, surveyVersion)
+		if name == "memory" {
+			s.store.PutUser(ctx, User{Id: "Legacy", Password: "hash", Responses: []int{1, 1, 1, 1}, SurveyComplete: true})
+		}
+		aggregates, err := s.countedAggregates(ctx, survey)
+		if err != nil || aggregates[0].Counts[0] != 2 {
+			t.Fatalf("%s: incorrect counted aggregate: %v", name, err)
+		}
+		if name == "memory" && aggregates[0].Counts[1] != 1 {
+			t.Errorf("%s: Expected legacy responses to be counted", name)
+		}
+		counted := aggregates
+		if surveyVersion, _ := s.store.GetSurveyVersion(ctx, defaultSurveyId, 1); surveyVersion.Counted {
+			t.Errorf("%s: Expected reads not to rebuild the counters", name)
+		}
+		if err = s.rebuildCounters(ctx, defaultSurveyId, 1); err != nil {
+			t.Fatalf("%s: failed to rebuild counters: %v", name, err)
+		}
+		if surveyVersion, _ := s.store.GetSurveyVersion(ctx, defaultSurveyId, 1); !surveyVersion.Counted {
+			t.Errorf("%s: Expected survey version to be counted", name)
+		}
+		// counters that drifted from the answers are fixed by a rebuild
+		if err = s.store.PutCounts(ctx, defaultSurveyId, 1, nil); err != nil {
+			t.Fatalf("%s: failed to clear counters: %v", name, err)
+		}
+		if aggregates, _ = s.countedAggregates(ctx, survey); aggregates[0].Counts[0] != 0 {
+			t.Errorf("%s: Expected aggregate to be read from the counters", name)
+		}
+		rebuilt, err := s.rebuildAllCounters(ctx)
+		if err != nil || rebuilt != len(seedSurveys) {
+			t.Errorf("%s: rebuilt %d survey versions: %v", name, rebuilt, err)
+		}
+		if aggregates, _ = s.countedAggregates(ctx, survey); !reflect.DeepEqual(aggregates, counted) {
+			t.Errorf("%s: Expected rebuilt counters to match the answers", name)
+		}
+		// answers picking more choices than a datastore transaction spans
+		// entity groups are counted
+		testManyChoices(t, s, ctx, name)
+	}
+	// legacy responses are counted as the default survey is seeded
+	s := newTestServer()
+	ctx := context.Background()
+	s.store.PutUser(ctx, User{Id: "Legacy", Password: "hash", Responses: []int{1, 1, 1, 1}, SurveyComplete: true})
+	survey, _ := s.loadSurvey(ctx, defaultSurveyId)
+	surveyVersion, _ := s.store.GetSurveyVersion(ctx, defaultSurveyId, 1)
+	counts, _ := s.store.GetCounts(ctx, defaultSurveyId, 1)
+	if !surveyVersion.Counted || counts[counterKey{survey.Questions[0].Id, 1}] != 1 || len(counts) != len(survey.Questions) {
+		t.Errorf("Expected legacy responses to be counted as the survey is seeded, got %v", counts)
+	}
+}
+
+// testManyChoices records an answer picking more choices than a datastore
+// transaction may span entity groups, each counted in a shard of its own, and
+// checks it is counted.
+func testManyChoices(t *testing.T, s *server, ctx context.Context, name string) {
+	labels := make([]string, 13)
+	for i := range labels {
+		labels[i] = fmt.Sprintf("Choice %d", i)
+	}
+	seed := &Survey{Id: "many", Title: "Many", Questions: []Question{{Text: "Which apply?", Type: questionMulti, Choices: choices(labels...)}}}
+	if err := s.seedSurvey(ctx, seed); err != nil {
+		t.Fatalf("%s: failed to seed survey: %v", name, err)
+	}
+	survey, _ := s.loadSurvey(ctx, "many")
+	s.store.PutUser(ctx, User{Id: "Picker", Password: "hash"})
+	var responses []string
+	for _, choice := range survey.Questions[0].Choices {
+		responses = append(responses, fmt.Sprint(choice.Id))
+	}
+	if err := s.updateUserResponses(ctx, "Picker", "many", survey.Questions[0].Id, responses); err != nil {
+		t.Fatalf("%s: failed to record answer picking every choice: %v", name, err)
+	}
+	counts, err := s.store.GetCounts(ctx, "many", survey.Version)
+	if err != nil || len(counts) != len(labels) {
+		t.Errorf("%s: Expected every picked choice to be counted, got %v: %v", name, counts, err)
+	}
+}
+
+func TestCohorts(t *testing.T) {
+	s := newTestServer()
+	ctx := context.Background()
+	// users answer the first question with their position, so user 6 is
+	// the only one answering it with the second choice
+	joined := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 7; i++ {
+		user := User{Id: fmt.Sprintf("User%d", i), Password: "hash", Created: joined.AddDate(0, 0, i), AgeBand: "25-34"}
+		if i >= 5 {
+			user.AgeBand = "35-44"
+		}
+		s.store.PutUser(ctx, user)
+		first := 0
+		if i == 6 {
+			first = 1
+		}
+		putAttempt(s, ctx, user.Id, defaultSurveyId, []int{first, 0, 0, 0})
+	}
+	survey, _ := s.loadSurvey(ctx, defaultSurveyId)
+	aggregate := func(filters string) ([]QuestionAggregate, int) {
+		r := httptest.NewRequest("POST", "/api/aggregateResponses", strings.NewReader("survey=mood&"+filters))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded; param=value")
+		addCookies(s, r, "User0")
+		w := httptest.NewRecorder()
+		s.aggregateResponses(w, r)
+		var aggregates []QuestionAggregate
+		json.NewDecoder(w.Body).Decode(&aggregates)
+		return aggregates, w.Code
+	}
+	if aggregates, code := aggregate(""); code != http.StatusOK || aggregates[1].Counts[0] != 7 {
+		t.Error("Expected unfiltered aggregate to count every user")
+	}
+	if aggregates, code := aggregate("ageBand=25-34"); code != http.StatusOK || aggregates[1].Counts[0] != 5 {
+		t.Error("Expected aggregate filtered by attribute to count the cohort")
+	}
+	if aggregates, code := aggregate("from=2017-06-01&to=2017-06-06"); code != http.StatusOK || aggregates[1].Counts[0] != 6 {
+		t.Error("Expected aggregate filtered by signup date to count the cohort")
+	}
+	params := fmt.Sprintf("question=%d&answer=0", survey.Questions[0].Id)
+	if aggregates, code := aggregate(params); code != http.StatusOK || aggregates[0].Counts[0] != 6 || aggregates[0].Counts[1] != 0 {
+		t.Error("Expected aggregate filtered by answer to count the cohort")
+	}
+	// cohorts too small to keep users anonymous are not reported
+	if _, code := aggregate("ageBand=35-44"); code != http.StatusUnprocessableEntity {
+		t.Error("Expected small cohort to be rejected")
+	}
+	for _, filters := range []string{"from=June", "ageBand=unknown", "question=999999&answer=0", params + "9"} {
+		if _, code := aggregate(filters); code != http.StatusBadRequest {
+			t.Errorf("Expected filters %q to be rejected", filters)
+		}
+	}
+	// users supply their attributes when they sign up and on the dashboard
+	r := httptest.NewRequest("POST", "/createuser", strings.NewReader("username=New&password=horse-battery-staple&program=Stress"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded; param=value")
+	w := httptest.NewRecorder()
+	s.createUser(w, r)
+	user, err := s.store.GetUser(ctx, "New")
+	if err != nil || user.Program != "Stress" || user.Created.IsZero() {
+		t.Fatal("Expected user to be created with their attributes")
+	}
+	r = httptest.NewRequest("POST", "/profile", strings.NewReader("survey=mood&ageBand=65%2B"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded; param=value")
+	addCookies(s, r, "New")
+	w = httptest.NewRecorder()
+	s.updateProfile(w, r)
+	user, _ = s.store.GetUser(ctx, "New")
+	if w.Code != http.StatusFound || user.AgeBand != "65+" || user.Program != "" {
+		t.Error("Expected profile to replace the user's attributes")
+	}
+	r = httptest.NewRequest("POST", "/profile", strings.NewReader("ageBand=young"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded; param=value")
+	addCookies(s, r, "New")
+	w = httptest.NewRecorder()
+	s.updateProfile(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Error("Expected invalid attribute to be rejected")
+	}
+}
+
+func TestCrosstab(t *testing.T) {
+	s := newTestServer()
+	ctx := context.Background()
+	for i, answers := range [][]int{{0, 0}, {0, 0}, {0, 1}, {1, 1}, {1, 1}, {1, 0}} {
+		userId := fmt.Sprintf("User%d", i)
+		s.store.PutUser(ctx, User{Id: userId, Password: "hash", AgeBand: "25-34"})
+		putAttempt(s, ctx, userId, defaultSurveyId, append(answers, 0, 0))
+	}
+	survey, _ := s.loadSurvey(ctx, defaultSurveyId)
+	crosstab := func(params string) (Crosstab, int) {
+		r := httptest.NewRequest("GET", "/api/crosstab?survey=mood&"+params, nil)
+		addCookies(s, r, "User0")
+		w := httptest.NewRecorder()
+		s.crosstab(w, r)
+		var c Crosstab
+		json.NewDecoder(w.Body).Decode(&c)
+		return c, w.Code
+	}
+	params := fmt.Sprintf("q1=%d&q2=%d", survey.Questions[0].Id, survey.Questions[1].Id)
+	c, code := crosstab(params)
+	if code != http.StatusOK || c.Total != 6 || len(c.Counts) != len(survey.Questions[0].Choices) {
+		t.Fatal("failed to cross responses")
+	}
+	if c.Counts[0][0] != 2 || c.Counts[0][1] != 1 || c.Counts[1][0] != 1 || c.Counts[1][1] != 2 || c.RowLabels[0] != "Bored" {
+		t.Errorf("incorrect crosstab counts %v", c.Counts)
+	}
+	if math.Abs(c.RowPercents[0][0]-200.0/3) > 1e-9 || math.Abs(c.ColumnPercents[1][0]-100.0/3) > 1e-9 || c.RowPercents[2][0] != 0 {
+		t.Error("incorrect crosstab percentages")
+	}
+	// the empty rows and columns are left out of the test
+	if math.Abs(c.ChiSquare-2.0/3) > 1e-9 || c.DegreesOfFreedom != 1 || math.Abs(c.PValue-0.4142) > 1e-4 {
+		t.Errorf("incorrect chi-square test %v, %d, %v", c.ChiSquare, c.DegreesOfFreedom, c.PValue)
+	}
+	if c, code = crosstab(params + "&ageBand=25-34"); code != http.StatusOK || c.Total != 6 {
+		t.Error("Expected crosstab to be filtered by cohort")
+	}
+	for _, params := range []string{"q1=1", fmt.Sprintf("q1=%d&q2=%[1]d", survey.Questions[0].Id), "q1=999999&q2=1"} {
+		if _, code = crosstab(params); code != http.StatusBadRequest {
+			t.Errorf("Expected crosstab %q to be rejected", params)
+		}
+	}
+	// attempts picking several choices would be counted more than once
+	seed := &Survey{
+		Id:    "typed",
+		Title: "Typed",
+		Questions: []Question{
+			{Text: "Which apply?", Type: questionMulti, Choices: choices("A", "B")},
+			{Text: "How much?", Type: questionLikert, Min: 1, Max: 5},
+		},
+	}
+	if err := s.seedSurvey(ctx, seed); err != nil {
+		t.Fatal("failed to seed survey:", err)
+	}
+	typed, _ := s.loadSurvey(ctx, "typed")
+	r := httptest.NewRequest("GET", fmt.Sprintf("/api/crosstab?survey=typed&q1=%d&q2=%d", typed.Questions[1].Id, typed.Questions[0].Id), nil)
+	addCookies(s, r, "User0")
+	w := httptest.NewRecorder()
+	s.crosstab(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Error("Expected crosstab of a multi-select question to be rejected")
+	}
+	for _, test := range []struct {
+		x  float64
+		df int
+		p  float64
+	}{{3.841459, 1, 0.05}, {5.991465, 2, 0.05}, {18.307038, 10, 0.05}, {0.5, 4, 0.973501}, {100, 3, 1.6e-21}} {
+		if p := chiSquareSurvival(test.x, test.df); math.Abs(p-test.p) > 1e-6 {
+			t.Errorf("chiSquareSurvival(%v, %d) = %v, expected %v", test.x, test.df, p, test.p)
+		}
+	}
+}
+
+func TestExport(t *testing.T) {
+	sqlServer, _ := newSQLTestServer(t)
+	for name, s := range map[string]*server{"memory": newTestServer(), "sql": sqlServer} {
+		ctx := context.Background()
+		s.pseudonymKey = []byte("secret")
+		seed := &Survey{
+			Id:    "typed",
+			Title: "Typed",
+			Questions: []Question{
+				{Text: "Which apply?", Type: questionMulti, Choices: choices("A", "B, or C")},
+				{Text: "How much?", Type: questionLikert, Min: 1, Max: 5},
+				{Text: "Anything else?", Type: questionText},
+			},
+		}
+		if err := s.seedSurvey(ctx, seed); err != nil {
+			t.Fatal("failed to seed survey:", err)
+		}
+		survey, _ := s.loadSurvey(ctx, "typed")
+		s.store.PutUser(ctx, User{Id: "User", Password: "hash"})
+		attemptId, _ := s.store.PutAttempt(ctx, "User", Attempt{SurveyId: "typed", Version: 1, Started: time.Now()})
+		answered := time.Date(2017, 7, 1, 9, 30, 0, 0, time.UTC)
+		for _, answer := range []Answer{
+			{QuestionId: survey.Questions[0].Id, ChoiceIds: []int64{survey.Questions[0].Choices[1].Id, survey.Questions[0].Choices[0].Id}},
+			{QuestionId: survey.Questions[1].Id, Number: 4},
+			{QuestionId: survey.Questions[2].Id, Text: "Fine,\n\"thanks\""},
+		} {
+			answer.SurveyId, answer.Version, answer.Answered = "typed", 1, answered
+			if err := s.store.PutAnswer(ctx, "User", attemptId, answer); err != nil {
+				t.Fatal("failed to put answer:", err)
+			}
+		}
+		var b strings.Builder
+		rows, err := s.exportResponses(ctx, &b, "csv", "typed")
+		if err != nil || rows != 4 {
+			t.Fatalf("%s: exported %d rows: %v", name, rows, err)
+		}
+		records, err := csv.NewReader(strings.NewReader(b.String())).ReadAll()
+		if err != nil || len(records) != 5 || !reflect.DeepEqual(records[0], exportHeader) {
+			t.Fatalf("%s: incorrect csv export: %v", name, err)
+		}
+		pseudonym := records[1][0]
+		if pseudonym == "User" || len(pseudonym) != 16 || pseudonym != s.pseudonym("User") {
+			t.Errorf("%s: Expected users to be exported by pseudonym", name)
+		}
+		// rows are in any order, so they are found by their label and type
+		found := make(map[string][]string)
+		for _, record := range records[1:] {
+			found[record[7]+":"+record[10]] = record
+		}
+		if row := found["multi:B, or C"]; row == nil || row[8] != "1" || row[4] != "1" || row[13] != "2017-07-01T09:30:00Z" {
+			t.Errorf("%s: incorrect multi-select rows %v", name, found)
+		}
+		if row := found["likert:"]; row == nil || row[11] != "4" || row[8] != "" {
+			t.Errorf("%s: incorrect likert row", name)
+		}
+		if row := found["text:"]; row == nil || row[12] != "Fine,\n\"thanks\"" {
+			t.Errorf("%s: incorrect text row", name)
+		}
+		b.Reset()
+		if rows, err = s.exportResponses(ctx, &b, "jsonl", "typed"); err != nil || rows != 4 {
+			t.Fatalf("%s: exported %d json rows: %v", name, rows, err)
+		}
+		decoder := json.NewDecoder(strings.NewReader(b.String()))
+		for decoder.More() {
+			var row exportRow
+			if err = decoder.Decode(&row); err != nil || row.User != pseudonym || row.Survey != "typed" {
+				t.Errorf("%s: incorrect json row %+v: %v", name, row, err)
+			}
+		}
+		// text that spreadsheets would run as a formula is quoted
+		attemptId, _ = s.store.PutAttempt(ctx, "User", Attempt{SurveyId: "typed", Version: 1, Started: time.Now()})
+		for i, text := range []string{"=HYPERLINK(\"http://example.com\")", "-1+2", "@SUM(A1)", "\tx", "fine"} {
+			answer := Answer{SurveyId: "typed", Version: 1, QuestionId: survey.Questions[2].Id, Text: text, Answered: answered}
+			if err = s.store.PutAnswer(ctx, "User", attemptId, answer); err != nil {
+				t.Fatal("failed to put answer:", err)
+			}
+			b.Reset()
+			if _, err = s.exportResponses(ctx, &b, "csv", "typed"); err != nil {
+				t.Fatalf("%s: failed to export: %v", name, err)
+			}
+			records, _ = csv.NewReader(strings.NewReader(b.String())).ReadAll()
+			want := "'" + text
+			if i == 4 {
+				want = text
+			}
+			if last := records[len(records)-1]; last[12] != want {
+				t.Errorf("%s: expected answer %q to be exported as %q, got %q", name, text, want, last[12])
+			}
+			// and imported unchanged
+			imported, _ := readImportRecords(strings.NewReader(b.String()), "csv")
+			if got := imported[len(imported)-1].Fields["text"]; got != text {
+				t.Errorf("%s: expected answer %q to be imported unchanged, got %q", name, text, got)
+			}
+		}
+	}
+	// SQL exports read the answers a page of attempts at a time
+	ctx := context.Background()
+	sqlServer.store.PutUser(ctx, User{Id: "Many", Password: "hash"})
+	for i := 0; i < scanPage+1; i++ {
+		attemptId, _ := sqlServer.store.PutAttempt(ctx, "Many", Attempt{SurveyId: "paged", Version: 1, Started: time.Now()})
+		answer := Answer{SurveyId: "paged", Version: 1, QuestionId: 1, ChoiceIds: []int64{1, 2}, Answered: time.Now()}
+		if err := sqlServer.store.PutAnswer(ctx, "Many", attemptId, answer); err != nil {
+			t.Fatal("failed to put answer:", err)
+		}
+	}
+	attempts := make(map[int64]bool)
+	err := sqlServer.store.ScanAnswers(ctx, "paged", func(userId string, attemptId int64, answer Answer) error {
+		if attempts[attemptId] || len(answer.ChoiceIds) != 2 {
+			t.Errorf("Incorrect answer of attempt %d: %+v", attemptId, answer)
+		}
+		attempts[attemptId] = true
+		return nil
+	})
+	if err != nil || len(attempts) != scanPage+1 {
+		t.Errorf("Expected %d attempts to be scanned, got %d: %v", scanPage+1, len(attempts), err)
+	}
+	// admins download exports
+	s := newTestServer()
+	s.store.PutUser(ctx, User{Id: "Admin", Password: "hash", Role: roleAdmin})
+	s.store.PutUser(ctx, User{Id: "Legacy", Password: "hash", Responses: []int{1, 1, 1, 1}, SurveyComplete: true})
+	get := func(params string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/admin/export?"+params, nil)
+		addCookies(s, r, "Admin")
+		w := httptest.NewRecorder()
+		s.adminExport(w, r)
+		return w
+	}
+	if w := get("format=csv"); w.Code != http.StatusServiceUnavailable {
+		t.Error("Expected export without a pseudonym key to be refused")
+	}
+	s.pseudonymKey = []byte("secret")
+	w := get("format=jsonl&survey=mood")
+	if w.Code != http.StatusOK || !strings.Contains(w.Header().Get("Content-Disposition"), "responses-mood-") {
+		t.Fatal("Failed to export responses")
+	}
+	if lines := strings.Count(w.Body.String(), "\n"); lines != 4 {
+		t.Errorf("Expected legacy responses to be exported, got %d rows", lines)
+	}
+	for _, params := range []string{"format=xml", "format=csv&survey=unknown"} {
+		if w = get(params); w.Code != http.StatusBadRequest && w.Code != http.StatusNotFound {
+			t.Errorf("Expected export %q to be rejected", params)
+		}
+	}
+}
+
+func TestImport(t *testing.T) {
+	s := newTestServer()
+	ctx := context.Background()
+	s.store.PutUser(ctx, User{Id: "Existing", Password: "hash"})
+	file := `user,password,ageBand,survey,attempt,question,choice,label,answered
+Alice,clinic-secret-2017,25-34,mood,1,1,0,,2017-06-01T09:00:00Z
+Alice,,,mood,1,2,,Woods,2017-06-01T09:01:00Z
+Alice,,,mood,1,3,1,,2017-06-01T09:02:00Z
+Alice,,,mood,1,4,1,,2017-06-01T09:03:00Z
+Alice,,,mood,2,1,1,,2017-06-08T09:00:00Z
+Existing,,,mood,1,1,0,,2017-06-02T09:00:00Z
+Bob,,,,,,,,
+`
+	records, err := readImportRecords(strings.NewReader(file), "csv")
+	if err != nil || len(records) != 7 || records[1].Line != 3 {
+		t.Fatal("failed to read import file:", err)
+	}
+	report, err := s.importRecords(ctx, records, true)
+	if err != nil || report.ErrorCount != 0 || report.Users != 2 || report.Attempts != 3 || report.Answers != 6 {
+		t.Fatalf("incorrect dry run report %+v: %v", report, err)
+	}
+	if _, err = s.store.GetUser(ctx, "Alice"); err != errNotFound {
+		t.Error("Expected dry run not to store users")
+	}
+	// rows with errors are reported with their line and nothing is stored
+	bad := file + `Carol,,,mood,1,1,9,,2017-06-01T09:00:00Z
+Carol,,,intake,1,1,0,,yesterday
+Carol,,,nope,1,1,0,,2017-06-01T09:00:00Z
+Alice,,,mood,2,1,0,,2017-06-08T09:00:00Z
+Carol,,old,mood,1,5,0,,2017-06-01T09:00:00Z
+`
+	records, _ = readImportRecords(strings.NewReader(bad), "csv")
+	report, err = s.importRecords(ctx, records, false)
+	if err != nil || report.ErrorCount != 6 || report.Errors[0].Line != 9 || report.Errors[3].Line != 12 {
+		t.Fatalf("incorrect error report %+v: %v", report, err)
+	}
+	if _, err = s.store.GetUser(ctx, "Alice"); err != errNotFound {
+		t.Error("Expected import with errors not to store users")
+	}
+	records, _ = readImportRecords(strings.NewReader(file), "csv")
+	if report, err = s.importRecords(ctx, records, false); err != nil || report.ErrorCount != 0 {
+		t.Fatalf("failed to import: %+v %v", report, err)
+	}
+	alice, err := s.store.GetUser(ctx, "Alice")
+	if err != nil || bcrypt.CompareHashAndPassword([]byte(alice.Password), []byte("clinic-secret-2017")) != nil || alice.AgeBand != "25-34" {
+		t.Fatal("Expected imported user to log in with their password")
+	}
+	attempts, _ := s.loadAttempts(ctx, alice, defaultSurveyId)
+	if len(attempts) != 2 || !attempts[0].Complete || attempts[1].Complete || len(attempts[0].Answers) != 4 {
+		t.Fatal("Expected imported attempts to be stored")
+	}
+	if !attempts[0].Started.Equal(time.Date(2017, 6, 1, 9, 0, 0, 0, time.UTC)) || !attempts[0].Finished.Equal(time.Date(2017, 6, 1, 9, 3, 0, 0, time.UTC)) {
+		t.Error("Expected attempt times to span the answers")
+	}
+	if _, err = s.store.GetUser(ctx, "Bob"); err != nil {
+		t.Error("Expected user without responses to be imported")
+	}
+	survey, _ := s.loadSurvey(ctx, defaultSurveyId)
+	if aggregates, _ := s.countedAggregates(ctx, survey); aggregates[0].Counts[0] != 2 || aggregates[0].Counts[1] != 1 {
+		t.Error("Expected imported answers to be counted")
+	}
+	// importing a file again skips the attempts imported before
+	records, _ = readImportRecords(strings.NewReader(file), "csv")
+	if report, err = s.importRecords(ctx, records, false); err != nil || report.Users != 0 || report.Attempts != 0 || report.Skipped != 3 {
+		t.Errorf("incorrect report importing again %+v: %v", report, err)
+	}
+	if attempts, _ = s.loadAttempts(ctx, alice, defaultSurveyId); len(attempts) != 2 {
+		t.Errorf("Expected importing again not to duplicate attempts, got %d", len(attempts))
+	}
+	// email addresses are stored, and drafts cannot be imported
+	s.editSurvey(ctx, defaultSurveyId, func(survey *Survey) error {
+		survey.Questions[0].Text = "How are you today?"
+		return nil
+	})
+	records, _ = readImportRecords(strings.NewReader(`user,email,survey,version,question,choice,answered
+Erin,erin@example.com,,,,,
+Frank,not-an-address,,,,,
+Erin,,mood,2,1,0,2017-06-01T09:00:00Z
+`), "csv")
+	if report, _ = s.importRecords(ctx, records, true); report.ErrorCount != 2 || report.Errors[0].Line != 3 || report.Errors[1].Line != 4 {
+		t.Errorf("Expected invalid email and draft version to be rejected, got %+v", report)
+	}
+	records = records[:1]
+	if report, err = s.importRecords(ctx, records, false); err != nil || report.ErrorCount != 0 {
+		t.Fatalf("failed to import user with email: %+v %v", report, err)
+	}
+	if erin, _ := s.store.GetUser(ctx, "Erin"); erin.Email != "erin@example.com" {
+		t.Errorf("Expected imported email address to be stored, got %q", erin.Email)
+	}
+	// exports import into another deployment
+	s.pseudonymKey = []byte("secret")
+	var b strings.Builder
+	if _, err = s.exportResponses(ctx, &b, "jsonl", defaultSurveyId); err != nil {
+		t.Fatal("failed to export:", err)
+	}
+	dst := newTestServer()
+	records, err = readImportRecords(strings.NewReader(b.String()), "jsonl")
+	if err != nil {
+		t.Fatal("failed to read exported responses:", err)
+	}
+	if report, err = dst.importRecords(ctx, records, false); err != nil || report.ErrorCount != 0 || report.Users != 2 || report.Answers != 6 {
+		t.Errorf("failed to import exported responses: %+v %v", report, err)
+	}
+	// admins upload import files
+	s.store.PutUser(ctx, User{Id: "Admin", Password: "hash", Role: roleAdmin})
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	part, _ := mw.CreateFormFile("file", "clinic.csv")
+	part.Write([]byte("user,survey,question,choice,answered\nDana,mood,1,0,2017-06-01T09:00:00Z\n"))
+	mw.WriteField("dryrun", "1")
+	mw.Close()
+	r := httptest.NewRequest("POST", "/admin/import", &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	addCookies(s, r, "Admin")
+	w := httptest.NewRecorder()
+	s.adminImport(w, r)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "Checked 1 rows: 1 new users") {
+		t.Error("Failed to check uploaded import file")
+	}
+}
+
+// newSQLTestServer returns a server backed by a new SQLite database.
+func newSQLTestServer(t *testing.T) (*server, *sqlStore) {
+	store, err := openSQLStore("sqlite3", filepath.Join(t.TempDir(), "app.db"))
+	if err != nil {
+		t.Fatal("failed to open SQL store:", err)
+	}
+	t.Cleanup(func() {
+		store.Close()
+	})
+	s := newTestServer()
+	s.store = store
+	return s, store
+}
+
+func TestAPI(t *testing.T) {
+	s := newTestServer()
+	handler := s.handler()
+	token := ""
+	call := func(method, path, body string) (*httptest.ResponseRecorder, map[string]interface{}) {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		var envelope map[string]interface{}
+		if w.Code != http.StatusNoContent {
+			if err := json.Unmarshal(w.Body.Bytes(), &envelope); err != nil {
+				t.Fatalf("%s %s: invalid json body %q", method, path, w.Body.String())
+			}
+		}
+		if failure, ok := envelope["error"].(map[string]interface{}); ok && failure["status"] != float64(w.Code) {
+			t.Errorf("%s %s: error status %v does not match %d", method, path, failure["status"], w.Code)
+		}
+		return w, envelope
+	}
+	// signing up starts a session
+	w, envelope := call("POST", "/api/v1/users", `{"username": "User", "password": "horse-battery-staple", "ageBand": "25-34"}`)
+	session, _ := envelope["data"].(map[string]interface{})
+	if w.Code != http.StatusCreated || session["token"] == "" || w.Result().Cookies() == nil {
+		t.Fatal("Failed to sign up:", w.Body.String())
+	}
+	if user := session["user"].(map[string]interface{}); user["username"] != "User" || user["ageBand"] != "25-34" || user["password"] != nil {
+		t.Error("Unexpected user", user)
+	}
+	if w, _ = call("POST", "/api/v1/users", `{"username": "User", "password": "other-battery-staple"}`); w.Code != http.StatusConflict {
+		t.Error("Expected taken username to conflict, got", w.Code)
+	}
+	if w, _ = call("POST", "/api/v1/users", `{"username": "Other", "password": "other-battery-staple", "ageBand": "old"}`); w.Code != http.StatusBadRequest {
+		t.Error("Expected invalid attribute to be rejected, got", w.Code)
+	}
+	// logging in
+	if w, _ = call("POST", "/api/v1/session", `{"username": "User", "password": "wrong"}`); w.Code != http.StatusUnauthorized {
+		t.Error("Expected wrong password to be rejected, got", w.Code)
+	}
+	if w, _ = call("POST", "/api/v1/session", `{"username": `); w.Code != http.StatusBadRequest {
+		t.Error("Expected malformed body to be rejected, got", w.Code)
+	}
+	if w, _ = call("GET", "/api/v1/session", ""); w.Code != http.StatusUnauthorized {
+		t.Error("Expected request without session to be unauthorized, got", w.Code)
+	}
+	w, envelope = call("POST", "/api/v1/session", `{"username": "User", "password": "horse-battery-staple"}`)
+	if w.Code != http.StatusCreated {
+		t.Fatal("Failed to log in:", w.Body.String())
+	}
+	token = envelope["data"].(map[string]interface{})["token"].(string)
+	if w, envelope = call("GET", "/api/v1/session", ""); w.Code != http.StatusOK || envelope["data"].(map[string]interface{})["username"] != "User" {
+		t.Error("Failed to authenticate with bearer token")
+	}
+	// surveys
+	w, envelope = call("GET", "/api/v1/surveys", "")
+	if surveys, _ := envelope["data"].([]interface{}); w.Code != http.StatusOK || len(surveys) != 2 || surveys[0].(map[string]interface{})["id"] != defaultSurveyId {
+		t.Error("Failed to list surveys:", w.Body.String())
+	}
+	w, envelope = call("GET", "/api/v1/surveys/mood", "")
+	if questions, _ := envelope["data"].(map[string]interface{})["questions"].([]interface{}); w.Code != http.StatusOK || len(questions) != 4 {
+		t.Error("Failed to get survey:", w.Body.String())
+	}
+	if w, _ = call("GET", "/api/v1/surveys/nope", ""); w.Code != http.StatusNotFound {
+		t.Error("Expected unknown survey to be not found, got", w.Code)
+	}
+	if w, _ = call("PUT", "/api/v1/surveys", ""); w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") != "GET" {
+		t.Error("Expected method to be not allowed, got", w.Code)
+	}
+	if w, _ = call("GET", "/api/v1/surveys/mood/nope", ""); w.Code != http.StatusNotFound {
+		t.Error("Expected unknown resource to be not found, got", w.Code)
+	}
+	// answering the survey through its attempt
+	survey, _ := s.loadSurvey(context.Background(), defaultSurveyId)
+	w, envelope = call("GET", "/api/v1/surveys/mood/attempt", "")
+	progress := envelope["data"].(map[string]interface{})
+	if w.Code != http.StatusOK || progress["attempt"] != nil || progress["next"].(map[string]interface{})["id"] != float64(survey.Questions[0].Id) {
+		t.Error("Unexpected progress before answering:", w.Body.String())
+	}
+	answer := func(q int) (*httptest.ResponseRecorder, map[string]interface{}) {
+		question := survey.Questions[q]
+		return call("POST", "/api/v1/surveys/mood/attempt/answers", fmt.Sprintf(`{"question": %d, "response": ["%d"]}`, question.Id, question.Choices[0].Id))
+	}
+	if w, _ = answer(1); w.Code != http.StatusConflict {
+		t.Error("Expected answer out of order to conflict, got", w.Code)
+	}
+	if w, _ = call("POST", "/api/v1/surveys/mood/attempt/answers", `{"question": 999999, "response": ["0"]}`); w.Code != http.StatusNotFound || !strings.Contains(w.Body.String(), "question not found") {
+		t.Error("Expected unknown question to be not found, got", w.Code, w.Body.String())
+	}
+	if w, _ = call("POST", "/api/v1/surveys/mood/attempt/answers", fmt.Sprintf(`{"question": %d, "response": ["0"]}`, survey.Questions[0].Id)); w.Code != http.StatusBadRequest {
+		t.Error("Expected unknown choice to be rejected, got", w.Code)
+	}
+	for q := range survey.Questions {
+		if w, envelope = answer(q); w.Code != http.StatusCreated {
+			t.Fatal("Failed to answer:", w.Body.String())
+		}
+	}
+	progress = envelope["data"].(map[string]interface{})
+	attempt := progress["attempt"].(map[string]interface{})
+	if progress["next"] != nil || attempt["complete"] != true || len(attempt["answers"].([]interface{})) != 4 {
+		t.Error("Unexpected progress after answering:", w.Body.String())
+	}
+	if w, _ = answer(0); w.Code != http.StatusConflict {
+		t.Error("Expected answer to complete attempt to conflict, got", w.Code)
+	}
+	// checking in again
+	w, envelope = call("POST", "/api/v1/surveys/mood/attempts", "")
+	if progress = envelope["data"].(map[string]interface{}); w.Code != http.StatusCreated || progress["attempt"].(map[string]interface{})["complete"] != false {
+		t.Error("Failed to start attempt:", w.Body.String())
+	}
+	if w, _ = call("POST", "/api/v1/surveys/mood/attempts", ""); w.Code != http.StatusConflict {
+		t.Error("Expected attempt in progress to conflict, got", w.Code)
+	}
+	// attempts started at once start one
+	s.store.PutUser(context.Background(), User{Id: "Racer", Password: "hash"})
+	started := make(chan error)
+	for i := 0; i < 10; i++ {
+		go func() {
+			survey, _ := s.getSurvey(context.Background(), defaultSurveyId)
+			_, err := s.startNextAttempt(context.Background(), "Racer", survey)
+			started <- err
+		}()
+	}
+	for i := 0; i < 10; i++ {
+		if err := <-started; err != nil && err != errAttemptOpen {
+			t.Error("failed to start attempt:", err)
+		}
+	}
+	if attempts, _ := s.store.ListAttempts(context.Background(), "Racer", defaultSurveyId); len(attempts) != 1 {
+		t.Errorf("Expected concurrent requests to start one attempt, got %d", len(attempts))
+	}
+	// aggregates
+	w, envelope = call("GET", "/api/v1/surveys/mood/aggregates", "")
+	if aggregates, _ := envelope["data"].([]interface{}); w.Code != http.StatusOK || len(aggregates) != 4 || aggregates[0].(map[string]interface{})["counts"].([]interface{})[0] != float64(1) {
+		t.Error("Failed to aggregate responses:", w.Body.String())
+	}
+	if w, _ = call("GET", "/api/v1/surveys/mood/aggregates?ageBand=25-34", ""); w.Code != http.StatusUnprocessableEntity {
+		t.Error("Expected small cohort to be rejected, got", w.Code)
+	}
+	q1, q2 := survey.Questions[0].Id, survey.Questions[1].Id
+	if w, _ = call("GET", fmt.Sprintf("/api/v1/surveys/mood/crosstab?q1=%d&q2=%d", q1, q2), ""); w.Code != http.StatusOK {
+		t.Error("Failed to cross responses:", w.Body.String())
+	}
+	if w, _ = call("GET", fmt.Sprintf("/api/v1/surveys/mood/crosstab?q1=%d&q2=%d", q1, q1), ""); w.Code != http.StatusBadRequest {
+		t.Error("Expected crossing a question with itself to be rejected, got", w.Code)
+	}
+	// logging out revokes the token
+	if w, _ = call("DELETE", "/api/v1/session", ""); w.Code != http.StatusNoContent {
+		t.Error("Failed to log out, got", w.Code)
+	}
+	if w, _ = call("GET", "/api/v1/session", ""); w.Code != http.StatusUnauthorized {
+		t.Error("Expected revoked token to be unauthorized, got", w.Code)
+	}
+}
+
+func TestStandalone(t *testing.T) {
+	handler := newTestServer().standaloneHandler()
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w
+	}
+	if w := get("/js/script.js"); w.Code != http.StatusOK || !strings.Contains(w.Header().Get("Content-Type"), "javascript") {
+		t.Error("Failed to serve static file")
+	}
+	if w := get("/stylesheets/"); w.Code != http.StatusNotFound {
+		t.Error("Unexpected directory listing")
+	}
+	if w := get("/templates/layout.html"); strings.Contains(w.Body.String(), "{{") {
+		t.Error("Unexpected access to template source")
+	}
+	if w := get("/about"); w.Code != http.StatusOK {
+		t.Error("Failed to serve app")
+	}
+	// shutting down waits for requests in flight
+	started, release := make(chan bool), make(chan bool)
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- true
+		<-release
+		w.Write([]byte("done"))
+	})}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("failed to listen:", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error)
+	go func() {
+		served <- serveUntil(ctx, srv, l, 5*time.Second)
+	}()
+	response := make(chan string)
+	go func() {
+		resp, err := http.Get("http://" + l.Addr().String())
+		if err != nil {
+			response <- err.Error()
+			return
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		response <- string(body)
+	}()
+	<-started
+	cancel()
+	close(release)
+	if body := <-response; body != "done" {
+		t.Errorf("Expected request in flight to finish, got %q", body)
+	}
+	if err = <-served; err != nil {
+		t.Error("Expected graceful shutdown, got", err)
+	}
+	// over plain HTTP cookies are not Secure, so browsers keep them and
+	// users can log in and send forms; the server is reached under a name
+	// other than localhost, which cookie jars trust like HTTPS
+	s := newTestServer()
+	s.secureCookies = false
+	plain := httptest.NewServer(s.standaloneHandler())
+	defer plain.Close()
+	jar, _ := cookiejar.New(nil)
+	client := &http.Client{
+		Jar: jar,
+		Transport: &http.Transport{DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return net.Dial(network, plain.Listener.Addr().String())
+		}},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	origin := "http://behaviorix.test"
+	csrfPattern := regexp.MustCompile(`<meta name="csrf-token" content="([^"]+)">`)
+	post := func(path string, params url.Values) int {
+		resp, err := client.Get(origin + "/")
+		if err != nil {
+			t.Fatal("failed to get page:", err)
+		}
+		page, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if m := csrfPattern.FindSubmatch(page); m != nil {
+			params.Set(csrfField, string(m[1]))
+		}
+		if resp, err = client.PostForm(origin+path, params); err != nil {
+			t.Fatal("failed to post:", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if code := post("/createuser", url.Values{"username": {"Plain"}, "password": {"horse-battery-staple"}}); code != http.StatusFound {
+		t.Errorf("Expected sign-up over plain HTTP to succeed, got %d", code)
+	}
+	if code := post("/profile", url.Values{"ageBand": {"25-34"}}); code != http.StatusFound {
+		t.Errorf("Expected logged in form over plain HTTP to be accepted, got %d", code)
+	}
+	if user, _ := s.store.GetUser(context.Background(), "Plain"); user.AgeBand != "25-34" {
+		t.Error("Expected profile to be updated over plain HTTP")
+	}
+	// behind trusted proxies terminating HTTPS cookies are Secure
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("X-Forwarded-Proto", "https")
+	if s.secureCookie(r) {
+		t.Error("Expected X-Forwarded-Proto to be ignored without trusted proxies")
+	}
+	s.trustedProxies = 1
+	if !s.secureCookie(r) {
+		t.Error("Expected X-Forwarded-Proto of a trusted proxy to make cookies Secure")
+	}
+}
+
+func TestTemplates(t *testing.T) {
+	// copy the templates to edit them
+	dir := t.TempDir()
+	paths, _ := filepath.Glob("templates/*.html")
+	for _, path := range paths {
+		content, _ := ioutil.ReadFile(path)
+		ioutil.WriteFile(filepath.Join(dir, filepath.Base(path)), content, 0644)
+	}
+	about := filepath.Join(dir, "about.html")
+	edit := func(content string) {
+		ioutil.WriteFile(about, []byte(content), 0644)
+		// make the change visible to file systems with coarse timestamps
+		later := time.Now().Add(time.Minute)
+		os.Chtimes(about, later, later)
+	}
+	serveAbout := func(s *server) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		s.about(w, httptest.NewRequest("GET", "/about", nil))
+		return w
+	}
+	s := newTestServer()
+	var err error
+	if s.templates, err = loadTemplates(dir, false); err != nil {
+		t.Fatal("failed to parse templates:", err)
+	}
+	dev := newTestServer()
+	if dev.templates, err = loadTemplates(dir, true); err != nil {
+		t.Fatal("failed to parse templates:", err)
+	}
+	edit(`{{ define "content" }}Edited{{ end }}`)
+	if strings.Contains(serveAbout(s).Body.String(), "Edited") {
+		t.Error("Expected templates to be parsed once")
+	}
+	if !strings.Contains(serveAbout(dev).Body.String(), "Edited") {
+		t.Error("Expected changed templates to be parsed again in dev mode")
+	}
+	// template errors are served as a plain 500
+	edit(`{{ define "content" }}Partial{{ .Missing }}{{ end }}`)
+	w := serveAbout(dev)
+	if w.Code != http.StatusInternalServerError || strings.Contains(w.Body.String(), "Partial") {
+		t.Error("Expected template error to be served without the partial page")
+	}
+	edit(`{{ define "content" }}{{ end`)
+	if w = serveAbout(dev); w.Code != http.StatusInternalServerError {
+		t.Error("Expected template parsing error to be served as 500")
+	}
+	if _, err = loadTemplates(dir, false); err == nil {
+		t.Error("Expected invalid template to fail parsing")
+	}
+}
+
+// putAttempt stores a completed attempt of the user with id userId at the
+// published version of the survey with id surveyId, answering each question
+// with the choice at the given position and counting the answers.
+func putAttempt(s *server, ctx context.Context, userId string, surveyId string, responses []int) int64 {
+	survey, err := s.loadSurvey(ctx, surveyId)
+	if err != nil {
+		log.Fatalf("failed to load survey: %v", err)
+	}
+	attempt := Attempt{
+		SurveyId: surveyId,
+		Version:  survey.Version,
+		Started:  time.Now(),
+		Finished: time.Now(),
+		Complete: true,
+	}
+	attemptId, err := s.store.PutAttempt(ctx, userId, attempt)
+	if err != nil {
+		log.Fatalf("failed to put attempt: %v", err)
+	}
+	for i, c := range responses {
+		question := survey.Questions[i]
+		answer := Answer{
+			SurveyId:   surveyId,
+			Version:    survey.Version,
+			QuestionId: question.Id,
+			ChoiceId:   question.Choices[c].Id,
+			Answered:   time.Now(),
+		}
+		if err := s.store.PutAnswer(ctx, userId, attemptId, answer); err != nil {
+			log.Fatalf("failed to put answer: %v", err)
+		}
+		if err := s.store.AddCounts(ctx, surveyId, survey.Version, answerCounts(question, answer)); err != nil {
+			log.Fatalf("failed to count answer: %v", err)
+		}
+	}
+	return attemptId
+}
+
+func addCookies(s *server, r *http.Request, id string) {
+	token, _, err := s.createSession(context.Background(), id)
+	if err != nil {
+		log.Fatalf("failed to create session: %v", err)
+	}
+	cUser := &http.Cookie{
+		Name:  sessionCookie,
+		Value: token,
 	}
 	r.AddCookie(cUser)
-	r.AddCookie(cQuestion)
-	r.AddCookie(qIndex)
 }
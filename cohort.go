@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// minCohortSize is the fewest respondents a filtered aggregate reports on, so
+// that narrow filters do not reveal the answers of individual users.
+const minCohortSize = 5
+
+// errCohortTooSmall is returned for filters matching fewer than
+// minCohortSize respondents.
+var errCohortTooSmall = fmt.Errorf("fewer than %d respondents match the filters", minCohortSize)
+
+// userAttribute is an optional attribute users supply about themselves,
+// which aggregates can be filtered by.
+type userAttribute struct {
+	Name    string
+	Label   string
+	Options []string
+}
+
+// userAttributes are the attributes users can supply, named after the form
+// and api parameters carrying them.
+var userAttributes = []userAttribute{
+	{Name: "ageBand", Label: "Age band", Options: []string{"18-24", "25-34", "35-44", "45-54", "55-64", "65+"}},
+	{Name: "program", Label: "Program", Options: []string{"Anxiety", "Depression", "Stress", "Chronic illness", "Substance use"}},
+}
+
+// attribute returns a pointer to the field of user holding the named
+// attribute, or nil for unknown attributes.
+func (user *User) attribute(name string) *string {
+	switch name {
+	case "ageBand":
+		return &user.AgeBand
+	case "program":
+		return &user.Program
+	}
+	return nil
+}
+
+// Attributes returns the attributes of user by name.
+func (user User) Attributes() map[string]string {
+	attributes := make(map[string]string)
+	for _, attribute := range userAttributes {
+		attributes[attribute.Name] = *user.attribute(attribute.Name)
+	}
+	return attributes
+}
+
+// setAttributes sets the attributes of user from values, which returns the
+// value of an attribute by name, such as the FormValue of a request.
+// Attributes without a value are cleared, and values other than the options
+// of an attribute are rejected.
+func setAttributes(user *User, values func(name string) string) error {
+	for _, attribute := range userAttributes {
+		value := values(attribute.Name)
+		if value != "" && !contains(attribute.Options, value) {
+			return fmt.Errorf("invalid %s", strings.ToLower(attribute.Label))
+		}
+		*user.attribute(attribute.Name) = value
+	}
+	return nil
+}
+
+// contains reports whether values contains value.
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// cohortFilter selects the respondents whose answers are aggregated: users
+// who signed up within [From, To), users with the given attribute values and
+// attempts whose answer to the question with id QuestionId is counted at
+// position Bucket of its aggregate. Zero fields do not filter.
+type cohortFilter struct {
+	From       time.Time
+	To         time.Time
+	Attributes map[string]string
+	QuestionId int64
+	Bucket     int
+}
+
+// empty reports whether the filter selects every respondent.
+func (f cohortFilter) empty() bool {
+	return f.From.IsZero() && f.To.IsZero() && len(f.Attributes) == 0 && f.QuestionId == 0
+}
+
+// filtersUsers reports whether the filter depends on the respondents' users.
+func (f cohortFilter) filtersUsers() bool {
+	return !f.From.IsZero() || !f.To.IsZero() || len(f.Attributes) > 0
+}
+
+// parseCohortFilter parses the cohort filter of an aggregate of survey from
+// the form values of r: from and to are dates in YYYY-MM-DD format bounding
+// the signup date inclusively, each user attribute is filtered by the
+// parameter of its name, and question and answer select the attempts whose
+// answer to the question with id question is counted at position answer of
+// its aggregate.
+func parseCohortFilter(r *http.Request, survey *Survey) (cohortFilter, error) {
+	var f cohortFilter
+	var err error
+	if from := r.FormValue("from"); from != "" {
+		if f.From, err = time.Parse("2006-01-02", from); err != nil {
+			return f, errors.New("invalid from date")
+		}
+	}
+	if to := r.FormValue("to"); to != "" {
+		if f.To, err = time.Parse("2006-01-02", to); err != nil {
+			return f, errors.New("invalid to date")
+		}
+		f.To = f.To.AddDate(0, 0, 1)
+	}
+	for _, attribute := range userAttributes {
+		value := r.FormValue(attribute.Name)
+		if value == "" {
+			continue
+		}
+		if !contains(attribute.Options, value) {
+			return f, fmt.Errorf("invalid %s", strings.ToLower(attribute.Label))
+		}
+		if f.Attributes == nil {
+			f.Attributes = make(map[string]string)
+		}
+		f.Attributes[attribute.Name] = value
+	}
+	if question := r.FormValue("question"); question != "" {
+		id, err := strconv.ParseInt(question, 10, 64)
+		q := survey.Question(id)
+		if err != nil || q < 0 || survey.Questions[q].Type == questionText {
+			return f, errors.New("invalid question")
+		}
+		f.QuestionId = id
+		f.Bucket, err = strconv.Atoi(r.FormValue("answer"))
+		if err != nil || f.Bucket < 0 || f.Bucket >= len(newQuestionAggregate(survey.Questions[q]).Labels) {
+			return f, errors.New("invalid answer")
+		}
+	}
+	return f, nil
+}
+
+// matchesUser reports whether user is in the cohort.
+func (f cohortFilter) matchesUser(user User) bool {
+	if !f.From.IsZero() && (user.Created.IsZero() || user.Created.Before(f.From)) {
+		return false
+	}
+	if !f.To.IsZero() && (user.Created.IsZero() || !user.Created.Before(f.To)) {
+		return false
+	}
+	for name, value := range f.Attributes {
+		if *user.attribute(name) != value {
+			return false
+		}
+	}
+	return true
+}
+
+// matchesAttempt reports whether attempt, an attempt at survey, is in the
+// cohort.
+func (f cohortFilter) matchesAttempt(survey *Survey, attempt Attempt) bool {
+	if f.QuestionId == 0 {
+		return true
+	}
+	q := survey.Question(f.QuestionId)
+	for _, answer := range attempt.Answers {
+		if answer.QuestionId != f.QuestionId {
+			continue
+		}
+		for _, bucket := range answerBuckets(survey.Questions[q], answer) {
+			if bucket == f.Bucket {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// cohortAttempts returns the attempts at survey, a loaded survey version, of
+// the cohort selected by f, including the legacy responses to the default
+// survey. It returns errCohortTooSmall if f filters and fewer than
+// minCohortSize users are in the cohort.
+func (s *server) cohortAttempts(ctx context.Context, survey *Survey, f cohortFilter) ([]Attempt, error) {
+	attempts, err := s.store.ListSurveyAttempts(ctx, survey.Id, survey.Version)
+	if err != nil {
+		return nil, err
+	}
+	if survey.Id == defaultSurveyId && survey.Version == 1 {
+		// users whose legacy responses have not been migrated yet
+		users, err := s.store.LegacyUsers(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, user := range users {
+			legacy, err := s.legacyAnswers(ctx, user.Responses)
+			if err != nil {
+				return nil, err
+			}
+			attempts = append(attempts, Attempt{UserId: user.Id, Answers: legacy})
+		}
+	}
+	var users map[string]User
+	if f.filtersUsers() {
+		all, err := s.store.ListUsers(ctx)
+		if err != nil {
+			return nil, err
+		}
+		users = make(map[string]User, len(all))
+		for _, user := range all {
+			users[user.Id] = user
+		}
+	}
+	var cohort []Attempt
+	respondents := make(map[string]bool)
+	for _, attempt := range attempts {
+		if users != nil && !f.matchesUser(users[attempt.UserId]) {
+			continue
+		}
+		if !f.matchesAttempt(survey, attempt) {
+			continue
+		}
+		respondents[attempt.UserId] = true
+		cohort = append(cohort, attempt)
+	}
+	if !f.empty() && len(respondents) < minCohortSize {
+		return nil, errCohortTooSmall
+	}
+	return cohort, nil
+}
+
+// filteredAggregates returns the aggregate of the answers of the cohort
+// selected by f to each question of survey, a loaded survey version. Unlike
+// countedAggregates it scans every attempt at the version.
+func (s *server) filteredAggregates(ctx context.Context, survey *Survey, f cohortFilter) ([]QuestionAggregate, error) {
+	attempts, err := s.cohortAttempts(ctx, survey, f)
+	if err != nil {
+		return nil, err
+	}
+	aggregates := make([]QuestionAggregate, len(survey.Questions))
+	for i, question := range survey.Questions {
+		aggregates[i] = newQuestionAggregate(question)
+	}
+	for _, attempt := range attempts {
+		for _, answer := range attempt.Answers {
+			if q := survey.Question(answer.QuestionId); q >= 0 {
+				aggregates[q].add(survey.Questions[q], answer)
+			}
+		}
+	}
+	return aggregates, nil
+}
+
+// answerOptions returns the answers to the questions of survey that
+// aggregates can be filtered by.
+func answerOptions(survey *Survey) []AnswerOption {
+	var options []AnswerOption
+	for _, question := range survey.Questions {
+		if question.Type == questionText {
+			continue
+		}
+		for bucket, label := range newQuestionAggregate(question).Labels {
+			options = append(options, AnswerOption{
+				Label: fmt.Sprintf("%d. %s", question.Number(), label),
+				Value: fmt.Sprintf("%d:%d", question.Id, bucket),
+			})
+		}
+	}
+	return options
+}
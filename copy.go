@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// copyStats counts the entities copied by copyTo.
+type copyStats struct {
+	Surveys  int
+	Users    int
+	Attempts int
+}
+
+// copyTo copies every survey version, user and attempt of the server's store
+// into dst, for moving the app to another store. Legacy responses stored on
+// users are converted into an attempt at the default survey on the way, and
+// sessions are not copied, so users log in again on the new store. Surveys
+// and users already in dst are skipped, so an interrupted copy can be run
+// again. Each survey and each user along with their attempts is copied in
+// one transaction.
+func (s *server) copyTo(ctx context.Context, dst Store) (copyStats, error) {
+	var stats copyStats
+	surveys, err := s.listSurveys(ctx, true)
+	if err != nil {
+		return stats, err
+	}
+	for _, survey := range surveys {
+		copied, err := s.copySurvey(ctx, dst, survey)
+		if err != nil {
+			return stats, err
+		}
+		if copied {
+			stats.Surveys++
+		}
+	}
+	users, err := s.store.ListUsers(ctx)
+	if err != nil {
+		return stats, err
+	}
+	for _, user := range users {
+		copied, attempts, err := s.copyUser(ctx, dst, user, surveys)
+		if err != nil {
+			return stats, err
+		}
+		if copied {
+			stats.Users++
+			stats.Attempts += attempts
+		}
+	}
+	return stats, nil
+}
+
+// copySurvey copies every version of survey into dst unless dst has the
+// survey already, and reports whether it was copied.
+func (s *server) copySurvey(ctx context.Context, dst Store, survey Survey) (bool, error) {
+	versions := make(map[int]SurveyVersion)
+	questions := make(map[int][]Question)
+	for version := 1; version <= survey.LatestVersion; version++ {
+		surveyVersion, err := s.store.GetSurveyVersion(ctx, survey.Id, version)
+		if err == errNotFound {
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+		versions[version] = surveyVersion
+		questions[version], err = s.store.GetQuestions(ctx, survey.Id, version)
+		if err != nil {
+			return false, err
+		}
+	}
+	copied := false
+	err := dst.RunInTransaction(ctx, func(ctx context.Context) error {
+		_, err := dst.GetSurvey(ctx, survey.Id)
+		if err != errNotFound {
+			return err
+		}
+		if err = dst.PutSurvey(ctx, survey); err != nil {
+			return err
+		}
+		for version, surveyVersion := range versions {
+			// counters are not copied, so dst counts the answers until
+			// they are rebuilt
+			surveyVersion.Counted = false
+			if err = dst.PutSurveyVersion(ctx, survey.Id, version, surveyVersion); err != nil {
+				return err
+			}
+			if err = dst.PutQuestions(ctx, survey.Id, version, questions[version]); err != nil {
+				return err
+			}
+		}
+		copied = true
+		return nil
+	})
+	return copied, err
+}
+
+// copyUser copies user along with their username reservation and their
+// attempts at surveys into dst unless dst has the user already. It reports whether the user was copied and
+// returns the number of their attempts.
+func (s *server) copyUser(ctx context.Context, dst Store, user User, surveys []Survey) (bool, int, error) {
+	var attempts []Attempt
+	if len(user.Responses) > 0 {
+		answers, err := s.legacyAnswers(ctx, user.Responses)
+		if err != nil {
+			return false, 0, err
+		}
+		for i := range answers {
+			answers[i].Answered = time.Now().Add(time.Duration(i))
+		}
+		attempts = append(attempts, Attempt{
+			SurveyId: defaultSurveyId,
+			Version:  1,
+			Complete: user.SurveyComplete,
+			Answers:  answers,
+		})
+	}
+	for _, survey := range surveys {
+		surveyAttempts, err := s.store.ListAttempts(ctx, user.Id, survey.Id)
+		if err != nil {
+			return false, 0, err
+		}
+		attempts = append(attempts, surveyAttempts...)
+	}
+	reserved := false
+	canonical, err := canonicalUsername(user.Id)
+	if err == nil {
+		userId, err := s.store.GetUsername(ctx, canonical)
+		if err != nil && err != errNotFound {
+			return false, 0, err
+		}
+		reserved = userId == user.Id
+	}
+	copied := false
+	err = dst.RunInTransaction(ctx, func(ctx context.Context) error {
+		_, err := dst.GetUser(ctx, user.Id)
+		if err != errNotFound {
+			return err
+		}
+		user.Responses = nil
+		user.SurveyComplete = false
+		if err = dst.PutUser(ctx, user); err != nil {
+			return err
+		}
+		if reserved {
+			if err = dst.PutUsername(ctx, canonical, user.Id); err != nil {
+				return err
+			}
+		}
+		for _, attempt := range attempts {
+			// attempt ids are only unique per user in some stores, so
+			// attempts are allocated new ids
+			attempt.Id = 0
+			attemptId, err := dst.PutAttempt(ctx, user.Id, attempt)
+			if err != nil {
+				return err
+			}
+			for _, answer := range attempt.Answers {
+				if err = dst.PutAnswer(ctx, user.Id, attemptId, answer); err != nil {
+					return err
+				}
+			}
+		}
+		copied = true
+		return nil
+	})
+	return copied, len(attempts), err
+}
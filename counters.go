@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+)
+
+// answerCounts returns the deltas counting answer, an answer to question, in
+// the answer counters.
+func answerCounts(question Question, answer Answer) map[counterKey]int {
+	deltas := make(map[counterKey]int)
+	for _, bucket := range answerBuckets(question, answer) {
+		deltas[counterKey{question.Id, bucket}]++
+	}
+	return deltas
+}
+
+// countedAggregates returns the aggregate of the answers to each question of
+// survey, a loaded survey version, read from its answer counters rather than
+// from the answers. Versions whose counters were never built, such as copied
+// or imported ones, are counted from their answers on every read instead, see
+// countAnswers, until an admin rebuilds their counters. Reads never rebuild counters themselves,
+// since rebuilds race with the answers recorded meanwhile.
+func (s *server) countedAggregates(ctx context.Context, survey *Survey) ([]QuestionAggregate, error) {
+	surveyVersion, err := s.store.GetSurveyVersion(ctx, survey.Id, survey.Version)
+	if err != nil {
+		return nil, err
+	}
+	var counts map[counterKey]int
+	if surveyVersion.Counted {
+		counts, err = s.store.GetCounts(ctx, survey.Id, survey.Version)
+	} else {
+		counts, err = s.countAnswers(ctx, survey)
+	}
+	if err != nil {
+		return nil, err
+	}
+	aggregates := make([]QuestionAggregate, len(survey.Questions))
+	for i, question := range survey.Questions {
+		aggregates[i] = newQuestionAggregate(question)
+		for bucket := range aggregates[i].Counts {
+			aggregates[i].Counts[bucket] = counts[counterKey{question.Id, bucket}]
+		}
+		if question.Type == questionText {
+			texts, err := s.store.ListTexts(ctx, survey.Id, survey.Version, question.Id, maxListedTexts)
+			if err != nil {
+				return nil, err
+			}
+			aggregates[i].Texts = append(aggregates[i].Texts, texts...)
+		}
+	}
+	return aggregates, nil
+}
+
+// countAnswers returns the answer counts of survey, a loaded survey version,
+// computed from its answers, including the legacy responses to the default
+// survey.
+func (s *server) countAnswers(ctx context.Context, survey *Survey) (map[counterKey]int, error) {
+	answers, err := s.store.ListAnswers(ctx, survey.Id, survey.Version)
+	if err != nil {
+		return nil, err
+	}
+	if survey.Id == defaultSurveyId && survey.Version == 1 {
+		// users whose legacy responses have not been migrated yet
+		users, err := s.store.LegacyUsers(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, user := range users {
+			legacy, err := s.legacyAnswers(ctx, user.Responses)
+			if err != nil {
+				return nil, err
+			}
+			answers = append(answers, legacy...)
+		}
+	}
+	counts := make(map[counterKey]int)
+	for _, answer := range answers {
+		q := survey.Question(answer.QuestionId)
+		if q < 0 {
+			continue
+		}
+		for k, delta := range answerCounts(survey.Questions[q], answer) {
+			counts[k] += delta
+		}
+	}
+	return counts, nil
+}
+
+// rebuildCounters recomputes the answer counters of the given version of the
+// survey with id surveyId from its answers, see countAnswers, and marks the
+// version counted. Answers recorded while the counters are rebuilt may be
+// missed or counted twice, until the next rebuild, so rebuilds are only run
+// by admins, at /admin or with -rebuild-counters.
+func (s *server) rebuildCounters(ctx context.Context, surveyId string, version int) error {
+	survey, err := s.loadSurveyVersion(ctx, surveyId, version)
+	if err != nil {
+		return err
+	}
+	counts, err := s.countAnswers(ctx, survey)
+	if err != nil {
+		return err
+	}
+	if err = s.store.PutCounts(ctx, surveyId, version, counts); err != nil {
+		return err
+	}
+	return s.store.RunInTransaction(ctx, func(ctx context.Context) error {
+		surveyVersion, err := s.store.GetSurveyVersion(ctx, surveyId, version)
+		if err != nil {
+			return err
+		}
+		surveyVersion.Counted = true
+		return s.store.PutSurveyVersion(ctx, surveyId, version, surveyVersion)
+	})
+}
+
+// rebuildAllCounters rebuilds the answer counters of every version of every
+// survey and returns the number of versions rebuilt.
+func (s *server) rebuildAllCounters(ctx context.Context) (int, error) {
+	surveys, err := s.listSurveys(ctx, true)
+	if err != nil {
+		return 0, err
+	}
+	rebuilt := 0
+	for _, survey := range surveys {
+		for version := 1; version <= survey.LatestVersion; version++ {
+			err = s.rebuildCounters(ctx, survey.Id, version)
+			if err == errNotFound {
+				continue
+			}
+			if err != nil {
+				return rebuilt, err
+			}
+			rebuilt++
+		}
+	}
+	return rebuilt, nil
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+)
+
+// newCrosstab returns an empty crosstab of the answers to row and column,
+// which are neither text nor multi-select questions.
+func newCrosstab(row Question, column Question) Crosstab {
+	rowLabels := newQuestionAggregate(row).Labels
+	columnLabels := newQuestionAggregate(column).Labels
+	c := Crosstab{
+		RowQuestion:    row.Text,
+		ColumnQuestion: column.Text,
+		RowLabels:      rowLabels,
+		ColumnLabels:   columnLabels,
+		Counts:         make([][]int, len(rowLabels)),
+		RowPercents:    make([][]float64, len(rowLabels)),
+		ColumnPercents: make([][]float64, len(rowLabels)),
+	}
+	for i := range rowLabels {
+		c.Counts[i] = make([]int, len(columnLabels))
+		c.RowPercents[i] = make([]float64, len(columnLabels))
+		c.ColumnPercents[i] = make([]float64, len(columnLabels))
+	}
+	return c
+}
+
+// add counts an attempt answering the row question in rows and the column
+// question in columns, positions as returned by answerBuckets, which hold at
+// most one position for the questions a crosstab is made of.
+func (c *Crosstab) add(rows []int, columns []int) {
+	for _, i := range rows {
+		for _, j := range columns {
+			c.Counts[i][j]++
+			c.Total++
+		}
+	}
+}
+
+// finish computes the percentages and the chi-square test of the counts.
+func (c *Crosstab) finish() {
+	rowTotals := make([]int, len(c.RowLabels))
+	columnTotals := make([]int, len(c.ColumnLabels))
+	for i, row := range c.Counts {
+		for j, count := range row {
+			rowTotals[i] += count
+			columnTotals[j] += count
+		}
+	}
+	for i, row := range c.Counts {
+		for j, count := range row {
+			if rowTotals[i] > 0 {
+				c.RowPercents[i][j] = 100 * float64(count) / float64(rowTotals[i])
+			}
+			if columnTotals[j] > 0 {
+				c.ColumnPercents[i][j] = 100 * float64(count) / float64(columnTotals[j])
+			}
+		}
+	}
+	c.ChiSquare, c.DegreesOfFreedom, c.PValue = chiSquareTest(c.Counts, rowTotals, columnTotals, c.Total)
+}
+
+// chiSquareTest returns Pearson's chi-square statistic of the independence of
+// the rows and columns of counts, along with its degrees of freedom and p
+// value. Empty rows and columns are left out. Tables with fewer than two
+// non-empty rows or columns have no degrees of freedom and a p value of 1.
+func chiSquareTest(counts [][]int, rowTotals []int, columnTotals []int, total int) (float64, int, float64) {
+	rows, columns := 0, 0
+	for _, n := range rowTotals {
+		if n > 0 {
+			rows++
+		}
+	}
+	for _, n := range columnTotals {
+		if n > 0 {
+			columns++
+		}
+	}
+	df := (rows - 1) * (columns - 1)
+	if df <= 0 {
+		return 0, 0, 1
+	}
+	chiSquare := 0.0
+	for i, row := range counts {
+		for j, count := range row {
+			if rowTotals[i] == 0 || columnTotals[j] == 0 {
+				continue
+			}
+			expected := float64(rowTotals[i]) * float64(columnTotals[j]) / float64(total)
+			d := float64(count) - expected
+			chiSquare += d * d / expected
+		}
+	}
+	return chiSquare, df, chiSquareSurvival(chiSquare, df)
+}
+
+// chiSquareSurvival returns the probability that a chi-square distributed
+// variable with df degrees of freedom exceeds x.
+func chiSquareSurvival(x float64, df int) float64 {
+	if x <= 0 {
+		return 1
+	}
+	return gammaQ(float64(df)/2, x/2)
+}
+
+// gammaQ returns the regularized upper incomplete gamma function Q(a, x) for
+// a > 0 and x > 0, by its series below a+1 and its continued fraction above.
+func gammaQ(a float64, x float64) float64 {
+	const (
+		maxIterations = 500
+		epsilon       = 1e-14
+		tiny          = 1e-300
+	)
+	lgamma, _ := math.Lgamma(a)
+	prefix := math.Exp(a*math.Log(x) - x - lgamma)
+	if x < a+1 {
+		sum, term := 1/a, 1/a
+		for n := 1; n < maxIterations; n++ {
+			term *= x / (a + float64(n))
+			sum += term
+			if math.Abs(term) < math.Abs(sum)*epsilon {
+				break
+			}
+		}
+		return math.Max(0, 1-sum*prefix)
+	}
+	// modified Lentz's method
+	b := x + 1 - a
+	c := 1 / tiny
+	d := 1 / b
+	h := d
+	for n := 1; n < maxIterations; n++ {
+		an := -float64(n) * (float64(n) - a)
+		b += 2
+		d = an*d + b
+		if math.Abs(d) < tiny {
+			d = tiny
+		}
+		c = b + an/c
+		if math.Abs(c) < tiny {
+			c = tiny
+		}
+		d = 1 / d
+		delta := d * c
+		h *= delta
+		if math.Abs(delta-1) < epsilon {
+			break
+		}
+	}
+	return prefix * h
+}
+
+// crossResponses returns the joint distribution of the answers to the
+// questions with ids given by the q1 and q2 parameters of r, questions of
+// survey, a loaded survey version, counting the attempts of the cohort
+// selected by filter that answered both. Rows are the answers to q1 and
+// columns the answers to q2, bucketed like aggregates. Text and multi-select
+// questions cannot be crossed: an attempt picking several choices would be
+// counted more than once, breaking the chi-square test. Invalid parameters
+// fail with a requestError.
+func (s *server) crossResponses(ctx context.Context, r *http.Request, survey *Survey, filter cohortFilter) (*Crosstab, error) {
+	var questions [2]Question
+	for i, name := range []string{"q1", "q2"} {
+		id, err := strconv.ParseInt(r.FormValue(name), 10, 64)
+		q := survey.Question(id)
+		if err != nil || q < 0 || survey.Questions[q].Type == questionText {
+			return nil, requestError{http.StatusBadRequest, "invalid " + name}
+		}
+		if survey.Questions[q].Type == questionMulti {
+			return nil, requestError{http.StatusBadRequest, "multi-select questions cannot be crossed"}
+		}
+		questions[i] = survey.Questions[q]
+	}
+	if questions[0].Id == questions[1].Id {
+		return nil, requestError{http.StatusBadRequest, "q1 and q2 must differ"}
+	}
+	attempts, err := s.cohortAttempts(ctx, survey, filter)
+	if err != nil {
+		return nil, err
+	}
+	c := newCrosstab(questions[0], questions[1])
+	for _, attempt := range attempts {
+		var rows, columns []int
+		for _, answer := range attempt.Answers {
+			switch answer.QuestionId {
+			case questions[0].Id:
+				rows = answerBuckets(questions[0], answer)
+			case questions[1].Id:
+				columns = answerBuckets(questions[1], answer)
+			}
+		}
+		c.add(rows, columns)
+	}
+	c.finish()
+	return &c, nil
+}
+
+// GET /api/crosstab
+// crosstab retrieves the joint distribution of the answers to the questions
+// with ids q1 and q2 of a version of the survey with id survey, in json
+// format, see crossResponses. The respondents can be filtered like
+// aggregateResponses, and the same users can cross the same versions.
+func (s *server) crosstab(w http.ResponseWriter, r *http.Request) {
+	ctx, _, survey, filter, ok := s.parseAggregateRequest(w, r, "crossing responses")
+	if !ok {
+		return
+	}
+	c, err := s.crossResponses(ctx, r, survey, filter)
+	if e, isRequestError := err.(requestError); isRequestError {
+		writeError(w, e.status, e.message)
+		return
+	}
+	if err == errCohortTooSmall {
+		writeError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	if err != nil {
+		log.Print("crossing responses failed: ", err)
+		writeError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(c)
+}
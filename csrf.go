@@ -0,0 +1,104 @@
+package main
+
+import (
+	"crypto/subtle"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+const (
+	// csrfCookie holds the secret CSRF tokens are bound to for visitors
+	// without a session cookie, see csrfSecret.
+	csrfCookie = "csrf-id"
+	// csrfHeader is the header script.js sends the CSRF token in.
+	csrfHeader = "X-CSRF-Token"
+	// csrfField is the form field forms send the CSRF token in.
+	csrfField = "csrf_token"
+)
+
+// csrfSecret returns the secret the CSRF tokens of r are bound to: the
+// session cookie, so tokens change with every session, or before the visitor
+// logged in the csrf cookie. It returns an empty string if there is neither.
+// Bearer tokens are not used, since they are not sent by browsers on their
+// own.
+func csrfSecret(r *http.Request) string {
+	for _, name := range []string{sessionCookie, csrfCookie} {
+		if c, err := r.Cookie(name); err == nil && c.Value != "" {
+			return c.Value
+		}
+	}
+	return ""
+}
+
+// csrfToken returns the CSRF token for secret. It is a hash of the secret,
+// so pages embedding it do not leak the session token.
+func csrfToken(secret string) string {
+	return sessionId("csrf\x00" + secret)
+}
+
+// csrfSafe reports whether r cannot change state, or cannot be sent by a
+// page of another site without a CORS preflight, which the app never
+// answers: requests with an Authorization header, and json api requests.
+func csrfSafe(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	if r.Header.Get("Authorization") != "" {
+		return true
+	}
+	if strings.HasPrefix(r.URL.Path, apiPrefix+"/") {
+		mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		return err == nil && mediaType == "application/json"
+	}
+	return false
+}
+
+// csrf wraps handler, rejecting state-changing requests without the CSRF
+// token of their session, sent in the X-CSRF-Token header or the csrf_token
+// form field, with 403 Forbidden. Visitors without a session cookie get a
+// csrf cookie to bind their tokens to, so the sign-up and login forms are
+// protected too. Multipart forms are read up to maxImportSize, the largest
+// form the app accepts.
+func (s *server) csrf(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		secret := csrfSecret(r)
+		if secret == "" {
+			var err error
+			if secret, err = newSessionToken(); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			c := &http.Cookie{
+				Name:     csrfCookie,
+				Value:    secret,
+				Path:     "/",
+				HttpOnly: true,
+				Secure:   s.secureCookie(r),
+				SameSite: http.SameSiteLaxMode,
+			}
+			http.SetCookie(w, c)
+			// pages served for r embed tokens bound to the new cookie
+			r.AddCookie(c)
+		}
+		if csrfSafe(r) {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		token := r.Header.Get(csrfHeader)
+		if token == "" {
+			r.Body = http.MaxBytesReader(w, r.Body, maxImportSize)
+			token = r.PostFormValue(csrfField)
+		}
+		if subtle.ConstantTimeCompare([]byte(token), []byte(csrfToken(secret))) != 1 {
+			if strings.HasPrefix(r.URL.Path, apiPrefix+"/") {
+				writeFailure(w, http.StatusForbidden, "missing or invalid CSRF token")
+			} else {
+				http.Error(w, "missing or invalid CSRF token", http.StatusForbidden)
+			}
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
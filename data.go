@@ -1,25 +1,313 @@
 package main
 
-// User model
+import "time"
+
+// roleAdmin is the role of users allowed to author surveys.
+const roleAdmin = "admin"
+
+// User model. Created is when the user signed up, and is zero for users who
+// signed up before it was recorded. AgeBand and Program are optional cohort
+// attributes supplied by the user, see userAttributes. Email is the optional
+// address password reset links are sent to. The password hash is left out of
+// the json representation of users served by the api.
 type User struct {
-	Id             string
-	Password       string
-	Responses      []int
-	SurveyComplete bool
+	Id       string    `json:"username"`
+	Password string    `json:"-"`
+	Role     string    `json:"role,omitempty"`
+	Created  time.Time `json:"created"`
+	AgeBand  string    `json:"ageBand"`
+	Program  string    `json:"program"`
+	Email    string    `json:"email"`
+	// Responses and SurveyComplete hold answers to the default survey from
+	// before responses were tracked per survey. They are only read to migrate
+	// them into an Attempt, see loadAttempt.
+	Responses      []int `json:"-"`
+	SurveyComplete bool  `json:"-"`
+}
+
+// Attempt model for one run of a user through a survey, stored under the
+// Attempt kind as a child of the user and keyed by an allocated id. Users can
+// retake a survey once their latest attempt is complete, so the attempts of
+// a user at a survey form their history. UserId is only set on attempts
+// listed across users.
+type Attempt struct {
+	Id       int64     `datastore:"-" json:"id"`
+	UserId   string    `datastore:"-" json:"-"`
+	SurveyId string    `json:"survey"`
+	Version  int       `json:"version"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+	Complete bool      `json:"complete"`
+	Answers  []Answer  `datastore:"-" json:"answers"`
+}
+
+// Answer model for a user's answer to a question, stored under the Answer
+// kind as a child of the attempt and keyed by the question id. Question and
+// choice ids are stable within a survey version, so an answer keeps its
+// meaning when later versions reword or reorder the survey. Which of
+// ChoiceId, ChoiceIds, Number and Text is set depends on the question type.
+type Answer struct {
+	SurveyId   string    `json:"-"`
+	Version    int       `json:"-"`
+	QuestionId int64     `json:"question"`
+	ChoiceId   int64     `json:"choice,omitempty"`
+	ChoiceIds  []int64   `json:"choices,omitempty"`
+	Number     float64   `json:"number"`
+	Text       string    `datastore:",noindex" json:"text,omitempty"`
+	Answered   time.Time `json:"answered"`
+}
+
+// Survey model, stored under the Survey kind and keyed by its id.
+// Respondents are served PublishedVersion while admins edit LatestVersion.
+// Version, Frozen and Questions describe the version that was loaded.
+type Survey struct {
+	Id               string     `datastore:"-" json:"id"`
+	Title            string     `json:"title"`
+	Published        bool       `json:"published"`
+	PublishedVersion int        `json:"publishedVersion"`
+	LatestVersion    int        `json:"-"`
+	Version          int        `datastore:"-" json:"version"`
+	Frozen           bool       `datastore:"-" json:"-"`
+	Questions        []Question `datastore:"-" json:"questions"`
+}
+
+// Question returns the position of the question with id questionId, or -1
+// if the loaded version has no such question.
+func (s Survey) Question(questionId int64) int {
+	for i, question := range s.Questions {
+		if question.Id == questionId {
+			return i
+		}
+	}
+	return -1
+}
+
+// HasDraft reports whether the latest version has not been published yet.
+func (s Survey) HasDraft() bool {
+	return s.LatestVersion != s.PublishedVersion
+}
+
+// SurveyVersion model for a revision of a survey's questions, stored under
+// the SurveyVersion kind as a child of its survey and keyed by its number.
+// A version is frozen once published and never edited afterwards. Counted is
+// set once the answer counters of the version hold every answer to it, see
+// rebuildCounters.
+type SurveyVersion struct {
+	Created time.Time
+	Frozen  bool
+	Counted bool
+}
+
+// Question model, stored under the Question kind as a child of its survey
+// version. Min and Max bound the answers to likert and number questions, and
+// MinLabel and MaxLabel name the ends of a likert scale. Rules pick the
+// question that follows an answer, see nextQuestion.
+type Question struct {
+	Id       int64    `datastore:"-" json:"id"`
+	Text     string   `json:"text"`
+	Type     string   `json:"type"`
+	Position int      `json:"position"`
+	Min      float64  `json:"min,omitempty"`
+	Max      float64  `json:"max,omitempty"`
+	MinLabel string   `json:"minLabel,omitempty"`
+	MaxLabel string   `json:"maxLabel,omitempty"`
+	Rules    []Rule   `json:"-"`
+	Choices  []Choice `datastore:"-" json:"choices,omitempty"`
+}
+
+// Number returns the 1-based number of the question within its survey.
+func (q Question) Number() int {
+	return q.Position + 1
+}
+
+// Choice returns the position of the choice with id choiceId, or -1 if the
+// question has no such choice.
+func (q Question) Choice(choiceId int64) int {
+	for i, choice := range q.Choices {
+		if choice.Id == choiceId {
+			return i
+		}
+	}
+	return -1
+}
+
+// Rule model for skip logic. An answer matches the rule if it picks the
+// choice at position Choice of a choice or multi-select question, or lies
+// between Min and Max for a likert or number question. Any answer matches an
+// Otherwise rule. Goto is the id of the question to continue at, or
+// endOfSurvey.
+type Rule struct {
+	Choice    int
+	Min       float64
+	Max       float64
+	Otherwise bool
+	Goto      int64
+}
+
+// Choice model, stored under the Choice kind as a child of its question.
+type Choice struct {
+	Id       int64  `datastore:"-" json:"id"`
+	Label    string `json:"label"`
+	Position int    `json:"position"`
+}
+
+// SessionRecord model for server-side sessions, stored under the Session kind
+// with the user as parent and keyed by the hash of the session token.
+type SessionRecord struct {
+	UserId  string
+	Created time.Time
+	Expires time.Time
+}
+
+// PasswordReset model for a password reset link sent to a user, stored under
+// the PasswordReset kind with the user as parent and keyed by the hash of its
+// token. Resets are deleted once used.
+type PasswordReset struct {
+	UserId  string
+	Created time.Time
+	Expires time.Time
+}
+
+// LoginThrottle model for the failed logins of an account or a client
+// address, stored under the LoginThrottle kind and keyed by what it throttles,
+// see loginLimit. Failures counts the failures since the last lockout, and
+// Pending the logins checked against it whose password is still being
+// verified, the last of which was checked at LastAttempt.
+type LoginThrottle struct {
+	Failures    int
+	LastFailure time.Time
+	LockedUntil time.Time
+	Pending     int
+	LastAttempt time.Time
+}
+
+// AuditEntry model for an entry of the audit log of security events, such
+// as lockouts, stored under the AuditEntry kind. Subject is what the event is
+// about, such as a locked out account, and Client the address of the client
+// causing it.
+type AuditEntry struct {
+	Time    time.Time
+	Event   string
+	Subject string
+	Client  string
+	Detail  string
 }
 
 // Session model
 type Session struct {
 	User
-	LoggedIn      bool
-	QuestionIndex int
-	CurQuestion   int
+	LoggedIn bool
+	// CSRFToken is the token forms and script.js send along with
+	// state-changing requests, see csrf.
+	CSRFToken string
+}
+
+// SurveySummary model for listing surveys along with the user's progress on
+// their latest attempt and the number of attempts they completed
+type SurveySummary struct {
+	Id       string `json:"id"`
+	Title    string `json:"title"`
+	Answered int    `json:"answered"`
+	Complete bool   `json:"complete"`
+	CheckIns int    `json:"checkIns"`
+}
+
+// Progress model for the api representation of a user's latest attempt at a
+// survey, or nil if they have not started one, along with the version it is
+// answered against and the question to answer next, or nil once the attempt
+// is complete.
+type Progress struct {
+	Attempt *Attempt  `json:"attempt"`
+	Version int       `json:"version"`
+	Next    *Question `json:"next"`
+}
+
+// SessionToken model for a session started through the api. Clients without
+// cookies send Token as a bearer token in the Authorization header.
+type SessionToken struct {
+	User    User      `json:"user"`
+	Token   string    `json:"token"`
+	Expires time.Time `json:"expires"`
+}
+
+// AnswerOption model for an answer that aggregates can be filtered by. Value
+// holds the question id and the position of the answer in the aggregate,
+// separated by a colon.
+type AnswerOption struct {
+	Label string
+	Value string
+}
+
+// AnsweredQuestion model for displaying a user's answer to a question
+type AnsweredQuestion struct {
+	Question Question
+	Answer   string
+}
+
+// HistoryRow model for a user's answers to a question across attempts
+type HistoryRow struct {
+	Question Question
+	Answers  []string
+}
+
+// QuestionAggregate model for the distribution of answers to a question.
+// Text answers are listed in Texts instead of being counted.
+type QuestionAggregate struct {
+	Question string   `json:"question"`
+	Type     string   `json:"type"`
+	Labels   []string `json:"labels"`
+	Counts   []int    `json:"counts"`
+	Texts    []string `json:"texts,omitempty"`
+}
+
+// Crosstab model for the joint distribution of answers to two questions.
+// Counts[i][j] counts the attempts answering the row question with
+// RowLabels[i] and the column question with ColumnLabels[j], and
+// RowPercents and ColumnPercents give each count as a percentage of its row
+// and column total. Total counts the attempts answering both questions, and
+// ChiSquare tests the independence of the answers. Multi-select questions
+// cannot be crossed, so each attempt is counted once.
+type Crosstab struct {
+	RowQuestion      string      `json:"rowQuestion"`
+	ColumnQuestion   string      `json:"columnQuestion"`
+	RowLabels        []string    `json:"rowLabels"`
+	ColumnLabels     []string    `json:"columnLabels"`
+	Counts           [][]int     `json:"counts"`
+	RowPercents      [][]float64 `json:"rowPercents"`
+	ColumnPercents   [][]float64 `json:"columnPercents"`
+	Total            int         `json:"total"`
+	ChiSquare        float64     `json:"chiSquare"`
+	DegreesOfFreedom int         `json:"degreesOfFreedom"`
+	PValue           float64     `json:"pValue"`
 }
 
 // Data model for templates
 type Data struct {
-	Session   Session
-	Questions []string
-	Answers   [][]string
-	Responses []string
+	Session      Session
+	Message      string
+	Surveys      []SurveySummary
+	AdminSurveys []Survey
+	Survey       *Survey
+	Question     *Question
+	Responses    []AnsweredQuestion
+	CheckIns     []Attempt
+	History      []HistoryRow
+	Migrate      bool
+	User         *User
+	Filters      []AnswerOption
+	Import       *importReport
+	PasswordForm string
+	Token        string
+	Registration Registration
+	AuditLog     []AuditEntry
+}
+
+// Registration model for the sign-up form served again with the values it
+// was submitted with and the problem with each invalid field by name, see
+// parseRegistration.
+type Registration struct {
+	Username   string
+	Email      string
+	Attributes map[string]string
+	Errors     map[string]string
 }
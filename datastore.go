@@ -0,0 +1,597 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+
+	"google.golang.org/appengine/datastore"
+)
+
+// datastoreStore is the Store backed by the App Engine datastore. Contexts
+// passed to it must come from appengine.NewContext.
+//
+// Users are stored under the User kind keyed by their id, with their attempts
+// as children and the answers of an attempt as its children. Surveys are
+// stored under the Survey kind keyed by their id, with their versions as
+// children and the questions and choices of a version as its descendants.
+type datastoreStore struct{}
+
+// notFound translates datastore errors for missing entities into
+// errNotFound.
+func notFound(err error) error {
+	if err == datastore.ErrNoSuchEntity || err == datastore.ErrInvalidKey {
+		return errNotFound
+	}
+	return err
+}
+
+// RunInTransaction runs f in a cross-group datastore transaction, which the
+// datastore runs again while it fails with ErrConcurrentTransaction. Calls
+// made within f join the transaction.
+func (datastoreStore) RunInTransaction(ctx context.Context, f func(ctx context.Context) error) error {
+	if inTransaction(ctx) {
+		return f(ctx)
+	}
+	return datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		return f(context.WithValue(ctx, txKey{}, true))
+	}, &datastore.TransactionOptions{XG: true, Attempts: txAttempts})
+}
+
+// userKey returns the datastore key of the user with id userId.
+func userKey(ctx context.Context, userId string) *datastore.Key {
+	return datastore.NewKey(ctx, "User", userId, 0, nil)
+}
+
+func (datastoreStore) GetUser(ctx context.Context, userId string) (User, error) {
+	var user User
+	err := datastore.Get(ctx, userKey(ctx, userId), &user)
+	return user, notFound(err)
+}
+
+func (datastoreStore) PutUser(ctx context.Context, user User) error {
+	_, err := datastore.Put(ctx, userKey(ctx, user.Id), &user)
+	return err
+}
+
+func (datastoreStore) ListUsers(ctx context.Context) ([]User, error) {
+	var users []User
+	_, err := datastore.NewQuery("User").GetAll(ctx, &users)
+	return users, err
+}
+
+func (datastoreStore) LegacyUsers(ctx context.Context) ([]User, error) {
+	var users []User
+	_, err := datastore.NewQuery("User").Filter("SurveyComplete =", true).GetAll(ctx, &users)
+	return users, err
+}
+
+// username model for the reservation of a username, stored under the
+// Username kind and keyed by the canonical form of the username.
+type username struct {
+	UserId string
+}
+
+// usernameKey returns the datastore key of the reservation of the username
+// with canonical form name.
+func usernameKey(ctx context.Context, name string) *datastore.Key {
+	return datastore.NewKey(ctx, "Username", name, 0, nil)
+}
+
+func (datastoreStore) GetUsername(ctx context.Context, name string) (string, error) {
+	var reservation username
+	err := datastore.Get(ctx, usernameKey(ctx, name), &reservation)
+	return reservation.UserId, notFound(err)
+}
+
+func (datastoreStore) PutUsername(ctx context.Context, name string, userId string) error {
+	_, err := datastore.Put(ctx, usernameKey(ctx, name), &username{UserId: userId})
+	return err
+}
+
+// sessionKey returns the datastore key of the session with id sessionId of
+// the user with id userId. Sessions are stored under their user, so those of
+// a user are found by a consistent ancestor query.
+func sessionKey(ctx context.Context, userId string, sessionId string) *datastore.Key {
+	return datastore.NewKey(ctx, "Session", sessionId, 0, userKey(ctx, userId))
+}
+
+func (datastoreStore) GetSession(ctx context.Context, userId string, sessionId string) (SessionRecord, error) {
+	var session SessionRecord
+	err := datastore.Get(ctx, sessionKey(ctx, userId, sessionId), &session)
+	return session, notFound(err)
+}
+
+func (datastoreStore) PutSession(ctx context.Context, sessionId string, session SessionRecord) error {
+	_, err := datastore.Put(ctx, sessionKey(ctx, session.UserId, sessionId), &session)
+	return err
+}
+
+func (datastoreStore) DeleteSession(ctx context.Context, userId string, sessionId string) error {
+	err := datastore.Delete(ctx, sessionKey(ctx, userId, sessionId))
+	if err == datastore.ErrNoSuchEntity {
+		return nil
+	}
+	return err
+}
+
+func (datastoreStore) DeleteUserSessions(ctx context.Context, userId string) error {
+	return deleteUserEntities(ctx, "Session", userId)
+}
+
+// deleteUserEntities deletes every entity of kind stored under the user with
+// id userId, in batches of datastoreBatch. The ancestor query is consistent,
+// so it may run in a transaction.
+func deleteUserEntities(ctx context.Context, kind string, userId string) error {
+	keys, err := datastore.NewQuery(kind).Ancestor(userKey(ctx, userId)).KeysOnly().GetAll(ctx, nil)
+	if err != nil {
+		return err
+	}
+	for start := 0; start < len(keys); start += datastoreBatch {
+		end := start + datastoreBatch
+		if end > len(keys) {
+			end = len(keys)
+		}
+		if err = datastore.DeleteMulti(ctx, keys[start:end]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// passwordResetKey returns the datastore key of the password reset with id
+// resetId of the user with id userId.
+func passwordResetKey(ctx context.Context, userId string, resetId string) *datastore.Key {
+	return datastore.NewKey(ctx, "PasswordReset", resetId, 0, userKey(ctx, userId))
+}
+
+func (datastoreStore) GetPasswordReset(ctx context.Context, userId string, resetId string) (PasswordReset, error) {
+	var reset PasswordReset
+	err := datastore.Get(ctx, passwordResetKey(ctx, userId, resetId), &reset)
+	return reset, notFound(err)
+}
+
+func (datastoreStore) PutPasswordReset(ctx context.Context, resetId string, reset PasswordReset) error {
+	_, err := datastore.Put(ctx, passwordResetKey(ctx, reset.UserId, resetId), &reset)
+	return err
+}
+
+func (datastoreStore) DeletePasswordReset(ctx context.Context, userId string, resetId string) error {
+	err := datastore.Delete(ctx, passwordResetKey(ctx, userId, resetId))
+	if err == datastore.ErrNoSuchEntity {
+		return nil
+	}
+	return err
+}
+
+func (datastoreStore) DeleteUserPasswordResets(ctx context.Context, userId string) error {
+	return deleteUserEntities(ctx, "PasswordReset", userId)
+}
+
+// loginThrottleKey returns the datastore key of the login throttle stored
+// under key.
+func loginThrottleKey(ctx context.Context, key string) *datastore.Key {
+	return datastore.NewKey(ctx, "LoginThrottle", key, 0, nil)
+}
+
+func (datastoreStore) GetLoginThrottle(ctx context.Context, key string) (LoginThrottle, error) {
+	var throttle LoginThrottle
+	err := datastore.Get(ctx, loginThrottleKey(ctx, key), &throttle)
+	return throttle, notFound(err)
+}
+
+func (datastoreStore) PutLoginThrottle(ctx context.Context, key string, throttle LoginThrottle) error {
+	_, err := datastore.Put(ctx, loginThrottleKey(ctx, key), &throttle)
+	return err
+}
+
+func (datastoreStore) DeleteLoginThrottle(ctx context.Context, key string) error {
+	err := datastore.Delete(ctx, loginThrottleKey(ctx, key))
+	if err == datastore.ErrNoSuchEntity {
+		return nil
+	}
+	return err
+}
+
+func (datastoreStore) PutAuditEntry(ctx context.Context, entry AuditEntry) error {
+	_, err := datastore.Put(ctx, datastore.NewIncompleteKey(ctx, "AuditEntry", nil), &entry)
+	return err
+}
+
+func (datastoreStore) ListAuditEntries(ctx context.Context, limit int) ([]AuditEntry, error) {
+	var entries []AuditEntry
+	_, err := datastore.NewQuery("AuditEntry").Order("-Time").Limit(limit).GetAll(ctx, &entries)
+	return entries, err
+}
+
+// surveyKey returns the datastore key of the survey with id surveyId.
+func surveyKey(ctx context.Context, surveyId string) *datastore.Key {
+	return datastore.NewKey(ctx, "Survey", surveyId, 0, nil)
+}
+
+// versionKey returns the datastore key of the version of the survey with id
+// surveyId.
+func versionKey(ctx context.Context, surveyId string, version int) *datastore.Key {
+	return datastore.NewKey(ctx, "SurveyVersion", "", int64(version), surveyKey(ctx, surveyId))
+}
+
+func (datastoreStore) ListSurveys(ctx context.Context) ([]Survey, error) {
+	var surveys []Survey
+	keys, err := datastore.NewQuery("Survey").GetAll(ctx, &surveys)
+	if err != nil {
+		return nil, err
+	}
+	for i := range surveys {
+		surveys[i].Id = keys[i].StringID()
+	}
+	return surveys, nil
+}
+
+func (datastoreStore) GetSurvey(ctx context.Context, surveyId string) (Survey, error) {
+	var survey Survey
+	err := datastore.Get(ctx, surveyKey(ctx, surveyId), &survey)
+	survey.Id = surveyId
+	return survey, notFound(err)
+}
+
+func (datastoreStore) PutSurvey(ctx context.Context, survey Survey) error {
+	_, err := datastore.Put(ctx, surveyKey(ctx, survey.Id), &survey)
+	return err
+}
+
+func (datastoreStore) GetSurveyVersion(ctx context.Context, surveyId string, version int) (SurveyVersion, error) {
+	var surveyVersion SurveyVersion
+	err := datastore.Get(ctx, versionKey(ctx, surveyId, version), &surveyVersion)
+	return surveyVersion, notFound(err)
+}
+
+func (datastoreStore) PutSurveyVersion(ctx context.Context, surveyId string, version int, surveyVersion SurveyVersion) error {
+	_, err := datastore.Put(ctx, versionKey(ctx, surveyId, version), &surveyVersion)
+	return err
+}
+
+func (datastoreStore) GetQuestions(ctx context.Context, surveyId string, version int) ([]Question, error) {
+	vKey := versionKey(ctx, surveyId, version)
+	var questions []Question
+	qKeys, err := datastore.NewQuery("Question").Ancestor(vKey).GetAll(ctx, &questions)
+	if err != nil {
+		return nil, err
+	}
+	var choices []Choice
+	cKeys, err := datastore.NewQuery("Choice").Ancestor(vKey).GetAll(ctx, &choices)
+	if err != nil {
+		return nil, err
+	}
+	byQuestion := make(map[int64][]Choice)
+	for i := range choices {
+		choices[i].Id = cKeys[i].IntID()
+		parent := cKeys[i].Parent().IntID()
+		byQuestion[parent] = append(byQuestion[parent], choices[i])
+	}
+	for i := range questions {
+		questions[i].Id = qKeys[i].IntID()
+		questions[i].Choices = byQuestion[questions[i].Id]
+	}
+	return questions, nil
+}
+
+func (datastoreStore) PutQuestions(ctx context.Context, surveyId string, version int, questions []Question) error {
+	vKey := versionKey(ctx, surveyId, version)
+	keys, err := datastore.NewQuery("Question").Ancestor(vKey).KeysOnly().GetAll(ctx, nil)
+	if err != nil {
+		return err
+	}
+	cKeys, err := datastore.NewQuery("Choice").Ancestor(vKey).KeysOnly().GetAll(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err = datastore.DeleteMulti(ctx, append(keys, cKeys...)); err != nil {
+		return err
+	}
+	for _, question := range questions {
+		qKey := datastore.NewKey(ctx, "Question", "", question.Id, vKey)
+		if question.Id == 0 {
+			qKey = datastore.NewIncompleteKey(ctx, "Question", vKey)
+		}
+		qKey, err := datastore.Put(ctx, qKey, &question)
+		if err != nil {
+			return err
+		}
+		for _, choice := range question.Choices {
+			cKey := datastore.NewKey(ctx, "Choice", "", choice.Id, qKey)
+			if choice.Id == 0 {
+				cKey = datastore.NewIncompleteKey(ctx, "Choice", qKey)
+			}
+			if _, err = datastore.Put(ctx, cKey, &choice); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// attemptKey returns the datastore key of the attempt with id attemptId of
+// the user with id userId, or an incomplete key for a new attempt if
+// attemptId is 0.
+func attemptKey(ctx context.Context, userId string, attemptId int64) *datastore.Key {
+	if attemptId == 0 {
+		return datastore.NewIncompleteKey(ctx, "Attempt", userKey(ctx, userId))
+	}
+	return datastore.NewKey(ctx, "Attempt", "", attemptId, userKey(ctx, userId))
+}
+
+// answerKey returns the datastore key of the answer to the question with id
+// questionId within the attempt with key aKey.
+func answerKey(ctx context.Context, aKey *datastore.Key, questionId int64) *datastore.Key {
+	return datastore.NewKey(ctx, "Answer", "", questionId, aKey)
+}
+
+// ListAttempts also moves attempts keyed by survey id, from when users had a
+// single attempt per survey, under an attempt id.
+func (d datastoreStore) ListAttempts(ctx context.Context, userId string, surveyId string) ([]Attempt, error) {
+	// attempts are few per user, so they are filtered here rather than with
+	// a composite index
+	var all []Attempt
+	keys, err := datastore.NewQuery("Attempt").Ancestor(userKey(ctx, userId)).GetAll(ctx, &all)
+	if err != nil {
+		return nil, err
+	}
+	var attempts []Attempt
+	for i, key := range keys {
+		attempt := all[i]
+		if attempt.SurveyId != surveyId {
+			continue
+		}
+		if key.IntID() == 0 {
+			attempt, err = d.rekeyAttempt(ctx, key)
+		} else {
+			attempt.Id = key.IntID()
+			_, err = datastore.NewQuery("Answer").Ancestor(key).GetAll(ctx, &attempt.Answers)
+		}
+		if err != nil {
+			return nil, err
+		}
+		attempts = append(attempts, attempt)
+	}
+	return attempts, nil
+}
+
+// rekeyAttempt moves the attempt with key key, which is keyed by its survey
+// id, along with its answers under a new attempt id. The attempt is dated by
+// its answers.
+func (d datastoreStore) rekeyAttempt(ctx context.Context, key *datastore.Key) (Attempt, error) {
+	var attempt Attempt
+	err := d.RunInTransaction(ctx, func(ctx context.Context) error {
+		attempt = Attempt{}
+		if err := datastore.Get(ctx, key, &attempt); err != nil {
+			return err
+		}
+		answerKeys, err := datastore.NewQuery("Answer").Ancestor(key).GetAll(ctx, &attempt.Answers)
+		if err != nil {
+			return err
+		}
+		for _, answer := range attempt.Answers {
+			if attempt.Started.IsZero() || answer.Answered.Before(attempt.Started) {
+				attempt.Started = answer.Answered
+			}
+			if attempt.Complete && answer.Answered.After(attempt.Finished) {
+				attempt.Finished = answer.Answered
+			}
+		}
+		newKey, err := datastore.Put(ctx, datastore.NewIncompleteKey(ctx, "Attempt", key.Parent()), &attempt)
+		if err != nil {
+			return err
+		}
+		for i := range attempt.Answers {
+			aKey := answerKey(ctx, newKey, attempt.Answers[i].QuestionId)
+			if _, err = datastore.Put(ctx, aKey, &attempt.Answers[i]); err != nil {
+				return err
+			}
+		}
+		attempt.Id = newKey.IntID()
+		return datastore.DeleteMulti(ctx, append(answerKeys, key))
+	})
+	return attempt, err
+}
+
+func (datastoreStore) PutAttempt(ctx context.Context, userId string, attempt Attempt) (int64, error) {
+	key, err := datastore.Put(ctx, attemptKey(ctx, userId, attempt.Id), &attempt)
+	if err != nil {
+		return 0, err
+	}
+	return key.IntID(), nil
+}
+
+func (datastoreStore) PutAnswer(ctx context.Context, userId string, attemptId int64, answer Answer) error {
+	aKey := attemptKey(ctx, userId, attemptId)
+	_, err := datastore.Put(ctx, answerKey(ctx, aKey, answer.QuestionId), &answer)
+	return err
+}
+
+func (datastoreStore) ListSurveyAttempts(ctx context.Context, surveyId string, version int) ([]Attempt, error) {
+	var attempts []Attempt
+	keys, err := datastore.NewQuery("Attempt").Filter("SurveyId =", surveyId).Filter("Version =", version).GetAll(ctx, &attempts)
+	if err != nil {
+		return nil, err
+	}
+	byKey := make(map[string]int)
+	for i, key := range keys {
+		attempts[i].Id = key.IntID()
+		attempts[i].UserId = key.Parent().StringID()
+		byKey[key.Encode()] = i
+	}
+	var answers []Answer
+	aKeys, err := datastore.NewQuery("Answer").Filter("SurveyId =", surveyId).Filter("Version =", version).GetAll(ctx, &answers)
+	if _, mismatch := err.(*datastore.ErrFieldMismatch); mismatch {
+		log.Print("skipping malformed answer: ", err)
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for i, key := range aKeys {
+		if a, ok := byKey[key.Parent().Encode()]; ok {
+			attempts[a].Answers = append(attempts[a].Answers, answers[i])
+		}
+	}
+	return attempts, nil
+}
+
+func (datastoreStore) ScanAnswers(ctx context.Context, surveyId string, f func(userId string, attemptId int64, answer Answer) error) error {
+	t := datastore.NewQuery("Answer").Filter("SurveyId =", surveyId).Run(ctx)
+	for {
+		var answer Answer
+		key, err := t.Next(&answer)
+		if err == datastore.Done {
+			return nil
+		}
+		if _, mismatch := err.(*datastore.ErrFieldMismatch); mismatch {
+			log.Print("skipping malformed answer: ", err)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		aKey := key.Parent()
+		if err = f(aKey.Parent().StringID(), aKey.IntID(), answer); err != nil {
+			return err
+		}
+	}
+}
+
+func (datastoreStore) ListAnswers(ctx context.Context, surveyId string, version int) ([]Answer, error) {
+	q := datastore.NewQuery("Answer").Filter("SurveyId =", surveyId).Filter("Version =", version)
+	var answers []Answer
+	_, err := q.GetAll(ctx, &answers)
+	if _, mismatch := err.(*datastore.ErrFieldMismatch); mismatch {
+		// the other answers are still loaded, so one bad record does not
+		// fail the listing
+		log.Print("skipping malformed answer: ", err)
+		err = nil
+	}
+	return answers, err
+}
+
+func (datastoreStore) ListTexts(ctx context.Context, surveyId string, version int, questionId int64, limit int) ([]string, error) {
+	q := datastore.NewQuery("Answer").Filter("SurveyId =", surveyId).Filter("Version =", version).
+		Filter("QuestionId =", questionId).Limit(limit)
+	var answers []Answer
+	_, err := q.GetAll(ctx, &answers)
+	if _, mismatch := err.(*datastore.ErrFieldMismatch); mismatch {
+		log.Print("skipping malformed answer: ", err)
+		err = nil
+	}
+	var texts []string
+	for _, answer := range answers {
+		if answer.Text != "" {
+			texts = append(texts, answer.Text)
+		}
+	}
+	return texts, err
+}
+
+// counterShard model for a shard of an answer counter, stored under the
+// Counter kind. Shards are root entities, so each is its own entity group
+// and answers counted in different shards do not contend.
+type counterShard struct {
+	SurveyId   string
+	Version    int
+	QuestionId int64
+	Bucket     int
+	Shard      int
+	Count      int
+}
+
+// counterShardKey returns the datastore key of the given shard of the
+// counter k of the version of the survey with id surveyId.
+func counterShardKey(ctx context.Context, surveyId string, version int, k counterKey, shard int) *datastore.Key {
+	name := fmt.Sprintf("%s/%d/%d/%d/%d", surveyId, version, k.questionId, k.bucket, shard)
+	return datastore.NewKey(ctx, "Counter", name, 0, nil)
+}
+
+// datastoreBatch is the most entities a datastore batch operation accepts.
+const datastoreBatch = 500
+
+// AddCounts adds each delta to a random shard of its counter. Outside of a
+// transaction each shard is updated in a transaction of its own, so no
+// increment is lost, and answers counting in many counters, such as
+// multi-select ones, do not span more entity groups than a transaction may.
+func (d datastoreStore) AddCounts(ctx context.Context, surveyId string, version int, deltas map[counterKey]int) error {
+	for k, delta := range deltas {
+		k, delta := k, delta
+		add := func(ctx context.Context) error {
+			shard := rand.Intn(counterShards)
+			key := counterShardKey(ctx, surveyId, version, k, shard)
+			var counter counterShard
+			if err := datastore.Get(ctx, key, &counter); err == datastore.ErrNoSuchEntity {
+				counter = counterShard{SurveyId: surveyId, Version: version, QuestionId: k.questionId, Bucket: k.bucket, Shard: shard}
+			} else if err != nil {
+				return err
+			}
+			counter.Count += delta
+			_, err := datastore.Put(ctx, key, &counter)
+			return err
+		}
+		var err error
+		if inTransaction(ctx) {
+			err = add(ctx)
+		} else {
+			err = d.RunInTransaction(ctx, add)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (datastoreStore) GetCounts(ctx context.Context, surveyId string, version int) (map[counterKey]int, error) {
+	q := datastore.NewQuery("Counter").Filter("SurveyId =", surveyId).Filter("Version =", version)
+	var shards []counterShard
+	if _, err := q.GetAll(ctx, &shards); err != nil {
+		return nil, err
+	}
+	counts := make(map[counterKey]int)
+	for _, shard := range shards {
+		counts[counterKey{shard.QuestionId, shard.Bucket}] += shard.Count
+	}
+	return counts, nil
+}
+
+// PutCounts deletes every shard of the counters and stores counts in the
+// first shard. Counter queries are not ancestor queries, so PutCounts does
+// not join transactions.
+func (datastoreStore) PutCounts(ctx context.Context, surveyId string, version int, counts map[counterKey]int) error {
+	q := datastore.NewQuery("Counter").Filter("SurveyId =", surveyId).Filter("Version =", version).KeysOnly()
+	keys, err := q.GetAll(ctx, nil)
+	if err != nil {
+		return err
+	}
+	for len(keys) > 0 {
+		n := len(keys)
+		if n > datastoreBatch {
+			n = datastoreBatch
+		}
+		if err = datastore.DeleteMulti(ctx, keys[:n]); err != nil {
+			return err
+		}
+		keys = keys[n:]
+	}
+	var shards []counterShard
+	for k, count := range counts {
+		keys = append(keys, counterShardKey(ctx, surveyId, version, k, 0))
+		shards = append(shards, counterShard{SurveyId: surveyId, Version: version, QuestionId: k.questionId, Bucket: k.bucket, Count: count})
+	}
+	for len(keys) > 0 {
+		n := len(keys)
+		if n > datastoreBatch {
+			n = datastoreBatch
+		}
+		if _, err = datastore.PutMulti(ctx, keys[:n], shards[:n]); err != nil {
+			return err
+		}
+		keys, shards = keys[n:], shards[n:]
+	}
+	return nil
+}
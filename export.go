@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// exportFormats are the content types of the formats responses are exported
+// in, by format name.
+var exportFormats = map[string]string{
+	"csv":   "text/csv; charset=utf-8",
+	"jsonl": "application/x-ndjson",
+}
+
+// errNoPseudonymKey is returned by exports when no key to derive user
+// pseudonyms from is configured.
+var errNoPseudonymKey = errors.New("EXPORT_PSEUDONYM_KEY is not set")
+
+// pseudonym returns the pseudonym of the user with id userId in exports, a
+// keyed hash of the id. Exports made with the same key can be joined on it
+// without revealing usernames.
+func (s *server) pseudonym(userId string) string {
+	mac := hmac.New(sha256.New, s.pseudonymKey)
+	mac.Write([]byte(userId))
+	return hex.EncodeToString(mac.Sum(nil))[:16]
+}
+
+// exportRow model for a row of a response export. Choice is the position of
+// the picked choice and Label its label, while Number and Text hold the
+// answers to likert, number and text questions.
+type exportRow struct {
+	User         string    `json:"user"`
+	Attempt      int64     `json:"attempt"`
+	Survey       string    `json:"survey"`
+	Version      int       `json:"version"`
+	Question     int       `json:"question"`
+	QuestionId   int64     `json:"questionId"`
+	QuestionText string    `json:"questionText"`
+	Type         string    `json:"type"`
+	Choice       *int      `json:"choice,omitempty"`
+	ChoiceId     int64     `json:"choiceId,omitempty"`
+	Label        string    `json:"label,omitempty"`
+	Number       *float64  `json:"number,omitempty"`
+	Text         string    `json:"text,omitempty"`
+	Answered     time.Time `json:"answered"`
+}
+
+// exportHeader is the header row of csv exports.
+var exportHeader = []string{"user", "attempt", "survey", "version", "question", "question_id", "question_text",
+	"type", "choice", "choice_id", "label", "number", "text", "answered"}
+
+// record returns the fields of the row in csv exports.
+func (row exportRow) record() []string {
+	choice, choiceId, number := "", "", ""
+	if row.Choice != nil {
+		choice = strconv.Itoa(*row.Choice)
+		choiceId = strconv.FormatInt(row.ChoiceId, 10)
+	}
+	if row.Number != nil {
+		number = strconv.FormatFloat(*row.Number, 'f', -1, 64)
+	}
+	question := ""
+	if row.Question > 0 {
+		question = strconv.Itoa(row.Question)
+	}
+	return []string{row.User, strconv.FormatInt(row.Attempt, 10), row.Survey, strconv.Itoa(row.Version),
+		question, strconv.FormatInt(row.QuestionId, 10), row.QuestionText, row.Type, choice, choiceId,
+		row.Label, number, row.Text, row.Answered.UTC().Format(time.RFC3339)}
+}
+
+// exportRows returns the rows exporting answer, an answer to survey, a loaded
+// survey version that is nil if the version no longer exists. Multi-select
+// answers are exported as one row per picked choice.
+func exportRows(survey *Survey, pseudonym string, attemptId int64, answer Answer) []exportRow {
+	row := exportRow{
+		User:       pseudonym,
+		Attempt:    attemptId,
+		Survey:     answer.SurveyId,
+		Version:    answer.Version,
+		QuestionId: answer.QuestionId,
+		Answered:   answer.Answered,
+	}
+	q := -1
+	if survey != nil {
+		q = survey.Question(answer.QuestionId)
+	}
+	if q < 0 {
+		// the question is unknown, so only its id is exported
+		return []exportRow{row}
+	}
+	question := survey.Questions[q]
+	row.Question = question.Number()
+	row.QuestionText = question.Text
+	row.Type = question.Type
+	choiceRow := func(choiceId int64) exportRow {
+		row := row
+		if c := question.Choice(choiceId); c >= 0 {
+			row.Choice = &c
+			row.ChoiceId = choiceId
+			row.Label = question.Choices[c].Label
+		}
+		return row
+	}
+	switch question.Type {
+	case questionChoice:
+		return []exportRow{choiceRow(answer.ChoiceId)}
+	case questionMulti:
+		var rows []exportRow
+		for _, choiceId := range answer.ChoiceIds {
+			rows = append(rows, choiceRow(choiceId))
+		}
+		return rows
+	case questionLikert, questionNumber:
+		number := answer.Number
+		row.Number = &number
+	case questionText:
+		row.Text = answer.Text
+	}
+	return []exportRow{row}
+}
+
+// rowWriter writes the rows of an export in some format.
+type rowWriter interface {
+	write(row exportRow) error
+	// flush writes any buffered rows.
+	flush() error
+}
+
+type csvRowWriter struct {
+	w *csv.Writer
+}
+
+// write writes the row, escaping the text of questions, choices and answers
+// so that spreadsheets do not run it as a formula.
+func (c csvRowWriter) write(row exportRow) error {
+	row.QuestionText = csvText(row.QuestionText)
+	row.Label = csvText(row.Label)
+	row.Text = csvText(row.Text)
+	return c.w.Write(row.record())
+}
+
+// csvText returns text prefixed with a quote if it starts with a character
+// that spreadsheets read as the start of a formula.
+func csvText(text string) string {
+	if text != "" && strings.ContainsRune("=+-@\t\r", rune(text[0])) {
+		return "'" + text
+	}
+	return text
+}
+
+// csvTextColumns are the columns of csv exports escaped by csvText.
+var csvTextColumns = map[string]bool{"question_text": true, "label": true, "text": true}
+
+// csvUnescape returns text without the quote added by csvText.
+func csvUnescape(text string) string {
+	if len(text) > 1 && text[0] == '\'' && csvText(text[1:]) != text[1:] {
+		return text[1:]
+	}
+	return text
+}
+
+func (c csvRowWriter) flush() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+type jsonRowWriter struct {
+	e *json.Encoder
+}
+
+func (j jsonRowWriter) write(row exportRow) error {
+	return j.e.Encode(row)
+}
+
+func (j jsonRowWriter) flush() error {
+	return nil
+}
+
+// newRowWriter returns the writer of rows in the named format to w, writing
+// the csv header first.
+func newRowWriter(w io.Writer, format string) (rowWriter, error) {
+	switch format {
+	case "csv":
+		c := csv.NewWriter(w)
+		return csvRowWriter{c}, c.Write(exportHeader)
+	case "jsonl":
+		return jsonRowWriter{json.NewEncoder(w)}, nil
+	}
+	return nil, fmt.Errorf("unknown export format %q", format)
+}
+
+// exportResponses writes every answer to the survey with id surveyId, or to
+// every survey if surveyId is empty, to w in the named format and returns the
+// number of rows written. Answers are streamed from the store rather than
+// loaded at once, and users are identified by their pseudonym. Legacy
+// responses to the default survey are exported with attempt 0.
+func (s *server) exportResponses(ctx context.Context, w io.Writer, format string, surveyId string) (int, error) {
+	if len(s.pseudonymKey) == 0 {
+		return 0, errNoPseudonymKey
+	}
+	rw, err := newRowWriter(w, format)
+	if err != nil {
+		return 0, err
+	}
+	var surveys []Survey
+	if surveyId == "" {
+		if surveys, err = s.listSurveys(ctx, true); err != nil {
+			return 0, err
+		}
+	} else {
+		survey, err := s.getSurvey(ctx, surveyId)
+		if err != nil {
+			return 0, err
+		}
+		surveys = []Survey{*survey}
+	}
+	rows := 0
+	for _, survey := range surveys {
+		// versions are loaded first since the store cannot be called
+		// while answers are scanned
+		versions := make(map[int]*Survey)
+		for version := 1; version <= survey.LatestVersion; version++ {
+			loaded, err := s.loadSurveyVersion(ctx, survey.Id, version)
+			if err == errNotFound {
+				continue
+			}
+			if err != nil {
+				return rows, err
+			}
+			versions[version] = loaded
+		}
+		write := func(userId string, attemptId int64, answer Answer) error {
+			for _, row := range exportRows(versions[answer.Version], s.pseudonym(userId), attemptId, answer) {
+				if err := rw.write(row); err != nil {
+					return err
+				}
+				rows++
+			}
+			return nil
+		}
+		if err = s.store.ScanAnswers(ctx, survey.Id, write); err != nil {
+			return rows, err
+		}
+		if survey.Id != defaultSurveyId {
+			continue
+		}
+		users, err := s.store.LegacyUsers(ctx)
+		if err != nil {
+			return rows, err
+		}
+		for _, user := range users {
+			answers, err := s.legacyAnswers(ctx, user.Responses)
+			if err != nil {
+				return rows, err
+			}
+			for _, answer := range answers {
+				if err = write(user.Id, 0, answer); err != nil {
+					return rows, err
+				}
+			}
+		}
+	}
+	return rows, rw.flush()
+}
@@ -0,0 +1,545 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// importBatch is the number of users written along with their attempts
+	// in one transaction. Each new user touches up to three entity groups on
+	// the datastore, see putNewUser, which allows 25 groups per transaction.
+	importBatch = 8
+	// maxImportErrors is the number of errors listed in an import report.
+	maxImportErrors = 100
+	// maxImportSize is the largest import file accepted by the admin page.
+	maxImportSize = 32 << 20
+)
+
+// importRecord is a row of an import file, mapping column names to values.
+type importRecord struct {
+	Line   int
+	Fields map[string]string
+}
+
+// importError is an error in the row of an import file at Line.
+type importError struct {
+	Line    int
+	Message string
+}
+
+// importReport reports the outcome of an import: the rows read, the users
+// and attempts created and the answers stored, or that would be if DryRun
+// is set, and the attempts skipped since they were imported before. Only the
+// first maxImportErrors errors are listed out of ErrorCount.
+type importReport struct {
+	DryRun     bool
+	Rows       int
+	Users      int
+	Attempts   int
+	Answers    int
+	Skipped    int
+	ErrorCount int
+	Errors     []importError
+}
+
+// errorf records an error in the row at line.
+func (r *importReport) errorf(line int, format string, args ...interface{}) {
+	r.ErrorCount++
+	if len(r.Errors) < maxImportErrors {
+		r.Errors = append(r.Errors, importError{line, fmt.Sprintf(format, args...)})
+	}
+}
+
+// String summarizes the report in a sentence.
+func (r *importReport) String() string {
+	verb := "Imported"
+	if r.DryRun {
+		verb = "Checked"
+	}
+	summary := fmt.Sprintf("%s %d rows: %d new users, %d attempts and %d answers.", verb, r.Rows, r.Users, r.Attempts, r.Answers)
+	if r.Skipped > 0 {
+		summary += fmt.Sprintf(" Skipped %d attempts imported before.", r.Skipped)
+	}
+	if r.ErrorCount > 0 {
+		summary = fmt.Sprintf("Found %d errors in %d rows, nothing was imported.", r.ErrorCount, r.Rows)
+	}
+	return summary
+}
+
+// importFormat returns the format of the import file with the given name,
+// jsonl for .jsonl and .json files and csv otherwise.
+func importFormat(name string) string {
+	if strings.HasSuffix(name, ".jsonl") || strings.HasSuffix(name, ".json") {
+		return "jsonl"
+	}
+	return "csv"
+}
+
+// readImportRecords reads the rows of an import file in the named format. A
+// csv file starts with a header row naming its columns, while each line of a
+// jsonl file is an object keyed by column name. The columns are those of
+// exports, see exportRow, along with password, email, ageBand and program.
+func readImportRecords(r io.Reader, format string) ([]importRecord, error) {
+	var records []importRecord
+	switch format {
+	case "csv":
+		cr := csv.NewReader(r)
+		cr.FieldsPerRecord = -1
+		header, err := cr.Read()
+		if err != nil {
+			return nil, fmt.Errorf("reading header: %v", err)
+		}
+		for {
+			values, err := cr.Read()
+			if err == io.EOF {
+				return records, nil
+			}
+			if err != nil {
+				return nil, err
+			}
+			line, _ := cr.FieldPos(0)
+			fields := make(map[string]string)
+			for i, value := range values {
+				if i < len(header) {
+					name := strings.TrimSpace(header[i])
+					if csvTextColumns[name] {
+						value = csvUnescape(value)
+					}
+					fields[name] = value
+				}
+			}
+			records = append(records, importRecord{line, fields})
+		}
+	case "jsonl":
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(nil, 1<<20)
+		for line := 1; scanner.Scan(); line++ {
+			if strings.TrimSpace(scanner.Text()) == "" {
+				continue
+			}
+			d := json.NewDecoder(strings.NewReader(scanner.Text()))
+			d.UseNumber()
+			var object map[string]interface{}
+			if err := d.Decode(&object); err != nil {
+				return nil, fmt.Errorf("line %d: %v", line, err)
+			}
+			fields := make(map[string]string)
+			for name, value := range object {
+				switch value := value.(type) {
+				case nil:
+				case string:
+					fields[name] = value
+				case json.Number:
+					fields[name] = value.String()
+				default:
+					return nil, fmt.Errorf("line %d: %s must be a string or a number", line, name)
+				}
+			}
+			records = append(records, importRecord{line, fields})
+		}
+		return records, scanner.Err()
+	}
+	return nil, fmt.Errorf("unknown import format %q", format)
+}
+
+// importUser is a user of an import along with the attempts to store for
+// them. New users are stored, existing ones only get the attempts.
+type importUser struct {
+	user     User
+	password string
+	new      bool
+	attempts []Attempt
+}
+
+// importAttempt collects the rows of an attempt while an import is planned.
+type importAttempt struct {
+	survey *Survey
+	// responses to each question as parseAnswer takes them, and the line
+	// and time of the first row answering it
+	responses map[int64][]string
+	lines     map[int64]int
+	answered  map[int64]time.Time
+}
+
+// importPlan is what an import stores, in the order of the import file.
+type importPlan struct {
+	users    []*importUser
+	versions map[versionId]bool
+}
+
+// planImport validates records against the stored users and the survey
+// definitions and returns what importing them would store, along with a
+// report of the errors found. Rows sharing a user, survey, version and
+// attempt form one attempt, and multi-select answers span one row per
+// picked choice. Rows without a question only create their user. Only frozen
+// versions can be imported, since answer ids are only stable once a version
+// is frozen. Attempts that a user already has, see hasAttempt, are skipped,
+// so that an import that failed partway can be run again.
+func (s *server) planImport(ctx context.Context, records []importRecord) (importPlan, *importReport) {
+	report := &importReport{Rows: len(records)}
+	plan := importPlan{versions: make(map[versionId]bool)}
+	users := make(map[string]*importUser)
+	surveys := make(map[versionId]*Survey)
+	attempts := make(map[string]*importAttempt)
+	var attemptOrder []string
+	attemptUser := make(map[string]*importUser)
+	for _, record := range records {
+		f := func(name string) string {
+			return strings.TrimSpace(record.Fields[name])
+		}
+		userId := f("user")
+		if userId == "" {
+			report.errorf(record.Line, "missing user")
+			continue
+		}
+		// rows name users in any case, see findUser
+		key := userId
+		if canonical, err := canonicalUsername(userId); err == nil {
+			key = canonical
+		}
+		u := users[key]
+		if u == nil {
+			user, err := s.findUser(ctx, userId)
+			if err == errNotFound {
+				username, err := normalizeUsername(userId)
+				if err != nil {
+					report.errorf(record.Line, "invalid user %s: %v", userId, err)
+					continue
+				}
+				u = &importUser{user: User{Id: username, Created: time.Now()}, new: true}
+			} else if err != nil {
+				report.errorf(record.Line, "loading user: %v", err)
+				continue
+			} else {
+				u = &importUser{user: user}
+			}
+			users[key] = u
+			plan.users = append(plan.users, u)
+		}
+		if u.new {
+			if password := record.Fields["password"]; password != "" {
+				if u.password != "" && u.password != password {
+					report.errorf(record.Line, "conflicting passwords for user %s", userId)
+				} else if err := s.checkPassword(u.user.Id, password); err != nil {
+					report.errorf(record.Line, "password of user %s: %v", userId, err)
+				}
+				u.password = password
+			}
+			if address := f("email"); address != "" {
+				email, err := parseEmail(address)
+				if err != nil {
+					report.errorf(record.Line, "email of user %s: %v", userId, err)
+				} else if u.user.Email != "" && u.user.Email != email {
+					report.errorf(record.Line, "conflicting email addresses for user %s", userId)
+				}
+				u.user.Email = email
+			}
+			for _, attribute := range userAttributes {
+				value := f(attribute.Name)
+				if value == "" {
+					continue
+				}
+				if !contains(attribute.Options, value) {
+					report.errorf(record.Line, "invalid %s", strings.ToLower(attribute.Label))
+				}
+				*u.user.attribute(attribute.Name) = value
+			}
+		}
+		if f("question") == "" {
+			continue
+		}
+		surveyId := f("survey")
+		if surveyId == "" {
+			report.errorf(record.Line, "missing survey")
+			continue
+		}
+		stored, err := s.getSurvey(ctx, surveyId)
+		if err == errNotFound {
+			report.errorf(record.Line, "unknown survey %s", surveyId)
+			continue
+		}
+		if err != nil {
+			report.errorf(record.Line, "loading survey: %v", err)
+			continue
+		}
+		version := stored.PublishedVersion
+		if v := f("version"); v != "" {
+			if version, err = strconv.Atoi(v); err != nil {
+				report.errorf(record.Line, "invalid version")
+				continue
+			}
+		}
+		id := versionId{surveyId, version}
+		survey := surveys[id]
+		if survey == nil {
+			if survey, err = s.loadSurveyVersion(ctx, surveyId, version); err != nil {
+				report.errorf(record.Line, "unknown version %d of survey %s", version, surveyId)
+				continue
+			}
+			if !survey.Frozen {
+				report.errorf(record.Line, "version %d of survey %s is a draft that was never published", version, surveyId)
+				continue
+			}
+			surveys[id] = survey
+		}
+		number, err := strconv.Atoi(f("question"))
+		if err != nil || number < 1 || number > len(survey.Questions) {
+			report.errorf(record.Line, "unknown question %s", f("question"))
+			continue
+		}
+		question := survey.Questions[number-1]
+		answered, err := time.Parse(time.RFC3339, f("answered"))
+		if err != nil {
+			report.errorf(record.Line, "answered must be a time such as 2017-06-01T09:30:00Z")
+			continue
+		}
+		var response string
+		switch question.Type {
+		case questionChoice, questionMulti:
+			c := -1
+			if choice := f("choice"); choice != "" {
+				if c, err = strconv.Atoi(choice); err != nil || c < 0 || c >= len(question.Choices) {
+					c = -1
+				}
+			} else {
+				for i, choice := range question.Choices {
+					if choice.Label == f("label") {
+						c = i
+					}
+				}
+			}
+			if c < 0 {
+				report.errorf(record.Line, "unknown choice of question %d", number)
+				continue
+			}
+			response = strconv.FormatInt(question.Choices[c].Id, 10)
+		case questionLikert, questionNumber:
+			response = f("number")
+		case questionText:
+			response = record.Fields["text"]
+		}
+		attemptKey := strings.Join([]string{key, surveyId, strconv.Itoa(version), f("attempt")}, "\x00")
+		a := attempts[attemptKey]
+		if a == nil {
+			a = &importAttempt{
+				survey:    survey,
+				responses: make(map[int64][]string),
+				lines:     make(map[int64]int),
+				answered:  make(map[int64]time.Time),
+			}
+			attempts[attemptKey] = a
+			attemptOrder = append(attemptOrder, attemptKey)
+			attemptUser[attemptKey] = u
+		}
+		if _, ok := a.responses[question.Id]; ok && question.Type != questionMulti {
+			report.errorf(record.Line, "question %d is answered twice in the attempt", number)
+			continue
+		}
+		if _, ok := a.lines[question.Id]; !ok {
+			a.lines[question.Id] = record.Line
+			a.answered[question.Id] = answered
+		}
+		a.responses[question.Id] = append(a.responses[question.Id], response)
+	}
+	// the attempts stored for existing users, by user and survey
+	stored := make(map[string][]Attempt)
+	for _, key := range attemptOrder {
+		a := attempts[key]
+		attempt := Attempt{SurveyId: a.survey.Id, Version: a.survey.Version}
+		valid := true
+		for _, question := range a.survey.Questions {
+			responses, ok := a.responses[question.Id]
+			if !ok {
+				continue
+			}
+			answer, err := parseAnswer(question, responses)
+			if err != nil {
+				report.errorf(a.lines[question.Id], "question %d: %v", question.Number(), err)
+				valid = false
+				continue
+			}
+			answer.SurveyId = attempt.SurveyId
+			answer.Version = attempt.Version
+			answer.Answered = a.answered[question.Id]
+			attempt.Answers = append(attempt.Answers, answer)
+		}
+		if !valid {
+			continue
+		}
+		// answers are stored in the order they were given
+		sort.SliceStable(attempt.Answers, func(i, j int) bool {
+			return attempt.Answers[i].Answered.Before(attempt.Answers[j].Answered)
+		})
+		attempt.Started = attempt.Answers[0].Answered
+		if nextQuestion(a.survey, attempt.Answers) == nil {
+			attempt.Complete = true
+			attempt.Finished = attempt.Answers[len(attempt.Answers)-1].Answered
+		}
+		u := attemptUser[key]
+		if !u.new {
+			storedKey := u.user.Id + "\x00" + attempt.SurveyId
+			existing, ok := stored[storedKey]
+			if !ok {
+				var err error
+				if existing, err = s.store.ListAttempts(ctx, u.user.Id, attempt.SurveyId); err != nil {
+					report.errorf(a.lines[attempt.Answers[0].QuestionId], "loading attempts: %v", err)
+					continue
+				}
+				stored[storedKey] = existing
+			}
+			if hasAttempt(existing, attempt) {
+				report.Skipped++
+				continue
+			}
+		}
+		u.attempts = append(u.attempts, attempt)
+		plan.versions[versionId{attempt.SurveyId, attempt.Version}] = true
+		report.Attempts++
+		report.Answers += len(attempt.Answers)
+	}
+	for _, u := range plan.users {
+		if u.new {
+			report.Users++
+		}
+	}
+	return plan, report
+}
+
+// importRecords validates records, see planImport, and unless dryRun is set
+// or the records have errors, stores their users and attempts in batches of
+// importBatch users per transaction. Passwords of new users are hashed with
+// bcrypt, and new users without one cannot log in until they get one.
+// Existing users are not modified, and importing a file again skips the
+// attempts imported before. The survey versions answered are counted from their
+// answers until an admin rebuilds their counters, see countedAggregates.
+func (s *server) importRecords(ctx context.Context, records []importRecord, dryRun bool) (*importReport, error) {
+	plan, report := s.planImport(ctx, records)
+	report.DryRun = dryRun
+	if dryRun || report.ErrorCount > 0 {
+		return report, nil
+	}
+	for _, u := range plan.users {
+		if u.new && u.password != "" {
+			hash, err := bcrypt.GenerateFromPassword([]byte(u.password), bcrypt.DefaultCost)
+			if err != nil {
+				return report, err
+			}
+			u.user.Password = string(hash)
+		}
+	}
+	for start := 0; start < len(plan.users); start += importBatch {
+		end := start + importBatch
+		if end > len(plan.users) {
+			end = len(plan.users)
+		}
+		err := s.store.RunInTransaction(ctx, func(ctx context.Context) error {
+			for _, u := range plan.users[start:end] {
+				if err := s.importUser(ctx, u); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return report, fmt.Errorf("importing users %d to %d: %v", start+1, end, err)
+		}
+	}
+	for id := range plan.versions {
+		err := s.store.RunInTransaction(ctx, func(ctx context.Context) error {
+			surveyVersion, err := s.store.GetSurveyVersion(ctx, id.surveyId, id.version)
+			if err != nil {
+				return err
+			}
+			surveyVersion.Counted = false
+			return s.store.PutSurveyVersion(ctx, id.surveyId, id.version, surveyVersion)
+		})
+		if err != nil {
+			return report, err
+		}
+	}
+	return report, nil
+}
+
+// hasAttempt reports whether attempts has one at the same survey version as
+// attempt that started at the same time, which is the time of its first
+// answer for imported attempts.
+func hasAttempt(attempts []Attempt, attempt Attempt) bool {
+	for _, a := range attempts {
+		if a.SurveyId == attempt.SurveyId && a.Version == attempt.Version && a.Started.Equal(attempt.Started) {
+			return true
+		}
+	}
+	return false
+}
+
+// importUser stores u if it is new, reserving its username, along with its
+// attempts. Attempts of existing users are checked again, see hasAttempt,
+// since they may have been imported since the import was planned.
+func (s *server) importUser(ctx context.Context, u *importUser) error {
+	if u.new {
+		if err := s.putNewUser(ctx, u.user); err != nil {
+			return fmt.Errorf("user %s: %v", u.user.Id, err)
+		}
+	}
+	stored := make(map[string][]Attempt)
+	for _, attempt := range u.attempts {
+		if !u.new {
+			existing, ok := stored[attempt.SurveyId]
+			if !ok {
+				var err error
+				if existing, err = s.store.ListAttempts(ctx, u.user.Id, attempt.SurveyId); err != nil {
+					return err
+				}
+				stored[attempt.SurveyId] = existing
+			}
+			if hasAttempt(existing, attempt) {
+				continue
+			}
+		}
+		attemptId, err := s.store.PutAttempt(ctx, u.user.Id, attempt)
+		if err != nil {
+			return err
+		}
+		for _, answer := range attempt.Answers {
+			if err = s.store.PutAnswer(ctx, u.user.Id, attemptId, answer); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// runImport imports the users and responses of the named file, see
+// importRecords, and prints the report.
+func runImport(s *server, name string, dryRun bool) error {
+	file, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	records, err := readImportRecords(file, importFormat(name))
+	if err != nil {
+		return err
+	}
+	report, err := s.importRecords(context.Background(), records, dryRun)
+	if err != nil {
+		return err
+	}
+	for _, e := range report.Errors {
+		fmt.Printf("line %d: %s\n", e.Line, e.Message)
+	}
+	fmt.Println(report)
+	return nil
+}
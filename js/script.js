@@ -1,4 +1,8 @@
 $(document).ready(function() {
+    // state-changing requests are refused without the csrf token of the page
+    $.ajaxSetup({
+        headers: {'X-CSRF-Token': $('meta[name="csrf-token"]').attr('content')}
+    });
     $("#landing").css('height', ($(window).height()-58).toString());
     $("#survey-background").css('height', ($(window).height()-58).toString());
     $(window).resize(function() {
@@ -8,6 +12,8 @@ $(document).ready(function() {
     $("#register").on('click', function(e) {
         e.preventDefault();
     });
+    // a rejected sign-up is served with the form open to show its problems
+    $("#register-modal[data-open]").modal('show');
     $("#login-submit").on('click', function(e) {
         e.preventDefault();
         $.ajax({
@@ -19,89 +25,218 @@ $(document).ready(function() {
                 password: $("#login-password").val()
             },
             success: function(data) {
-                console.log(data);
                 if (data === "true") {
                     window.location.href = "/";
                 } else {
-                    $("#login-error-message").show();
+                    $("#login-error-message").text("Incorrect username or password").show();
+                }
+            },
+            error: function(xhr) {
+                var message = "Login failed, please try again.";
+                if (xhr.status === 429) {
+                    message = "Too many failed logins. Try again in " +
+                        waitText(parseInt(xhr.getResponseHeader("Retry-After"), 10)) + ".";
                 }
+                $("#login-error-message").text(message).show();
             },
         });
     });
-    $("#start-survey-button").on('click', function(e) {
+    $("button.start-survey-button").not(".retake-survey-button").on('click', function(e) {
         e.preventDefault();
-        var user = getCookie("session-id");
-        if (user === "") {
+        if (!loggedIn()) {
             $(".alert").show();
         } else {
-            window.location.href = "/survey";
+            window.location.href = "/survey/" + $(this).data("survey");
         }
     });
     $(".close").on('click', function(e) {
         $(".alert").hide();
     });
-    $("#survey button").on('click', function(e) {
-        var buttonId = event.target.id;
-        var id = buttonId.split("-")[1];
-        var currentQuestion = getCookie("current-question");
-        var questionIndex = getCookie("current-qindex");
-        var index = parseInt(questionIndex) + 1;
-        var questionNumber = parseInt(currentQuestion) + 1;
-        $.ajax({
-            url: '/api/recordUserResponse',
-            type: 'post',
-            dataType: 'html',
-            data: {
-                response: id
-            },
-            success: function(data) {
-                if (data === "true") {
-                    currentIndex = index.toString();
-                    currentQuestion = questionNumber.toString();
-                    setCookie("current-qindex", currentIndex, 1);
-                    setCookie("current-question", currentQuestion, 1);
-                    if (index < 4) {
-                        window.location.href = "/survey";
-                    } else {
-                        window.location.href = "/dashboard";
-                    }
-                }
-            },
-        });
+    $("#survey .answer-button").on('click', function(e) {
+        e.preventDefault();
+        submitResponse($(this).data("value"));
     });
-    if (window.location.pathname === "/dashboard") {
-        var c = getCookie("session-id");
-        if (c === "") return;
-        var answersLabels = [
-            ["Bored", "Excited", "Happy", "Sad"],
-            ["Abandoned Farm", "Woods", "Busy city", "Sea"],
-            ["Friends", "Family", "Strangers", "Authorities"],
-            ["Friends", "Money", "Career Advancement", "Vacation"]
-        ];
-        $.ajax({
-            url: '/api/aggregateResponses',
-            type: 'post',
-            dataType: 'json',
-            data: {
-            },
-            success: function(data) {
-                for (var i = 0; i < data.length; i++) {
-                    var chartName = "chart" + (i+1).toString();
-                    var chartTitle = "Question " + (i+1).toString();
-                    var chartLabels = answersLabels[i]
-                    var chartData = data[i];
-                    initChart(chartName, chartTitle, chartLabels, chartData);
-                }
-            },
+    $("#answer-form").on('submit', function(e) {
+        e.preventDefault();
+        var values = $(this).find("[name=response]").filter(function() {
+            return this.type !== "checkbox" || this.checked;
+        }).map(function() {
+            return $(this).val();
+        }).get();
+        submitResponse(values);
+    });
+    if ($("#dashboard").length) {
+        if (!loggedIn()) return;
+        // compare the first two questions until others are picked
+        $("#crosstab-form [name=q2] option").eq(1).prop("selected", true);
+        loadAggregates();
+        loadCrosstab();
+        $("#cohort-form").on('submit', function(e) {
+            e.preventDefault();
+            loadAggregates();
+            loadCrosstab();
+        });
+        $("#crosstab-form").on('submit', function(e) {
+            e.preventDefault();
+            loadCrosstab();
         });
     }
 });
 
-// initialize doughnut chart with user survey data
-function initChart(id, chartTitle, chartLabels, chartData) {
+// charts drawn on the dashboard, by canvas id
+var charts = {};
+
+// the parameters selecting the dashboard survey and the cohort filters
+function cohortParams() {
+    var params = {
+        survey: $("#dashboard").data("survey"),
+        version: $("#dashboard").data("version")
+    };
+    $.each($("#cohort-form").serializeArray(), function(i, field) {
+        if (field.value === "") return;
+        if (field.name === "answered") {
+            // the question id and the position of the answer
+            var parts = field.value.split(":");
+            params.question = parts[0];
+            params.answer = parts[1];
+        } else {
+            params[field.name] = field.value;
+        }
+    });
+    return params;
+}
+
+// the error message of a failed api request
+function apiError(xhr, message) {
+    try {
+        return JSON.parse(xhr.responseText).error || message;
+    } catch (e) {
+        return message;
+    }
+}
+
+// chart the responses of the users matching the cohort filters
+function loadAggregates() {
+    $.ajax({
+        url: '/api/aggregateResponses',
+        type: 'post',
+        dataType: 'json',
+        data: cohortParams(),
+        success: function(data) {
+            $("#cohort-message").text("");
+            for (var i = 0; i < data.length; i++) {
+                if (data[i].type === "text") {
+                    var list = $("#texts" + (i+1).toString()).empty();
+                    $.each(data[i].texts || [], function(j, text) {
+                        list.append($("<li>").text(text));
+                    });
+                    continue;
+                }
+                var chartName = "chart" + (i+1).toString();
+                var chartTitle = "Question " + (i+1).toString();
+                var chartLabels = data[i].labels;
+                var chartData = data[i].counts;
+                // distributions over a scale or range read better as bars
+                var chartType = data[i].type === "choice" ? 'doughnut' : 'bar';
+                if (charts[chartName]) {
+                    charts[chartName].destroy();
+                }
+                charts[chartName] = initChart(chartName, chartType, chartTitle, chartLabels, chartData);
+            }
+        },
+        error: function(xhr) {
+            $("#cohort-message").text(apiError(xhr, "The responses could not be loaded."));
+        },
+    });
+}
+
+// render the joint distribution of the answers to the compared questions as
+// a heatmap, shading each cell by its share of the largest count
+function loadCrosstab() {
+    var params = cohortParams();
+    $.each($("#crosstab-form").serializeArray(), function(i, field) {
+        params[field.name] = field.value;
+    });
+    var table = $("#crosstab").empty();
+    $("#crosstab-message").text("");
+    $.ajax({
+        url: '/api/crosstab',
+        type: 'get',
+        dataType: 'json',
+        data: params,
+        success: function(data) {
+            var max = 0;
+            $.each(data.counts, function(i, row) {
+                max = Math.max.apply(Math, [max].concat(row));
+            });
+            var header = $("<tr>").append($("<th>"));
+            $.each(data.columnLabels, function(j, label) {
+                header.append($("<th>").text(label));
+            });
+            table.append($("<thead>").append(header));
+            var body = $("<tbody>");
+            $.each(data.counts, function(i, row) {
+                var tr = $("<tr>").append($("<th>").text(data.rowLabels[i]));
+                $.each(row, function(j, count) {
+                    var share = max > 0 ? count / max : 0;
+                    tr.append($("<td>")
+                        .text(count + " (" + Math.round(data.rowPercents[i][j]) + "%)")
+                        .attr("title", Math.round(data.columnPercents[i][j]) + "% of column")
+                        .css("background-color", "rgba(54, 162, 235, " + share.toFixed(2) + ")"));
+                });
+                body.append(tr);
+            });
+            table.append(body);
+            $("#crosstab-message").text("Cells show counts and row percentages. Chi-square " +
+                data.chiSquare.toFixed(2) + " with " + data.degreesOfFreedom +
+                " degrees of freedom, p = " + data.pValue.toPrecision(2) + ".");
+        },
+        error: function(xhr) {
+            $("#crosstab-message").text(apiError(xhr, "The comparison could not be loaded."));
+        },
+    });
+}
+
+// post the response to the current survey question; multi-select responses
+// are sent as repeated response values
+function submitResponse(response) {
+    var survey = $("#survey").data("survey");
+    $.ajax({
+        url: '/api/recordUserResponse',
+        type: 'post',
+        dataType: 'html',
+        traditional: true,
+        data: {
+            survey: survey,
+            question: $("#survey").data("question"),
+            response: response
+        },
+        success: function() {
+            // the server tracks progress and redirects to the dashboard
+            // once the last question has been answered
+            window.location.href = "/survey/" + survey;
+        },
+        error: function(xhr) {
+            if (xhr.status === 400) {
+                var message = "Please check your answer and try again.";
+                try {
+                    message = JSON.parse(xhr.responseText).error || message;
+                } catch (e) {}
+                $("#answer-error").text(message);
+            } else if (xhr.status === 401) {
+                window.location.href = "/";
+            } else {
+                window.location.href = "/survey/" + survey;
+            }
+        },
+    });
+}
+
+// initialize chart of the given type with user survey data
+function initChart(id, chartType, chartTitle, chartLabels, chartData) {
     var ctx = $("#" + id);
-    var chart = new Chart(ctx, {
-        type: 'doughnut',
+    return new Chart(ctx, {
+        type: chartType,
         data: {
             labels: chartLabels,
             datasets: [{
@@ -137,25 +272,19 @@ function initChart(id, chartTitle, chartLabels, chartData) {
     });
 }
 
-// cookie functions from http://www.w3schools.com/js/js_cookies.asp
-function setCookie(cname, cvalue, exdays) {
-    var d = new Date();
-    d.setTime(d.getTime() + (exdays*24*60*60*1000));
-    var expires = "expires="+ d.toUTCString();
-    document.cookie = cname + "=" + cvalue + ";" + expires + ";path=/";
+// describe a wait of the given number of seconds, as sent in Retry-After
+function waitText(seconds) {
+    if (!(seconds > 0)) {
+        return "a little while";
+    }
+    if (seconds < 60) {
+        return seconds + (seconds === 1 ? " second" : " seconds");
+    }
+    var minutes = Math.ceil(seconds / 60);
+    return minutes + (minutes === 1 ? " minute" : " minutes");
 }
 
-function getCookie(cname) {
-    var name = cname + "=";
-    var ca = document.cookie.split(';');
-    for(var i = 0; i <ca.length; i++) {
-        var c = ca[i];
-        while (c.charAt(0)==' ') {
-            c = c.substring(1);
-        }
-        if (c.indexOf(name) == 0) {
-            return c.substring(name.length,c.length);
-        }
-    }
-    return "";
+// the session cookie is HttpOnly, so login state is rendered into the page
+function loggedIn() {
+    return $("body").data("logged-in") === true;
 }
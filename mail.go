@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Mailer sends email to users. The app picks one at startup, see newMailer.
+type Mailer interface {
+	// Send sends a plain text message with subject and body to the address
+	// to.
+	Send(ctx context.Context, to string, subject string, body string) error
+}
+
+// formatMessage returns the message with subject and body sent from from to
+// to, with headers.
+func formatMessage(from string, to string, subject string, body string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", to)
+	fmt.Fprintf(&b, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	b.WriteString(strings.Replace(body, "\n", "\r\n", -1))
+	return b.String()
+}
+
+// smtpMailer sends messages from from through the SMTP server at addr,
+// authenticating with auth if set.
+type smtpMailer struct {
+	addr string
+	from string
+	auth smtp.Auth
+}
+
+func (m smtpMailer) Send(ctx context.Context, to string, subject string, body string) error {
+	return smtp.SendMail(m.addr, m.auth, m.from, []string{to}, []byte(formatMessage(m.from, to, subject, body)))
+}
+
+// fileMailer is a stand-in for local development that appends messages to
+// the file at path instead of sending them.
+type fileMailer struct {
+	mu   sync.Mutex
+	path string
+}
+
+func (m *fileMailer) Send(ctx context.Context, to string, subject string, body string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f, err := os.OpenFile(m.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = f.WriteString(formatMessage("behaviorix", to, subject, body) + "\r\n\r\n"); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// logMailer is a stand-in for local development that logs messages instead
+// of sending them.
+type logMailer struct{}
+
+func (logMailer) Send(ctx context.Context, to string, subject string, body string) error {
+	log.Printf("mail to %s: %s\n%s", to, subject, body)
+	return nil
+}
+
+// newMailer returns the mailer configured by the environment: SMTP_ADDR
+// names the SMTP server as host:port, SMTP_FROM the sender and SMTP_USERNAME
+// and SMTP_PASSWORD the credentials, if any. Without SMTP_ADDR messages are
+// appended to the file named by MAIL_FILE. Without either, messages are
+// logged if dev is set, and otherwise there is no mailer and newMailer
+// returns nil, since logged messages would put working password reset links
+// in the logs.
+func newMailer(dev bool) (Mailer, error) {
+	addr := os.Getenv("SMTP_ADDR")
+	if addr == "" {
+		if path := os.Getenv("MAIL_FILE"); path != "" {
+			return &fileMailer{path: path}, nil
+		}
+		if !dev {
+			return nil, nil
+		}
+		log.Print("SMTP_ADDR is not set, logging mail instead of sending it")
+		return logMailer{}, nil
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SMTP_ADDR: %v", err)
+	}
+	m := smtpMailer{addr: addr, from: os.Getenv("SMTP_FROM")}
+	if m.from == "" {
+		return nil, fmt.Errorf("SMTP_FROM is not set")
+	}
+	if username := os.Getenv("SMTP_USERNAME"); username != "" {
+		m.auth = smtp.PlainAuth("", username, os.Getenv("SMTP_PASSWORD"), host)
+	}
+	return m, nil
+}
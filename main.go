@@ -1,300 +1,850 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
 	"net/http"
+	"net/url"
+	"os"
 	"strconv"
+	"time"
 
 	"golang.org/x/crypto/bcrypt"
 
 	"google.golang.org/appengine"
-	"google.golang.org/appengine/datastore"
 )
 
-const MAX_QUESTIONS = 4
-const MAX_ANSWERS = 4
+// server serves the app from store. newContext returns the context store
+// calls are made with for a request. migrateTo is the store admins can copy
+// the data of the app into, if any. pseudonymKey is the key user pseudonyms
+// in exports are derived from. mailer sends password reset links, which
+// point to baseURL; password resets are unavailable unless it is set.
+type server struct {
+	store        Store
+	newContext   func(r *http.Request) context.Context
+	templates    *templateSet
+	migrateTo    Store
+	pseudonymKey []byte
+	mailer       Mailer
+	baseURL      string
+	// commonPasswords are the lower-cased passwords users cannot pick, see
+	// checkPassword.
+	commonPasswords map[string]bool
+	// trustedProxies is the number of proxies in front of the app appending
+	// to X-Forwarded-For, see clientAddress.
+	trustedProxies int
+	// secureCookies makes every cookie Secure, see secureCookie.
+	secureCookies bool
+	// now returns the current time logins are throttled by, see
+	// verifyLogin.
+	now func() time.Time
+}
 
-var (
-	questions = []string{
-		"How do you feel today?",
-		"Given your mood today, which of the following places would you prefer to be right now?",
-		"Which of the following makes you anxious?",
-		"Which of the following do you need most in your life right now?",
-	}
-	answers = [][]string{
-		{"Bored", "Excited", "Happy", "Sad"},
-		{"Abandoned Farm", "Woods", "Busy city", "Sea"},
-		{"Friends", "Family", "Strangers", "Authorities"},
-		{"Friends", "Money", "Career Advancement", "Vacation"},
-	}
-)
+// handler returns the handler serving every route of the app, with
+// state-changing requests checked for their CSRF token, see csrf.
+func (s *server) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", s.home)
+	mux.HandleFunc("/about", s.about)
+	mux.HandleFunc("/createuser", s.createUser)
+	mux.HandleFunc("/dashboard", s.dashboard)
+	mux.HandleFunc("/dashboard/", s.dashboard)
+	mux.HandleFunc("/login", s.login)
+	mux.HandleFunc("/logout", s.logout)
+	mux.HandleFunc("/profile", s.updateProfile)
+	mux.HandleFunc("/password/change", s.changePassword)
+	mux.HandleFunc("/password/forgot", s.forgotPassword)
+	mux.HandleFunc("/password/reset", s.resetPassword)
+	mux.HandleFunc("/survey", s.handleSurvey)
+	mux.HandleFunc("/survey/", s.handleSurvey)
+	mux.HandleFunc("/admin", s.adminHome)
+	mux.HandleFunc("/admin/surveys", s.adminCreateSurvey)
+	mux.HandleFunc("/admin/survey/", s.adminSurvey)
+	mux.HandleFunc("/admin/migrate", s.adminMigrate)
+	mux.HandleFunc("/admin/counters", s.adminRebuildCounters)
+	mux.HandleFunc("/admin/usernames", s.adminReserveUsernames)
+	mux.HandleFunc("/admin/export", s.adminExport)
+	mux.HandleFunc("/admin/import", s.adminImport)
+	mux.HandleFunc("/api/recordUserResponse", s.recordUserResponse)
+	mux.HandleFunc("/api/aggregateResponses", s.aggregateResponses)
+	mux.HandleFunc("/api/crosstab", s.crosstab)
+	mux.HandleFunc(apiPrefix+"/", s.api)
+	return s.csrf(mux)
+}
 
-// main the server main function.
+// main the server main function. The app is served from the App Engine
+// datastore unless SQL_DRIVER and SQL_DSN name a SQL database to serve it
+// from. MIGRATE_SQL_DRIVER and MIGRATE_SQL_DSN name the SQL database admins
+// can copy the data of the app into. With -standalone the app serves itself
+// instead of running in the App Engine runtime, from memory if no SQL
+// database is set.
 func main() {
-	http.HandleFunc("/", home)
-	http.HandleFunc("/about", about)
-	http.HandleFunc("/createuser", createUser)
-	http.HandleFunc("/dashboard", dashboard)
-	http.HandleFunc("/login", login)
-	http.HandleFunc("/logout", logout)
-	http.HandleFunc("/survey", handleSurvey)
-	http.HandleFunc("/api/recordUserResponse", recordUserResponse)
-	http.HandleFunc("/api/aggregateResponses", aggregateResponses)
+	if err := run(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// run runs main, returning the error to exit with, so that the stores opened
+// are closed first.
+func run() error {
+	standalone := flag.Bool("standalone", false, "serve with net/http instead of the App Engine runtime")
+	addr := flag.String("addr", ":8080", "address to listen on when standalone")
+	readTimeout := flag.Duration("read-timeout", 10*time.Second, "maximum duration for reading a request when standalone")
+	writeTimeout := flag.Duration("write-timeout", 30*time.Second, "maximum duration for writing a response when standalone")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 30*time.Second, "maximum duration for finishing requests in flight on SIGTERM when standalone")
+	secureCookies := flag.Bool("secure-cookies", false, "mark cookies Secure even for requests that did not come over HTTPS when standalone")
+	dev := flag.Bool("dev", false, "parse templates again when they change, and log mail if no mailer is set")
+	rebuildCounters := flag.Bool("rebuild-counters", false, "recompute the answer counters of the SQL store from its answers and exit")
+	export := flag.String("export", "", "write every response in the SQL store to stdout as csv or jsonl and exit")
+	exportSurvey := flag.String("export-survey", "", "only export the responses to the survey with this id")
+	importFile := flag.String("import", "", "import users and responses from this csv or jsonl file into the SQL store and exit")
+	dryRun := flag.Bool("dry-run", false, "only check the file passed to -import")
+	reserveUsernames := flag.Bool("reserve-usernames", false, "reserve the usernames of users of the SQL store who signed up before usernames were reserved and exit")
+	flag.Parse()
+
+	templates, err := loadTemplates("templates", *dev)
+	if err != nil {
+		return fmt.Errorf("parsing templates: %v", err)
+	}
+	mailer, err := newMailer(*dev)
+	if err != nil {
+		return fmt.Errorf("configuring mail: %v", err)
+	}
+	commonPasswords, err := loadCommonPasswords("common-passwords.txt")
+	if err != nil {
+		return fmt.Errorf("loading common passwords: %v", err)
+	}
+	trustedProxies := 0
+	if proxies := os.Getenv("TRUSTED_PROXIES"); proxies != "" {
+		if trustedProxies, err = strconv.Atoi(proxies); err != nil || trustedProxies < 0 {
+			return fmt.Errorf("invalid TRUSTED_PROXIES: %s", proxies)
+		}
+	}
+	baseURL := os.Getenv("BASE_URL")
+	if baseURL == "" {
+		log.Print("BASE_URL is not set: password resets are disabled")
+	} else if u, err := url.Parse(baseURL); err != nil || u.Scheme != "https" && u.Scheme != "http" || u.Host == "" {
+		return fmt.Errorf("invalid BASE_URL: %s", baseURL)
+	}
+	if baseURL != "" && mailer == nil {
+		return errors.New("BASE_URL is set but neither SMTP_ADDR nor MAIL_FILE is, so password reset links cannot be sent; set one of them, or -dev to log mail")
+	}
+	s := &server{
+		store:           datastoreStore{},
+		newContext:      appengine.NewContext,
+		templates:       templates,
+		pseudonymKey:    []byte(os.Getenv("EXPORT_PSEUDONYM_KEY")),
+		mailer:          mailer,
+		baseURL:         baseURL,
+		commonPasswords: commonPasswords,
+		trustedProxies:  trustedProxies,
+		now:             time.Now,
+	}
+	// app.yaml only lets HTTPS requests through on App Engine
+	s.secureCookies = *secureCookies || !*standalone
+	requestContext := func(r *http.Request) context.Context {
+		return r.Context()
+	}
+	if driver := os.Getenv("SQL_DRIVER"); driver != "" {
+		store, err := openSQLStore(driver, os.Getenv("SQL_DSN"))
+		if err != nil {
+			return fmt.Errorf("opening SQL store: %v", err)
+		}
+		defer store.Close()
+		s.store = store
+		s.newContext = requestContext
+	} else if *standalone {
+		log.Print("SQL_DRIVER is not set, serving from memory: data is lost on exit")
+		s.store = newMemoryStore()
+		s.newContext = requestContext
+	}
+	if *rebuildCounters {
+		if os.Getenv("SQL_DRIVER") == "" {
+			return errors.New("-rebuild-counters needs SQL_DRIVER; on App Engine rebuild the counters at /admin")
+		}
+		rebuilt, err := s.rebuildAllCounters(context.Background())
+		if err != nil {
+			return fmt.Errorf("rebuilding counters: %v", err)
+		}
+		log.Printf("rebuilt the answer counters of %d survey versions", rebuilt)
+		return nil
+	}
+	if *reserveUsernames {
+		if os.Getenv("SQL_DRIVER") == "" {
+			return errors.New("-reserve-usernames needs SQL_DRIVER; on App Engine reserve the usernames at /admin")
+		}
+		reserved, err := s.reserveUsernames(context.Background())
+		if err != nil {
+			return fmt.Errorf("reserving usernames: %v", err)
+		}
+		log.Printf("reserved %d usernames", reserved)
+		return nil
+	}
+	if *export != "" {
+		if os.Getenv("SQL_DRIVER") == "" {
+			return errors.New("-export needs SQL_DRIVER; on App Engine export at /admin")
+		}
+		rows, err := s.exportResponses(context.Background(), os.Stdout, *export, *exportSurvey)
+		if err != nil {
+			return fmt.Errorf("exporting responses: %v", err)
+		}
+		log.Printf("exported %d rows", rows)
+		return nil
+	}
+	if *importFile != "" {
+		if os.Getenv("SQL_DRIVER") == "" {
+			return errors.New("-import needs SQL_DRIVER; on App Engine import at /admin")
+		}
+		if err := runImport(s, *importFile, *dryRun); err != nil {
+			return fmt.Errorf("importing: %v", err)
+		}
+		return nil
+	}
+	if driver := os.Getenv("MIGRATE_SQL_DRIVER"); driver != "" {
+		store, err := openSQLStore(driver, os.Getenv("MIGRATE_SQL_DSN"))
+		if err != nil {
+			return fmt.Errorf("opening SQL store to migrate to: %v", err)
+		}
+		defer store.Close()
+		s.migrateTo = store
+	}
+	if *standalone {
+		return runStandalone(s, *addr, *readTimeout, *writeTimeout, *shutdownTimeout)
+	}
+	http.Handle("/", s.handler())
 	appengine.Main()
+	return nil
 }
 
 // GET /
-// home serves the home page.
-func home(w http.ResponseWriter, r *http.Request) {
-	session := getSession(r)
+// home serves the home page listing the surveys along with the user's
+// progress on each.
+func (s *server) home(w http.ResponseWriter, r *http.Request) {
+	s.serveLanding(w, r, http.StatusOK, Registration{})
+}
+
+// serveLanding serves the home page with status. A registration with errors
+// opens the sign-up form again, filled in with it.
+func (s *server) serveLanding(w http.ResponseWriter, r *http.Request, status int, registration Registration) {
+	session := s.getSession(r)
 	data := Data{
-		Session: session,
+		Session:      session,
+		Registration: registration,
+	}
+	var err error
+	data.Surveys, err = s.surveySummaries(s.newContext(r), session)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
-	ctx := appengine.NewContext(r)
+	s.serveTemplateStatus(w, status, "landing", data)
+}
+
+// surveySummaries lists the published surveys along with the progress of the
+// user of session on each, if logged in.
+func (s *server) surveySummaries(ctx context.Context, session Session) ([]SurveySummary, error) {
 	var user User
 	if session.LoggedIn {
-		key := datastore.NewKey(ctx, "User", session.Id, 0, nil)
-		err := datastore.Get(ctx, key, &user)
+		var err error
+		user, err = s.store.GetUser(ctx, session.Id)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+			return nil, err
 		}
 	}
-	if user.SurveyComplete {
-		http.Redirect(w, r, "/dashboard", http.StatusFound)
-		return
+	surveys, err := s.listSurveys(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	summaries := []SurveySummary{}
+	for _, survey := range surveys {
+		summary := SurveySummary{
+			Id:    survey.Id,
+			Title: survey.Title,
+		}
+		if session.LoggedIn {
+			attempts, err := s.loadAttempts(ctx, user, survey.Id)
+			if err != nil {
+				return nil, err
+			}
+			for _, attempt := range attempts {
+				if attempt.Complete {
+					summary.CheckIns++
+				}
+			}
+			if len(attempts) > 0 {
+				latest := attempts[len(attempts)-1]
+				summary.Answered = len(latest.Answers)
+				summary.Complete = latest.Complete
+			}
+		}
+		summaries = append(summaries, summary)
 	}
-	serveTemplate(w, data, "layout", "navbar", "login", "register", "landing", "footer")
+	return summaries, nil
 }
 
 // GET /about
 // about serves the info page.
-func about(w http.ResponseWriter, r *http.Request) {
-	session := getSession(r)
+func (s *server) about(w http.ResponseWriter, r *http.Request) {
+	session := s.getSession(r)
 	data := Data{
 		Session: session,
 	}
-	serveTemplate(w, data, "layout", "navbar", "login", "register", "about", "footer")
+	s.serveTemplate(w, "about", data)
 }
 
-// GET /dashboard
-// dashboard serves dashboard page containing user's survey responses and
-// charts showing the distribution of responses to each survey question.
-func dashboard(w http.ResponseWriter, r *http.Request) {
-	session := getSession(r)
+// GET /dashboard/{id}
+// dashboard serves dashboard page containing user's responses to their
+// latest completed attempt at the survey, a history of their answers across
+// completed attempts and charts showing the distribution of responses to
+// each survey question.
+// GET /dashboard redirects to the dashboard of the default survey.
+func (s *server) dashboard(w http.ResponseWriter, r *http.Request) {
+	session := s.getSession(r)
 	data := Data{
-		Session:   session,
-		Questions: questions,
+		Session: session,
 	}
 	if !session.LoggedIn {
 		w.WriteHeader(http.StatusUnauthorized)
 		return
 	}
-	ctx := appengine.NewContext(r)
-	var user User
-	if session.LoggedIn {
-		key := datastore.NewKey(ctx, "User", session.Id, 0, nil)
-		err := datastore.Get(ctx, key, &user)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+	surveyId := pathId(r, "/dashboard")
+	if surveyId == "" {
+		http.Redirect(w, r, "/dashboard/"+defaultSurveyId, http.StatusFound)
+		return
+	}
+	ctx := s.newContext(r)
+	survey, err := s.getSurvey(ctx, surveyId)
+	if err == errNotFound {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	user, err := s.store.GetUser(ctx, session.Id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	attempts, err := s.loadAttempts(ctx, user, surveyId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// completed attempts, newest first
+	var checkIns []Attempt
+	for i := len(attempts) - 1; i >= 0; i-- {
+		if attempts[i].Complete {
+			checkIns = append(checkIns, attempts[i])
 		}
 	}
-	if !user.SurveyComplete {
+	if len(checkIns) == 0 {
 		http.Redirect(w, r, "/", http.StatusFound)
 		return
 	}
-	responses := []string{}
-	for i := 0; i < len(user.Responses); i++ {
-		responses = append(responses, answers[i][user.Responses[i]])
+	if len(checkIns) > maxHistory {
+		checkIns = checkIns[:maxHistory]
+	}
+	// responses are shown against the version that was answered
+	versions := make(map[int]*Survey)
+	for _, attempt := range checkIns {
+		version := attemptVersion(attempt, survey)
+		if versions[version] != nil {
+			continue
+		}
+		versions[version], err = s.loadSurveyVersion(ctx, surveyId, version)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	latest := checkIns[0]
+	survey = versions[attemptVersion(latest, survey)]
+	responses := []AnsweredQuestion{}
+	for _, answer := range latest.Answers {
+		q := survey.Question(answer.QuestionId)
+		if q < 0 {
+			continue
+		}
+		question := survey.Questions[q]
+		responses = append(responses, AnsweredQuestion{
+			Question: question,
+			Answer:   answerLabel(question, answer),
+		})
+	}
+	// question ids are kept across versions, so answers to earlier versions
+	// line up with the questions of the latest one
+	for _, question := range survey.Questions {
+		row := HistoryRow{Question: question}
+		for _, attempt := range checkIns {
+			answered := versions[attemptVersion(attempt, survey)]
+			label := ""
+			for _, answer := range attempt.Answers {
+				if q := answered.Question(answer.QuestionId); answer.QuestionId == question.Id && q >= 0 {
+					label = answerLabel(answered.Questions[q], answer)
+				}
+			}
+			row.Answers = append(row.Answers, label)
+		}
+		data.History = append(data.History, row)
 	}
+	data.Survey = survey
 	data.Responses = responses
-	serveTemplate(w, data, "layout", "navbar", "login", "register", "dashboard", "footer")
+	data.CheckIns = checkIns
+	data.User = &user
+	data.Filters = answerOptions(survey)
+	s.serveTemplate(w, "dashboard", data)
 }
 
 // POST /createuser
-// createUser adds user to database.
-func createUser(w http.ResponseWriter, r *http.Request) {
-	ctx := appengine.NewContext(r)
-	username := r.FormValue("username")
-	password := r.FormValue("password")
-	hash, _ := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
-	user := User{
-		Id:             username,
-		Password:       string(hash[:]),
-		Responses:      []int{},
-		SurveyComplete: false,
-	}
-	key := datastore.NewKey(ctx, "User", user.Id, 0, nil)
-	err := datastore.Get(ctx, key, &user)
-	if err == nil {
-		http.Redirect(w, r, "/", http.StatusFound)
+// createUser adds user to database and logs them in. Invalid fields and taken
+// usernames serve the home page with the sign-up form open again, showing
+// the problem with each field.
+func (s *server) createUser(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
 		return
 	}
-	_, err = datastore.Put(ctx, key, &user)
+	ctx := s.newContext(r)
+	user, problems := s.parseRegistration(r.PostFormValue)
+	if len(problems) == 0 {
+		var err error
+		user, err = s.registerUser(ctx, user, r.PostFormValue("password"))
+		if err == errUserExists {
+			problems["username"] = "this " + err.Error()
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	if len(problems) > 0 {
+		registration := Registration{
+			Username:   r.PostFormValue("username"),
+			Email:      r.PostFormValue("email"),
+			Attributes: make(map[string]string),
+			Errors:     problems,
+		}
+		for _, attribute := range userAttributes {
+			registration.Attributes[attribute.Name] = r.PostFormValue(attribute.Name)
+		}
+		s.serveLanding(w, r, http.StatusBadRequest, registration)
+		return
+	}
+	_, _, err := s.startSession(w, r, user.Id)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	cUser := &http.Cookie{
-		Name:  "session-id",
-		Value: user.Id,
-	}
-	cQuestion := &http.Cookie{
-		Name:  "current-question",
-		Value: strconv.Itoa(1),
-	}
-	qIndex := &http.Cookie{
-		Name:  "current-qindex",
-		Value: strconv.Itoa(0),
-	}
-	http.SetCookie(w, cUser)
-	http.SetCookie(w, cQuestion)
-	http.SetCookie(w, qIndex)
 	http.Redirect(w, r, "/", http.StatusFound)
 }
 
-// POST /login
-// login authenticates user.
-func login(w http.ResponseWriter, r *http.Request) {
-	ctx := appengine.NewContext(r)
-	username := r.FormValue("username")
-	key := datastore.NewKey(ctx, "User", username, 0, nil)
-	var user User
-	err := datastore.Get(ctx, key, &user)
+// POST /profile
+// updateProfile sets the cohort attributes and the email address of the
+// logged in user and redirects to the dashboard of the survey with id survey.
+func (s *server) updateProfile(w http.ResponseWriter, r *http.Request) {
+	session := s.getSession(r)
+	if !session.LoggedIn {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var attributes User
+	if err := setAttributes(&attributes, r.FormValue); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	email, err := parseEmail(r.FormValue("email"))
 	if err != nil {
-		w.Write([]byte("false"))
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	password := r.FormValue("password")
-	hash := []byte(user.Password)
-	err = bcrypt.CompareHashAndPassword(hash, []byte(password))
+	ctx := s.newContext(r)
+	err = s.store.RunInTransaction(ctx, func(ctx context.Context) error {
+		user, err := s.store.GetUser(ctx, session.Id)
+		if err != nil {
+			return err
+		}
+		for _, attribute := range userAttributes {
+			*user.attribute(attribute.Name) = *attributes.attribute(attribute.Name)
+		}
+		user.Email = email
+		return s.store.PutUser(ctx, user)
+	})
 	if err != nil {
-		w.Write([]byte("false"))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	cUser := &http.Cookie{
-		Name:  "session-id",
-		Value: user.Id,
+	surveyId := r.FormValue("survey")
+	if !surveyIdPattern.MatchString(surveyId) {
+		surveyId = defaultSurveyId
 	}
-	questionIndex := 0
-	curQuestion := 1
-	if user.SurveyComplete {
-		curQuestion = -1
-		questionIndex = -1
-	} else {
-		user.Responses = []int{}
-		_, err = datastore.Put(ctx, key, &user)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+	http.Redirect(w, r, "/dashboard/"+surveyId, http.StatusFound)
+}
+
+// registerUser stores user, a new user, with the bcrypt hash of password and
+// reserves its username, see canonicalUsername. It returns the stored user,
+// or errUserExists if the username is taken in any case.
+func (s *server) registerUser(ctx context.Context, user User, password string) (User, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return User{}, err
+	}
+	user.Password = string(hash)
+	user.Created = s.now()
+	err = s.store.RunInTransaction(ctx, func(ctx context.Context) error {
+		return s.putNewUser(ctx, user)
+	})
+	return user, err
+}
+
+// putNewUser stores user, a new user, and reserves its username, see
+// canonicalUsername, unless it is taken in any case, in which case it returns
+// errUserExists. Call it in a transaction.
+func (s *server) putNewUser(ctx context.Context, user User) error {
+	canonical, err := canonicalUsername(user.Id)
+	if err != nil {
+		return err
+	}
+	_, err = s.store.GetUsername(ctx, canonical)
+	if err == nil {
+		return errUserExists
+	}
+	if err != errNotFound {
+		return err
+	}
+	// users who signed up before usernames were reserved
+	for _, id := range []string{user.Id, canonical} {
+		_, err := s.store.GetUser(ctx, id)
+		if err == nil {
+			return errUserExists
+		}
+		if err != errNotFound {
+			return err
 		}
 	}
-	cQuestion := &http.Cookie{
-		Name:  "current-question",
-		Value: strconv.Itoa(curQuestion),
+	if err := s.store.PutUser(ctx, user); err != nil {
+		return err
 	}
-	qIndex := &http.Cookie{
-		Name:  "current-qindex",
-		Value: strconv.Itoa(questionIndex),
+	return s.store.PutUsername(ctx, canonical, user.Id)
+}
+
+// authenticate returns the user with the given username, see findUser, if
+// password is theirs, and errInvalidCredentials otherwise.
+func (s *server) authenticate(ctx context.Context, username string, password string) (User, error) {
+	user, err := s.findUser(ctx, username)
+	if err == errNotFound {
+		return User{}, errInvalidCredentials
+	}
+	if err != nil {
+		return User{}, err
+	}
+	if bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)) != nil {
+		return User{}, errInvalidCredentials
+	}
+	return user, nil
+}
+
+// POST /login
+// login authenticates user. Failed logins are throttled, see verifyLogin, and
+// throttled ones are refused with 429 Too Many Requests and a Retry-After
+// header.
+func (s *server) login(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	ctx := s.newContext(r)
+	user, err := s.verifyLogin(ctx, r, r.PostFormValue("username"), r.PostFormValue("password"))
+	if e, ok := err.(loginThrottledError); ok {
+		w.Header().Set("Retry-After", strconv.Itoa(e.seconds()))
+		http.Error(w, e.Error(), http.StatusTooManyRequests)
+		return
+	}
+	if err == errInvalidCredentials {
+		w.Write([]byte("false"))
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	_, _, err = s.startSession(w, r, user.Id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
-	http.SetCookie(w, cUser)
-	http.SetCookie(w, cQuestion)
-	http.SetCookie(w, qIndex)
 	w.Write([]byte("true"))
 }
 
 // POST /logout
-// logout deletes the session data and redirects user back to home.
-func logout(w http.ResponseWriter, r *http.Request) {
-	cUser, _ := r.Cookie("session-id")
-	cUser = &http.Cookie{
-		Name:   "session-id",
-		Value:  "",
-		MaxAge: -1,
-	}
-	cQuestion, _ := r.Cookie("current-question")
-	cQuestion = &http.Cookie{
-		Name:   "current-question",
-		Value:  "",
-		MaxAge: -1,
-	}
-	qIndex, _ := r.Cookie("current-qindex")
-	qIndex = &http.Cookie{
-		Name:   "current-qindex",
-		Value:  "",
-		MaxAge: -1,
-	}
-	http.SetCookie(w, cUser)
-	http.SetCookie(w, cQuestion)
-	http.SetCookie(w, qIndex)
+// logout revokes the session and redirects user back to home.
+func (s *server) logout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	err := s.endSession(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 	http.Redirect(w, r, "/", http.StatusFound)
 }
 
-// GET /survey
-// handleSurvey displays the survey if the user is logged in.
+// GET /survey/{id}
+// POST /survey/{id}
+// handleSurvey displays the next question of the user's latest attempt at
+// the survey if the user is logged in. The answers given so far pick the
+// next question, see nextQuestion. POST starts a new attempt once the latest
+// one is complete, so users can check in again.
+// GET /survey redirects to the default survey.
 // If survey is already completed, user is redirected to the dashboard.
 // If user is not logged in, user is redirected back to home.
-func handleSurvey(w http.ResponseWriter, r *http.Request) {
-	session := getSession(r)
+func (s *server) handleSurvey(w http.ResponseWriter, r *http.Request) {
+	session := s.getSession(r)
 	if session.Id == "" {
 		w.WriteHeader(http.StatusUnauthorized)
 		return
 	}
-	ctx := appengine.NewContext(r)
-	var user User
-	key := datastore.NewKey(ctx, "User", session.Id, 0, nil)
-	err := datastore.Get(ctx, key, &user)
+	surveyId := pathId(r, "/survey")
+	if surveyId == "" {
+		http.Redirect(w, r, "/survey/"+defaultSurveyId, http.StatusFound)
+		return
+	}
+	ctx := s.newContext(r)
+	survey, err := s.getSurvey(ctx, surveyId)
+	if err == errNotFound {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	user, err := s.store.GetUser(ctx, session.Id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	attempt, err := s.loadAttempt(ctx, user, surveyId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !survey.Published && !attempt.Complete {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method == http.MethodPost {
+		if !survey.Published {
+			http.NotFound(w, r)
+			return
+		}
+		if attempt.Complete {
+			// an attempt started by a concurrent request is continued
+			_, err = s.startNextAttempt(ctx, session.Id, survey)
+			if err != nil && err != errAttemptOpen {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		http.Redirect(w, r, "/survey/"+surveyId, http.StatusFound)
+		return
+	}
+	// started attempts continue on the version they were started on
+	survey, err = s.loadSurveyVersion(ctx, surveyId, attemptVersion(attempt, survey))
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	if user.SurveyComplete {
-		http.Redirect(w, r, "/dashboard", http.StatusFound)
+	next := nextQuestion(survey, attempt.Answers)
+	if attempt.Complete || next == nil {
+		http.Redirect(w, r, "/dashboard/"+surveyId, http.StatusFound)
 		return
 	}
 	data := Data{
-		Session:   session,
-		Questions: questions,
-		Answers:   answers,
+		Session:  session,
+		Survey:   survey,
+		Question: next,
 	}
-	serveTemplate(w, data, "layout", "navbar", "login", "register", "survey", "footer")
+	s.serveTemplate(w, "survey", data)
 }
 
 // POST /api/recordUserResponse
-// recordUserResponse updates the user's survey responses and writes true.
-// If the response was successfully recorded, false otherwise.
-func recordUserResponse(w http.ResponseWriter, r *http.Request) {
-	cUser, _ := r.Cookie("session-id")
-	response := r.FormValue("response")
-	username := cUser.Value
-	if ok := updateUserResponses(w, r, username, response); !ok {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte("false"))
+// recordUserResponse records the response values as the user's answer to the
+// question with id question of the survey with id survey and writes true if
+// the response was successfully recorded. Responses are choice ids for choice
+// questions, repeated for multi-select questions, a number for likert and
+// number questions and the text for text questions. Failures are reported
+// with a json error body: 401 Unauthorized without a session, 400 Bad Request
+// for malformed requests and responses that do not fit the question, 404 Not
+// Found for unknown or unpublished surveys, attempts and questions, and 409
+// Conflict for answers that are out of order, duplicated or past the end of
+// the survey.
+func (s *server) recordUserResponse(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
 		return
 	}
-	w.Write([]byte("true"))
+	session := s.getSession(r)
+	if !session.LoggedIn {
+		writeError(w, http.StatusUnauthorized, "not logged in")
+		return
+	}
+	surveyId := r.FormValue("survey")
+	if surveyId == "" {
+		writeError(w, http.StatusBadRequest, "missing survey")
+		return
+	}
+	question, err := strconv.ParseInt(r.FormValue("question"), 10, 64)
+	if err != nil || question <= 0 {
+		writeError(w, http.StatusBadRequest, "invalid question")
+		return
+	}
+	err = s.updateUserResponses(s.newContext(r), session.Id, surveyId, question, r.Form["response"])
+	if _, ok := err.(invalidAnswerError); ok {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	switch err {
+	case nil:
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte("true"))
+	case errNotFound, errNotPublished:
+		writeError(w, http.StatusNotFound, "survey not found")
+	case errAttemptNotFound, errQuestionNotFound:
+		writeError(w, http.StatusNotFound, err.Error())
+	case errSurveyComplete, errOutOfOrder:
+		writeError(w, http.StatusConflict, err.Error())
+	default:
+		log.Print("recording response failed: ", err)
+		writeError(w, http.StatusInternalServerError, "internal error")
+	}
 }
 
-// POST /api/aggregateResponses
-// aggregateResponses retrieves the distribution of responses to each
-// survey question in json format.
-func aggregateResponses(w http.ResponseWriter, r *http.Request) {
-	ctx := appengine.NewContext(r)
-	u := datastore.NewQuery("User")
-	var users []User
-	_, err := u.GetAll(ctx, &users)
+// loadAggregateRequest loads the survey version and the cohort filter of a
+// request by session aggregating the answers to the survey with id surveyId:
+// the version given by the version parameter or the published one, and the
+// filters read by parseCohortFilter. Only logged in users can aggregate
+// answers, and only admins can aggregate unpublished surveys and versions
+// that were never published. Invalid requests fail with a requestError.
+func (s *server) loadAggregateRequest(ctx context.Context, r *http.Request, session Session, surveyId string) (*Survey, cohortFilter, error) {
+	if !session.LoggedIn {
+		return nil, cohortFilter{}, requestError{http.StatusUnauthorized, "not logged in"}
+	}
+	if surveyId == "" {
+		return nil, cohortFilter{}, requestError{http.StatusBadRequest, "missing survey"}
+	}
+	admin := session.Role == roleAdmin
+	survey, err := s.getSurvey(ctx, surveyId)
+	if err == errNotFound || err == nil && !survey.Published && !admin {
+		return nil, cohortFilter{}, requestError{http.StatusNotFound, "survey not found"}
+	}
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, cohortFilter{}, err
+	}
+	published := survey.PublishedVersion
+	version := published
+	if v := r.FormValue("version"); v != "" {
+		version, err = strconv.Atoi(v)
+		if err != nil || version < 1 {
+			return nil, cohortFilter{}, requestError{http.StatusBadRequest, "invalid version"}
+		}
+	}
+	survey, err = s.loadSurveyVersion(ctx, surveyId, version)
+	if err == errNotFound || err == nil && version != published && !survey.Frozen && !admin {
+		return nil, cohortFilter{}, requestError{http.StatusNotFound, "survey not found"}
+	}
+	if err != nil {
+		return nil, cohortFilter{}, err
+	}
+	filter, err := parseCohortFilter(r, survey)
+	if err != nil {
+		return nil, cohortFilter{}, requestError{http.StatusBadRequest, err.Error()}
+	}
+	return survey, filter, nil
+}
+
+// parseAggregateRequest reads the survey version and the cohort filter of a
+// request by the logged in user aggregating the answers to the survey with id
+// survey, see loadAggregateRequest. Invalid requests are answered with an
+// error and ok is false. action names the request in logs.
+func (s *server) parseAggregateRequest(w http.ResponseWriter, r *http.Request, action string) (ctx context.Context, session Session, survey *Survey, filter cohortFilter, ok bool) {
+	ctx = s.newContext(r)
+	session = s.getSession(r)
+	survey, filter, err := s.loadAggregateRequest(ctx, r, session, r.FormValue("survey"))
+	if e, isRequestError := err.(requestError); isRequestError {
+		writeError(w, e.status, e.message)
+		return
+	}
+	if err != nil {
+		log.Print(action, " failed: ", err)
+		writeError(w, http.StatusInternalServerError, "internal error")
 		return
 	}
-	var responses []int
-	allResponses := [MAX_QUESTIONS][MAX_ANSWERS]int{}
-	for i := 0; i < len(users); i++ {
-		responses = users[i].Responses
-		for j := 0; j < MAX_QUESTIONS; j++ {
-			allResponses[j][responses[j]]++
+	return ctx, session, survey, filter, true
+}
+
+// aggregate returns the aggregate of the answers to each question of survey,
+// a loaded survey version, by the cohort selected by filter, as seen by
+// session. Counts are read from the answer counters maintained as answers
+// are recorded, see countedAggregates, unless filter selects respondents.
+// Text answers are only listed for admins, since they may identify their
+// authors.
+func (s *server) aggregate(ctx context.Context, session Session, survey *Survey, filter cohortFilter) ([]QuestionAggregate, error) {
+	var aggregates []QuestionAggregate
+	var err error
+	if filter.empty() {
+		aggregates, err = s.countedAggregates(ctx, survey)
+	} else {
+		aggregates, err = s.filteredAggregates(ctx, survey, filter)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if session.Role != roleAdmin {
+		for i := range aggregates {
+			aggregates[i].Texts = nil
 		}
 	}
+	return aggregates, nil
+}
+
+// POST /api/aggregateResponses
+// aggregateResponses retrieves the distribution of responses to each
+// question of a version of the survey with id survey, along with the
+// question text and labels of that version, in json format. Choice answers
+// are counted per choice, likert answers per scale point and number answers
+// per histogram bin, while text answers are listed. The version defaults to
+// the published one. Counts are read from the answer counters maintained as
+// answers are recorded, see countedAggregates, unless the request filters the
+// respondents by the parameters read by parseCohortFilter. Filters matching
+// too few respondents are rejected with 422. Users need to be logged in, and
+// only admins get the text answers or unpublished versions, see
+// loadAggregateRequest.
+func (s *server) aggregateResponses(w http.ResponseWriter, r *http.Request) {
+	ctx, session, survey, filter, ok := s.parseAggregateRequest(w, r, "aggregating responses")
+	if !ok {
+		return
+	}
+	allResponses, err := s.aggregate(ctx, session, survey, filter)
+	if err == errCohortTooSmall {
+		writeError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	if err != nil {
+		log.Print("aggregating responses failed: ", err)
+		writeError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(allResponses)
 }
@@ -0,0 +1,649 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// versionId identifies a version of a survey.
+type versionId struct {
+	surveyId string
+	version  int
+}
+
+// memoryData holds the entities of a memoryStore.
+type memoryData struct {
+	users     map[string]User
+	usernames map[string]string
+	sessions  map[string]SessionRecord
+	resets    map[string]PasswordReset
+	throttles map[string]LoginThrottle
+	audit     []AuditEntry
+	surveys   map[string]Survey
+	versions  map[versionId]SurveyVersion
+	questions map[versionId][]Question
+	attempts  map[string][]Attempt
+	counters  map[versionId]map[counterKey]int
+	lastId    int64
+}
+
+// memoryStore is a Store keeping its entities in memory, for tests and local
+// development. Transactions hold a lock for their whole duration and are
+// rolled back by undoing their changes, journaled before each write.
+type memoryStore struct {
+	mu   sync.Mutex
+	data *memoryData
+	// undo holds the functions undoing the changes of the running
+	// transaction, in the order they were made.
+	undo []func()
+}
+
+// newMemoryStore returns an empty memoryStore.
+func newMemoryStore() *memoryStore {
+	return &memoryStore{data: &memoryData{
+		users:     make(map[string]User),
+		usernames: make(map[string]string),
+		sessions:  make(map[string]SessionRecord),
+		resets:    make(map[string]PasswordReset),
+		throttles: make(map[string]LoginThrottle),
+		surveys:   make(map[string]Survey),
+		versions:  make(map[versionId]SurveyVersion),
+		questions: make(map[versionId][]Question),
+		attempts:  make(map[string][]Attempt),
+		counters:  make(map[versionId]map[counterKey]int),
+	}}
+}
+
+// copyQuestions returns a deep copy of questions.
+func copyQuestions(questions []Question) []Question {
+	copied := make([]Question, len(questions))
+	for i, question := range questions {
+		question.Rules = append([]Rule(nil), question.Rules...)
+		question.Choices = append([]Choice(nil), question.Choices...)
+		copied[i] = question
+	}
+	return copied
+}
+
+// copyAttempts returns a deep copy of attempts.
+func copyAttempts(attempts []Attempt) []Attempt {
+	copied := make([]Attempt, len(attempts))
+	for i, attempt := range attempts {
+		answers := make([]Answer, len(attempt.Answers))
+		for j, answer := range attempt.Answers {
+			answer.ChoiceIds = append([]int64(nil), answer.ChoiceIds...)
+			answers[j] = answer
+		}
+		attempt.Answers = answers
+		copied[i] = attempt
+	}
+	return copied
+}
+
+// copyUser returns a deep copy of user.
+func copyUser(user User) User {
+	user.Responses = append([]int(nil), user.Responses...)
+	return user
+}
+
+// copyCounts returns a copy of counts.
+func copyCounts(counts map[counterKey]int) map[counterKey]int {
+	copied := make(map[counterKey]int, len(counts))
+	for k, v := range counts {
+		copied[k] = v
+	}
+	return copied
+}
+
+// The restore methods return a function restoring an entity, or a group of
+// entities stored together, to its current value, so a failed transaction
+// only restores what it changed.
+
+func (d *memoryData) restoreUser(userId string) func() {
+	old, ok := d.users[userId]
+	return func() {
+		if ok {
+			d.users[userId] = old
+		} else {
+			delete(d.users, userId)
+		}
+	}
+}
+
+func (d *memoryData) restoreUsername(name string) func() {
+	old, ok := d.usernames[name]
+	return func() {
+		if ok {
+			d.usernames[name] = old
+		} else {
+			delete(d.usernames, name)
+		}
+	}
+}
+
+func (d *memoryData) restoreSession(sessionId string) func() {
+	old, ok := d.sessions[sessionId]
+	return func() {
+		if ok {
+			d.sessions[sessionId] = old
+		} else {
+			delete(d.sessions, sessionId)
+		}
+	}
+}
+
+func (d *memoryData) restoreReset(resetId string) func() {
+	old, ok := d.resets[resetId]
+	return func() {
+		if ok {
+			d.resets[resetId] = old
+		} else {
+			delete(d.resets, resetId)
+		}
+	}
+}
+
+func (d *memoryData) restoreThrottle(key string) func() {
+	old, ok := d.throttles[key]
+	return func() {
+		if ok {
+			d.throttles[key] = old
+		} else {
+			delete(d.throttles, key)
+		}
+	}
+}
+
+func (d *memoryData) restoreSurvey(surveyId string) func() {
+	old, ok := d.surveys[surveyId]
+	return func() {
+		if ok {
+			d.surveys[surveyId] = old
+		} else {
+			delete(d.surveys, surveyId)
+		}
+	}
+}
+
+func (d *memoryData) restoreVersion(id versionId) func() {
+	old, ok := d.versions[id]
+	return func() {
+		if ok {
+			d.versions[id] = old
+		} else {
+			delete(d.versions, id)
+		}
+	}
+}
+
+func (d *memoryData) restoreQuestions(id versionId) func() {
+	old, ok := d.questions[id]
+	return func() {
+		if ok {
+			d.questions[id] = old
+		} else {
+			delete(d.questions, id)
+		}
+	}
+}
+
+// restoreAttempts copies the attempts of the user, which are changed in
+// place.
+func (d *memoryData) restoreAttempts(userId string) func() {
+	old, ok := d.attempts[userId]
+	old = copyAttempts(old)
+	return func() {
+		if ok {
+			d.attempts[userId] = old
+		} else {
+			delete(d.attempts, userId)
+		}
+	}
+}
+
+// restoreCounts copies the counters of the version, which are changed in
+// place.
+func (d *memoryData) restoreCounts(id versionId) func() {
+	old, ok := d.counters[id]
+	old = copyCounts(old)
+	return func() {
+		if ok {
+			d.counters[id] = old
+		} else {
+			delete(d.counters, id)
+		}
+	}
+}
+
+// allocateId returns a new id for questions, choices and attempts.
+func (d *memoryData) allocateId() int64 {
+	d.lastId++
+	return d.lastId
+}
+
+// lock locks the store unless ctx runs in a transaction, which holds the
+// lock already, and returns the function unlocking it.
+func (m *memoryStore) lock(ctx context.Context) func() {
+	if inTransaction(ctx) {
+		return func() {}
+	}
+	m.mu.Lock()
+	return m.mu.Unlock
+}
+
+// journal records restore, undoing a change about to be made, if ctx runs in
+// a transaction.
+func (m *memoryStore) journal(ctx context.Context, restore func()) {
+	if inTransaction(ctx) {
+		m.undo = append(m.undo, restore)
+	}
+}
+
+// RunInTransaction runs f holding the store lock, so transactions never
+// conflict, and undoes the changes of f if it fails. Calls made within f join
+// the transaction.
+func (m *memoryStore) RunInTransaction(ctx context.Context, f func(ctx context.Context) error) error {
+	if inTransaction(ctx) {
+		return f(ctx)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	lastId, audit := m.data.lastId, len(m.data.audit)
+	m.undo = nil
+	err := f(context.WithValue(ctx, txKey{}, true))
+	if err != nil {
+		for i := len(m.undo) - 1; i >= 0; i-- {
+			m.undo[i]()
+		}
+		// audit entries are only appended
+		m.data.lastId, m.data.audit = lastId, m.data.audit[:audit]
+	}
+	m.undo = nil
+	return err
+}
+
+func (m *memoryStore) GetUser(ctx context.Context, userId string) (User, error) {
+	defer m.lock(ctx)()
+	user, ok := m.data.users[userId]
+	if !ok {
+		return User{}, errNotFound
+	}
+	return copyUser(user), nil
+}
+
+func (m *memoryStore) PutUser(ctx context.Context, user User) error {
+	defer m.lock(ctx)()
+	m.journal(ctx, m.data.restoreUser(user.Id))
+	m.data.users[user.Id] = copyUser(user)
+	return nil
+}
+
+func (m *memoryStore) ListUsers(ctx context.Context) ([]User, error) {
+	defer m.lock(ctx)()
+	var users []User
+	for _, user := range m.data.users {
+		users = append(users, copyUser(user))
+	}
+	return users, nil
+}
+
+func (m *memoryStore) LegacyUsers(ctx context.Context) ([]User, error) {
+	defer m.lock(ctx)()
+	var users []User
+	for _, user := range m.data.users {
+		if user.SurveyComplete {
+			users = append(users, copyUser(user))
+		}
+	}
+	return users, nil
+}
+
+func (m *memoryStore) GetUsername(ctx context.Context, name string) (string, error) {
+	defer m.lock(ctx)()
+	userId, ok := m.data.usernames[name]
+	if !ok {
+		return "", errNotFound
+	}
+	return userId, nil
+}
+
+func (m *memoryStore) PutUsername(ctx context.Context, name string, userId string) error {
+	defer m.lock(ctx)()
+	m.journal(ctx, m.data.restoreUsername(name))
+	m.data.usernames[name] = userId
+	return nil
+}
+
+func (m *memoryStore) GetSession(ctx context.Context, userId string, sessionId string) (SessionRecord, error) {
+	defer m.lock(ctx)()
+	session, ok := m.data.sessions[sessionId]
+	if !ok || session.UserId != userId {
+		return SessionRecord{}, errNotFound
+	}
+	return session, nil
+}
+
+func (m *memoryStore) PutSession(ctx context.Context, sessionId string, session SessionRecord) error {
+	defer m.lock(ctx)()
+	m.journal(ctx, m.data.restoreSession(sessionId))
+	m.data.sessions[sessionId] = session
+	return nil
+}
+
+func (m *memoryStore) DeleteSession(ctx context.Context, userId string, sessionId string) error {
+	defer m.lock(ctx)()
+	if m.data.sessions[sessionId].UserId != userId {
+		return nil
+	}
+	m.journal(ctx, m.data.restoreSession(sessionId))
+	delete(m.data.sessions, sessionId)
+	return nil
+}
+
+func (m *memoryStore) DeleteUserSessions(ctx context.Context, userId string) error {
+	defer m.lock(ctx)()
+	for id, session := range m.data.sessions {
+		if session.UserId == userId {
+			m.journal(ctx, m.data.restoreSession(id))
+			delete(m.data.sessions, id)
+		}
+	}
+	return nil
+}
+
+func (m *memoryStore) GetPasswordReset(ctx context.Context, userId string, resetId string) (PasswordReset, error) {
+	defer m.lock(ctx)()
+	reset, ok := m.data.resets[resetId]
+	if !ok || reset.UserId != userId {
+		return PasswordReset{}, errNotFound
+	}
+	return reset, nil
+}
+
+func (m *memoryStore) PutPasswordReset(ctx context.Context, resetId string, reset PasswordReset) error {
+	defer m.lock(ctx)()
+	m.journal(ctx, m.data.restoreReset(resetId))
+	m.data.resets[resetId] = reset
+	return nil
+}
+
+func (m *memoryStore) DeletePasswordReset(ctx context.Context, userId string, resetId string) error {
+	defer m.lock(ctx)()
+	if m.data.resets[resetId].UserId != userId {
+		return nil
+	}
+	m.journal(ctx, m.data.restoreReset(resetId))
+	delete(m.data.resets, resetId)
+	return nil
+}
+
+func (m *memoryStore) DeleteUserPasswordResets(ctx context.Context, userId string) error {
+	defer m.lock(ctx)()
+	for id, reset := range m.data.resets {
+		if reset.UserId == userId {
+			m.journal(ctx, m.data.restoreReset(id))
+			delete(m.data.resets, id)
+		}
+	}
+	return nil
+}
+
+func (m *memoryStore) GetLoginThrottle(ctx context.Context, key string) (LoginThrottle, error) {
+	defer m.lock(ctx)()
+	throttle, ok := m.data.throttles[key]
+	if !ok {
+		return LoginThrottle{}, errNotFound
+	}
+	return throttle, nil
+}
+
+func (m *memoryStore) PutLoginThrottle(ctx context.Context, key string, throttle LoginThrottle) error {
+	defer m.lock(ctx)()
+	m.journal(ctx, m.data.restoreThrottle(key))
+	m.data.throttles[key] = throttle
+	return nil
+}
+
+func (m *memoryStore) DeleteLoginThrottle(ctx context.Context, key string) error {
+	defer m.lock(ctx)()
+	m.journal(ctx, m.data.restoreThrottle(key))
+	delete(m.data.throttles, key)
+	return nil
+}
+
+func (m *memoryStore) PutAuditEntry(ctx context.Context, entry AuditEntry) error {
+	defer m.lock(ctx)()
+	m.data.audit = append(m.data.audit, entry)
+	return nil
+}
+
+func (m *memoryStore) ListAuditEntries(ctx context.Context, limit int) ([]AuditEntry, error) {
+	defer m.lock(ctx)()
+	var entries []AuditEntry
+	for i := len(m.data.audit) - 1; i >= 0 && len(entries) < limit; i-- {
+		entries = append(entries, m.data.audit[i])
+	}
+	return entries, nil
+}
+
+func (m *memoryStore) ListSurveys(ctx context.Context) ([]Survey, error) {
+	defer m.lock(ctx)()
+	var surveys []Survey
+	for _, survey := range m.data.surveys {
+		surveys = append(surveys, survey)
+	}
+	return surveys, nil
+}
+
+func (m *memoryStore) GetSurvey(ctx context.Context, surveyId string) (Survey, error) {
+	defer m.lock(ctx)()
+	survey, ok := m.data.surveys[surveyId]
+	if !ok {
+		return Survey{}, errNotFound
+	}
+	return survey, nil
+}
+
+func (m *memoryStore) PutSurvey(ctx context.Context, survey Survey) error {
+	defer m.lock(ctx)()
+	m.journal(ctx, m.data.restoreSurvey(survey.Id))
+	survey.Version = 0
+	survey.Frozen = false
+	survey.Questions = nil
+	m.data.surveys[survey.Id] = survey
+	return nil
+}
+
+func (m *memoryStore) GetSurveyVersion(ctx context.Context, surveyId string, version int) (SurveyVersion, error) {
+	defer m.lock(ctx)()
+	surveyVersion, ok := m.data.versions[versionId{surveyId, version}]
+	if !ok {
+		return SurveyVersion{}, errNotFound
+	}
+	return surveyVersion, nil
+}
+
+func (m *memoryStore) PutSurveyVersion(ctx context.Context, surveyId string, version int, surveyVersion SurveyVersion) error {
+	defer m.lock(ctx)()
+	m.journal(ctx, m.data.restoreVersion(versionId{surveyId, version}))
+	m.data.versions[versionId{surveyId, version}] = surveyVersion
+	return nil
+}
+
+func (m *memoryStore) GetQuestions(ctx context.Context, surveyId string, version int) ([]Question, error) {
+	defer m.lock(ctx)()
+	return copyQuestions(m.data.questions[versionId{surveyId, version}]), nil
+}
+
+func (m *memoryStore) PutQuestions(ctx context.Context, surveyId string, version int, questions []Question) error {
+	defer m.lock(ctx)()
+	m.journal(ctx, m.data.restoreQuestions(versionId{surveyId, version}))
+	questions = copyQuestions(questions)
+	for i := range questions {
+		if questions[i].Id == 0 {
+			questions[i].Id = m.data.allocateId()
+		}
+		for j := range questions[i].Choices {
+			if questions[i].Choices[j].Id == 0 {
+				questions[i].Choices[j].Id = m.data.allocateId()
+			}
+		}
+	}
+	m.data.questions[versionId{surveyId, version}] = questions
+	return nil
+}
+
+func (m *memoryStore) ListAttempts(ctx context.Context, userId string, surveyId string) ([]Attempt, error) {
+	defer m.lock(ctx)()
+	var attempts []Attempt
+	for _, attempt := range m.data.attempts[userId] {
+		if attempt.SurveyId == surveyId {
+			attempts = append(attempts, attempt)
+		}
+	}
+	return copyAttempts(attempts), nil
+}
+
+func (m *memoryStore) PutAttempt(ctx context.Context, userId string, attempt Attempt) (int64, error) {
+	defer m.lock(ctx)()
+	m.journal(ctx, m.data.restoreAttempts(userId))
+	attempts := m.data.attempts[userId]
+	for i := range attempts {
+		if attempts[i].Id == attempt.Id {
+			attempt.Answers = attempts[i].Answers
+			attempts[i] = attempt
+			return attempt.Id, nil
+		}
+	}
+	if attempt.Id == 0 {
+		attempt.Id = m.data.allocateId()
+	}
+	attempt.Answers = nil
+	m.data.attempts[userId] = append(attempts, attempt)
+	return attempt.Id, nil
+}
+
+func (m *memoryStore) PutAnswer(ctx context.Context, userId string, attemptId int64, answer Answer) error {
+	defer m.lock(ctx)()
+	m.journal(ctx, m.data.restoreAttempts(userId))
+	attempts := m.data.attempts[userId]
+	for i := range attempts {
+		if attempts[i].Id != attemptId {
+			continue
+		}
+		answer.ChoiceIds = append([]int64(nil), answer.ChoiceIds...)
+		for j := range attempts[i].Answers {
+			if attempts[i].Answers[j].QuestionId == answer.QuestionId {
+				attempts[i].Answers[j] = answer
+				return nil
+			}
+		}
+		attempts[i].Answers = append(attempts[i].Answers, answer)
+		return nil
+	}
+	return errNotFound
+}
+
+func (m *memoryStore) ListSurveyAttempts(ctx context.Context, surveyId string, version int) ([]Attempt, error) {
+	defer m.lock(ctx)()
+	var attempts []Attempt
+	for userId, userAttempts := range m.data.attempts {
+		for _, attempt := range copyAttempts(userAttempts) {
+			if attempt.SurveyId == surveyId && attempt.Version == version {
+				attempt.UserId = userId
+				attempts = append(attempts, attempt)
+			}
+		}
+	}
+	return attempts, nil
+}
+
+// ScanAnswers copies the answers before calling f, so f runs without
+// holding the store lock.
+func (m *memoryStore) ScanAnswers(ctx context.Context, surveyId string, f func(userId string, attemptId int64, answer Answer) error) error {
+	type scanned struct {
+		userId    string
+		attemptId int64
+		answer    Answer
+	}
+	var answers []scanned
+	unlock := m.lock(ctx)
+	for userId, attempts := range m.data.attempts {
+		for _, attempt := range copyAttempts(attempts) {
+			for _, answer := range attempt.Answers {
+				if answer.SurveyId == surveyId {
+					answers = append(answers, scanned{userId, attempt.Id, answer})
+				}
+			}
+		}
+	}
+	unlock()
+	for _, a := range answers {
+		if err := f(a.userId, a.attemptId, a.answer); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *memoryStore) ListAnswers(ctx context.Context, surveyId string, version int) ([]Answer, error) {
+	defer m.lock(ctx)()
+	var answers []Answer
+	for _, attempts := range m.data.attempts {
+		for _, attempt := range copyAttempts(attempts) {
+			for _, answer := range attempt.Answers {
+				if answer.SurveyId == surveyId && answer.Version == version {
+					answers = append(answers, answer)
+				}
+			}
+		}
+	}
+	return answers, nil
+}
+
+func (m *memoryStore) ListTexts(ctx context.Context, surveyId string, version int, questionId int64, limit int) ([]string, error) {
+	defer m.lock(ctx)()
+	var texts []string
+	for _, attempts := range m.data.attempts {
+		for _, attempt := range attempts {
+			for _, answer := range attempt.Answers {
+				if len(texts) == limit {
+					return texts, nil
+				}
+				if answer.SurveyId == surveyId && answer.Version == version && answer.QuestionId == questionId && answer.Text != "" {
+					texts = append(texts, answer.Text)
+				}
+			}
+		}
+	}
+	return texts, nil
+}
+
+// AddCounts adds deltas to the counters. The memory store is locked for
+// every write, so counters are not sharded.
+func (m *memoryStore) AddCounts(ctx context.Context, surveyId string, version int, deltas map[counterKey]int) error {
+	defer m.lock(ctx)()
+	id := versionId{surveyId, version}
+	m.journal(ctx, m.data.restoreCounts(id))
+	counts := m.data.counters[id]
+	if counts == nil {
+		counts = make(map[counterKey]int)
+		m.data.counters[id] = counts
+	}
+	for k, delta := range deltas {
+		counts[k] += delta
+	}
+	return nil
+}
+
+func (m *memoryStore) GetCounts(ctx context.Context, surveyId string, version int) (map[counterKey]int, error) {
+	defer m.lock(ctx)()
+	return copyCounts(m.data.counters[versionId{surveyId, version}]), nil
+}
+
+func (m *memoryStore) PutCounts(ctx context.Context, surveyId string, version int, counts map[counterKey]int) error {
+	defer m.lock(ctx)()
+	m.journal(ctx, m.data.restoreCounts(versionId{surveyId, version}))
+	m.data.counters[versionId{surveyId, version}] = copyCounts(counts)
+	return nil
+}
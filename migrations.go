@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// migrations are the versioned changes to the SQL schema, applied in order by
+// migrate. Version n is migrations[n-1]. Released migrations must never be
+// edited, only followed by new ones. {{serial}} stands for the
+// auto-incrementing primary key type of the dialect.
+var migrations = []string{
+	// 1: initial schema
+	`
+CREATE TABLE users (
+	id       TEXT PRIMARY KEY,
+	password TEXT NOT NULL,
+	role     TEXT NOT NULL
+);
+
+CREATE TABLE sessions (
+	id      TEXT PRIMARY KEY,
+	user_id TEXT NOT NULL,
+	created TIMESTAMP NOT NULL,
+	expires TIMESTAMP NOT NULL
+);
+
+CREATE TABLE surveys (
+	id                TEXT PRIMARY KEY,
+	title             TEXT NOT NULL,
+	published         BOOLEAN NOT NULL,
+	published_version INTEGER NOT NULL,
+	latest_version    INTEGER NOT NULL
+);
+
+CREATE TABLE survey_versions (
+	survey_id TEXT NOT NULL REFERENCES surveys (id) ON DELETE CASCADE,
+	version   INTEGER NOT NULL,
+	created   TIMESTAMP NOT NULL,
+	frozen    BOOLEAN NOT NULL,
+	PRIMARY KEY (survey_id, version)
+);
+
+CREATE TABLE questions (
+	survey_id TEXT NOT NULL,
+	version   INTEGER NOT NULL,
+	id        BIGINT NOT NULL,
+	position  INTEGER NOT NULL,
+	text      TEXT NOT NULL,
+	type      TEXT NOT NULL,
+	min_value DOUBLE PRECISION NOT NULL,
+	max_value DOUBLE PRECISION NOT NULL,
+	min_label TEXT NOT NULL,
+	max_label TEXT NOT NULL,
+	rules     TEXT NOT NULL,
+	PRIMARY KEY (survey_id, version, id),
+	FOREIGN KEY (survey_id, version) REFERENCES survey_versions (survey_id, version) ON DELETE CASCADE
+);
+
+CREATE TABLE choices (
+	survey_id   TEXT NOT NULL,
+	version     INTEGER NOT NULL,
+	question_id BIGINT NOT NULL,
+	id          BIGINT NOT NULL,
+	position    INTEGER NOT NULL,
+	label       TEXT NOT NULL,
+	PRIMARY KEY (survey_id, version, question_id, id),
+	FOREIGN KEY (survey_id, version, question_id) REFERENCES questions (survey_id, version, id) ON DELETE CASCADE
+);
+
+CREATE TABLE attempts (
+	id        {{serial}},
+	user_id   TEXT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+	survey_id TEXT NOT NULL,
+	version   INTEGER NOT NULL,
+	started   TIMESTAMP NOT NULL,
+	finished  TIMESTAMP NOT NULL,
+	complete  BOOLEAN NOT NULL
+);
+
+CREATE INDEX attempts_user_survey ON attempts (user_id, survey_id);
+
+CREATE TABLE responses (
+	attempt_id  BIGINT NOT NULL REFERENCES attempts (id) ON DELETE CASCADE,
+	question_id BIGINT NOT NULL,
+	survey_id   TEXT NOT NULL,
+	version     INTEGER NOT NULL,
+	choice_id   BIGINT NOT NULL,
+	number      DOUBLE PRECISION NOT NULL,
+	text        TEXT NOT NULL,
+	answered    TIMESTAMP NOT NULL,
+	PRIMARY KEY (attempt_id, question_id)
+);
+
+CREATE INDEX responses_survey_version ON responses (survey_id, version);
+
+CREATE TABLE response_choices (
+	attempt_id  BIGINT NOT NULL,
+	question_id BIGINT NOT NULL,
+	position    INTEGER NOT NULL,
+	choice_id   BIGINT NOT NULL,
+	PRIMARY KEY (attempt_id, question_id, position),
+	FOREIGN KEY (attempt_id, question_id) REFERENCES responses (attempt_id, question_id) ON DELETE CASCADE
+);
+`,
+	// 2: sharded answer counters
+	`
+ALTER TABLE survey_versions ADD COLUMN counted BOOLEAN NOT NULL DEFAULT FALSE;
+
+CREATE TABLE counters (
+	survey_id   TEXT NOT NULL,
+	version     INTEGER NOT NULL,
+	question_id BIGINT NOT NULL,
+	bucket      INTEGER NOT NULL,
+	shard       INTEGER NOT NULL,
+	count       BIGINT NOT NULL,
+	PRIMARY KEY (survey_id, version, question_id, bucket, shard)
+);
+`,
+	// 3: user signup dates and cohort attributes
+	`
+ALTER TABLE users ADD COLUMN created TIMESTAMP NOT NULL DEFAULT '0001-01-01 00:00:00';
+ALTER TABLE users ADD COLUMN age_band TEXT NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN program TEXT NOT NULL DEFAULT '';
+
+CREATE INDEX attempts_survey_version ON attempts (survey_id, version);
+`,
+	// 4: email addresses and password resets
+	`
+ALTER TABLE users ADD COLUMN email TEXT NOT NULL DEFAULT '';
+
+CREATE INDEX sessions_user ON sessions (user_id);
+
+CREATE TABLE password_resets (
+	id      TEXT PRIMARY KEY,
+	user_id TEXT NOT NULL,
+	created TIMESTAMP NOT NULL,
+	expires TIMESTAMP NOT NULL
+);
+`,
+	// 5: usernames reserved by their canonical form
+	`
+CREATE TABLE usernames (
+	name    TEXT PRIMARY KEY,
+	user_id TEXT NOT NULL
+);
+`,
+	// 6: login throttles and the audit log
+	`
+CREATE TABLE login_throttles (
+	id           TEXT PRIMARY KEY,
+	failures     INTEGER NOT NULL,
+	last_failure TIMESTAMP NOT NULL,
+	locked_until TIMESTAMP NOT NULL
+);
+
+CREATE TABLE audit_log (
+	id      {{serial}},
+	time    TIMESTAMP NOT NULL,
+	event   TEXT NOT NULL,
+	subject TEXT NOT NULL,
+	client  TEXT NOT NULL,
+	detail  TEXT NOT NULL
+);
+
+CREATE INDEX audit_log_time ON audit_log (time);
+`,
+	// 7: logins in flight reserved against login throttles
+	`
+ALTER TABLE login_throttles ADD COLUMN pending INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE login_throttles ADD COLUMN last_attempt TIMESTAMP NOT NULL DEFAULT '0001-01-01 00:00:00';
+`,
+	// 8: password resets by user
+	`
+CREATE INDEX password_resets_user ON password_resets (user_id);
+`,
+}
+
+// migrate brings the schema of the database up to date by applying the
+// migrations it has not applied yet, each in its own transaction. Applied
+// versions are recorded in the schema_migrations table.
+func (s *sqlStore) migrate(ctx context.Context) error {
+	_, err := s.db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+	version INTEGER PRIMARY KEY,
+	applied TIMESTAMP NOT NULL
+)`)
+	if err != nil {
+		return err
+	}
+	current, err := s.schemaVersion(ctx)
+	if err != nil {
+		return err
+	}
+	if current > len(migrations) {
+		return fmt.Errorf("database schema version %d is newer than this build, which knows %d", current, len(migrations))
+	}
+	for version := current + 1; version <= len(migrations); version++ {
+		err = s.RunInTransaction(ctx, func(ctx context.Context) error {
+			ddl := strings.Replace(migrations[version-1], "{{serial}}", s.dialect.serial, -1)
+			if _, err := s.conn(ctx).ExecContext(ctx, ddl); err != nil {
+				return err
+			}
+			_, err := s.exec(ctx, "INSERT INTO schema_migrations (version, applied) VALUES (?, ?)", version, time.Now().UTC())
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("applying migration %d: %v", version, err)
+		}
+	}
+	return nil
+}
+
+// schemaVersion returns the latest migration applied to the database.
+func (s *sqlStore) schemaVersion(ctx context.Context) (int, error) {
+	var version int
+	err := s.queryRow(ctx, "SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&version)
+	return version, err
+}
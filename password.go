@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// resetLifetime is how long a password reset link can be used.
+const resetLifetime = time.Hour
+
+var (
+	errInvalidReset     = errors.New("this reset link is invalid or has expired")
+	errPasswordMismatch = errors.New("the passwords do not match")
+	errInvalidEmail     = errors.New("invalid email address")
+)
+
+// parseEmail returns address, trimmed, if it is empty or a plain email
+// address, and errInvalidEmail otherwise.
+func parseEmail(address string) (string, error) {
+	address = strings.TrimSpace(address)
+	if address == "" {
+		return "", nil
+	}
+	parsed, err := mail.ParseAddress(address)
+	if err != nil || parsed.Address != address {
+		return "", errInvalidEmail
+	}
+	return address, nil
+}
+
+// checkNewPassword returns an error to show the user with id username if
+// password, a new password, is too weak, see checkPassword, or does not match
+// confirm, its confirmation.
+func (s *server) checkNewPassword(username string, password string, confirm string) error {
+	if err := s.checkPassword(username, password); err != nil {
+		return err
+	}
+	if password != confirm {
+		return errPasswordMismatch
+	}
+	return nil
+}
+
+// putPassword replaces the password hash of the user with id userId with
+// hash.
+func (s *server) putPassword(ctx context.Context, userId string, hash []byte) error {
+	return s.store.RunInTransaction(ctx, func(ctx context.Context) error {
+		user, err := s.store.GetUser(ctx, userId)
+		if err != nil {
+			return err
+		}
+		user.Password = string(hash)
+		return s.store.PutUser(ctx, user)
+	})
+}
+
+// setPassword replaces the password of the user with id userId with the
+// bcrypt hash of password and revokes every session of the user.
+func (s *server) setPassword(ctx context.Context, userId string, password string) error {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	return s.store.RunInTransaction(ctx, func(ctx context.Context) error {
+		if err := s.putPassword(ctx, userId, hash); err != nil {
+			return err
+		}
+		return s.store.DeleteUserSessions(ctx, userId)
+	})
+}
+
+// GET /password/change
+// POST /password/change
+// changePassword serves the form changing the password of the logged in
+// user, and changes it once the current password is verified, throttling
+// guesses like logins, see verifyLogin. Every session
+// of the user is revoked and a new one started, so sessions started with the
+// old password end.
+func (s *server) changePassword(w http.ResponseWriter, r *http.Request) {
+	session := s.getSession(r)
+	if !session.LoggedIn {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	data := Data{Session: session, PasswordForm: "change"}
+	if r.Method != http.MethodPost {
+		s.serveTemplate(w, "password", data)
+		return
+	}
+	ctx := s.newContext(r)
+	_, err := s.verifyLogin(ctx, r, session.Id, r.FormValue("current"))
+	if err == errInvalidCredentials {
+		data.Message = "Your current password is incorrect."
+		s.serveTemplateStatus(w, http.StatusBadRequest, "password", data)
+		return
+	}
+	if e, ok := err.(loginThrottledError); ok {
+		w.Header().Set("Retry-After", strconv.Itoa(e.seconds()))
+		data.Message = "Too many incorrect passwords. Try again in " + strconv.Itoa(e.seconds()) + " seconds."
+		s.serveTemplateStatus(w, http.StatusTooManyRequests, "password", data)
+		return
+	}
+	if err == nil {
+		err = s.checkNewPassword(session.Id, r.FormValue("password"), r.FormValue("confirm"))
+		if err != nil {
+			data.Message = err.Error()
+			s.serveTemplateStatus(w, http.StatusBadRequest, "password", data)
+			return
+		}
+		err = s.setPassword(ctx, session.Id, r.FormValue("password"))
+	}
+	var token string
+	if err == nil {
+		token, _, err = s.startSession(w, r, session.Id)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// the page is served with the new session cookie
+	data.Session.CSRFToken = csrfToken(token)
+	data.Message = "Your password was changed."
+	s.serveTemplate(w, "password", data)
+}
+
+// resetLink returns the link to the password reset page for token, which
+// points to BASE_URL. Links are never built from the request, whose Host
+// header is set by the client.
+func (s *server) resetLink(token string) string {
+	return strings.TrimSuffix(s.baseURL, "/") + "/password/reset?token=" + url.QueryEscape(token)
+}
+
+// sendPasswordReset stores a password reset for user and sends the link to
+// it to the user's email address.
+func (s *server) sendPasswordReset(ctx context.Context, user User) error {
+	token, err := newUserToken(user.Id)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	reset := PasswordReset{UserId: user.Id, Created: now, Expires: now.Add(resetLifetime)}
+	if err = s.store.PutPasswordReset(ctx, sessionId(token), reset); err != nil {
+		return err
+	}
+	body := "Hello " + user.Id + ",\n\n" +
+		"Someone asked to reset the password of your Behaviorix account. To choose a new password, open\n\n" +
+		s.resetLink(token) + "\n\n" +
+		"The link can be used once within an hour. If you did not ask for it, you can ignore this message.\n"
+	return s.mailer.Send(ctx, user.Email, "Reset your Behaviorix password", body)
+}
+
+// GET /password/forgot
+// POST /password/forgot
+// forgotPassword serves the form asking for a password reset link, and sends
+// one to the email address of the user with the given username if they have
+// one, see sendPasswordReset. The response does not tell whether it was
+// sent, so usernames cannot be probed. Requests are throttled, see
+// throttleReset, and throttled ones are refused with 429 Too Many Requests
+// and a Retry-After header. Resets are unavailable unless BASE_URL is set,
+// since the links point to it.
+func (s *server) forgotPassword(w http.ResponseWriter, r *http.Request) {
+	data := Data{Session: s.getSession(r), PasswordForm: "forgot"}
+	if s.baseURL == "" {
+		data.PasswordForm = ""
+		data.Message = "Password resets are not available on this server."
+		s.serveTemplateStatus(w, http.StatusServiceUnavailable, "password", data)
+		return
+	}
+	if r.Method != http.MethodPost {
+		s.serveTemplate(w, "password", data)
+		return
+	}
+	ctx := s.newContext(r)
+	username := strings.TrimSpace(r.FormValue("username"))
+	err := s.throttleReset(ctx, r, username)
+	if e, ok := err.(loginThrottledError); ok {
+		w.Header().Set("Retry-After", strconv.Itoa(e.seconds()))
+		data.Message = "Too many password reset requests. Try again in " + strconv.Itoa(e.seconds()) + " seconds."
+		s.serveTemplateStatus(w, http.StatusTooManyRequests, "password", data)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	user, err := s.findUser(ctx, username)
+	if err == nil && user.Email != "" {
+		err = s.sendPasswordReset(ctx, user)
+	}
+	if err != nil && err != errNotFound {
+		log.Print("sending password reset failed: ", err)
+	}
+	data.PasswordForm = ""
+	data.Message = "If the account has an email address, a link to reset its password was sent to it."
+	s.serveTemplate(w, "password", data)
+}
+
+// lookupPasswordReset returns the password reset for token. Unknown and
+// expired tokens are rejected with errInvalidReset.
+func (s *server) lookupPasswordReset(ctx context.Context, token string) (PasswordReset, error) {
+	userId := tokenUser(token)
+	if userId == "" {
+		return PasswordReset{}, errInvalidReset
+	}
+	reset, err := s.store.GetPasswordReset(ctx, userId, sessionId(token))
+	if err == errNotFound || err == nil && time.Now().After(reset.Expires) {
+		return PasswordReset{}, errInvalidReset
+	}
+	return reset, err
+}
+
+// GET /password/reset?token=
+// POST /password/reset
+// resetPassword serves the form choosing a new password with the token of a
+// password reset link, and sets the password of the user the link was sent
+// to. The link is deleted as the password is set, so it works once, along
+// with the other links sent to the user and every session of the user. A new
+// session is started after.
+func (s *server) resetPassword(w http.ResponseWriter, r *http.Request) {
+	// the token is in the url, so it must not leak to other sites
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	token := r.FormValue("token")
+	data := Data{Session: s.getSession(r), PasswordForm: "reset", Token: token}
+	ctx := s.newContext(r)
+	if r.Method != http.MethodPost {
+		_, err := s.lookupPasswordReset(ctx, token)
+		if err == errInvalidReset {
+			data.PasswordForm = ""
+			data.Message = "This reset link is invalid or has expired."
+			s.serveTemplateStatus(w, http.StatusNotFound, "password", data)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		s.serveTemplate(w, "password", data)
+		return
+	}
+	// the reset is looked up again as it is used, in a transaction
+	reset, err := s.lookupPasswordReset(ctx, token)
+	if err == errInvalidReset {
+		data.PasswordForm = ""
+		data.Message = "This reset link is invalid or has expired."
+		s.serveTemplateStatus(w, http.StatusNotFound, "password", data)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	password := r.FormValue("password")
+	if err := s.checkNewPassword(reset.UserId, password, r.FormValue("confirm")); err != nil {
+		data.Message = err.Error()
+		s.serveTemplateStatus(w, http.StatusBadRequest, "password", data)
+		return
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var userId string
+	err = s.store.RunInTransaction(ctx, func(ctx context.Context) error {
+		reset, err := s.lookupPasswordReset(ctx, token)
+		if err != nil {
+			return err
+		}
+		userId = reset.UserId
+		if err = s.store.DeletePasswordReset(ctx, userId, sessionId(token)); err != nil {
+			return err
+		}
+		if err = s.putPassword(ctx, userId, hash); err != nil {
+			return err
+		}
+		if err = s.store.DeleteUserPasswordResets(ctx, userId); err != nil {
+			return err
+		}
+		return s.store.DeleteUserSessions(ctx, userId)
+	})
+	if err == errInvalidReset {
+		data.PasswordForm = ""
+		data.Message = "This reset link is invalid or has expired."
+		s.serveTemplateStatus(w, http.StatusNotFound, "password", data)
+		return
+	}
+	if err == nil {
+		_, _, err = s.startSession(w, r, userId)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/", http.StatusFound)
+}
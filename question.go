@@ -0,0 +1,329 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Question types. Questions without a type are single choice questions.
+const (
+	questionChoice = "choice"
+	questionMulti  = "multi"
+	questionLikert = "likert"
+	questionText   = "text"
+	questionNumber = "number"
+)
+
+const (
+	maxTextAnswer  = 1000
+	maxNumberBins  = 10
+	maxListedTexts = 100
+	maxScalePoints = 11
+)
+
+// endOfSurvey is the Goto of rules that end the survey.
+const endOfSurvey = 0
+
+// questionTemplates are the template files rendering each question type.
+var questionTemplates = []string{"question_choice", "question_multi", "question_likert", "question_text", "question_number"}
+
+// invalidAnswerError is returned for answers rejected by validation.
+type invalidAnswerError string
+
+func (e invalidAnswerError) Error() string {
+	return string(e)
+}
+
+// HasChoices reports whether answers to the question pick from its choices.
+func (q Question) HasChoices() bool {
+	return q.Type == questionChoice || q.Type == questionMulti
+}
+
+// Scale returns the points of a likert question's scale, or none if the
+// scale is malformed.
+func (q Question) Scale() []int {
+	if q.Max-q.Min >= maxScalePoints {
+		return nil
+	}
+	var points []int
+	for i := int(q.Min); i <= int(q.Max); i++ {
+		points = append(points, i)
+	}
+	return points
+}
+
+// parseAnswer validates the form values submitted as the answer to question
+// and returns the typed answer. Choice questions take choice ids, likert and
+// number questions a single number within the question's range, and text
+// questions a single non-empty text.
+func parseAnswer(question Question, values []string) (Answer, error) {
+	answer := Answer{QuestionId: question.Id}
+	if len(values) == 0 {
+		return answer, invalidAnswerError("missing response")
+	}
+	if question.Type != questionMulti && len(values) > 1 {
+		return answer, invalidAnswerError("question takes a single response")
+	}
+	switch question.Type {
+	case questionChoice, questionMulti:
+		seen := make(map[int64]bool)
+		for _, value := range values {
+			choiceId, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || question.Choice(choiceId) < 0 {
+				return answer, invalidAnswerError("unknown choice")
+			}
+			if seen[choiceId] {
+				return answer, invalidAnswerError("duplicate choice")
+			}
+			seen[choiceId] = true
+			answer.ChoiceIds = append(answer.ChoiceIds, choiceId)
+		}
+		if question.Type == questionChoice {
+			answer.ChoiceId = answer.ChoiceIds[0]
+			answer.ChoiceIds = nil
+		}
+	case questionLikert, questionNumber:
+		number, err := strconv.ParseFloat(strings.TrimSpace(values[0]), 64)
+		if err != nil || math.IsNaN(number) || number < question.Min || number > question.Max {
+			return answer, invalidAnswerError(fmt.Sprintf("response must be a number from %g to %g", question.Min, question.Max))
+		}
+		if question.Type == questionLikert && number != math.Trunc(number) {
+			return answer, invalidAnswerError("response must be a point on the scale")
+		}
+		answer.Number = number
+	case questionText:
+		text := strings.TrimSpace(values[0])
+		if text == "" {
+			return answer, invalidAnswerError("response must not be empty")
+		}
+		if utf8.RuneCountInString(text) > maxTextAnswer {
+			return answer, invalidAnswerError(fmt.Sprintf("response must be at most %d characters", maxTextAnswer))
+		}
+		answer.Text = text
+	default:
+		return answer, invalidAnswerError("unknown question type")
+	}
+	return answer, nil
+}
+
+// answerLabel returns the answer to question as displayed to the user.
+func answerLabel(question Question, answer Answer) string {
+	switch question.Type {
+	case questionChoice:
+		if c := question.Choice(answer.ChoiceId); c >= 0 {
+			return question.Choices[c].Label
+		}
+	case questionMulti:
+		var labels []string
+		for _, choiceId := range answer.ChoiceIds {
+			if c := question.Choice(choiceId); c >= 0 {
+				labels = append(labels, question.Choices[c].Label)
+			}
+		}
+		return strings.Join(labels, ", ")
+	case questionLikert, questionNumber:
+		return strconv.FormatFloat(answer.Number, 'f', -1, 64)
+	case questionText:
+		return answer.Text
+	}
+	return ""
+}
+
+// numberBins returns the lower bounds and width of the histogram bins of a
+// number question. Small integer ranges get one bin per value, and an empty
+// range has no bins.
+func numberBins(question Question) (lows []float64, width float64) {
+	span := question.Max - question.Min
+	if !(span > 0) || math.IsInf(span, 0) {
+		return nil, 0
+	}
+	if span <= maxNumberBins && question.Min == math.Trunc(question.Min) && question.Max == math.Trunc(question.Max) {
+		for v := question.Min; v <= question.Max; v++ {
+			lows = append(lows, v)
+		}
+		return lows, 1
+	}
+	width = span / maxNumberBins
+	for i := 0; i < maxNumberBins; i++ {
+		lows = append(lows, question.Min+float64(i)*width)
+	}
+	return lows, width
+}
+
+// newQuestionAggregate returns an empty aggregate of the answers to question:
+// a count per choice for choice questions, per scale point for likert
+// questions and per bin for number questions. Text answers are listed.
+func newQuestionAggregate(question Question) QuestionAggregate {
+	aggregate := QuestionAggregate{
+		Question: question.Text,
+		Type:     question.Type,
+	}
+	switch question.Type {
+	case questionChoice, questionMulti:
+		for _, choice := range question.Choices {
+			aggregate.Labels = append(aggregate.Labels, choice.Label)
+		}
+	case questionLikert:
+		for _, point := range question.Scale() {
+			aggregate.Labels = append(aggregate.Labels, strconv.Itoa(point))
+		}
+	case questionNumber:
+		lows, width := numberBins(question)
+		for _, low := range lows {
+			if width == 1 {
+				aggregate.Labels = append(aggregate.Labels, strconv.FormatFloat(low, 'f', -1, 64))
+			} else {
+				aggregate.Labels = append(aggregate.Labels, fmt.Sprintf("%.3g–%.3g", low, low+width))
+			}
+		}
+	case questionText:
+		aggregate.Texts = []string{}
+		return aggregate
+	}
+	aggregate.Counts = make([]int, len(aggregate.Labels))
+	return aggregate
+}
+
+// answerBuckets returns the positions of the counts of the aggregate of
+// question that answer, an answer to question, is counted in: the position
+// of each picked choice, of the scale point or of the bin. Answers that do
+// not fit the question and text answers are counted nowhere.
+func answerBuckets(question Question, answer Answer) []int {
+	switch question.Type {
+	case questionChoice:
+		if c := question.Choice(answer.ChoiceId); c >= 0 {
+			return []int{c}
+		}
+	case questionMulti:
+		var buckets []int
+		for _, choiceId := range answer.ChoiceIds {
+			if c := question.Choice(choiceId); c >= 0 {
+				buckets = append(buckets, c)
+			}
+		}
+		return buckets
+	case questionLikert:
+		if i := int(answer.Number - question.Min); i >= 0 && i < len(question.Scale()) {
+			return []int{i}
+		}
+	case questionNumber:
+		lows, width := numberBins(question)
+		if len(lows) == 0 || math.IsNaN(answer.Number) || answer.Number < question.Min {
+			return nil
+		}
+		i := int((answer.Number - question.Min) / width)
+		if i == len(lows) && answer.Number == question.Max {
+			i--
+		}
+		if i >= 0 && i < len(lows) {
+			return []int{i}
+		}
+	}
+	return nil
+}
+
+// add counts answer, an answer to question, in the aggregate. Answers that
+// do not fit the question are ignored.
+func (a *QuestionAggregate) add(question Question, answer Answer) {
+	if question.Type == questionText {
+		if answer.Text != "" && len(a.Texts) < maxListedTexts {
+			a.Texts = append(a.Texts, answer.Text)
+		}
+		return
+	}
+	for _, bucket := range answerBuckets(question, answer) {
+		a.Counts[bucket]++
+	}
+}
+
+// matches reports whether answer, an answer to question, matches the rule.
+func (rule Rule) matches(question Question, answer Answer) bool {
+	if rule.Otherwise {
+		return true
+	}
+	switch question.Type {
+	case questionChoice:
+		return question.Choice(answer.ChoiceId) == rule.Choice
+	case questionMulti:
+		for _, choiceId := range answer.ChoiceIds {
+			if question.Choice(choiceId) == rule.Choice {
+				return true
+			}
+		}
+	case questionLikert, questionNumber:
+		return answer.Number >= rule.Min && answer.Number <= rule.Max
+	}
+	return false
+}
+
+// nextPosition returns the position of the question that follows answer, the
+// answer to the question at position q, or len(survey.Questions) if the
+// survey ends there. The first matching rule picks the next question, and
+// the question after it follows if no rule matches. Rules only skip ahead,
+// so rules jumping back or to a deleted question are ignored.
+func nextPosition(survey *Survey, q int, answer Answer) int {
+	question := survey.Questions[q]
+	for _, rule := range question.Rules {
+		if !rule.matches(question, answer) {
+			continue
+		}
+		if rule.Goto == endOfSurvey {
+			return len(survey.Questions)
+		}
+		if target := survey.Question(rule.Goto); target > q {
+			return target
+		}
+	}
+	return q + 1
+}
+
+// nextQuestion follows the answers given so far from the first question of
+// survey and returns the first question on the path that has not been
+// answered, or nil if the path reached the end of the survey. Answers to
+// questions off the path are ignored.
+func nextQuestion(survey *Survey, answers []Answer) *Question {
+	byQuestion := make(map[int64]Answer)
+	for _, answer := range answers {
+		byQuestion[answer.QuestionId] = answer
+	}
+	q := 0
+	for q < len(survey.Questions) {
+		answer, ok := byQuestion[survey.Questions[q].Id]
+		if !ok {
+			return &survey.Questions[q]
+		}
+		q = nextPosition(survey, q, answer)
+	}
+	return nil
+}
+
+// RulesText returns the rules of question in the syntax read by parseRules.
+func (s Survey) RulesText(question Question) string {
+	var lines []string
+	for _, rule := range question.Rules {
+		var when, target string
+		switch {
+		case rule.Otherwise:
+			when = "*"
+		case question.HasChoices():
+			if rule.Choice < 0 || rule.Choice >= len(question.Choices) {
+				continue
+			}
+			when = question.Choices[rule.Choice].Label
+		default:
+			when = fmt.Sprintf("%g..%g", rule.Min, rule.Max)
+		}
+		if rule.Goto == endOfSurvey {
+			target = "end"
+		} else if q := s.Question(rule.Goto); q >= 0 {
+			target = strconv.Itoa(s.Questions[q].Number())
+		} else {
+			continue
+		}
+		lines = append(lines, when+" -> "+target)
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/secure/precis"
+)
+
+const (
+	minUsernameLength = 3
+	maxUsernameLength = 32
+	minPasswordLength = 8
+	// maxPasswordBytes is the longest password bcrypt hashes.
+	maxPasswordBytes = 72
+)
+
+var (
+	errInvalidUsername = fmt.Errorf("usernames are %d to %d letters, digits, dots, dashes or underscores", minUsernameLength, maxUsernameLength)
+	errShortPassword   = fmt.Errorf("passwords need at least %d characters", minPasswordLength)
+	errLongPassword    = fmt.Errorf("passwords can be at most %d bytes long", maxPasswordBytes)
+	errCommonPassword  = errors.New("this password is too common, choose another one")
+	errUsernameInPass  = errors.New("passwords cannot contain the username")
+)
+
+// normalizeUsername returns username in the form it is stored in, with its
+// width and Unicode normalization fixed but its case kept, or
+// errInvalidUsername if it breaks the username rules.
+func normalizeUsername(username string) (string, error) {
+	normalized, err := precis.UsernameCasePreserved.String(username)
+	if err != nil {
+		return "", errInvalidUsername
+	}
+	if n := utf8.RuneCountInString(normalized); n < minUsernameLength || n > maxUsernameLength {
+		return "", errInvalidUsername
+	}
+	for _, c := range normalized {
+		if !unicode.IsLetter(c) && !unicode.IsDigit(c) && !unicode.IsMark(c) && !strings.ContainsRune("._-", c) {
+			return "", errInvalidUsername
+		}
+	}
+	return normalized, nil
+}
+
+// canonicalUsername returns the form usernames are compared in, which is
+// case-insensitive and Unicode-normalized, or errInvalidUsername if username
+// has none.
+func canonicalUsername(username string) (string, error) {
+	canonical, err := precis.UsernameCaseMapped.String(username)
+	if err != nil {
+		return "", errInvalidUsername
+	}
+	return canonical, nil
+}
+
+// loadCommonPasswords reads the list of common and breached passwords that
+// users cannot pick from the file at path, one password per line. Blank
+// lines and lines starting with # are skipped.
+func loadCommonPasswords(path string) (map[string]bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	passwords := make(map[string]bool)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			passwords[strings.ToLower(line)] = true
+		}
+	}
+	return passwords, scanner.Err()
+}
+
+// checkPassword returns an error to show the user with id username if
+// password is too weak: shorter than minPasswordLength characters, longer
+// than bcrypt hashes, on the list of common passwords or containing the
+// username.
+func (s *server) checkPassword(username string, password string) error {
+	if utf8.RuneCountInString(password) < minPasswordLength {
+		return errShortPassword
+	}
+	if len(password) > maxPasswordBytes {
+		return errLongPassword
+	}
+	lower := strings.ToLower(password)
+	if s.commonPasswords[lower] {
+		return errCommonPassword
+	}
+	if username != "" && strings.Contains(lower, strings.ToLower(username)) {
+		return errUsernameInPass
+	}
+	return nil
+}
+
+// parseRegistration reads a new user from the sign-up fields returned by
+// values by name: username, password, email and the user attributes. It
+// returns the problem with each invalid field by name, with the problems with
+// user attributes under attributes.
+func (s *server) parseRegistration(values func(name string) string) (User, map[string]string) {
+	problems := make(map[string]string)
+	var user User
+	username, err := normalizeUsername(values("username"))
+	if err != nil {
+		problems["username"] = err.Error()
+	}
+	user.Id = username
+	if err = s.checkPassword(username, values("password")); err != nil {
+		problems["password"] = err.Error()
+	}
+	if user.Email, err = parseEmail(values("email")); err != nil {
+		problems["email"] = err.Error()
+	}
+	if err = setAttributes(&user, values); err != nil {
+		problems["attributes"] = err.Error()
+	}
+	return user, problems
+}
+
+// findUser returns the user with the given username. Usernames are compared
+// by their canonical form, see canonicalUsername, except for users who signed
+// up before usernames were reserved, see reserveUsernames, who are found by
+// their exact username.
+func (s *server) findUser(ctx context.Context, username string) (User, error) {
+	user, err := s.store.GetUser(ctx, username)
+	if err != errNotFound {
+		return user, err
+	}
+	canonical, err := canonicalUsername(username)
+	if err != nil {
+		return User{}, errNotFound
+	}
+	userId, err := s.store.GetUsername(ctx, canonical)
+	if err != nil {
+		return User{}, err
+	}
+	return s.store.GetUser(ctx, userId)
+}
+
+// reserveUsername reserves the canonical form of the username of the user
+// with id userId for them, unless it is reserved already. It reports whether
+// the username was reserved for the user.
+func (s *server) reserveUsername(ctx context.Context, userId string) (bool, error) {
+	canonical, err := canonicalUsername(userId)
+	if err != nil {
+		// usernames from before the username rules are found exactly
+		return false, nil
+	}
+	reserved := false
+	err = s.store.RunInTransaction(ctx, func(ctx context.Context) error {
+		_, err := s.store.GetUsername(ctx, canonical)
+		if err != errNotFound {
+			return err
+		}
+		reserved = true
+		return s.store.PutUsername(ctx, canonical, userId)
+	})
+	return reserved, err
+}
+
+// reserveUsernames reserves the usernames of users who signed up before
+// usernames were reserved, so that new users cannot sign up with their
+// username in another case. It returns the number of usernames reserved.
+// Where usernames of several users only differ by case, the first one in
+// ListUsers order gets the reservation, and the rest log in with their exact
+// username.
+func (s *server) reserveUsernames(ctx context.Context) (int, error) {
+	users, err := s.store.ListUsers(ctx)
+	if err != nil {
+		return 0, err
+	}
+	reserved := 0
+	for _, user := range users {
+		ok, err := s.reserveUsername(ctx, user.Id)
+		if err != nil {
+			return reserved, fmt.Errorf("reserving username of %s: %v", user.Id, err)
+		}
+		if ok {
+			reserved++
+		}
+	}
+	return reserved, nil
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	sessionCookie   = "session-id"
+	sessionLifetime = 7 * 24 * time.Hour
+	sessionTokenLen = 32
+)
+
+var errInvalidSession = errors.New("invalid or expired session")
+
+// newSessionToken returns a random url-safe token.
+func newSessionToken() (string, error) {
+	b := make([]byte, sessionTokenLen)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// newUserToken returns a random url-safe token for the user with id userId.
+// The token starts with the encoded user id, see tokenUser, since sessions
+// and password resets are stored under their user on the datastore.
+func newUserToken(userId string) (string, error) {
+	token, err := newSessionToken()
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString([]byte(userId)) + "." + token, nil
+}
+
+// tokenUser returns the id of the user token was made for by newUserToken,
+// or an empty string if token was not made by it.
+func tokenUser(token string) string {
+	i := strings.IndexByte(token, '.')
+	if i < 0 {
+		return ""
+	}
+	userId, err := base64.RawURLEncoding.DecodeString(token[:i])
+	if err != nil {
+		return ""
+	}
+	return string(userId)
+}
+
+// sessionId returns the id the session for token is stored under. Only the
+// hash of the token is stored so a leaked store does not leak sessions.
+func sessionId(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// createSession stores a new session for the user with id userId and
+// returns its token.
+func (s *server) createSession(ctx context.Context, userId string) (string, SessionRecord, error) {
+	token, err := newUserToken(userId)
+	if err != nil {
+		return "", SessionRecord{}, err
+	}
+	now := time.Now()
+	record := SessionRecord{
+		UserId:  userId,
+		Created: now,
+		Expires: now.Add(sessionLifetime),
+	}
+	err = s.store.PutSession(ctx, sessionId(token), record)
+	if err != nil {
+		return "", SessionRecord{}, err
+	}
+	return token, record, nil
+}
+
+// lookupSession returns the id of the user the session token belongs to.
+// Unknown and expired tokens are rejected with errInvalidSession.
+func (s *server) lookupSession(ctx context.Context, token string) (string, error) {
+	userId := tokenUser(token)
+	if userId == "" {
+		return "", errInvalidSession
+	}
+	id := sessionId(token)
+	record, err := s.store.GetSession(ctx, userId, id)
+	if err == errNotFound {
+		return "", errInvalidSession
+	}
+	if err != nil {
+		return "", err
+	}
+	if time.Now().After(record.Expires) {
+		s.store.DeleteSession(ctx, userId, id)
+		return "", errInvalidSession
+	}
+	return record.UserId, nil
+}
+
+// sessionToken returns the session token of the request: the bearer token
+// of its Authorization header, sent by api clients without cookies, or else
+// the session cookie. It returns an empty string if there is neither.
+func sessionToken(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+	}
+	if c, err := r.Cookie(sessionCookie); err == nil {
+		return c.Value
+	}
+	return ""
+}
+
+// secureCookie reports whether the cookies set on the response to r are
+// Secure, so browsers only send them over HTTPS: always with secureCookies,
+// and otherwise if r came over HTTPS, to the app or, behind trusted proxies,
+// to the proxy setting X-Forwarded-Proto. Standalone servers over plain HTTP
+// would otherwise set cookies browsers drop.
+func (s *server) secureCookie(r *http.Request) bool {
+	if s.secureCookies || r.TLS != nil {
+		return true
+	}
+	if s.trustedProxies == 0 {
+		return false
+	}
+	protos := strings.Split(r.Header.Get("X-Forwarded-Proto"), ",")
+	return strings.TrimSpace(protos[len(protos)-1]) == "https"
+}
+
+// startSession creates a session for the user with id userId and sets the
+// session cookie on the response. It returns the session token along with
+// the stored session.
+func (s *server) startSession(w http.ResponseWriter, r *http.Request, userId string) (string, SessionRecord, error) {
+	ctx := s.newContext(r)
+	token, record, err := s.createSession(ctx, userId)
+	if err != nil {
+		return "", SessionRecord{}, err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    token,
+		Path:     "/",
+		Expires:  record.Expires,
+		HttpOnly: true,
+		Secure:   s.secureCookie(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+	return token, record, nil
+}
+
+// endSession revokes the current session, if any, and clears the session
+// cookie.
+func (s *server) endSession(w http.ResponseWriter, r *http.Request) error {
+	var err error
+	if token := sessionToken(r); tokenUser(token) != "" {
+		err = s.store.DeleteSession(s.newContext(r), tokenUser(token), sessionId(token))
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   s.secureCookie(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+	return err
+}
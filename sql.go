@@ -0,0 +1,802 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
+)
+
+// dialect describes how the SQL of a database driver differs from the SQL
+// the store is written in.
+type dialect struct {
+	// serial is the type of auto-incrementing primary keys.
+	serial string
+	// numbered is set if placeholders are numbered $1, $2... instead of ?.
+	numbered bool
+	// syncSerial returns the statement moving the sequence of the serial
+	// column of table past ids stored explicitly, if the database needs it.
+	syncSerial func(table string) string
+	// isolation is the isolation level of transactions, which keeps
+	// transactions that read rows and write depending on them from
+	// interleaving.
+	isolation sql.IsolationLevel
+	// conflict reports whether err aborted a transaction because of a
+	// concurrent one, in which case the transaction is run again.
+	conflict func(err error) bool
+}
+
+// dialects are the supported database drivers, by driver name.
+var dialects = map[string]dialect{
+	"sqlite3": {
+		serial: "INTEGER PRIMARY KEY AUTOINCREMENT",
+		// SQLite transactions are serializable, and the store has a
+		// single connection, see openSQLStore
+		isolation: sql.LevelDefault,
+		conflict: func(err error) bool {
+			e, ok := err.(sqlite3.Error)
+			return ok && (e.Code == sqlite3.ErrBusy || e.Code == sqlite3.ErrLocked)
+		},
+	},
+	"postgres": {
+		serial:   "BIGSERIAL PRIMARY KEY",
+		numbered: true,
+		syncSerial: func(table string) string {
+			return fmt.Sprintf("SELECT setval(pg_get_serial_sequence('%[1]s', 'id'), (SELECT MAX(id) FROM %[1]s))", table)
+		},
+		isolation: sql.LevelSerializable,
+		conflict: func(err error) bool {
+			// serialization_failure and deadlock_detected
+			e, ok := err.(*pq.Error)
+			return ok && (e.Code == "40001" || e.Code == "40P01")
+		},
+	},
+}
+
+// errLegacyResponses is returned for users carrying legacy responses, which
+// the SQL schema has no place for.
+var errLegacyResponses = errors.New("legacy responses must be migrated into an attempt before the user is stored")
+
+// sqlStore is the Store backed by a SQL database, for hosting the app outside
+// of App Engine. Entities are stored in a normalized schema kept up to date
+// by the migrations in migrations.go. Question rules are stored as JSON.
+type sqlStore struct {
+	db      *sql.DB
+	dialect dialect
+}
+
+// openSQLStore opens the database at dsn with the named driver, which is
+// "sqlite3" or "postgres", and applies pending migrations.
+func openSQLStore(driver string, dsn string) (*sqlStore, error) {
+	d, ok := dialects[driver]
+	if !ok {
+		return nil, fmt.Errorf("unsupported SQL driver %q", driver)
+	}
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	if driver == "sqlite3" {
+		// SQLite allows a single writer, so connections would wait on
+		// each other's transactions
+		db.SetMaxOpenConns(1)
+	}
+	s := &sqlStore{db: db, dialect: d}
+	if err = s.migrate(context.Background()); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Close closes the database.
+func (s *sqlStore) Close() error {
+	return s.db.Close()
+}
+
+// queryer is implemented by both *sql.DB and *sql.Tx.
+type queryer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// conn returns the transaction ctx runs in, or the database outside of
+// transactions.
+func (s *sqlStore) conn(ctx context.Context) queryer {
+	if tx, ok := ctx.Value(txKey{}).(*sql.Tx); ok {
+		return tx
+	}
+	return s.db
+}
+
+// rebind rewrites the ? placeholders of query for the dialect.
+func (s *sqlStore) rebind(query string) string {
+	if !s.dialect.numbered {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+func (s *sqlStore) exec(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	return s.conn(ctx).ExecContext(ctx, s.rebind(query), args...)
+}
+
+func (s *sqlStore) query(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	return s.conn(ctx).QueryContext(ctx, s.rebind(query), args...)
+}
+
+func (s *sqlStore) queryRow(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	return s.conn(ctx).QueryRowContext(ctx, s.rebind(query), args...)
+}
+
+// notFoundRow translates sql.ErrNoRows into errNotFound.
+func notFoundRow(err error) error {
+	if err == sql.ErrNoRows {
+		return errNotFound
+	}
+	return err
+}
+
+// RunInTransaction runs f in a database transaction at the isolation level
+// of the dialect, and runs it again while it conflicts with a concurrent
+// transaction. Calls made within f join the transaction.
+func (s *sqlStore) RunInTransaction(ctx context.Context, f func(ctx context.Context) error) error {
+	if inTransaction(ctx) {
+		return f(ctx)
+	}
+	var err error
+	for attempt := 0; attempt < txAttempts; attempt++ {
+		if err = s.runTransaction(ctx, f); !s.dialect.conflict(err) {
+			return err
+		}
+	}
+	return err
+}
+
+// runTransaction runs f in a single database transaction.
+func (s *sqlStore) runTransaction(ctx context.Context, f func(ctx context.Context) error) error {
+	tx, err := s.db.BeginTx(ctx, &sql.TxOptions{Isolation: s.dialect.isolation})
+	if err != nil {
+		return err
+	}
+	if err = f(context.WithValue(ctx, txKey{}, tx)); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *sqlStore) GetUser(ctx context.Context, userId string) (User, error) {
+	user := User{Id: userId}
+	err := s.queryRow(ctx, "SELECT password, role, created, age_band, program, email FROM users WHERE id = ?", userId).
+		Scan(&user.Password, &user.Role, &user.Created, &user.AgeBand, &user.Program, &user.Email)
+	return user, notFoundRow(err)
+}
+
+func (s *sqlStore) PutUser(ctx context.Context, user User) error {
+	if len(user.Responses) > 0 {
+		return errLegacyResponses
+	}
+	_, err := s.exec(ctx, `INSERT INTO users (id, password, role, created, age_band, program, email) VALUES (?, ?, ?, ?, ?, ?, ?)
+ON CONFLICT (id) DO UPDATE SET password = excluded.password, role = excluded.role, created = excluded.created,
+	age_band = excluded.age_band, program = excluded.program, email = excluded.email`,
+		user.Id, user.Password, user.Role, user.Created.UTC(), user.AgeBand, user.Program, user.Email)
+	return err
+}
+
+// LegacyUsers returns no users since users are stored without legacy
+// responses.
+func (s *sqlStore) LegacyUsers(ctx context.Context) ([]User, error) {
+	return nil, nil
+}
+
+func (s *sqlStore) ListUsers(ctx context.Context) ([]User, error) {
+	rows, err := s.query(ctx, "SELECT id, password, role, created, age_band, program, email FROM users ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var users []User
+	for rows.Next() {
+		var user User
+		if err = rows.Scan(&user.Id, &user.Password, &user.Role, &user.Created, &user.AgeBand, &user.Program, &user.Email); err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
+
+func (s *sqlStore) GetUsername(ctx context.Context, name string) (string, error) {
+	var userId string
+	err := s.queryRow(ctx, "SELECT user_id FROM usernames WHERE name = ?", name).Scan(&userId)
+	return userId, notFoundRow(err)
+}
+
+func (s *sqlStore) PutUsername(ctx context.Context, name string, userId string) error {
+	_, err := s.exec(ctx, `INSERT INTO usernames (name, user_id) VALUES (?, ?)
+ON CONFLICT (name) DO UPDATE SET user_id = excluded.user_id`, name, userId)
+	return err
+}
+
+func (s *sqlStore) GetSession(ctx context.Context, userId string, sessionId string) (SessionRecord, error) {
+	var session SessionRecord
+	err := s.queryRow(ctx, "SELECT user_id, created, expires FROM sessions WHERE id = ? AND user_id = ?", sessionId, userId).
+		Scan(&session.UserId, &session.Created, &session.Expires)
+	return session, notFoundRow(err)
+}
+
+func (s *sqlStore) PutSession(ctx context.Context, sessionId string, session SessionRecord) error {
+	_, err := s.exec(ctx, `INSERT INTO sessions (id, user_id, created, expires) VALUES (?, ?, ?, ?)
+ON CONFLICT (id) DO UPDATE SET user_id = excluded.user_id, created = excluded.created, expires = excluded.expires`,
+		sessionId, session.UserId, session.Created.UTC(), session.Expires.UTC())
+	return err
+}
+
+func (s *sqlStore) DeleteSession(ctx context.Context, userId string, sessionId string) error {
+	_, err := s.exec(ctx, "DELETE FROM sessions WHERE id = ? AND user_id = ?", sessionId, userId)
+	return err
+}
+
+func (s *sqlStore) DeleteUserSessions(ctx context.Context, userId string) error {
+	_, err := s.exec(ctx, "DELETE FROM sessions WHERE user_id = ?", userId)
+	return err
+}
+
+func (s *sqlStore) GetPasswordReset(ctx context.Context, userId string, resetId string) (PasswordReset, error) {
+	var reset PasswordReset
+	err := s.queryRow(ctx, "SELECT user_id, created, expires FROM password_resets WHERE id = ? AND user_id = ?", resetId, userId).
+		Scan(&reset.UserId, &reset.Created, &reset.Expires)
+	return reset, notFoundRow(err)
+}
+
+func (s *sqlStore) PutPasswordReset(ctx context.Context, resetId string, reset PasswordReset) error {
+	_, err := s.exec(ctx, `INSERT INTO password_resets (id, user_id, created, expires) VALUES (?, ?, ?, ?)
+ON CONFLICT (id) DO UPDATE SET user_id = excluded.user_id, created = excluded.created, expires = excluded.expires`,
+		resetId, reset.UserId, reset.Created.UTC(), reset.Expires.UTC())
+	return err
+}
+
+func (s *sqlStore) DeletePasswordReset(ctx context.Context, userId string, resetId string) error {
+	_, err := s.exec(ctx, "DELETE FROM password_resets WHERE id = ? AND user_id = ?", resetId, userId)
+	return err
+}
+
+func (s *sqlStore) DeleteUserPasswordResets(ctx context.Context, userId string) error {
+	_, err := s.exec(ctx, "DELETE FROM password_resets WHERE user_id = ?", userId)
+	return err
+}
+
+func (s *sqlStore) GetLoginThrottle(ctx context.Context, key string) (LoginThrottle, error) {
+	var throttle LoginThrottle
+	err := s.queryRow(ctx, "SELECT failures, last_failure, locked_until, pending, last_attempt FROM login_throttles WHERE id = ?", key).
+		Scan(&throttle.Failures, &throttle.LastFailure, &throttle.LockedUntil, &throttle.Pending, &throttle.LastAttempt)
+	return throttle, notFoundRow(err)
+}
+
+func (s *sqlStore) PutLoginThrottle(ctx context.Context, key string, throttle LoginThrottle) error {
+	_, err := s.exec(ctx, `INSERT INTO login_throttles (id, failures, last_failure, locked_until, pending, last_attempt) VALUES (?, ?, ?, ?, ?, ?)
+ON CONFLICT (id) DO UPDATE SET failures = excluded.failures, last_failure = excluded.last_failure, locked_until = excluded.locked_until,
+	pending = excluded.pending, last_attempt = excluded.last_attempt`,
+		key, throttle.Failures, throttle.LastFailure.UTC(), throttle.LockedUntil.UTC(), throttle.Pending, throttle.LastAttempt.UTC())
+	return err
+}
+
+func (s *sqlStore) DeleteLoginThrottle(ctx context.Context, key string) error {
+	_, err := s.exec(ctx, "DELETE FROM login_throttles WHERE id = ?", key)
+	return err
+}
+
+func (s *sqlStore) PutAuditEntry(ctx context.Context, entry AuditEntry) error {
+	_, err := s.exec(ctx, "INSERT INTO audit_log (time, event, subject, client, detail) VALUES (?, ?, ?, ?, ?)",
+		entry.Time.UTC(), entry.Event, entry.Subject, entry.Client, entry.Detail)
+	return err
+}
+
+func (s *sqlStore) ListAuditEntries(ctx context.Context, limit int) ([]AuditEntry, error) {
+	rows, err := s.query(ctx, "SELECT time, event, subject, client, detail FROM audit_log ORDER BY time DESC, id DESC LIMIT ?", limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var entries []AuditEntry
+	for rows.Next() {
+		var entry AuditEntry
+		if err = rows.Scan(&entry.Time, &entry.Event, &entry.Subject, &entry.Client, &entry.Detail); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+// surveyColumns are the columns scanned by scanSurvey.
+const surveyColumns = "id, title, published, published_version, latest_version"
+
+// scanSurvey scans a row of surveyColumns.
+func scanSurvey(row interface{ Scan(...interface{}) error }) (Survey, error) {
+	var survey Survey
+	err := row.Scan(&survey.Id, &survey.Title, &survey.Published, &survey.PublishedVersion, &survey.LatestVersion)
+	return survey, err
+}
+
+func (s *sqlStore) ListSurveys(ctx context.Context) ([]Survey, error) {
+	rows, err := s.query(ctx, "SELECT "+surveyColumns+" FROM surveys")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var surveys []Survey
+	for rows.Next() {
+		survey, err := scanSurvey(rows)
+		if err != nil {
+			return nil, err
+		}
+		surveys = append(surveys, survey)
+	}
+	return surveys, rows.Err()
+}
+
+func (s *sqlStore) GetSurvey(ctx context.Context, surveyId string) (Survey, error) {
+	survey, err := scanSurvey(s.queryRow(ctx, "SELECT "+surveyColumns+" FROM surveys WHERE id = ?", surveyId))
+	return survey, notFoundRow(err)
+}
+
+func (s *sqlStore) PutSurvey(ctx context.Context, survey Survey) error {
+	_, err := s.exec(ctx, `INSERT INTO surveys (id, title, published, published_version, latest_version) VALUES (?, ?, ?, ?, ?)
+ON CONFLICT (id) DO UPDATE SET title = excluded.title, published = excluded.published,
+	published_version = excluded.published_version, latest_version = excluded.latest_version`,
+		survey.Id, survey.Title, survey.Published, survey.PublishedVersion, survey.LatestVersion)
+	return err
+}
+
+func (s *sqlStore) GetSurveyVersion(ctx context.Context, surveyId string, version int) (SurveyVersion, error) {
+	var surveyVersion SurveyVersion
+	err := s.queryRow(ctx, "SELECT created, frozen, counted FROM survey_versions WHERE survey_id = ? AND version = ?", surveyId, version).
+		Scan(&surveyVersion.Created, &surveyVersion.Frozen, &surveyVersion.Counted)
+	return surveyVersion, notFoundRow(err)
+}
+
+func (s *sqlStore) PutSurveyVersion(ctx context.Context, surveyId string, version int, surveyVersion SurveyVersion) error {
+	_, err := s.exec(ctx, `INSERT INTO survey_versions (survey_id, version, created, frozen, counted) VALUES (?, ?, ?, ?, ?)
+ON CONFLICT (survey_id, version) DO UPDATE SET created = excluded.created, frozen = excluded.frozen, counted = excluded.counted`,
+		surveyId, version, surveyVersion.Created.UTC(), surveyVersion.Frozen, surveyVersion.Counted)
+	return err
+}
+
+func (s *sqlStore) GetQuestions(ctx context.Context, surveyId string, version int) ([]Question, error) {
+	rows, err := s.query(ctx, `SELECT id, position, text, type, min_value, max_value, min_label, max_label, rules
+FROM questions WHERE survey_id = ? AND version = ?`, surveyId, version)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var questions []Question
+	for rows.Next() {
+		var question Question
+		var rules string
+		err = rows.Scan(&question.Id, &question.Position, &question.Text, &question.Type,
+			&question.Min, &question.Max, &question.MinLabel, &question.MaxLabel, &rules)
+		if err != nil {
+			return nil, err
+		}
+		if err = json.Unmarshal([]byte(rules), &question.Rules); err != nil {
+			return nil, err
+		}
+		questions = append(questions, question)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	rows, err = s.query(ctx, "SELECT question_id, id, position, label FROM choices WHERE survey_id = ? AND version = ?", surveyId, version)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	byQuestion := make(map[int64][]Choice)
+	for rows.Next() {
+		var questionId int64
+		var choice Choice
+		if err = rows.Scan(&questionId, &choice.Id, &choice.Position, &choice.Label); err != nil {
+			return nil, err
+		}
+		byQuestion[questionId] = append(byQuestion[questionId], choice)
+	}
+	for i := range questions {
+		questions[i].Choices = byQuestion[questions[i].Id]
+	}
+	return questions, rows.Err()
+}
+
+// PutQuestions allocates ids of new questions and choices above the ids used
+// by any version of the survey.
+func (s *sqlStore) PutQuestions(ctx context.Context, surveyId string, version int, questions []Question) error {
+	return s.RunInTransaction(ctx, func(ctx context.Context) error {
+		var lastQuestion, lastChoice int64
+		err := s.queryRow(ctx, "SELECT COALESCE(MAX(id), 0) FROM questions WHERE survey_id = ?", surveyId).Scan(&lastQuestion)
+		if err != nil {
+			return err
+		}
+		err = s.queryRow(ctx, "SELECT COALESCE(MAX(id), 0) FROM choices WHERE survey_id = ?", surveyId).Scan(&lastChoice)
+		if err != nil {
+			return err
+		}
+		// choices are deleted first since SQLite only cascades deletes
+		// with foreign keys enabled
+		if _, err = s.exec(ctx, "DELETE FROM choices WHERE survey_id = ? AND version = ?", surveyId, version); err != nil {
+			return err
+		}
+		if _, err = s.exec(ctx, "DELETE FROM questions WHERE survey_id = ? AND version = ?", surveyId, version); err != nil {
+			return err
+		}
+		for _, question := range questions {
+			if question.Id == 0 {
+				lastQuestion++
+				question.Id = lastQuestion
+			}
+			rules, err := json.Marshal(question.Rules)
+			if err != nil {
+				return err
+			}
+			_, err = s.exec(ctx, `INSERT INTO questions
+(survey_id, version, id, position, text, type, min_value, max_value, min_label, max_label, rules)
+VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+				surveyId, version, question.Id, question.Position, question.Text, question.Type,
+				question.Min, question.Max, question.MinLabel, question.MaxLabel, string(rules))
+			if err != nil {
+				return err
+			}
+			for _, choice := range question.Choices {
+				if choice.Id == 0 {
+					lastChoice++
+					choice.Id = lastChoice
+				}
+				_, err = s.exec(ctx, `INSERT INTO choices (survey_id, version, question_id, id, position, label)
+VALUES (?, ?, ?, ?, ?, ?)`,
+					surveyId, version, question.Id, choice.Id, choice.Position, choice.Label)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// responseKey identifies an answer by its attempt and question.
+type responseKey struct {
+	attemptId  int64
+	questionId int64
+}
+
+// loadAnswers returns the answers selected by where, which filters the
+// responses table aliased r, grouped by attempt id.
+func (s *sqlStore) loadAnswers(ctx context.Context, where string, args ...interface{}) (map[int64][]Answer, error) {
+	rows, err := s.query(ctx, `SELECT r.attempt_id, r.question_id, rc.choice_id
+FROM responses r JOIN response_choices rc ON rc.attempt_id = r.attempt_id AND rc.question_id = r.question_id
+WHERE `+where+" ORDER BY rc.position", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	choiceIds := make(map[responseKey][]int64)
+	for rows.Next() {
+		var key responseKey
+		var choiceId int64
+		if err = rows.Scan(&key.attemptId, &key.questionId, &choiceId); err != nil {
+			return nil, err
+		}
+		choiceIds[key] = append(choiceIds[key], choiceId)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	rows, err = s.query(ctx, `SELECT r.attempt_id, r.survey_id, r.version, r.question_id, r.choice_id, r.number, r.text, r.answered
+FROM responses r WHERE `+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	answers := make(map[int64][]Answer)
+	for rows.Next() {
+		var attemptId int64
+		var answer Answer
+		err = rows.Scan(&attemptId, &answer.SurveyId, &answer.Version, &answer.QuestionId,
+			&answer.ChoiceId, &answer.Number, &answer.Text, &answer.Answered)
+		if err != nil {
+			return nil, err
+		}
+		answer.ChoiceIds = choiceIds[responseKey{attemptId, answer.QuestionId}]
+		answers[attemptId] = append(answers[attemptId], answer)
+	}
+	return answers, rows.Err()
+}
+
+func (s *sqlStore) ListAttempts(ctx context.Context, userId string, surveyId string) ([]Attempt, error) {
+	rows, err := s.query(ctx, `SELECT id, version, started, finished, complete FROM attempts
+WHERE user_id = ? AND survey_id = ?`, userId, surveyId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var attempts []Attempt
+	for rows.Next() {
+		attempt := Attempt{SurveyId: surveyId}
+		err = rows.Scan(&attempt.Id, &attempt.Version, &attempt.Started, &attempt.Finished, &attempt.Complete)
+		if err != nil {
+			return nil, err
+		}
+		attempts = append(attempts, attempt)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	answers, err := s.loadAnswers(ctx, "r.attempt_id IN (SELECT id FROM attempts WHERE user_id = ? AND survey_id = ?)", userId, surveyId)
+	if err != nil {
+		return nil, err
+	}
+	for i := range attempts {
+		attempts[i].Answers = answers[attempts[i].Id]
+	}
+	return attempts, nil
+}
+
+// PutAttempt stores attempts with an id that is not taken under that id.
+func (s *sqlStore) PutAttempt(ctx context.Context, userId string, attempt Attempt) (int64, error) {
+	started, finished := attempt.Started.UTC(), attempt.Finished.UTC()
+	if attempt.Id == 0 {
+		err := s.queryRow(ctx, `INSERT INTO attempts (user_id, survey_id, version, started, finished, complete)
+VALUES (?, ?, ?, ?, ?, ?) RETURNING id`,
+			userId, attempt.SurveyId, attempt.Version, started, finished, attempt.Complete).Scan(&attempt.Id)
+		return attempt.Id, err
+	}
+	err := s.RunInTransaction(ctx, func(ctx context.Context) error {
+		result, err := s.exec(ctx, `UPDATE attempts SET survey_id = ?, version = ?, started = ?, finished = ?, complete = ?
+WHERE id = ? AND user_id = ?`,
+			attempt.SurveyId, attempt.Version, started, finished, attempt.Complete, attempt.Id, userId)
+		if err != nil {
+			return err
+		}
+		if updated, err := result.RowsAffected(); err != nil || updated > 0 {
+			return err
+		}
+		_, err = s.exec(ctx, `INSERT INTO attempts (id, user_id, survey_id, version, started, finished, complete)
+VALUES (?, ?, ?, ?, ?, ?, ?)`,
+			attempt.Id, userId, attempt.SurveyId, attempt.Version, started, finished, attempt.Complete)
+		if err != nil || s.dialect.syncSerial == nil {
+			return err
+		}
+		_, err = s.exec(ctx, s.dialect.syncSerial("attempts"))
+		return err
+	})
+	return attempt.Id, err
+}
+
+func (s *sqlStore) PutAnswer(ctx context.Context, userId string, attemptId int64, answer Answer) error {
+	return s.RunInTransaction(ctx, func(ctx context.Context) error {
+		var found int
+		err := s.queryRow(ctx, "SELECT 1 FROM attempts WHERE id = ? AND user_id = ?", attemptId, userId).Scan(&found)
+		if err != nil {
+			return notFoundRow(err)
+		}
+		_, err = s.exec(ctx, "DELETE FROM response_choices WHERE attempt_id = ? AND question_id = ?", attemptId, answer.QuestionId)
+		if err != nil {
+			return err
+		}
+		_, err = s.exec(ctx, `INSERT INTO responses (attempt_id, question_id, survey_id, version, choice_id, number, text, answered)
+VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+ON CONFLICT (attempt_id, question_id) DO UPDATE SET survey_id = excluded.survey_id, version = excluded.version,
+	choice_id = excluded.choice_id, number = excluded.number, text = excluded.text, answered = excluded.answered`,
+			attemptId, answer.QuestionId, answer.SurveyId, answer.Version, answer.ChoiceId, answer.Number, answer.Text, answer.Answered.UTC())
+		if err != nil {
+			return err
+		}
+		for i, choiceId := range answer.ChoiceIds {
+			_, err = s.exec(ctx, "INSERT INTO response_choices (attempt_id, question_id, position, choice_id) VALUES (?, ?, ?, ?)",
+				attemptId, answer.QuestionId, i, choiceId)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *sqlStore) ListSurveyAttempts(ctx context.Context, surveyId string, version int) ([]Attempt, error) {
+	rows, err := s.query(ctx, `SELECT id, user_id, started, finished, complete FROM attempts
+WHERE survey_id = ? AND version = ?`, surveyId, version)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var attempts []Attempt
+	for rows.Next() {
+		attempt := Attempt{SurveyId: surveyId, Version: version}
+		err = rows.Scan(&attempt.Id, &attempt.UserId, &attempt.Started, &attempt.Finished, &attempt.Complete)
+		if err != nil {
+			return nil, err
+		}
+		attempts = append(attempts, attempt)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	answers, err := s.loadAnswers(ctx, "r.survey_id = ? AND r.version = ?", surveyId, version)
+	if err != nil {
+		return nil, err
+	}
+	for i := range attempts {
+		attempts[i].Answers = answers[attempts[i].Id]
+	}
+	return attempts, nil
+}
+
+// scanPage is the number of attempts whose answers ScanAnswers reads in
+// each query.
+const scanPage = 100
+
+// scannedAnswer is an answer read by ScanAnswers along with its ids.
+type scannedAnswer struct {
+	userId    string
+	attemptId int64
+	answer    Answer
+}
+
+// ScanAnswers reads the answers a page of attempts at a time and calls f
+// between queries, so a slow export does not hold a connection, which is the
+// only one on SQLite, while it writes.
+func (s *sqlStore) ScanAnswers(ctx context.Context, surveyId string, f func(userId string, attemptId int64, answer Answer) error) error {
+	var after int64
+	for {
+		page, err := s.scanAnswerPage(ctx, surveyId, after)
+		if err != nil || len(page) == 0 {
+			return err
+		}
+		for _, a := range page {
+			if err = f(a.userId, a.attemptId, a.answer); err != nil {
+				return err
+			}
+		}
+		after = page[len(page)-1].attemptId
+	}
+}
+
+// scanAnswerPage returns the answers to the survey with id surveyId of the
+// next scanPage attempts with ids above after. They are read in one query
+// ordered by attempt and question, so the choices of a multi-select answer
+// are on consecutive rows.
+func (s *sqlStore) scanAnswerPage(ctx context.Context, surveyId string, after int64) ([]scannedAnswer, error) {
+	rows, err := s.query(ctx, `SELECT a.user_id, r.attempt_id, r.survey_id, r.version, r.question_id, r.choice_id, r.number, r.text, r.answered, rc.choice_id
+FROM responses r JOIN attempts a ON a.id = r.attempt_id
+LEFT JOIN response_choices rc ON rc.attempt_id = r.attempt_id AND rc.question_id = r.question_id
+WHERE r.survey_id = ? AND r.attempt_id IN (SELECT DISTINCT attempt_id FROM responses
+	WHERE survey_id = ? AND attempt_id > ? ORDER BY attempt_id LIMIT ?)
+ORDER BY r.attempt_id, r.question_id, rc.position`, surveyId, surveyId, after, scanPage)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var page []scannedAnswer
+	var key responseKey
+	for rows.Next() {
+		var a scannedAnswer
+		var rowKey responseKey
+		var choiceId sql.NullInt64
+		err = rows.Scan(&a.userId, &rowKey.attemptId, &a.answer.SurveyId, &a.answer.Version, &rowKey.questionId,
+			&a.answer.ChoiceId, &a.answer.Number, &a.answer.Text, &a.answer.Answered, &choiceId)
+		if err != nil {
+			return nil, err
+		}
+		if len(page) > 0 && rowKey == key {
+			last := &page[len(page)-1].answer
+			last.ChoiceIds = append(last.ChoiceIds, choiceId.Int64)
+			continue
+		}
+		key = rowKey
+		a.attemptId = key.attemptId
+		a.answer.QuestionId = key.questionId
+		if choiceId.Valid {
+			a.answer.ChoiceIds = []int64{choiceId.Int64}
+		}
+		page = append(page, a)
+	}
+	return page, rows.Err()
+}
+
+func (s *sqlStore) ListAnswers(ctx context.Context, surveyId string, version int) ([]Answer, error) {
+	byAttempt, err := s.loadAnswers(ctx, "r.survey_id = ? AND r.version = ?", surveyId, version)
+	if err != nil {
+		return nil, err
+	}
+	var answers []Answer
+	for _, attemptAnswers := range byAttempt {
+		answers = append(answers, attemptAnswers...)
+	}
+	return answers, nil
+}
+
+func (s *sqlStore) ListTexts(ctx context.Context, surveyId string, version int, questionId int64, limit int) ([]string, error) {
+	rows, err := s.query(ctx, `SELECT text FROM responses
+WHERE survey_id = ? AND version = ? AND question_id = ? AND text <> '' LIMIT ?`, surveyId, version, questionId, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var texts []string
+	for rows.Next() {
+		var text string
+		if err = rows.Scan(&text); err != nil {
+			return nil, err
+		}
+		texts = append(texts, text)
+	}
+	return texts, rows.Err()
+}
+
+func (s *sqlStore) AddCounts(ctx context.Context, surveyId string, version int, deltas map[counterKey]int) error {
+	return s.RunInTransaction(ctx, func(ctx context.Context) error {
+		for k, delta := range deltas {
+			_, err := s.exec(ctx, `INSERT INTO counters (survey_id, version, question_id, bucket, shard, count) VALUES (?, ?, ?, ?, ?, ?)
+ON CONFLICT (survey_id, version, question_id, bucket, shard) DO UPDATE SET count = counters.count + excluded.count`,
+				surveyId, version, k.questionId, k.bucket, rand.Intn(counterShards), delta)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *sqlStore) GetCounts(ctx context.Context, surveyId string, version int) (map[counterKey]int, error) {
+	rows, err := s.query(ctx, `SELECT question_id, bucket, SUM(count) FROM counters
+WHERE survey_id = ? AND version = ? GROUP BY question_id, bucket`, surveyId, version)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	counts := make(map[counterKey]int)
+	for rows.Next() {
+		var k counterKey
+		var count int
+		if err = rows.Scan(&k.questionId, &k.bucket, &count); err != nil {
+			return nil, err
+		}
+		counts[k] = count
+	}
+	return counts, rows.Err()
+}
+
+func (s *sqlStore) PutCounts(ctx context.Context, surveyId string, version int, counts map[counterKey]int) error {
+	return s.RunInTransaction(ctx, func(ctx context.Context) error {
+		_, err := s.exec(ctx, "DELETE FROM counters WHERE survey_id = ? AND version = ?", surveyId, version)
+		if err != nil {
+			return err
+		}
+		for k, count := range counts {
+			_, err = s.exec(ctx, `INSERT INTO counters (survey_id, version, question_id, bucket, shard, count) VALUES (?, ?, ?, ?, 0, ?)`,
+				surveyId, version, k.questionId, k.bucket, count)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// staticDirs are the directories of static files served by the app when it
+// runs standalone. On App Engine they are served by the handlers in app.yaml
+// before requests reach the app.
+var staticDirs = []string{"stylesheets", "img", "js"}
+
+// staticFiles serves the files below the working directory without listing
+// directories.
+func staticFiles() http.Handler {
+	files := http.FileServer(http.Dir("."))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/") {
+			http.NotFound(w, r)
+			return
+		}
+		files.ServeHTTP(w, r)
+	})
+}
+
+// standaloneHandler returns the handler serving the app along with its
+// static files.
+func (s *server) standaloneHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/", s.handler())
+	for _, dir := range staticDirs {
+		mux.Handle("/"+dir+"/", staticFiles())
+	}
+	return mux
+}
+
+// runStandalone serves the app on addr until the process receives SIGTERM or
+// an interrupt, then shuts down gracefully. Templates and static files are
+// read from the working directory.
+func runStandalone(s *server, addr string, readTimeout, writeTimeout, shutdownTimeout time.Duration) error {
+	srv := &http.Server{
+		Handler:           s.standaloneHandler(),
+		ReadHeaderTimeout: readTimeout,
+		ReadTimeout:       readTimeout,
+		WriteTimeout:      writeTimeout,
+		IdleTimeout:       2 * writeTimeout,
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	log.Print("listening on ", l.Addr())
+	err = serveUntil(ctx, srv, l, shutdownTimeout)
+	log.Print("shut down")
+	return err
+}
+
+// serveUntil serves srv on l until ctx is done, then shuts srv down, waiting
+// up to timeout for requests in flight to finish.
+func serveUntil(ctx context.Context, srv *http.Server, l net.Listener, timeout time.Duration) error {
+	served := make(chan error, 1)
+	go func() {
+		served <- srv.Serve(l)
+	}()
+	select {
+	case err := <-served:
+		return err
+	case <-ctx.Done():
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		return err
+	}
+	if err := <-served; err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"errors"
+)
+
+// errNotFound is returned by stores for entities that do not exist.
+var errNotFound = errors.New("not found")
+
+// Store persists users and their usernames, sessions, password resets, login
+// throttles, the audit log, surveys and survey attempts. Handlers reach
+// it through the server, so the app runs on any implementation: the App
+// Engine datastore in production, a SQL database when self-hosted and memory
+// in tests.
+type Store interface {
+	// RunInTransaction runs f in a transaction. Store calls made with the
+	// context passed to f are committed together if f returns nil and
+	// discarded otherwise. Transactions reading what a concurrent one wrote
+	// are run again, up to txAttempts times, so f must read what it writes
+	// within the transaction and have no other effects.
+	RunInTransaction(ctx context.Context, f func(ctx context.Context) error) error
+
+	// GetUser returns the user with id userId.
+	GetUser(ctx context.Context, userId string) (User, error)
+	// PutUser stores user, replacing any user with the same id.
+	PutUser(ctx context.Context, user User) error
+	// ListUsers returns every user.
+	ListUsers(ctx context.Context) ([]User, error)
+	// LegacyUsers returns the users whose legacy responses to the default
+	// survey have not been migrated into an attempt yet.
+	LegacyUsers(ctx context.Context) ([]User, error)
+	// GetUsername returns the id of the user the username with canonical
+	// form name is reserved for, see canonicalUsername.
+	GetUsername(ctx context.Context, name string) (string, error)
+	// PutUsername reserves the username with canonical form name for the
+	// user with id userId.
+	PutUsername(ctx context.Context, name string, userId string) error
+
+	// GetSession returns the session with id sessionId of the user with id
+	// userId.
+	GetSession(ctx context.Context, userId string, sessionId string) (SessionRecord, error)
+	// PutSession stores session under sessionId.
+	PutSession(ctx context.Context, sessionId string, session SessionRecord) error
+	// DeleteSession deletes the session with id sessionId of the user with
+	// id userId, if any.
+	DeleteSession(ctx context.Context, userId string, sessionId string) error
+	// DeleteUserSessions deletes every session of the user with id userId.
+	DeleteUserSessions(ctx context.Context, userId string) error
+
+	// GetPasswordReset returns the password reset with id resetId of the
+	// user with id userId.
+	GetPasswordReset(ctx context.Context, userId string, resetId string) (PasswordReset, error)
+	// PutPasswordReset stores reset under resetId.
+	PutPasswordReset(ctx context.Context, resetId string, reset PasswordReset) error
+	// DeletePasswordReset deletes the password reset with id resetId of the
+	// user with id userId, if any.
+	DeletePasswordReset(ctx context.Context, userId string, resetId string) error
+	// DeleteUserPasswordResets deletes every password reset of the user with
+	// id userId.
+	DeleteUserPasswordResets(ctx context.Context, userId string) error
+
+	// GetLoginThrottle returns the failed logins throttled under key.
+	GetLoginThrottle(ctx context.Context, key string) (LoginThrottle, error)
+	// PutLoginThrottle stores throttle under key.
+	PutLoginThrottle(ctx context.Context, key string, throttle LoginThrottle) error
+	// DeleteLoginThrottle deletes the failed logins throttled under key, if
+	// any.
+	DeleteLoginThrottle(ctx context.Context, key string) error
+
+	// PutAuditEntry adds entry to the audit log.
+	PutAuditEntry(ctx context.Context, entry AuditEntry) error
+	// ListAuditEntries returns the latest limit entries of the audit log,
+	// newest first.
+	ListAuditEntries(ctx context.Context, limit int) ([]AuditEntry, error)
+
+	// ListSurveys returns every survey without its questions.
+	ListSurveys(ctx context.Context) ([]Survey, error)
+	// GetSurvey returns the survey with id surveyId without its questions.
+	GetSurvey(ctx context.Context, surveyId string) (Survey, error)
+	// PutSurvey stores survey, replacing any survey with the same id.
+	PutSurvey(ctx context.Context, survey Survey) error
+	// GetSurveyVersion returns the given version of the survey with id
+	// surveyId.
+	GetSurveyVersion(ctx context.Context, surveyId string, version int) (SurveyVersion, error)
+	// PutSurveyVersion stores the given version of the survey with id
+	// surveyId.
+	PutSurveyVersion(ctx context.Context, surveyId string, version int, surveyVersion SurveyVersion) error
+	// GetQuestions returns the questions of the given version of the survey
+	// with id surveyId along with their choices, in any order.
+	GetQuestions(ctx context.Context, surveyId string, version int) ([]Question, error)
+	// PutQuestions replaces the questions of the given version of the
+	// survey with id surveyId. Questions and choices keep their ids, and
+	// those without one are allocated an id.
+	PutQuestions(ctx context.Context, surveyId string, version int, questions []Question) error
+
+	// ListAttempts returns the attempts of the user with id userId at the
+	// survey with id surveyId along with their answers, in any order.
+	ListAttempts(ctx context.Context, userId string, surveyId string) ([]Attempt, error)
+	// PutAttempt stores attempt, without its answers, for the user with id
+	// userId and returns its id. Attempts without an id are allocated one.
+	PutAttempt(ctx context.Context, userId string, attempt Attempt) (int64, error)
+	// PutAnswer stores answer within the attempt with id attemptId of the
+	// user with id userId, replacing any answer to the same question.
+	PutAnswer(ctx context.Context, userId string, attemptId int64, answer Answer) error
+	// ListSurveyAttempts returns the attempts of every user at the given
+	// version of the survey with id surveyId along with their answers and
+	// user ids, in any order.
+	ListSurveyAttempts(ctx context.Context, surveyId string, version int) ([]Attempt, error)
+	// ScanAnswers calls f with every answer to any version of the survey with
+	// id surveyId, along with the ids of the user and the attempt it belongs
+	// to, without loading every answer first. It stops at the first error
+	// returned by f and returns it. f must not call the store.
+	ScanAnswers(ctx context.Context, surveyId string, f func(userId string, attemptId int64, answer Answer) error) error
+	// ListAnswers returns every answer to the given version of the survey
+	// with id surveyId.
+	ListAnswers(ctx context.Context, surveyId string, version int) ([]Answer, error)
+	// ListTexts returns up to limit text answers to the question with id
+	// questionId of the given version of the survey with id surveyId.
+	ListTexts(ctx context.Context, surveyId string, version int, questionId int64, limit int) ([]string, error)
+
+	// AddCounts adds deltas to the answer counters of the given version of
+	// the survey with id surveyId. Each counter is split into shards and a
+	// delta is added to a random shard, so concurrent answers rarely contend.
+	AddCounts(ctx context.Context, surveyId string, version int, deltas map[counterKey]int) error
+	// GetCounts returns the answer counters of the given version of the
+	// survey with id surveyId, summed over their shards. Counters that were
+	// never added to are missing.
+	GetCounts(ctx context.Context, surveyId string, version int) (map[counterKey]int, error)
+	// PutCounts replaces the answer counters of the given version of the
+	// survey with id surveyId with counts.
+	PutCounts(ctx context.Context, surveyId string, version int, counts map[counterKey]int) error
+}
+
+// counterKey identifies an answer counter of a survey version: the number
+// of answers to the question with id questionId counted at position bucket
+// of its aggregate, see answerBuckets.
+type counterKey struct {
+	questionId int64
+	bucket     int
+}
+
+// counterShards is the number of shards each answer counter is split into.
+const counterShards = 16
+
+// txAttempts is the number of times a transaction is run before giving up on
+// conflicts with concurrent transactions.
+const txAttempts = 5
+
+// txKey is the context key marking contexts that run in a transaction.
+type txKey struct{}
+
+// inTransaction reports whether ctx runs in a transaction started by
+// RunInTransaction.
+func inTransaction(ctx context.Context) bool {
+	return ctx.Value(txKey{}) != nil
+}
@@ -0,0 +1,556 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sort"
+	"time"
+)
+
+var (
+	errNotPublished = errors.New("survey is not published")
+	errSurveyExists = errors.New("survey already exists")
+	errNoQuestions  = errors.New("survey has no questions")
+)
+
+// maxHistory is the number of latest completed attempts shown on the
+// dashboard.
+const maxHistory = 12
+
+// defaultSurveyId is the id of the survey served at /survey and /dashboard.
+const defaultSurveyId = "mood"
+
+// seedSurveys are seeded into the store the first time they are
+// requested.
+var seedSurveys = []*Survey{
+	{
+		Id:    defaultSurveyId,
+		Title: "Mood Check-in",
+		Questions: []Question{
+			{Text: "How do you feel today?", Choices: choices(
+				"Bored", "Excited", "Happy", "Sad")},
+			{Text: "Given your mood today, which of the following places would you prefer to be right now?", Choices: choices(
+				"Abandoned Farm", "Woods", "Busy city", "Sea")},
+			{Text: "Which of the following makes you anxious?", Choices: choices(
+				"Friends", "Family", "Strangers", "Authorities")},
+			{Text: "Which of the following do you need most in your life right now?", Choices: choices(
+				"Friends", "Money", "Career Advancement", "Vacation")},
+		},
+	},
+	{
+		Id:    "intake",
+		Title: "Intake Questionnaire",
+		Questions: []Question{
+			{Text: "What brings you here today?", Choices: choices(
+				"Stress", "Anxiety", "Low mood", "Relationships")},
+			{Text: "How long have you felt this way?", Choices: choices(
+				"Less than a month", "1 to 6 months", "6 to 12 months", "More than a year")},
+			{Text: "Have you spoken to a professional about this before?", Choices: choices(
+				"Yes", "No")},
+			{Text: "How would you prefer to be contacted?", Choices: choices(
+				"Phone", "Email", "Text message", "Video call")},
+		},
+	},
+}
+
+// findSeedSurvey returns the seed survey with id surveyId, or nil if there
+// is none.
+func findSeedSurvey(surveyId string) *Survey {
+	for _, survey := range seedSurveys {
+		if survey.Id == surveyId {
+			return survey
+		}
+	}
+	return nil
+}
+
+// choices returns choices with the given labels in order.
+func choices(labels ...string) []Choice {
+	var cs []Choice
+	for i, label := range labels {
+		cs = append(cs, Choice{Label: label, Position: i})
+	}
+	return cs
+}
+
+// listSurveys returns the published surveys, or every survey if all is set,
+// without their questions. The default survey is listed first and the rest
+// are ordered by title. Seed surveys are seeded if they do not exist yet.
+func (s *server) listSurveys(ctx context.Context, all bool) ([]Survey, error) {
+	surveys, err := s.store.ListSurveys(ctx)
+	if err != nil {
+		return nil, err
+	}
+	found := make(map[string]bool)
+	for _, survey := range surveys {
+		found[survey.Id] = true
+	}
+	for _, seed := range seedSurveys {
+		if found[seed.Id] {
+			continue
+		}
+		if err = s.seedSurvey(ctx, seed); err != nil {
+			return nil, err
+		}
+		survey, err := s.getSurvey(ctx, seed.Id)
+		if err != nil {
+			return nil, err
+		}
+		surveys = append(surveys, *survey)
+	}
+	listed := surveys[:0]
+	for _, survey := range surveys {
+		if all || survey.Published {
+			listed = append(listed, survey)
+		}
+	}
+	sort.Slice(listed, func(a, b int) bool {
+		if listed[a].Id == defaultSurveyId || listed[b].Id == defaultSurveyId {
+			return listed[a].Id == defaultSurveyId
+		}
+		return listed[a].Title < listed[b].Title
+	})
+	return listed, nil
+}
+
+// getSurvey fetches the survey with id surveyId without its questions. Seed
+// surveys are seeded if they do not exist yet.
+func (s *server) getSurvey(ctx context.Context, surveyId string) (*Survey, error) {
+	survey, err := s.store.GetSurvey(ctx, surveyId)
+	if seed := findSeedSurvey(surveyId); err == errNotFound && seed != nil {
+		err = s.seedSurvey(ctx, seed)
+		if err == nil {
+			survey, err = s.store.GetSurvey(ctx, surveyId)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &survey, nil
+}
+
+// loadSurvey fetches the published version of the survey with id surveyId
+// along with its questions and choices, ordered by position. It returns
+// errNotPublished if the survey is not published.
+func (s *server) loadSurvey(ctx context.Context, surveyId string) (*Survey, error) {
+	survey, err := s.getSurvey(ctx, surveyId)
+	if err != nil {
+		return nil, err
+	}
+	if !survey.Published {
+		return nil, errNotPublished
+	}
+	return s.loadSurveyVersion(ctx, surveyId, survey.PublishedVersion)
+}
+
+// loadSurveyVersion fetches the given version of the survey with id surveyId
+// along with its questions and choices, ordered by position.
+func (s *server) loadSurveyVersion(ctx context.Context, surveyId string, version int) (*Survey, error) {
+	survey, err := s.getSurvey(ctx, surveyId)
+	if err != nil {
+		return nil, err
+	}
+	surveyVersion, err := s.store.GetSurveyVersion(ctx, surveyId, version)
+	if err != nil {
+		return nil, err
+	}
+	survey.Version = version
+	survey.Frozen = surveyVersion.Frozen
+	survey.Questions, err = s.loadQuestions(ctx, surveyId, version)
+	if err != nil {
+		return nil, err
+	}
+	return survey, nil
+}
+
+// loadQuestions fetches the questions and choices of the given version of
+// the survey with id surveyId, ordered by position. Questions stored before
+// question types were introduced are single choice questions.
+func (s *server) loadQuestions(ctx context.Context, surveyId string, version int) ([]Question, error) {
+	questions, err := s.store.GetQuestions(ctx, surveyId, version)
+	if err != nil {
+		return nil, err
+	}
+	for i := range questions {
+		if questions[i].Type == "" {
+			questions[i].Type = questionChoice
+		}
+		sort.Slice(questions[i].Choices, func(a, b int) bool {
+			return questions[i].Choices[a].Position < questions[i].Choices[b].Position
+		})
+	}
+	sort.Slice(questions, func(a, b int) bool {
+		return questions[a].Position < questions[b].Position
+	})
+	return questions, nil
+}
+
+// putQuestions replaces the questions and choices of the given version of
+// the survey with id surveyId. Positions are renumbered to follow the order
+// of questions. Questions and choices keep their ids, so rules and answers
+// still refer to them in the next version.
+func (s *server) putQuestions(ctx context.Context, surveyId string, version int, questions []Question) error {
+	numbered := make([]Question, len(questions))
+	for i, question := range questions {
+		question.Position = i
+		question.Choices = append([]Choice(nil), question.Choices...)
+		for j := range question.Choices {
+			question.Choices[j].Position = j
+		}
+		numbered[i] = question
+	}
+	return s.store.PutQuestions(ctx, surveyId, version, numbered)
+}
+
+// seedSurvey stores survey as the published first version of a new survey
+// unless a survey with the same id already exists. The version is counted
+// from the start: the legacy responses to the default survey, which predate
+// it, are added to its counters as it is seeded, see countLegacyResponses.
+func (s *server) seedSurvey(ctx context.Context, seed *Survey) error {
+	var legacy []User
+	if seed.Id == defaultSurveyId {
+		// legacy responses are only migrated once the survey exists, so
+		// none are missed or counted twice
+		var err error
+		if legacy, err = s.store.LegacyUsers(ctx); err != nil {
+			return err
+		}
+	}
+	seeded := false
+	err := s.store.RunInTransaction(ctx, func(ctx context.Context) error {
+		_, err := s.store.GetSurvey(ctx, seed.Id)
+		if err == nil {
+			// seeded by a concurrent request
+			seeded = false
+			return nil
+		}
+		if err != errNotFound {
+			return err
+		}
+		survey := Survey{
+			Id:               seed.Id,
+			Title:            seed.Title,
+			Published:        true,
+			PublishedVersion: 1,
+			LatestVersion:    1,
+		}
+		if err = s.store.PutSurvey(ctx, survey); err != nil {
+			return err
+		}
+		surveyVersion := SurveyVersion{Created: time.Now(), Frozen: true, Counted: len(legacy) == 0}
+		if err = s.store.PutSurveyVersion(ctx, seed.Id, 1, surveyVersion); err != nil {
+			return err
+		}
+		seeded = true
+		return s.putQuestions(ctx, seed.Id, 1, seed.Questions)
+	})
+	if err != nil || !seeded || len(legacy) == 0 {
+		return err
+	}
+	if err = s.countLegacyResponses(ctx, legacy); err != nil {
+		log.Print("counting legacy responses failed: ", err)
+	}
+	return nil
+}
+
+// countLegacyResponses adds the legacy responses of users to the counters of
+// the first version of the default survey, which was just seeded, and marks
+// it counted. The counts are added rather than put, so answers counted
+// meanwhile are kept. Until then the version is counted from its answers, as
+// it is if counting fails, until an admin rebuilds its counters.
+func (s *server) countLegacyResponses(ctx context.Context, users []User) error {
+	survey, err := s.loadSurveyVersion(ctx, defaultSurveyId, 1)
+	if err != nil {
+		return err
+	}
+	counts := make(map[counterKey]int)
+	for _, user := range users {
+		answers, err := s.legacyAnswers(ctx, user.Responses)
+		if err != nil {
+			return err
+		}
+		for _, answer := range answers {
+			for k, delta := range answerCounts(survey.Questions[survey.Question(answer.QuestionId)], answer) {
+				counts[k] += delta
+			}
+		}
+	}
+	if err = s.store.AddCounts(ctx, defaultSurveyId, 1, counts); err != nil {
+		return err
+	}
+	return s.store.RunInTransaction(ctx, func(ctx context.Context) error {
+		surveyVersion, err := s.store.GetSurveyVersion(ctx, defaultSurveyId, 1)
+		if err != nil {
+			return err
+		}
+		surveyVersion.Counted = true
+		return s.store.PutSurveyVersion(ctx, defaultSurveyId, 1, surveyVersion)
+	})
+}
+
+// createSurvey stores a new unpublished survey with an empty draft version.
+// It returns errSurveyExists if the id is taken.
+func (s *server) createSurvey(ctx context.Context, surveyId string, title string) error {
+	if findSeedSurvey(surveyId) != nil {
+		return errSurveyExists
+	}
+	return s.store.RunInTransaction(ctx, func(ctx context.Context) error {
+		_, err := s.store.GetSurvey(ctx, surveyId)
+		if err == nil {
+			return errSurveyExists
+		}
+		if err != errNotFound {
+			return err
+		}
+		survey := Survey{Id: surveyId, Title: title, LatestVersion: 1}
+		if err = s.store.PutSurvey(ctx, survey); err != nil {
+			return err
+		}
+		return s.store.PutSurveyVersion(ctx, surveyId, 1, SurveyVersion{Created: time.Now(), Counted: true})
+	})
+}
+
+// editSurvey applies edit to the latest version of the survey with id
+// surveyId and stores the result. Frozen versions have been published and
+// may have been answered, so editing one stores the result as a new draft
+// version instead.
+func (s *server) editSurvey(ctx context.Context, surveyId string, edit func(survey *Survey) error) error {
+	if _, err := s.getSurvey(ctx, surveyId); err != nil {
+		return err
+	}
+	return s.store.RunInTransaction(ctx, func(ctx context.Context) error {
+		survey, err := s.store.GetSurvey(ctx, surveyId)
+		if err != nil {
+			return err
+		}
+		surveyVersion, err := s.store.GetSurveyVersion(ctx, surveyId, survey.LatestVersion)
+		if err != nil {
+			return err
+		}
+		survey.Version = survey.LatestVersion
+		survey.Questions, err = s.loadQuestions(ctx, surveyId, survey.LatestVersion)
+		if err != nil {
+			return err
+		}
+		if err = edit(&survey); err != nil {
+			return err
+		}
+		if surveyVersion.Frozen {
+			survey.LatestVersion++
+			surveyVersion = SurveyVersion{Created: time.Now(), Counted: true}
+			if err = s.store.PutSurveyVersion(ctx, surveyId, survey.LatestVersion, surveyVersion); err != nil {
+				return err
+			}
+		}
+		if err = s.store.PutSurvey(ctx, survey); err != nil {
+			return err
+		}
+		return s.putQuestions(ctx, surveyId, survey.LatestVersion, survey.Questions)
+	})
+}
+
+// publishSurvey publishes the latest version of the survey with id surveyId
+// and freezes it. It returns errNoQuestions if the version has no questions.
+func (s *server) publishSurvey(ctx context.Context, surveyId string) error {
+	if _, err := s.getSurvey(ctx, surveyId); err != nil {
+		return err
+	}
+	return s.store.RunInTransaction(ctx, func(ctx context.Context) error {
+		survey, err := s.store.GetSurvey(ctx, surveyId)
+		if err != nil {
+			return err
+		}
+		surveyVersion, err := s.store.GetSurveyVersion(ctx, surveyId, survey.LatestVersion)
+		if err != nil {
+			return err
+		}
+		questions, err := s.store.GetQuestions(ctx, surveyId, survey.LatestVersion)
+		if err != nil {
+			return err
+		}
+		if len(questions) == 0 {
+			return errNoQuestions
+		}
+		surveyVersion.Frozen = true
+		if err = s.store.PutSurveyVersion(ctx, surveyId, survey.LatestVersion, surveyVersion); err != nil {
+			return err
+		}
+		survey.Published = true
+		survey.PublishedVersion = survey.LatestVersion
+		return s.store.PutSurvey(ctx, survey)
+	})
+}
+
+// renameSurvey changes the title of the survey with id surveyId. Titles are
+// not versioned since they do not change the meaning of responses.
+func (s *server) renameSurvey(ctx context.Context, surveyId string, title string) error {
+	return s.store.RunInTransaction(ctx, func(ctx context.Context) error {
+		survey, err := s.store.GetSurvey(ctx, surveyId)
+		if err != nil {
+			return err
+		}
+		survey.Title = title
+		return s.store.PutSurvey(ctx, survey)
+	})
+}
+
+// unpublishSurvey withdraws the survey with id surveyId from respondents.
+// Existing attempts and their results are kept.
+func (s *server) unpublishSurvey(ctx context.Context, surveyId string) error {
+	return s.store.RunInTransaction(ctx, func(ctx context.Context) error {
+		survey, err := s.store.GetSurvey(ctx, surveyId)
+		if err != nil {
+			return err
+		}
+		survey.Published = false
+		return s.store.PutSurvey(ctx, survey)
+	})
+}
+
+// loadAttempts fetches user's attempts at the survey with id surveyId along
+// with their answers in the order they were given, oldest attempt first.
+// Legacy responses stored on the user are migrated into an attempt at the
+// default survey.
+func (s *server) loadAttempts(ctx context.Context, user User, surveyId string) ([]Attempt, error) {
+	if surveyId == defaultSurveyId && len(user.Responses) > 0 {
+		if err := s.migrateLegacyResponses(ctx, user); err != nil {
+			return nil, err
+		}
+	}
+	attempts, err := s.store.ListAttempts(ctx, user.Id, surveyId)
+	if err != nil {
+		return nil, err
+	}
+	for i := range attempts {
+		answers := attempts[i].Answers
+		sort.Slice(answers, func(a, b int) bool {
+			return answers[a].Answered.Before(answers[b].Answered)
+		})
+	}
+	sort.SliceStable(attempts, func(a, b int) bool {
+		return attempts[a].Started.Before(attempts[b].Started)
+	})
+	return attempts, nil
+}
+
+// loadAttempt returns user's latest attempt at the survey with id surveyId,
+// see loadAttempts. An empty attempt is returned if the user has not
+// answered the survey yet.
+func (s *server) loadAttempt(ctx context.Context, user User, surveyId string) (Attempt, error) {
+	attempts, err := s.loadAttempts(ctx, user, surveyId)
+	if err != nil || len(attempts) == 0 {
+		return Attempt{SurveyId: surveyId}, err
+	}
+	return attempts[len(attempts)-1], nil
+}
+
+// startAttempt stores a new attempt of the user with id userId at the
+// version of the survey with id surveyId.
+func (s *server) startAttempt(ctx context.Context, userId string, surveyId string, version int) (Attempt, error) {
+	attempt := Attempt{
+		SurveyId: surveyId,
+		Version:  version,
+		Started:  time.Now(),
+	}
+	id, err := s.store.PutAttempt(ctx, userId, attempt)
+	attempt.Id = id
+	return attempt, err
+}
+
+// startNextAttempt starts another attempt of the user with id userId at the
+// published version of survey, a survey without its questions, unless their
+// latest attempt is not complete, in which case it fails with errAttemptOpen.
+// The latest attempt is checked and the new one stored in one transaction,
+// within the entity group of the user, so concurrent requests start one
+// attempt.
+func (s *server) startNextAttempt(ctx context.Context, userId string, survey *Survey) (Attempt, error) {
+	var attempt Attempt
+	err := s.store.RunInTransaction(ctx, func(ctx context.Context) error {
+		user, err := s.store.GetUser(ctx, userId)
+		if err != nil {
+			return err
+		}
+		latest, err := s.loadAttempt(ctx, user, survey.Id)
+		if err != nil {
+			return err
+		}
+		if latest.Id != 0 && !latest.Complete {
+			return errAttemptOpen
+		}
+		attempt, err = s.startAttempt(ctx, userId, survey.Id, survey.PublishedVersion)
+		return err
+	})
+	return attempt, err
+}
+
+// legacyAnswers converts legacy responses, which are choice positions in the
+// first version of the default survey, into answers.
+func (s *server) legacyAnswers(ctx context.Context, responses []int) ([]Answer, error) {
+	survey, err := s.loadSurveyVersion(ctx, defaultSurveyId, 1)
+	if err != nil {
+		return nil, err
+	}
+	var answers []Answer
+	for i, c := range responses {
+		if i >= len(survey.Questions) || c < 0 || c >= len(survey.Questions[i].Choices) {
+			continue
+		}
+		answers = append(answers, Answer{
+			SurveyId:   defaultSurveyId,
+			Version:    1,
+			QuestionId: survey.Questions[i].Id,
+			ChoiceId:   survey.Questions[i].Choices[c].Id,
+		})
+	}
+	return answers, nil
+}
+
+// migrateLegacyResponses moves the responses stored on user into an attempt
+// at the default survey in a single transaction. The answers are not added to
+// the answer counters, which count legacy responses already, see
+// countLegacyResponses and rebuildCounters.
+func (s *server) migrateLegacyResponses(ctx context.Context, user User) error {
+	answers, err := s.legacyAnswers(ctx, user.Responses)
+	if err != nil {
+		return err
+	}
+	return s.store.RunInTransaction(ctx, func(ctx context.Context) error {
+		user, err := s.store.GetUser(ctx, user.Id)
+		if err != nil {
+			return err
+		}
+		if len(user.Responses) == 0 {
+			// migrated by a concurrent request
+			return nil
+		}
+		attempt := Attempt{
+			SurveyId: defaultSurveyId,
+			Version:  1,
+			Complete: user.SurveyComplete,
+		}
+		attemptId, err := s.store.PutAttempt(ctx, user.Id, attempt)
+		if err != nil {
+			return err
+		}
+		for i, answer := range answers {
+			answer.Answered = time.Now().Add(time.Duration(i))
+			if err = s.store.PutAnswer(ctx, user.Id, attemptId, answer); err != nil {
+				return err
+			}
+		}
+		user.Responses = nil
+		user.SurveyComplete = false
+		return s.store.PutUser(ctx, user)
+	})
+}
+
+// attemptVersion returns the version of survey the attempt is answered
+// against: the version it was started on, or the published version if it has
+// not been started yet.
+func attemptVersion(attempt Attempt, survey *Survey) int {
+	if attempt.Version == 0 {
+		return survey.PublishedVersion
+	}
+	return attempt.Version
+}
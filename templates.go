@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// templateFuncs are the functions available to templates.
+var templateFuncs = template.FuncMap{
+	"userAttributes": func() []userAttribute {
+		return userAttributes
+	},
+}
+
+// layoutTemplates are the templates shared by every page.
+var layoutTemplates = []string{"layout", "navbar", "login", "register", "footer"}
+
+// pageTemplates are the templates defining the content of each page, by page
+// name.
+var pageTemplates = map[string][]string{
+	"landing":     {"landing"},
+	"about":       {"about"},
+	"dashboard":   {"dashboard"},
+	"survey":      append([]string{"survey"}, questionTemplates...),
+	"admin":       {"admin"},
+	"adminsurvey": {"adminsurvey"},
+	"password":    {"password"},
+}
+
+// templateSet holds the pages of the app parsed from the template files in
+// dir. Pages are parsed once, unless dev is set, in which case they are
+// parsed again whenever a template file changed since they were parsed.
+type templateSet struct {
+	dir string
+	dev bool
+
+	mu       sync.Mutex
+	pages    map[string]*template.Template
+	modified time.Time
+	files    int
+}
+
+// loadTemplates parses the pages of the app from the template files in dir.
+func loadTemplates(dir string, dev bool) (*templateSet, error) {
+	t := &templateSet{dir: dir, dev: dev}
+	if err := t.parse(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// paths returns the paths of the template files with the given names.
+func (t *templateSet) paths(names []string) []string {
+	var paths []string
+	for _, name := range names {
+		paths = append(paths, filepath.Join(t.dir, name+".html"))
+	}
+	return paths
+}
+
+// changed returns the latest modification time and the number of the
+// template files.
+func (t *templateSet) changed() (time.Time, int, error) {
+	paths, err := filepath.Glob(filepath.Join(t.dir, "*.html"))
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+	var latest time.Time
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, 0, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, len(paths), nil
+}
+
+// parse parses every page. The pages are only replaced if all of them parse.
+func (t *templateSet) parse() error {
+	modified, files, err := t.changed()
+	if err != nil {
+		return err
+	}
+	layout, err := template.New("layout").Funcs(templateFuncs).ParseFiles(t.paths(layoutTemplates)...)
+	if err != nil {
+		return err
+	}
+	pages := make(map[string]*template.Template)
+	for page, names := range pageTemplates {
+		tmpl, err := layout.Clone()
+		if err != nil {
+			return err
+		}
+		if tmpl, err = tmpl.ParseFiles(t.paths(names)...); err != nil {
+			return err
+		}
+		pages[page] = tmpl
+	}
+	t.pages, t.modified, t.files = pages, modified, files
+	return nil
+}
+
+// page returns the named page, parsing the pages again first in dev mode if
+// a template file changed.
+func (t *templateSet) page(name string) (*template.Template, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.dev {
+		modified, files, err := t.changed()
+		if err != nil {
+			return nil, err
+		}
+		if !modified.Equal(t.modified) || files != t.files {
+			if err = t.parse(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	page, ok := t.pages[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown page %q", name)
+	}
+	return page, nil
+}
+
+// serveTemplate serves the named page rendered with data.
+func (s *server) serveTemplate(w http.ResponseWriter, page string, data Data) {
+	s.serveTemplateStatus(w, http.StatusOK, page, data)
+}
+
+// serveTemplateStatus serves the named page rendered with data along with
+// status. The page is rendered into a buffer first, so a template error is
+// served as a plain 500 rather than a partial page.
+func (s *server) serveTemplateStatus(w http.ResponseWriter, status int, page string, data Data) {
+	tmpl, err := s.templates.page(page)
+	if err != nil {
+		log.Print("template parsing error: ", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	var b bytes.Buffer
+	if err = tmpl.ExecuteTemplate(&b, "layout", data); err != nil {
+		log.Print("template executing error: ", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	b.WriteTo(w)
+}
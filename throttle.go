@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// loginLimit limits the failed logins throttled under keys starting with
+// prefix. The first free failures are not throttled, after which each login
+// waits for a delay doubling with every failure from loginBaseDelay up to
+// loginMaxDelay, and lockout failures lock logins out for loginLockout.
+type loginLimit struct {
+	prefix  string
+	free    int
+	lockout int
+}
+
+var (
+	// accountLimit limits the failed logins to an account, by canonical
+	// username.
+	accountLimit = loginLimit{prefix: "account:", free: 3, lockout: 10}
+	// clientLimit limits the failed logins from a client address, which is
+	// allowed more since users behind a NAT share it.
+	clientLimit = loginLimit{prefix: "client:", free: 20, lockout: 100}
+	// resetAccountLimit and resetClientLimit limit the password reset
+	// requests for an account and from a client address like failed logins,
+	// since each of them may send a mail.
+	resetAccountLimit = loginLimit{prefix: "reset-account:", free: 3, lockout: 10}
+	resetClientLimit  = loginLimit{prefix: "reset-client:", free: 20, lockout: 100}
+)
+
+const (
+	loginBaseDelay = time.Second
+	loginMaxDelay  = 5 * time.Minute
+	loginLockout   = 30 * time.Minute
+	// loginFailureMemory is how long failed logins are counted after the
+	// last one.
+	loginFailureMemory = 24 * time.Hour
+	// loginPendingTimeout is how long logins in flight are counted after
+	// the last one was checked, so that logins cut short before they were
+	// settled do not throttle for good.
+	loginPendingTimeout = time.Minute
+)
+
+// loginThrottledError is returned for logins refused because of earlier
+// failed logins until retryAfter passed.
+type loginThrottledError struct {
+	retryAfter time.Duration
+}
+
+func (e loginThrottledError) Error() string {
+	return fmt.Sprintf("too many failed logins, try again in %d seconds", e.seconds())
+}
+
+// seconds returns retryAfter in whole seconds, rounded up, as sent in the
+// Retry-After header.
+func (e loginThrottledError) seconds() int {
+	return int((e.retryAfter + time.Second - 1) / time.Second)
+}
+
+// pending returns the number of logins in flight counted by throttle as of
+// now.
+func (throttle LoginThrottle) pending(now time.Time) int {
+	if now.Sub(throttle.LastAttempt) > loginPendingTimeout {
+		return 0
+	}
+	return throttle.Pending
+}
+
+// wait returns how long logins throttled by throttle wait as of now. Logins
+// in flight count as failures, and once they are beyond the free ones, the
+// next login waits for them, so that logins sent at once cannot all be
+// checked before their failures are counted.
+func (limit loginLimit) wait(throttle LoginThrottle, now time.Time) time.Duration {
+	if now.Before(throttle.LockedUntil) {
+		return throttle.LockedUntil.Sub(now)
+	}
+	failures := throttle.Failures
+	if now.Sub(throttle.LastFailure) > loginFailureMemory {
+		failures = 0
+	}
+	pending := throttle.pending(now)
+	if failures+pending <= limit.free {
+		return 0
+	}
+	if pending > 0 {
+		return loginBaseDelay
+	}
+	delay := loginMaxDelay
+	if n := failures - limit.free - 1; n < 32 && loginBaseDelay<<uint(n) < loginMaxDelay {
+		delay = loginBaseDelay << uint(n)
+	}
+	if next := throttle.LastFailure.Add(delay); now.Before(next) {
+		return next.Sub(now)
+	}
+	return 0
+}
+
+// clientAddress returns the address of the client that sent r. Behind
+// trustedProxies proxies, each appending the address it got r from to the
+// X-Forwarded-For header, it is the address the first proxy appended, since
+// the ones before it are set by the client.
+func (s *server) clientAddress(r *http.Request) string {
+	if s.trustedProxies > 0 {
+		var hops []string
+		for _, header := range r.Header["X-Forwarded-For"] {
+			for _, hop := range strings.Split(header, ",") {
+				hops = append(hops, strings.TrimSpace(hop))
+			}
+		}
+		if len(hops) >= s.trustedProxies {
+			return hops[len(hops)-s.trustedProxies]
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// throttledKey is a key failed logins are throttled under, along with its
+// limit.
+type throttledKey struct {
+	limit loginLimit
+	key   string
+}
+
+// throttledKeys returns the keys requests for the account with the given
+// username from client are throttled under, with byAccount and byClient.
+// Unknown usernames are throttled by client only, so that requests for
+// made-up accounts do not store a throttle each.
+func (s *server) throttledKeys(ctx context.Context, username string, client string, byAccount loginLimit, byClient loginLimit) ([]throttledKey, error) {
+	keys := []throttledKey{{byClient, byClient.prefix + client}}
+	if _, err := s.findUser(ctx, username); err == errNotFound {
+		return keys, nil
+	} else if err != nil {
+		return nil, err
+	}
+	name := username
+	if canonical, err := canonicalUsername(username); err == nil {
+		name = canonical
+	}
+	return append([]throttledKey{{byAccount, byAccount.prefix + name}}, keys...), nil
+}
+
+// verifyLogin returns the user with the given username if password is
+// theirs, see authenticate, throttling failed logins by account and by the
+// address of the client that sent r, see throttledKeys. Throttled logins are
+// refused with a loginThrottledError without checking the password. A
+// successful login clears the failures of the account, but not those of the
+// client, which could otherwise clear them by logging in to an account of its
+// own.
+func (s *server) verifyLogin(ctx context.Context, r *http.Request, username string, password string) (User, error) {
+	client := s.clientAddress(r)
+	keys, err := s.throttledKeys(ctx, username, client, accountLimit, clientLimit)
+	if err != nil {
+		return User{}, err
+	}
+	if err = s.reserveLogin(ctx, keys, s.now()); err != nil {
+		return User{}, err
+	}
+	user, err := s.authenticate(ctx, username, password)
+	now := s.now()
+	locked, settleErr := s.settleLogin(ctx, keys, now, err)
+	for _, k := range locked {
+		s.audit(ctx, AuditEntry{
+			Time:    now,
+			Event:   "lockout",
+			Subject: k.key,
+			Client:  client,
+			Detail:  fmt.Sprintf("locked out for %v after %d failed logins", loginLockout, k.limit.lockout),
+		})
+	}
+	if err == nil {
+		err = settleErr
+	}
+	if err != nil {
+		return User{}, err
+	}
+	return user, nil
+}
+
+// throttleReset counts a password reset request for the account with the
+// given username from the client that sent r against resetAccountLimit and
+// resetClientLimit. Throttled requests are refused with a
+// loginThrottledError and not counted.
+func (s *server) throttleReset(ctx context.Context, r *http.Request, username string) error {
+	client := s.clientAddress(r)
+	keys, err := s.throttledKeys(ctx, username, client, resetAccountLimit, resetClientLimit)
+	if err != nil {
+		return err
+	}
+	now := s.now()
+	if err = s.reserveLogin(ctx, keys, now); err != nil {
+		return err
+	}
+	// every request counts, as a failed login does
+	locked, err := s.settleLogin(ctx, keys, now, errInvalidCredentials)
+	for _, k := range locked {
+		s.audit(ctx, AuditEntry{
+			Time:    now,
+			Event:   "lockout",
+			Subject: k.key,
+			Client:  client,
+			Detail:  fmt.Sprintf("locked out for %v after %d password reset requests", loginLockout, k.limit.lockout),
+		})
+	}
+	return err
+}
+
+// reserveLogin checks a login at now against the throttles of keys and
+// counts it as in flight under each of them, in one transaction, so that
+// concurrent logins see each other. Throttled logins are refused with a
+// loginThrottledError and not counted.
+func (s *server) reserveLogin(ctx context.Context, keys []throttledKey, now time.Time) error {
+	return s.store.RunInTransaction(ctx, func(ctx context.Context) error {
+		throttles := make([]LoginThrottle, len(keys))
+		for i, k := range keys {
+			throttle, err := s.store.GetLoginThrottle(ctx, k.key)
+			if err != nil && err != errNotFound {
+				return err
+			}
+			if wait := k.limit.wait(throttle, now); wait > 0 {
+				return loginThrottledError{wait}
+			}
+			throttle.Pending = throttle.pending(now) + 1
+			throttle.LastAttempt = now
+			throttles[i] = throttle
+		}
+		for i, k := range keys {
+			if err := s.store.PutLoginThrottle(ctx, k.key, throttles[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// settleLogin settles a login reserved against the throttles of keys, see
+// reserveLogin, which ended at now with result, the error of authenticate.
+// Wrong credentials count a failure against each key, locking logins out
+// once it reaches the lockout failures of its limit; the failures are counted
+// again after a lockout. A successful login clears the throttle of the
+// account. It returns the keys logins were locked out under.
+func (s *server) settleLogin(ctx context.Context, keys []throttledKey, now time.Time, result error) ([]throttledKey, error) {
+	var locked []throttledKey
+	err := s.store.RunInTransaction(ctx, func(ctx context.Context) error {
+		locked = nil
+		for _, k := range keys {
+			throttle, err := s.store.GetLoginThrottle(ctx, k.key)
+			if err != nil && err != errNotFound {
+				return err
+			}
+			if throttle.Pending > 0 {
+				throttle.Pending--
+			}
+			switch {
+			case result == errInvalidCredentials:
+				if now.Sub(throttle.LastFailure) > loginFailureMemory {
+					throttle.Failures = 0
+				}
+				throttle.Failures++
+				throttle.LastFailure = now
+				if throttle.Failures >= k.limit.lockout {
+					throttle.Failures = 0
+					throttle.LockedUntil = now.Add(loginLockout)
+					locked = append(locked, k)
+				}
+			case result == nil && k.limit == accountLimit:
+				// logins still in flight stay counted
+				throttle = LoginThrottle{Pending: throttle.Pending, LastAttempt: throttle.LastAttempt}
+			}
+			if throttle.Failures == 0 && throttle.Pending == 0 && !now.Before(throttle.LockedUntil) {
+				err = s.store.DeleteLoginThrottle(ctx, k.key)
+			} else {
+				err = s.store.PutLoginThrottle(ctx, k.key, throttle)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return locked, err
+}
+
+// audit adds entry to the audit log and logs it. Failing to store it is
+// logged rather than returned, so that it does not fail the request.
+func (s *server) audit(ctx context.Context, entry AuditEntry) {
+	log.Printf("audit: %s of %s from %s: %s", entry.Event, entry.Subject, entry.Client, entry.Detail)
+	if err := s.store.PutAuditEntry(ctx, entry); err != nil {
+		log.Print("storing audit entry failed: ", err)
+	}
+}
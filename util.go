@@ -1,71 +1,167 @@
 package main
 
 import (
-	"fmt"
-	"html/template"
+	"context"
+	"encoding/json"
+	"errors"
 	"log"
 	"net/http"
-	"strconv"
+	"strings"
+	"time"
+)
 
-	"google.golang.org/appengine"
-	"google.golang.org/appengine/datastore"
+var (
+	errSurveyComplete     = errors.New("survey already complete")
+	errOutOfOrder         = errors.New("response is not for the next unanswered question")
+	errUserExists         = errors.New("username is taken")
+	errInvalidCredentials = errors.New("invalid username or password")
+	errAttemptOpen        = errors.New("latest attempt is not complete")
+	errAttemptNotFound    = errors.New("attempt not found")
+	errQuestionNotFound   = errors.New("question not found")
 )
 
-// serveTemplate parses template files and serves resulting html.
-func serveTemplate(w http.ResponseWriter, data Data, filenames ...string) {
-	var files []string
-	for _, file := range filenames {
-		files = append(files, fmt.Sprintf("templates/%s.html", file))
-	}
+// requestError is an error caused by the request rather than the server,
+// answered with status and message.
+type requestError struct {
+	status  int
+	message string
+}
 
-	t := template.Must(template.ParseFiles(files...))
-	err := t.ExecuteTemplate(w, "layout", data)
-	if err != nil {
-		log.Print("template executing error: ", err)
-	}
+func (e requestError) Error() string {
+	return e.message
+}
+
+// apiError model for the json body of failed api requests
+type apiError struct {
+	Error string `json:"error"`
+}
+
+// writeError responds with status and a json body carrying message.
+func writeError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(apiError{Error: message})
 }
 
 // getSession returns the current session if it exists, otherwise an empty
 // session is returned.
-func getSession(r *http.Request) Session {
-	cUser, err := r.Cookie("session-id")
+func (s *server) getSession(r *http.Request) Session {
 	var session Session
-	if err == nil {
-		session.Id = cUser.Value
-		session.LoggedIn = true
-	}
-	cQuestion, err := r.Cookie("current-question")
-	if err == nil {
-		curQuestion, _ := strconv.Atoi(cQuestion.Value)
-		session.CurQuestion = curQuestion
+	if token := sessionToken(r); token != "" {
+		ctx := s.newContext(r)
+		userId, err := s.lookupSession(ctx, token)
+		if err == nil {
+			session.Id = userId
+			session.LoggedIn = true
+			if user, err := s.store.GetUser(ctx, userId); err == nil {
+				session.Role = user.Role
+			}
+		}
 	}
-	qIndex, err := r.Cookie("current-qindex")
-	if err == nil {
-		qIndex, _ := strconv.Atoi(qIndex.Value)
-		session.QuestionIndex = qIndex
+	if secret := csrfSecret(r); secret != "" {
+		session.CSRFToken = csrfToken(secret)
 	}
 	return session
 }
 
-// updateUserResponses fetches the user with id username and adds response to
-// the user's list of responses.
-// It returns true if update was successful, false otherwise.
-func updateUserResponses(w http.ResponseWriter, r *http.Request, username string, response string) bool {
-	ctx := appengine.NewContext(r)
-	key := datastore.NewKey(ctx, "User", username, 0, nil)
-	var user User
-	err := datastore.Get(ctx, key, &user)
+// pathId returns the id following prefix in the request path, or an empty
+// string if there is none.
+func pathId(r *http.Request, prefix string) string {
+	return strings.Trim(strings.TrimPrefix(r.URL.Path, prefix), "/")
+}
+
+// updateUserResponses fetches the latest attempt of the user with id
+// username at the survey with id surveyId and records responses, validated
+// against the question type by parseAnswer, as the answer to the question
+// with id question. The first answer starts an attempt if the user has none.
+// The server-side list of answers is the survey progress, so question must be
+// the next question picked by nextQuestion: errOutOfOrder is returned
+// otherwise, and errSurveyComplete once the answers reached the end of the
+// survey, until the user starts another attempt, and errQuestionNotFound if
+// the survey has no question with id question. The answer is added to the
+// answer counters of the survey version.
+//
+// The attempt is read and the answer stored in one transaction, so
+// concurrent responses to the same question, such as from a double click,
+// record one answer and reject the others with errOutOfOrder or
+// errSurveyComplete. The answer is counted once it is stored: counter shards
+// are entity groups of their own on the datastore, and a multi-select answer
+// may count in more of them than a transaction can span. Failing to count it
+// is logged rather than returned, since the answer was recorded, and the
+// counters are fixed by rebuilding them.
+func (s *server) updateUserResponses(ctx context.Context, username string, surveyId string, question int64, responses []string) error {
+	var version int
+	var deltas map[counterKey]int
+	err := s.store.RunInTransaction(ctx, func(ctx context.Context) error {
+		var err error
+		version, deltas, err = s.recordResponses(ctx, username, surveyId, question, responses)
+		return err
+	})
 	if err != nil {
-		return false
+		return err
 	}
-	qRes, _ := strconv.Atoi(response)
-	user.Responses = append(user.Responses, qRes)
-	if len(user.Responses) == MAX_QUESTIONS {
-		user.SurveyComplete = true
+	if err = s.store.AddCounts(ctx, surveyId, version, deltas); err != nil {
+		log.Printf("counting answer to version %d of survey %s failed: %v", version, surveyId, err)
+	}
+	return nil
+}
+
+// recordResponses is updateUserResponses within its transaction. It returns
+// the version of the survey answered and the deltas counting the answer.
+func (s *server) recordResponses(ctx context.Context, username string, surveyId string, question int64, responses []string) (int, map[counterKey]int, error) {
+	user, err := s.store.GetUser(ctx, username)
+	if err != nil {
+		return 0, nil, err
 	}
-	_, err = datastore.Put(ctx, key, &user)
+	survey, err := s.getSurvey(ctx, surveyId)
 	if err != nil {
-		return false
+		return 0, nil, err
+	}
+	attempt, err := s.loadAttempt(ctx, user, surveyId)
+	if err != nil {
+		return 0, nil, err
+	}
+	if !survey.Published && !attempt.Complete {
+		return 0, nil, errNotPublished
+	}
+	attempt.Version = attemptVersion(attempt, survey)
+	survey, err = s.loadSurveyVersion(ctx, surveyId, attempt.Version)
+	if err != nil {
+		return 0, nil, err
+	}
+	next := nextQuestion(survey, attempt.Answers)
+	if attempt.Complete || next == nil {
+		return 0, nil, errSurveyComplete
+	}
+	if survey.Question(question) < 0 {
+		return 0, nil, errQuestionNotFound
+	}
+	if question != next.Id {
+		return 0, nil, errOutOfOrder
+	}
+	answer, err := parseAnswer(*next, responses)
+	if err != nil {
+		return 0, nil, err
+	}
+	now := time.Now()
+	answer.SurveyId = surveyId
+	answer.Version = attempt.Version
+	answer.Answered = now
+	if attempt.Id == 0 {
+		attempt.Started = now
+	}
+	if nextQuestion(survey, append(attempt.Answers, answer)) == nil {
+		attempt.Complete = true
+		attempt.Finished = now
+	}
+	attemptId, err := s.store.PutAttempt(ctx, username, attempt)
+	if err != nil {
+		return 0, nil, err
+	}
+	if err = s.store.PutAnswer(ctx, username, attemptId, answer); err == errNotFound {
+		return 0, nil, errAttemptNotFound
+	} else if err != nil {
+		return 0, nil, err
 	}
-	return true
+	return attempt.Version, answerCounts(*next, answer), nil
 }